@@ -24,6 +24,9 @@ import (
 // ErrAggregateNotFound is when no aggregate can be found.
 var ErrAggregateNotFound = errors.New("aggregate not found")
 
+// ErrAggregateDeleted is when an aggregate has been deleted with a tombstone.
+var ErrAggregateDeleted = errors.New("aggregate deleted")
+
 // AggregateType is the type of an aggregate.
 type AggregateType string
 
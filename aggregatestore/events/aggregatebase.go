@@ -17,6 +17,7 @@ package events
 import (
 	"time"
 
+	"github.com/google/uuid"
 	eh "github.com/looplab/eventhorizon"
 )
 
@@ -91,6 +92,11 @@ func (a *AggregateBase) IncrementVersion() {
 	a.v++
 }
 
+// SetVersion implements the SetVersion method of the SnapshotAggregate interface.
+func (a *AggregateBase) SetVersion(v int) {
+	a.v = v
+}
+
 // Events implements the Events method of the Aggregate interface.
 func (a *AggregateBase) Events() []eh.Event {
 	return a.events
@@ -101,11 +107,17 @@ func (a *AggregateBase) ClearEvents() {
 	a.events = nil
 }
 
-// StoreEvent stores an event for later retrieval by Events().
-func (a *AggregateBase) StoreEvent(t eh.EventType, data eh.EventData, timestamp time.Time) eh.Event {
+// StoreEvent stores an event for later retrieval by Events(). A unique event
+// ID is always added to the metadata, any options are applied after that. The
+// correlation, causation and user IDs are added from the context when the
+// aggregate is saved by the AggregateStore.
+func (a *AggregateBase) StoreEvent(t eh.EventType, data eh.EventData, timestamp time.Time, options ...eh.EventOption) eh.Event {
+	options = append([]eh.EventOption{eh.WithMetadata(map[string]interface{}{
+		eh.EventIDMetadataKey: uuid.New().String(),
+	})}, options...)
 	e := eh.NewEventForAggregate(t, data, timestamp,
 		a.AggregateType(), a.EntityID(),
-		a.Version()+len(a.events)+1)
+		a.Version()+len(a.events)+1, options...)
 	a.events = append(a.events, e)
 	return e
 }
@@ -17,6 +17,7 @@ package events
 import (
 	"context"
 	"errors"
+	"time"
 
 	eh "github.com/looplab/eventhorizon"
 )
@@ -33,6 +34,9 @@ var ErrInvalidAggregateType = errors.New("invalid aggregate type")
 // ErrMismatchedEventType occurs when loaded events from ID does not match aggregate type.
 var ErrMismatchedEventType = errors.New("mismatched event type and aggregate type")
 
+// ErrMismatchedSnapshotType occurs when a loaded snapshot does not match the aggregate type.
+var ErrMismatchedSnapshotType = errors.New("mismatched snapshot type and aggregate type")
+
 // ApplyEventError is when an event could not be applied. It contains the error
 // and the event that caused it.
 type ApplyEventError struct {
@@ -47,6 +51,24 @@ func (a ApplyEventError) Error() string {
 	return "failed to apply event " + a.Event.String() + ": " + a.Err.Error()
 }
 
+// SnapshotError is when a snapshot could not be saved after the events of an
+// aggregate have been saved. It is not returned by Save, as the events are
+// already committed, but sent on the errors channel of the store.
+type SnapshotError struct {
+	// Err is the error that happened when saving the snapshot.
+	Err error
+	// AggregateType is the type of the aggregate.
+	AggregateType eh.AggregateType
+	// AggregateID is the ID of the aggregate.
+	AggregateID eh.ID
+}
+
+// Error implements the Error method of the error interface.
+func (e SnapshotError) Error() string {
+	return "could not save snapshot of " + string(e.AggregateType) + " " +
+		e.AggregateID + ": " + e.Err.Error()
+}
+
 // Aggregate is an interface representing a versioned data entity created from
 // events. It receives commands and generates events that are stored.
 //
@@ -79,6 +101,13 @@ type Aggregate interface {
 type AggregateStore struct {
 	store eh.EventStore
 	bus   eh.EventBus
+
+	snapshotStore  eh.SnapshotStore
+	snapshotPolicy SnapshotPolicy
+
+	outbox eh.OutboxEventStore
+
+	errCh chan SnapshotError
 }
 
 // NewAggregateStore creates a repository that will use an event store
@@ -95,6 +124,7 @@ func NewAggregateStore(store eh.EventStore, bus eh.EventBus) (*AggregateStore, e
 	d := &AggregateStore{
 		store: store,
 		bus:   bus,
+		errCh: make(chan SnapshotError, 100),
 	}
 	return d, nil
 }
@@ -113,11 +143,28 @@ func (r *AggregateStore) Load(ctx context.Context, aggregateType eh.AggregateTyp
 		return nil, ErrInvalidAggregateType
 	}
 
-	events, err := r.store.Load(ctx, a.EntityID())
-	if err != nil {
+	if err := r.loadSnapshot(ctx, a); err != nil {
+		return nil, err
+	}
+
+	// Only load the events after the snapshot if the store supports it.
+	var events []eh.Event
+	if s, ok := r.store.(eh.VersionedEventStore); ok && a.Version() > 0 {
+		events, err = s.LoadFromVersion(ctx, a.EntityID(), a.Version())
+	} else {
+		events, err = r.store.Load(ctx, a.EntityID())
+	}
+	if esErr, ok := err.(eh.EventStoreError); ok && esErr.Err == eh.ErrAggregateDeleted {
+		return nil, eh.ErrAggregateDeleted
+	} else if err != nil {
 		return nil, err
 	}
 
+	// Skip events that are already part of a snapshot.
+	for len(events) > 0 && events[0].Version() <= a.Version() {
+		events = events[1:]
+	}
+
 	if err := r.applyEvents(ctx, a, events); err != nil {
 		return nil, err
 	}
@@ -137,8 +184,14 @@ func (r *AggregateStore) Save(ctx context.Context, agg eh.Aggregate) error {
 	if len(events) < 1 {
 		return nil
 	}
+	events = withContextMetadata(ctx, events)
 
-	if err := r.store.Save(ctx, events, a.Version()); err != nil {
+	fromVersion := a.Version()
+	if r.outbox != nil {
+		if err := r.outbox.SaveWithOutbox(ctx, events, fromVersion); err != nil {
+			return err
+		}
+	} else if err := r.store.Save(ctx, events, fromVersion); err != nil {
 		return err
 	}
 	a.ClearEvents()
@@ -149,15 +202,122 @@ func (r *AggregateStore) Save(ctx context.Context, agg eh.Aggregate) error {
 		return err
 	}
 
-	for _, e := range events {
-		if err := r.bus.PublishEvent(ctx, e); err != nil {
-			return err
+	// Events in the outbox are published by a relay.
+	if r.outbox == nil {
+		for _, e := range events {
+			if err := r.bus.PublishEvent(ctx, e); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Snapshots are only an optimization, a failed snapshot must not fail the
+	// save as the events are already committed.
+	if err := r.saveSnapshot(ctx, a, fromVersion); err != nil {
+		select {
+		case r.errCh <- SnapshotError{Err: err, AggregateType: a.AggregateType(), AggregateID: a.EntityID()}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Errors returns an error channel where snapshot errors are sent, as they do
+// not fail the save. Errors are dropped if the channel is full.
+func (r *AggregateStore) Errors() <-chan SnapshotError {
+	return r.errCh
+}
+
+// EnableOutbox makes Save record the events in the outbox of the event store,
+// atomically with saving them, instead of publishing them directly. They must
+// then be published by an outbox.Relay. Returns eventhorizon.ErrOutboxNotSupported
+// if the event store is not an eventhorizon.OutboxEventStore.
+func (r *AggregateStore) EnableOutbox() error {
+	outbox, ok := r.store.(eh.OutboxEventStore)
+	if !ok {
+		return eh.ErrOutboxNotSupported
+	}
+	r.outbox = outbox
+	return nil
+}
+
+// withContextMetadata adds the tracing metadata from the context to events,
+// keeping any metadata already set on the events.
+func withContextMetadata(ctx context.Context, events []eh.Event) []eh.Event {
+	metadata := eh.MetadataFromContext(ctx)
+	if metadata == nil {
+		return events
+	}
+
+	withMetadata := make([]eh.Event, len(events))
+	for i, e := range events {
+		m := map[string]interface{}{}
+		for k, v := range metadata {
+			m[k] = v
+		}
+		for k, v := range e.Metadata() {
+			m[k] = v
 		}
+		withMetadata[i] = eh.NewEventForAggregate(e.EventType(), e.Data(), e.Timestamp(),
+			e.AggregateType(), e.AggregateID(), e.Version(), eh.WithMetadata(m))
+	}
+	return withMetadata
+}
+
+// SetSnapshotStore sets a snapshot store and a policy for when to take
+// snapshots. Only aggregates implementing SnapshotAggregate will be snapshotted.
+func (r *AggregateStore) SetSnapshotStore(store eh.SnapshotStore, policy SnapshotPolicy) {
+	r.snapshotStore = store
+	r.snapshotPolicy = policy
+}
+
+// loadSnapshot restores the aggregate from the latest snapshot, if any.
+func (r *AggregateStore) loadSnapshot(ctx context.Context, a Aggregate) error {
+	sa, ok := a.(SnapshotAggregate)
+	if !ok || r.snapshotStore == nil {
+		return nil
+	}
+
+	snapshot, err := r.snapshotStore.LoadSnapshot(ctx, a.EntityID())
+	if err != nil {
+		return err
+	} else if snapshot == nil {
+		return nil
+	}
+
+	if snapshot.AggregateType != a.AggregateType() {
+		return ErrMismatchedSnapshotType
+	}
+	if err := sa.UnmarshalSnapshot(snapshot.State); err != nil {
+		return err
 	}
+	sa.SetVersion(snapshot.Version)
 
 	return nil
 }
 
+// saveSnapshot takes a snapshot of the aggregate if the policy says so.
+func (r *AggregateStore) saveSnapshot(ctx context.Context, a Aggregate, fromVersion int) error {
+	sa, ok := a.(SnapshotAggregate)
+	if !ok || r.snapshotStore == nil || r.snapshotPolicy == nil ||
+		!r.snapshotPolicy(fromVersion, a.Version()) {
+		return nil
+	}
+
+	state, err := sa.MarshalSnapshot()
+	if err != nil {
+		return err
+	}
+
+	return r.snapshotStore.SaveSnapshot(ctx, a.EntityID(), eh.Snapshot{
+		Version:       a.Version(),
+		AggregateType: a.AggregateType(),
+		Timestamp:     time.Now(),
+		State:         state,
+	})
+}
+
 func (r *AggregateStore) applyEvents(ctx context.Context, a Aggregate, events []eh.Event) error {
 	for _, event := range events {
 		if event.AggregateType() != a.AggregateType() {
@@ -24,6 +24,7 @@ import (
 	"github.com/google/uuid"
 	eh "github.com/looplab/eventhorizon"
 	"github.com/looplab/eventhorizon/aggregatestore/events"
+	"github.com/looplab/eventhorizon/eventstore/memory"
 	"github.com/looplab/eventhorizon/mocks"
 )
 
@@ -152,6 +153,32 @@ func Test_AggregateStore_LoadEvents_MismatchedEventType(t *testing.T) {
 	}
 }
 
+func Test_AggregateStore_LoadTombstoned(t *testing.T) {
+	eventStore := memory.NewEventStore()
+	store, err := events.NewAggregateStore(eventStore, &mocks.EventBus{})
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	ctx := context.Background()
+
+	id := uuid.New().String()
+	agg := NewTestAggregate(id)
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	event1 := agg.StoreEvent(mocks.EventType, &mocks.EventData{Content: "event1"}, timestamp)
+	if err := eventStore.Save(ctx, []eh.Event{event1}, 0); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := eventStore.Tombstone(ctx, id); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	_, err = store.Load(ctx, TestAggregateType, id)
+	if err != eh.ErrAggregateDeleted {
+		t.Error("there should be an aggregate deleted error:", err)
+	}
+}
+
 func Test_AggregateStore_SaveEvents(t *testing.T) {
 	store, eventStore, bus := createStore(t)
 
@@ -219,6 +246,85 @@ func Test_AggregateStore_SaveEvents(t *testing.T) {
 	}
 }
 
+func Test_AggregateStore_SaveEventsWithMetadata(t *testing.T) {
+	store, eventStore, bus := createStore(t)
+
+	ctx := eh.NewContextWithCorrelationID(context.Background(), "correlation")
+	ctx = eh.NewContextWithUserID(ctx, "user")
+
+	id := uuid.New().String()
+	agg := NewTestAggregateOther(id)
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	event1 := agg.StoreEvent(mocks.EventType, &mocks.EventData{Content: "event"}, timestamp)
+	eventID, ok := event1.Metadata()[eh.EventIDMetadataKey].(string)
+	if !ok || eventID == "" {
+		t.Error("the event should have an event ID:", event1.Metadata())
+	}
+	if err := store.Save(ctx, agg); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	evts, err := eventStore.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(evts) != 1 {
+		t.Fatal("there should be one event stored:", len(evts))
+	}
+	expectedMetadata := map[string]interface{}{
+		eh.EventIDMetadataKey:       eventID,
+		eh.CorrelationIDMetadataKey: "correlation",
+		eh.UserIDMetadataKey:        "user",
+	}
+	if !reflect.DeepEqual(evts[0].Metadata(), expectedMetadata) {
+		t.Error("the stored metadata should be correct:", evts[0].Metadata())
+	}
+	if err := mocks.CompareEvents(evts[0], bus.Events[0]); err != nil {
+		t.Error("the published event should be correct:", err)
+	}
+}
+
+func Test_AggregateStore_SaveEventsWithOutbox(t *testing.T) {
+	store, _, bus := createStore(t)
+	if err := store.EnableOutbox(); err != eh.ErrOutboxNotSupported {
+		t.Error("there should be an outbox not supported error:", err)
+	}
+
+	eventStore := memory.NewEventStore()
+	store, err := events.NewAggregateStore(eventStore, bus)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := store.EnableOutbox(); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	ctx := context.Background()
+
+	id := uuid.New().String()
+	agg := NewTestAggregateOther(id)
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	event1 := agg.StoreEvent(mocks.EventType, &mocks.EventData{Content: "event1"}, timestamp)
+	if err := store.Save(ctx, agg); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	// The events should be recorded in the outbox instead of published.
+	if len(bus.Events) != 0 {
+		t.Error("there should be no events on the bus:", bus.Events)
+	}
+	entries, err := eventStore.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 1 {
+		t.Fatal("there should be one event in the outbox:", entries)
+	}
+	if err := mocks.CompareEvents(entries[0].Event, event1); err != nil {
+		t.Error("the event should be correct:", err)
+	}
+}
+
 func Test_AggregateStore_AggregateNotRegistered(t *testing.T) {
 	store, _, _ := createStore(t)
 
@@ -234,6 +340,150 @@ func Test_AggregateStore_AggregateNotRegistered(t *testing.T) {
 	}
 }
 
+func Test_AggregateStore_Snapshots(t *testing.T) {
+	eventStore := memory.NewEventStore()
+	bus := &mocks.EventBus{
+		Events: make([]eh.Event, 0),
+	}
+	store, err := events.NewAggregateStore(eventStore, bus)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	store.SetSnapshotStore(eventStore, events.SnapshotEveryNEvents(3))
+
+	ctx := context.Background()
+
+	id := uuid.New().String()
+	agg := NewTestSnapshotAggregate(id)
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	agg.StoreEvent(mocks.EventType, &mocks.EventData{Content: "event1"}, timestamp)
+	agg.StoreEvent(mocks.EventType, &mocks.EventData{Content: "event2"}, timestamp)
+	if err := store.Save(ctx, agg); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	snapshot, err := eventStore.LoadSnapshot(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if snapshot != nil {
+		t.Error("there should be no snapshot:", snapshot)
+	}
+
+	agg.StoreEvent(mocks.EventType, &mocks.EventData{Content: "event3"}, timestamp)
+	agg.StoreEvent(mocks.EventType, &mocks.EventData{Content: "event4"}, timestamp)
+	if err := store.Save(ctx, agg); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	snapshot, err = eventStore.LoadSnapshot(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if snapshot == nil {
+		t.Fatal("there should be a snapshot")
+	}
+	if snapshot.Version != 4 {
+		t.Error("the snapshot version should be 4:", snapshot.Version)
+	}
+	if snapshot.AggregateType != TestSnapshotAggregateType {
+		t.Error("the snapshot aggregate type should be correct:", snapshot.AggregateType)
+	}
+	if string(snapshot.State) != "event1,event2,event3,event4" {
+		t.Error("the snapshot state should be correct:", string(snapshot.State))
+	}
+
+	agg.StoreEvent(mocks.EventType, &mocks.EventData{Content: "event5"}, timestamp)
+	if err := store.Save(ctx, agg); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// Modify the snapshot to make sure that it is used.
+	snapshot.State = []byte("snapshot")
+	if err := eventStore.SaveSnapshot(ctx, id, *snapshot); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	loaded, err := store.Load(ctx, TestSnapshotAggregateType, id)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	a, ok := loaded.(*TestSnapshotAggregate)
+	if !ok {
+		t.Fatal("the aggregate shoud be of correct type")
+	}
+	if a.Version() != 5 {
+		t.Error("the version should be 5:", a.Version())
+	}
+	if a.content != "snapshot,event5" {
+		t.Error("the state should be restored from the snapshot:", a.content)
+	}
+
+	// Snapshot of the wrong type.
+	snapshot.AggregateType = TestAggregateType
+	snapshot.Version = 6
+	if err := eventStore.SaveSnapshot(ctx, id, *snapshot); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	_, err = store.Load(ctx, TestSnapshotAggregateType, id)
+	if err != events.ErrMismatchedSnapshotType {
+		t.Error("there should be a ErrMismatchedSnapshotType error:", err)
+	}
+}
+
+func Test_AggregateStore_SnapshotError(t *testing.T) {
+	eventStore := memory.NewEventStore()
+	bus := &mocks.EventBus{
+		Events: make([]eh.Event, 0),
+	}
+	store, err := events.NewAggregateStore(eventStore, bus)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	snapshotErr := errors.New("snapshot error")
+	store.SetSnapshotStore(&failingSnapshotStore{eventStore, snapshotErr},
+		events.SnapshotEveryNEvents(1))
+
+	// The save should succeed even if the snapshot fails.
+	ctx := context.Background()
+	id := uuid.New().String()
+	agg := NewTestSnapshotAggregate(id)
+	agg.StoreEvent(mocks.EventType, &mocks.EventData{Content: "event1"},
+		time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC))
+	if err := store.Save(ctx, agg); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(bus.Events) != 1 {
+		t.Error("the event should be published:", bus.Events)
+	}
+	loaded, err := eventStore.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(loaded) != 1 {
+		t.Error("the event should be saved:", loaded)
+	}
+	select {
+	case err := <-store.Errors():
+		if err.Err != snapshotErr {
+			t.Error("the snapshot error should be correct:", err)
+		}
+		if err.AggregateID != id {
+			t.Error("the aggregate ID should be correct:", err.AggregateID)
+		}
+	default:
+		t.Error("there should be a snapshot error")
+	}
+}
+
+// failingSnapshotStore is a snapshot store that fails to save snapshots.
+type failingSnapshotStore struct {
+	eh.SnapshotStore
+	err error
+}
+
+func (s *failingSnapshotStore) SaveSnapshot(ctx context.Context, id eh.ID, snapshot eh.Snapshot) error {
+	return s.err
+}
+
 func createStore(t *testing.T) (*events.AggregateStore, *mocks.EventStore, *mocks.EventBus) {
 	eventStore := &mocks.EventStore{
 		Events: make([]eh.Event, 0),
@@ -255,6 +505,9 @@ func init() {
 	eh.RegisterAggregate(func(id eh.ID) eh.Aggregate {
 		return NewTestAggregateOther(id)
 	})
+	eh.RegisterAggregate(func(id eh.ID) eh.Aggregate {
+		return NewTestSnapshotAggregate(id)
+	})
 }
 
 const TestAggregateOtherType eh.AggregateType = "TestAggregateOther"
@@ -282,3 +535,43 @@ func (a *TestAggregateOther) ApplyEvent(ctx context.Context, event eh.Event) err
 	}
 	return nil
 }
+
+const TestSnapshotAggregateType eh.AggregateType = "TestSnapshotAggregate"
+
+type TestSnapshotAggregate struct {
+	*events.AggregateBase
+	content string
+}
+
+var _ = events.SnapshotAggregate(&TestSnapshotAggregate{})
+
+func NewTestSnapshotAggregate(id eh.ID) *TestSnapshotAggregate {
+	return &TestSnapshotAggregate{
+		AggregateBase: events.NewAggregateBase(TestSnapshotAggregateType, id),
+	}
+}
+
+func (a *TestSnapshotAggregate) HandleCommand(ctx context.Context, cmd eh.Command) error {
+	return nil
+}
+
+func (a *TestSnapshotAggregate) ApplyEvent(ctx context.Context, event eh.Event) error {
+	data, ok := event.Data().(*mocks.EventData)
+	if !ok {
+		return errors.New("invalid event data")
+	}
+	if a.content != "" {
+		a.content += ","
+	}
+	a.content += data.Content
+	return nil
+}
+
+func (a *TestSnapshotAggregate) MarshalSnapshot() ([]byte, error) {
+	return []byte(a.content), nil
+}
+
+func (a *TestSnapshotAggregate) UnmarshalSnapshot(b []byte) error {
+	a.content = string(b)
+	return nil
+}
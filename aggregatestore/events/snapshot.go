@@ -0,0 +1,50 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+// SnapshotAggregate is an aggregate that can marshal its state to a snapshot
+// and restore it again, to avoid applying all events when loading it.
+//
+// A typical example, using JSON to marshal the state:
+//   func (a *Aggregate) MarshalSnapshot() ([]byte, error) {
+//       return json.Marshal(a.state)
+//   }
+//
+//   func (a *Aggregate) UnmarshalSnapshot(b []byte) error {
+//       return json.Unmarshal(b, &a.state)
+//   }
+type SnapshotAggregate interface {
+	Aggregate
+
+	// MarshalSnapshot marshals the current state of the aggregate.
+	MarshalSnapshot() ([]byte, error)
+	// UnmarshalSnapshot restores the state of the aggregate from a snapshot.
+	UnmarshalSnapshot([]byte) error
+
+	// SetVersion sets the version of the aggregate when it is restored from
+	// a snapshot.
+	SetVersion(int)
+}
+
+// SnapshotPolicy decides if a snapshot should be taken after an aggregate
+// has been saved, going from one version to a newer version.
+type SnapshotPolicy func(fromVersion, toVersion int) bool
+
+// SnapshotEveryNEvents is a policy that takes a snapshot every n events.
+func SnapshotEveryNEvents(n int) SnapshotPolicy {
+	return func(fromVersion, toVersion int) bool {
+		return n > 0 && fromVersion/n != toVersion/n
+	}
+}
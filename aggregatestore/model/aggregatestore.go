@@ -30,8 +30,9 @@ var ErrInvalidAggregate = errors.New("invalid aggregate")
 // AggregateStore is an aggregate store that uses a read write repo for
 // loading and saving aggregates.
 type AggregateStore struct {
-	repo eh.ReadWriteRepo
-	bus  eh.EventBus
+	repo   eh.ReadWriteRepo
+	bus    eh.EventBus
+	outbox eh.OutboxRepo
 }
 
 // NewAggregateStore creates an aggregate store with a read write repo.
@@ -69,6 +70,22 @@ func (r *AggregateStore) Load(ctx context.Context, aggregateType eh.AggregateTyp
 
 // Save implements the Save method of the eventhorizon.AggregateStore interface.
 func (r *AggregateStore) Save(ctx context.Context, aggregate eh.Aggregate) error {
+	// Record the events in the outbox, to be published by a relay.
+	if r.outbox != nil {
+		var events []eh.Event
+		publisher, ok := aggregate.(EventPublisher)
+		if ok {
+			events = publisher.EventsToPublish()
+		}
+		if err := r.outbox.SaveWithOutbox(ctx, aggregate, events); err != nil {
+			return err
+		}
+		if ok {
+			publisher.ClearEvents()
+		}
+		return nil
+	}
+
 	if err := r.repo.Save(ctx, aggregate); err != nil {
 		return err
 	}
@@ -86,3 +103,16 @@ func (r *AggregateStore) Save(ctx context.Context, aggregate eh.Aggregate) error
 
 	return nil
 }
+
+// EnableOutbox makes Save record the events to publish in the outbox of the
+// repo, atomically with saving the aggregate, instead of publishing them
+// directly. They must then be published by an outbox.Relay. Returns
+// eventhorizon.ErrOutboxNotSupported if the repo is not an eventhorizon.OutboxRepo.
+func (r *AggregateStore) EnableOutbox() error {
+	outbox, ok := r.repo.(eh.OutboxRepo)
+	if !ok {
+		return eh.ErrOutboxNotSupported
+	}
+	r.outbox = outbox
+	return nil
+}
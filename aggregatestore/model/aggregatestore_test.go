@@ -25,6 +25,7 @@ import (
 	eh "github.com/looplab/eventhorizon"
 	"github.com/looplab/eventhorizon/aggregatestore/model"
 	"github.com/looplab/eventhorizon/mocks"
+	"github.com/looplab/eventhorizon/repo/memory"
 )
 
 func Test_NewAggregateStore(t *testing.T) {
@@ -176,6 +177,49 @@ func Test_AggregateStore_SaveWithPublish(t *testing.T) {
 	}
 }
 
+func Test_AggregateStore_SaveWithOutbox(t *testing.T) {
+	store, _, bus := createStore(t)
+	if err := store.EnableOutbox(); err != eh.ErrOutboxNotSupported {
+		t.Error("there should be an outbox not supported error:", err)
+	}
+
+	repo := memory.NewRepo()
+	store, err := model.NewAggregateStore(repo, bus)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := store.EnableOutbox(); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	ctx := context.Background()
+	id := uuid.New().String()
+	agg := NewAggregate(id)
+	event := eh.NewEvent("test", nil, time.Now())
+
+	// The events should be recorded in the outbox instead of published.
+	agg.PublishEvent(event)
+	if err := store.Save(ctx, agg); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if entity, err := repo.Find(ctx, id); err != nil || entity != agg {
+		t.Error("the aggregate should be saved:", err)
+	}
+	if len(bus.Events) != 0 {
+		t.Error("there should be no event on the bus:", bus.Events)
+	}
+	if len(agg.SliceEventPublisher) != 0 {
+		t.Error("there should be no events to publish")
+	}
+	entries, err := repo.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 1 || entries[0].Event != event {
+		t.Error("the event should be in the outbox:", entries)
+	}
+}
+
 func createStore(t *testing.T) (*model.AggregateStore, *mocks.Repo, *mocks.EventBus) {
 	repo := &mocks.Repo{}
 	bus := &mocks.EventBus{
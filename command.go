@@ -15,6 +15,7 @@
 package eventhorizon
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
@@ -43,6 +44,24 @@ type Command interface {
 	CommandType() CommandType
 }
 
+// IdentifiableCommand is a command with a unique ID, used to detect when the
+// same command is handled more than once, for example when it is retried.
+type IdentifiableCommand interface {
+	Command
+
+	// CommandID returns the unique ID of the command.
+	CommandID() ID
+}
+
+// CommandID returns the ID of a command if it is an IdentifiableCommand, or
+// else the command ID from the context, if any.
+func CommandID(ctx context.Context, cmd Command) (ID, bool) {
+	if c, ok := cmd.(IdentifiableCommand); ok && !IsNilID(c.CommandID()) {
+		return c.CommandID(), true
+	}
+	return CommandIDFromContext(ctx)
+}
+
 // CommandType is the type of a command, used as its unique identifier.
 type CommandType string
 
@@ -15,6 +15,7 @@
 package eventhorizon_test
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -167,6 +168,32 @@ func Test_CheckCommand(t *testing.T) {
 	}
 }
 
+func Test_CommandID(t *testing.T) {
+	// Commands without an ID.
+	cmd := &TestCommandFields{uuid.New().String(), "command1"}
+	if id, ok := eh.CommandID(context.Background(), cmd); ok {
+		t.Error("there should be no command ID:", id)
+	}
+
+	// The ID from the context.
+	ctx := eh.NewContextWithCommandID(context.Background(), "ctxID")
+	if id, ok := eh.CommandID(ctx, cmd); !ok || id != "ctxID" {
+		t.Error("the command ID should be correct:", id)
+	}
+
+	// The ID of the command is used before the context.
+	idCmd := &TestCommandIdentifiable{TestID: uuid.New().String(), ID: "cmdID"}
+	if id, ok := eh.CommandID(ctx, idCmd); !ok || id != "cmdID" {
+		t.Error("the command ID should be correct:", id)
+	}
+
+	// An empty command ID is not used.
+	idCmd.ID = eh.NilID
+	if id, ok := eh.CommandID(ctx, idCmd); !ok || id != "ctxID" {
+		t.Error("the command ID should be correct:", id)
+	}
+}
+
 // Mocks for Register/Unregister.
 
 const (
@@ -215,6 +242,20 @@ func (a TestCommandUnregisterTwice) CommandType() eh.CommandType {
 
 // Mocks for CheckCommand.
 
+type TestCommandIdentifiable struct {
+	TestID eh.ID
+	ID     eh.ID
+}
+
+var _ = eh.IdentifiableCommand(TestCommandIdentifiable{})
+
+func (t TestCommandIdentifiable) AggregateID() eh.ID              { return t.TestID }
+func (t TestCommandIdentifiable) AggregateType() eh.AggregateType { return TestAggregateType }
+func (t TestCommandIdentifiable) CommandType() eh.CommandType {
+	return eh.CommandType("TestCommandIdentifiable")
+}
+func (t TestCommandIdentifiable) CommandID() eh.ID { return t.ID }
+
 type TestCommandFields struct {
 	TestID  eh.ID
 	Content string
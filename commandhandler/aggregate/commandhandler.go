@@ -59,6 +59,11 @@ func (h *CommandHandler) HandleCommand(ctx context.Context, cmd eh.Command) erro
 		return err
 	}
 
+	// The command causes the events, if it has an ID.
+	if id, ok := eh.CommandID(ctx, cmd); ok {
+		ctx = eh.NewContextWithCausationID(ctx, id)
+	}
+
 	a, err := h.store.Load(ctx, h.t, cmd.AggregateID())
 	if err != nil {
 		return err
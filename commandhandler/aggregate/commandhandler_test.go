@@ -68,6 +68,22 @@ func Test_CommandHandler(t *testing.T) {
 	}
 }
 
+func Test_CommandHandler_CausationID(t *testing.T) {
+	a, h, _ := createAggregateAndHandler(t)
+
+	ctx := eh.NewContextWithCommandID(context.Background(), "command")
+	cmd := &mocks.Command{
+		ID:      a.EntityID(),
+		Content: "command1",
+	}
+	if err := h.HandleCommand(ctx, cmd); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if id, ok := eh.CausationIDFromContext(a.Context); !ok || id != "command" {
+		t.Error("the causation ID should be the command ID:", id)
+	}
+}
+
 func Test_CommandHandler_AggregateNotFound(t *testing.T) {
 	store := &mocks.AggregateStore{
 		Aggregates: map[eh.ID]eh.Aggregate{},
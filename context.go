@@ -57,20 +57,52 @@ func init() {
 		}
 		return ctx
 	})
+
+	// Register the tracing contexts.
+	RegisterContextMarshaler(func(ctx context.Context, vals map[string]interface{}) {
+		if id, ok := ctx.Value(correlationIDKey).(string); ok {
+			vals[CorrelationIDKeyStr] = id
+		}
+		if id, ok := ctx.Value(causationIDKey).(string); ok {
+			vals[CausationIDKeyStr] = id
+		}
+		if id, ok := ctx.Value(userIDKey).(string); ok {
+			vals[UserIDKeyStr] = id
+		}
+	})
+	RegisterContextUnmarshaler(func(ctx context.Context, vals map[string]interface{}) context.Context {
+		if id, ok := vals[CorrelationIDKeyStr].(string); ok {
+			ctx = NewContextWithCorrelationID(ctx, id)
+		}
+		if id, ok := vals[CausationIDKeyStr].(string); ok {
+			ctx = NewContextWithCausationID(ctx, id)
+		}
+		if id, ok := vals[UserIDKeyStr].(string); ok {
+			ctx = NewContextWithUserID(ctx, id)
+		}
+		return ctx
+	})
 }
 
 type contextKey int
 
-// Context keys for namespace and min version.
+// Context keys for namespace, min version, tracing and command IDs.
 const (
 	namespaceKey contextKey = iota
 	minVersionKey
+	correlationIDKey
+	causationIDKey
+	userIDKey
+	commandIDKey
 )
 
 // Strings used to marshal context values.
 const (
-	NamespaceKeyStr  = "eh_namespace"
-	MinVersionKeyStr = "eh_minversion"
+	NamespaceKeyStr     = "eh_namespace"
+	MinVersionKeyStr    = "eh_minversion"
+	CorrelationIDKeyStr = "eh_correlation_id"
+	CausationIDKeyStr   = "eh_causation_id"
+	UserIDKeyStr        = "eh_user_id"
 )
 
 // NamespaceFromContext returns the namespace from the context, or the default
@@ -106,6 +138,99 @@ func NewContextWithMinVersionWait(ctx context.Context, minVersion int) (c contex
 	return context.WithTimeout(ctx, DefaultMinVersionDeadline)
 }
 
+// CorrelationIDFromContext returns the correlation ID from the context.
+func CorrelationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey).(string)
+	return id, ok
+}
+
+// NewContextWithCorrelationID sets the correlation ID to use in the context.
+// It is added as metadata to all events saved with the context.
+func NewContextWithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey, id)
+}
+
+// CausationIDFromContext returns the causation ID from the context.
+func CausationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(causationIDKey).(string)
+	return id, ok
+}
+
+// NewContextWithCausationID sets the causation ID to use in the context.
+// It is added as metadata to all events saved with the context.
+func NewContextWithCausationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, causationIDKey, id)
+}
+
+// UserIDFromContext returns the user ID from the context.
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(userIDKey).(string)
+	return id, ok
+}
+
+// NewContextWithUserID sets the user ID to use in the context. It is added as
+// metadata to all events saved with the context.
+func NewContextWithUserID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, userIDKey, id)
+}
+
+// CommandIDFromContext returns the command ID from the context.
+func CommandIDFromContext(ctx context.Context) (ID, bool) {
+	id, ok := ctx.Value(commandIDKey).(ID)
+	return id, ok
+}
+
+// NewContextWithCommandID sets the ID of the command to handle with the
+// context, for commands that are not IdentifiableCommands. It is only used
+// locally and is not marshaled with the context.
+func NewContextWithCommandID(ctx context.Context, id ID) context.Context {
+	return context.WithValue(ctx, commandIDKey, id)
+}
+
+// NewContextWithCausingEvent returns a context to use for commands caused by
+// an event. The correlation and user IDs are kept from the event and the
+// event ID is used as causation ID. If the event has no correlation ID its
+// own ID is used, as it is the start of the chain. The command ID of the
+// command that caused the event is removed, as it does not identify the new
+// commands.
+func NewContextWithCausingEvent(ctx context.Context, event Event) context.Context {
+	ctx = context.WithValue(ctx, commandIDKey, nil)
+
+	metadata := event.Metadata()
+	eventID, _ := metadata[EventIDMetadataKey].(string)
+	if id, ok := metadata[CorrelationIDMetadataKey].(string); ok {
+		ctx = NewContextWithCorrelationID(ctx, id)
+	} else if eventID != "" {
+		ctx = NewContextWithCorrelationID(ctx, eventID)
+	}
+	if eventID != "" {
+		ctx = NewContextWithCausationID(ctx, eventID)
+	}
+	if id, ok := metadata[UserIDMetadataKey].(string); ok {
+		ctx = NewContextWithUserID(ctx, id)
+	}
+	return ctx
+}
+
+// MetadataFromContext returns the event metadata from the tracing values in
+// the context, or nil if there are none.
+func MetadataFromContext(ctx context.Context) map[string]interface{} {
+	var metadata map[string]interface{}
+	for k, key := range map[string]contextKey{
+		CorrelationIDMetadataKey: correlationIDKey,
+		CausationIDMetadataKey:   causationIDKey,
+		UserIDMetadataKey:        userIDKey,
+	} {
+		if id, ok := ctx.Value(key).(string); ok {
+			if metadata == nil {
+				metadata = map[string]interface{}{}
+			}
+			metadata[k] = id
+		}
+	}
+	return metadata
+}
+
 // Private context marshaling funcs.
 var (
 	contextMarshalFuncs   = []ContextMarshalFunc{}
@@ -17,7 +17,9 @@ package eventhorizon_test
 import (
 	"context"
 	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 
 	eh "github.com/looplab/eventhorizon"
 )
@@ -88,17 +90,115 @@ func Test_ContextMinVersion(t *testing.T) {
 	}
 }
 
+func Test_ContextTracing(t *testing.T) {
+	ctx := context.Background()
+
+	if md := eh.MetadataFromContext(ctx); md != nil {
+		t.Error("there should be no metadata:", md)
+	}
+
+	ctx = eh.NewContextWithCorrelationID(ctx, "correlation")
+	ctx = eh.NewContextWithCausationID(ctx, "causation")
+	ctx = eh.NewContextWithUserID(ctx, "user")
+	expectedMetadata := map[string]interface{}{
+		eh.CorrelationIDMetadataKey: "correlation",
+		eh.CausationIDMetadataKey:   "causation",
+		eh.UserIDMetadataKey:        "user",
+	}
+	if md := eh.MetadataFromContext(ctx); !reflect.DeepEqual(md, expectedMetadata) {
+		t.Error("the metadata should be correct:", md)
+	}
+
+	// Marshal via JSON to get more realistic testing.
+	b, err := json.Marshal(eh.MarshalContext(ctx))
+	if err != nil {
+		t.Error("could not marshal JSON:", err)
+	}
+	vals := map[string]interface{}{}
+	if err := json.Unmarshal(b, &vals); err != nil {
+		t.Error("could not unmarshal JSON:", err)
+	}
+	ctx = eh.UnmarshalContext(vals)
+	if id, ok := eh.CorrelationIDFromContext(ctx); !ok || id != "correlation" {
+		t.Error("the correlation ID should be correct:", id)
+	}
+	if id, ok := eh.CausationIDFromContext(ctx); !ok || id != "causation" {
+		t.Error("the causation ID should be correct:", id)
+	}
+	if id, ok := eh.UserIDFromContext(ctx); !ok || id != "user" {
+		t.Error("the user ID should be correct:", id)
+	}
+}
+
+func Test_ContextCommandID(t *testing.T) {
+	ctx := context.Background()
+
+	if id, ok := eh.CommandIDFromContext(ctx); ok {
+		t.Error("there should be no command ID:", id)
+	}
+
+	ctx = eh.NewContextWithCommandID(ctx, "command")
+	if id, ok := eh.CommandIDFromContext(ctx); !ok || id != "command" {
+		t.Error("the command ID should be correct:", id)
+	}
+
+	// The command ID should not be marshaled.
+	vals := eh.MarshalContext(ctx)
+	ctx = eh.UnmarshalContext(vals)
+	if id, ok := eh.CommandIDFromContext(ctx); ok {
+		t.Error("there should be no command ID:", id)
+	}
+}
+
+func Test_ContextWithCausingEvent(t *testing.T) {
+	// The first event in a chain is used as correlation.
+	event := eh.NewEvent(TestEventType, nil, time.Now(), eh.WithMetadata(map[string]interface{}{
+		eh.EventIDMetadataKey: "event1",
+		eh.UserIDMetadataKey:  "user",
+	}))
+	ctx := eh.NewContextWithCausingEvent(context.Background(), event)
+	if id, _ := eh.CorrelationIDFromContext(ctx); id != "event1" {
+		t.Error("the correlation ID should be correct:", id)
+	}
+	if id, _ := eh.CausationIDFromContext(ctx); id != "event1" {
+		t.Error("the causation ID should be correct:", id)
+	}
+	if id, _ := eh.UserIDFromContext(ctx); id != "user" {
+		t.Error("the user ID should be correct:", id)
+	}
+
+	// The correlation is kept for later events.
+	event = eh.NewEvent(TestEventType, nil, time.Now(), eh.WithMetadata(map[string]interface{}{
+		eh.EventIDMetadataKey:       "event2",
+		eh.CorrelationIDMetadataKey: "event1",
+	}))
+	ctx = eh.NewContextWithCausingEvent(context.Background(), event)
+	if id, _ := eh.CorrelationIDFromContext(ctx); id != "event1" {
+		t.Error("the correlation ID should be correct:", id)
+	}
+	if id, _ := eh.CausationIDFromContext(ctx); id != "event2" {
+		t.Error("the causation ID should be correct:", id)
+	}
+
+	// The command ID of the causing command is not kept.
+	ctx = eh.NewContextWithCommandID(context.Background(), "command")
+	ctx = eh.NewContextWithCausingEvent(ctx, event)
+	if id, ok := eh.CommandIDFromContext(ctx); ok {
+		t.Error("there should be no command ID:", id)
+	}
+}
+
 func Test_ContextMarshaler(t *testing.T) {
-	if len(eh.ContextMarshalers()) != 2 {
-		t.Error("there should be two context marshalers")
+	if len(eh.ContextMarshalers()) != 3 {
+		t.Error("there should be three context marshalers")
 	}
 	eh.RegisterContextMarshaler(func(ctx context.Context, vals map[string]interface{}) {
 		if val, ok := ContextTestOne(ctx); ok {
 			vals[contextTestKeyOneStr] = val
 		}
 	})
-	if len(eh.ContextMarshalers()) != 3 {
-		t.Error("there should be three context marshaler")
+	if len(eh.ContextMarshalers()) != 4 {
+		t.Error("there should be four context marshaler")
 	}
 
 	ctx := context.Background()
@@ -115,8 +215,8 @@ func Test_ContextMarshaler(t *testing.T) {
 }
 
 func Test_ContextUnmarshaler(t *testing.T) {
-	if len(eh.ContextUnmarshalers()) != 2 {
-		t.Error("there should be two context marshalers")
+	if len(eh.ContextUnmarshalers()) != 3 {
+		t.Error("there should be three context marshalers")
 	}
 	eh.RegisterContextUnmarshaler(func(ctx context.Context, vals map[string]interface{}) context.Context {
 		if val, ok := vals[contextTestKeyOneStr].(string); ok {
@@ -124,8 +224,8 @@ func Test_ContextUnmarshaler(t *testing.T) {
 		}
 		return ctx
 	})
-	if len(eh.ContextUnmarshalers()) != 3 {
-		t.Error("there should be three context unmarshalers")
+	if len(eh.ContextUnmarshalers()) != 4 {
+		t.Error("there should be four context unmarshalers")
 	}
 
 	vals := map[string]interface{}{}
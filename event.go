@@ -52,24 +52,64 @@ type Event interface {
 	// Version of the aggregate for this event (after it has been applied).
 	Version() int
 
+	// Metadata is app-specific metadata, like the event ID or the correlation
+	// and causation IDs. Some standard keys are defined as MetadataKey consts.
+	Metadata() map[string]interface{}
+
 	// A string representation of the event.
 	String() string
 }
 
+// Standard metadata keys used to trace events.
+const (
+	// EventIDMetadataKey is the key for the unique ID of an event.
+	EventIDMetadataKey = "event_id"
+	// CorrelationIDMetadataKey is the key for the ID shared by all events
+	// and commands originating from the same request.
+	CorrelationIDMetadataKey = "correlation_id"
+	// CausationIDMetadataKey is the key for the ID of the command or event
+	// that directly caused an event.
+	CausationIDMetadataKey = "causation_id"
+	// UserIDMetadataKey is the key for the ID of the user that caused an event.
+	UserIDMetadataKey = "user_id"
+)
+
+// EventOption is an option to use when creating events.
+type EventOption func(Event)
+
+// WithMetadata adds metadata when creating an event. The values must be
+// supported by the marshalers of the event stores and busses used.
+func WithMetadata(metadata map[string]interface{}) EventOption {
+	return func(e Event) {
+		if evt, ok := e.(*event); ok {
+			if evt.metadata == nil {
+				evt.metadata = map[string]interface{}{}
+			}
+			for k, v := range metadata {
+				evt.metadata[k] = v
+			}
+		}
+	}
+}
+
 // NewEvent creates a new event with a type and data, setting its timestamp.
-func NewEvent(eventType EventType, data EventData, timestamp time.Time) Event {
-	return event{
+func NewEvent(eventType EventType, data EventData, timestamp time.Time, options ...EventOption) Event {
+	e := &event{
 		eventType: eventType,
 		data:      data,
 		timestamp: timestamp,
 	}
+	for _, option := range options {
+		option(e)
+	}
+	return e
 }
 
 // NewEventForAggregate creates a new event with a type and data, setting its
 // timestamp. It also sets the aggregate data on it.
 func NewEventForAggregate(eventType EventType, data EventData, timestamp time.Time,
-	aggregateType AggregateType, aggregateID ID, version int) Event {
-	return event{
+	aggregateType AggregateType, aggregateID ID, version int, options ...EventOption) Event {
+	e := &event{
 		eventType:     eventType,
 		data:          data,
 		timestamp:     timestamp,
@@ -77,6 +117,10 @@ func NewEventForAggregate(eventType EventType, data EventData, timestamp time.Ti
 		aggregateID:   aggregateID,
 		version:       version,
 	}
+	for _, option := range options {
+		option(e)
+	}
+	return e
 }
 
 // event is an internal representation of an event, returned when the aggregate
@@ -89,6 +133,7 @@ type event struct {
 	aggregateType AggregateType
 	aggregateID   ID
 	version       int
+	metadata      map[string]interface{}
 }
 
 // EventType implements the EventType method of the Event interface.
@@ -121,6 +166,11 @@ func (e event) Version() int {
 	return e.version
 }
 
+// Metadata implements the Metadata method of the Event interface.
+func (e event) Metadata() map[string]interface{} {
+	return e.metadata
+}
+
 // String implements the String method of the Event interface.
 func (e event) String() string {
 	return fmt.Sprintf("%s@%d", e.eventType, e.version)
@@ -66,6 +66,22 @@ func Test_NewEvent(t *testing.T) {
 	if event.String() != "TestEvent@3" {
 		t.Error("the string representation should be correct:", event.String())
 	}
+	if event.Metadata() != nil {
+		t.Error("there should be no metadata:", event.Metadata())
+	}
+
+	event = eh.NewEventForAggregate(TestEventType, &TestEventData{"event1"}, timestamp,
+		TestAggregateType, id, 3, eh.WithMetadata(map[string]interface{}{
+			eh.EventIDMetadataKey: "event1",
+		}), eh.WithMetadata(map[string]interface{}{
+			eh.UserIDMetadataKey: "user",
+		}))
+	if !reflect.DeepEqual(event.Metadata(), map[string]interface{}{
+		eh.EventIDMetadataKey: "event1",
+		eh.UserIDMetadataKey:  "user",
+	}) {
+		t.Error("the metadata should be correct:", event.Metadata())
+	}
 }
 
 func Test_CreateEventData(t *testing.T) {
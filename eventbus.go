@@ -16,9 +16,13 @@ package eventhorizon
 
 import (
 	"context"
+	"errors"
 	"fmt"
 )
 
+// ErrHandlerNotFound is when a handler or observer to remove is not added.
+var ErrHandlerNotFound = errors.New("handler not found")
+
 // EventBusError is an async error containing the error returned from a handler
 // or observer and the event that it happened on.
 type EventBusError struct {
@@ -49,6 +53,12 @@ type EventBus interface {
 	// is already added.
 	AddObserver(EventMatcher, EventHandler)
 
+	// RemoveHandler removes a handler or observer by type, which will not
+	// receive any more events when it returns. Resources that are only used
+	// by the observer, like subscriptions, are deleted. Returns
+	// ErrHandlerNotFound if there is no handler or observer of the type.
+	RemoveHandler(EventHandlerType) error
+
 	// Errors returns an error channel where async handling errors are sent.
 	Errors() <-chan EventBusError
 }
@@ -74,7 +74,9 @@ func AcceptanceTest(t *testing.T, bus1, bus2 eh.EventBus, timeout time.Duration)
 	id := "c1138e5f-f6fb-4dd0-8e79-255c6c8d3756"
 	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
 	event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"}, timestamp,
-		mocks.AggregateType, id, 1)
+		mocks.AggregateType, id, 1, eh.WithMetadata(map[string]interface{}{
+			eh.EventIDMetadataKey: "f3b0d9a4-6a8e-4c1e-9a57-2b3c4d5e6f70",
+		}))
 	if err := bus1.PublishEvent(ctx, event1); err != nil {
 		t.Error("there should be no error:", err)
 	}
@@ -170,6 +172,35 @@ func AcceptanceTest(t *testing.T, bus1, bus2 eh.EventBus, timeout time.Duration)
 		t.Error("the context should be correct:", observerBus2.Context)
 	}
 
+	// Remove an unknown handler.
+	if err := bus1.RemoveHandler("unknown"); err != eh.ErrHandlerNotFound {
+		t.Error("there should be a handler not found error:", err)
+	}
+
+	// Remove observer 1, which should not receive any more events.
+	if err := bus1.RemoveHandler(observerName); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	observerBus1.Reset()
+	if err := bus1.PublishEvent(ctx, event1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !observerBus2.Wait(timeout) {
+		t.Error("did not receive event in time")
+	}
+	if observerBus1.Wait(timeout / 10) {
+		t.Error("a removed observer should not receive events:", observerBus1.Events)
+	}
+
+	// Add observer 1 again.
+	bus1.AddObserver(eh.MatchAny(), observerBus1)
+	if err := bus1.PublishEvent(ctx, event1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !observerBus1.Wait(timeout) {
+		t.Error("did not receive event in time")
+	}
+
 	// Test async errors from handlers.
 	errorHandler := mocks.NewEventHandler("error_handler")
 	errorHandler.Err = errors.New("handler error")
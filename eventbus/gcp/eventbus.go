@@ -38,11 +38,13 @@ type EventBus struct {
 	appID        string
 	client       *pubsub.Client
 	topic        *pubsub.Topic
-	registered   map[eh.EventHandlerType]struct{}
+	registered   map[eh.EventHandlerType]*registration
 	registeredMu sync.RWMutex
 	errCh        chan eh.EventBusError
 }
 
+var _ = eh.EventBus(&EventBus{})
+
 // NewEventBus creates an EventBus, with optional GCP connection settings.
 func NewEventBus(projectID, appID string, opts ...option.ClientOption) (*EventBus, error) {
 	ctx := context.Background()
@@ -66,7 +68,7 @@ func NewEventBus(projectID, appID string, opts ...option.ClientOption) (*EventBu
 		appID:      appID,
 		client:     client,
 		topic:      topic,
-		registered: map[eh.EventHandlerType]struct{}{},
+		registered: map[eh.EventHandlerType]*registration{},
 		errCh:      make(chan eh.EventBusError, 100),
 	}, nil
 }
@@ -80,6 +82,8 @@ func (b *EventBus) PublishEvent(ctx context.Context, event eh.Event) error {
 		Version:       event.Version(),
 		Timestamp:     event.Timestamp(),
 		Context:       eh.MarshalContext(ctx),
+		SchemaVersion: eh.EventSchemaVersion(event.EventType()),
+		Metadata:      event.Metadata(),
 	}
 
 	// Marshal event data if there is any.
@@ -112,14 +116,61 @@ func (b *EventBus) PublishEvent(ctx context.Context, event eh.Event) error {
 
 // AddHandler implements the AddHandler method of the eventhorizon.EventBus interface.
 func (b *EventBus) AddHandler(m eh.EventMatcher, h eh.EventHandler) {
-	sub := b.subscription(m, h, false)
-	go b.handle(m, h, sub)
+	r := b.subscription(m, h, false)
+	go b.handle(m, h, r)
 }
 
 // AddObserver implements the AddObserver method of the eventhorizon.EventBus interface.
 func (b *EventBus) AddObserver(m eh.EventMatcher, h eh.EventHandler) {
-	sub := b.subscription(m, h, true)
-	go b.handle(m, h, sub)
+	r := b.subscription(m, h, true)
+	go b.handle(m, h, r)
+}
+
+// RemoveHandler implements the RemoveHandler method of the eventhorizon.EventBus interface.
+// The subscription of an observer is deleted, while the subscription of a
+// handler is kept to receive events for other instances of the handler.
+//
+// NOTE: The subscriptions of observers are only deleted when removed, which
+// Close does. They are left if the process exits without closing the bus, and
+// must then be deleted manually, they are labeled with "observer".
+func (b *EventBus) RemoveHandler(t eh.EventHandlerType) error {
+	b.registeredMu.Lock()
+	r, ok := b.registered[t]
+	if !ok {
+		b.registeredMu.Unlock()
+		return eh.ErrHandlerNotFound
+	}
+	delete(b.registered, t)
+	b.registeredMu.Unlock()
+
+	r.cancel()
+	<-r.stopped
+
+	if r.observer {
+		if err := r.sub.Delete(context.Background()); err != nil {
+			return errors.New("could not delete subscription: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Close removes all handlers and observers, deleting the subscriptions of
+// the observers.
+func (b *EventBus) Close() error {
+	b.registeredMu.RLock()
+	types := make([]eh.EventHandlerType, 0, len(b.registered))
+	for t := range b.registered {
+		types = append(types, t)
+	}
+	b.registeredMu.RUnlock()
+
+	var err error
+	for _, t := range types {
+		if rErr := b.RemoveHandler(t); rErr != nil && err == nil {
+			err = rErr
+		}
+	}
+	return err
 }
 
 // Errors implements the Errors method of the eventhorizon.EventBus interface.
@@ -127,8 +178,17 @@ func (b *EventBus) Errors() <-chan eh.EventBusError {
 	return b.errCh
 }
 
+// registration is a handler or observer added to the bus.
+type registration struct {
+	sub      *pubsub.Subscription
+	observer bool
+	ctx      context.Context
+	cancel   func()
+	stopped  chan struct{}
+}
+
 // Checks the matcher and handler and gets the event subscription.
-func (b *EventBus) subscription(m eh.EventMatcher, h eh.EventHandler, observer bool) *pubsub.Subscription {
+func (b *EventBus) subscription(m eh.EventMatcher, h eh.EventHandler, observer bool) *registration {
 	b.registeredMu.Lock()
 	defer b.registeredMu.Unlock()
 
@@ -141,7 +201,6 @@ func (b *EventBus) subscription(m eh.EventMatcher, h eh.EventHandler, observer b
 	if _, ok := b.registered[h.HandlerType()]; ok {
 		panic(fmt.Sprintf("multiple registrations for %s", h.HandlerType()))
 	}
-	b.registered[h.HandlerType()] = struct{}{}
 
 	id := string(h.HandlerType())
 	if observer { // Generate unique ID for each observer.
@@ -156,30 +215,59 @@ func (b *EventBus) subscription(m eh.EventMatcher, h eh.EventHandler, observer b
 	if ok, err := sub.Exists(ctx); err != nil {
 		panic("could not check subscription: " + err.Error())
 	} else if !ok {
-		if sub, err = b.client.CreateSubscription(ctx, subscriptionID,
-			pubsub.SubscriptionConfig{
-				Topic:       b.topic,
-				AckDeadline: 60 * time.Second,
-			},
-		); err != nil {
+		config := pubsub.SubscriptionConfig{
+			Topic:       b.topic,
+			AckDeadline: 60 * time.Second,
+		}
+		// The subscriptions of observers are deleted when they are removed,
+		// but are left if the process exits without closing the bus. Keep the
+		// backlog of such subscriptions as short as possible and label them.
+		// NOTE: The pinned Pub/Sub client does not support an expiration
+		// policy, which would also delete them when left unused.
+		if observer {
+			config.RetentionDuration = 10 * time.Minute
+			config.Labels = map[string]string{"observer": "true"}
+		}
+		if sub, err = b.client.CreateSubscription(ctx, subscriptionID, config); err != nil {
 			panic("could not create subscription: " + err.Error())
 		}
 	}
 
-	return sub
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &registration{
+		sub:      sub,
+		observer: observer,
+		ctx:      ctx,
+		cancel:   cancel,
+		stopped:  make(chan struct{}),
+	}
+	b.registered[h.HandlerType()] = r
+	return r
 }
 
-// Handles all events coming in on the channel.
-func (b *EventBus) handle(m eh.EventMatcher, h eh.EventHandler, sub *pubsub.Subscription) {
+// Handles all events coming in on the subscription, until the handler is
+// removed.
+func (b *EventBus) handle(m eh.EventMatcher, h eh.EventHandler, r *registration) {
+	defer close(r.stopped)
+
 	for {
-		ctx := context.Background()
-		if err := sub.Receive(ctx, b.handler(m, h)); err != context.Canceled {
+		// Receive returns nil when the context is done.
+		err := r.sub.Receive(r.ctx, b.handler(m, h))
+		if r.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
 			select {
-			case b.errCh <- eh.EventBusError{Ctx: ctx, Err: errors.New("could not receive: " + err.Error())}:
+			case b.errCh <- eh.EventBusError{Ctx: r.ctx, Err: errors.New("could not receive: " + err.Error())}:
 			default:
 			}
 		}
-		time.Sleep(time.Second)
+
+		select {
+		case <-time.After(time.Second):
+		case <-r.ctx.Done():
+			return
+		}
 	}
 }
 
@@ -200,6 +288,20 @@ func (b *EventBus) handler(m eh.EventMatcher, h eh.EventHandler) func(ctx contex
 			return
 		}
 
+		// Upcast the raw BSON data if the event was published with an older
+		// schema version.
+		if eh.EventSchemaVersion(e.EventType) > e.SchemaVersion {
+			var err error
+			if e, err = upcast(e); err != nil {
+				select {
+				case b.errCh <- eh.EventBusError{Err: errors.New("could not upcast event: " + err.Error()), Ctx: ctx}:
+				default:
+				}
+				msg.Nack()
+				return
+			}
+		}
+
 		// Create an event of the correct type.
 		if data, err := eh.CreateEventData(e.EventType); err == nil {
 			// Manually decode the raw BSON event.
@@ -249,6 +351,30 @@ type evt struct {
 	AggregateID   string                 `bson:"_id"`
 	Version       int                    `bson:"version"`
 	Context       map[string]interface{} `bson:"context"`
+	SchemaVersion int                    `bson:"schema_version"`
+	Metadata      map[string]interface{} `bson:"metadata,omitempty"`
+}
+
+// upcast upcasts the raw BSON data of an event to the current schema version
+// of its event type.
+func upcast(e evt) (evt, error) {
+	var data []byte
+	if e.RawData.Kind != 0 {
+		data = e.RawData.Data
+	}
+
+	var err error
+	e.EventType, e.SchemaVersion, data, err = eh.UpcastRawEventData(
+		e.EventType, e.SchemaVersion, data, bson.Unmarshal, bson.Marshal)
+	if err != nil {
+		return e, err
+	}
+	e.RawData = bson.Raw{}
+	if data != nil {
+		e.RawData = bson.Raw{Kind: 3, Data: data}
+	}
+
+	return e, nil
 }
 
 // event is the private implementation of the eventhorizon.Event interface
@@ -282,6 +408,11 @@ func (e event) AggregateID() eh.ID {
 	return e.evt.AggregateID
 }
 
+// Metadata implements the Metadata method of the eventhorizon.Event interface.
+func (e event) Metadata() map[string]interface{} {
+	return e.evt.Metadata
+}
+
 // Version implements the Version method of the eventhorizon.Event interface.
 func (e event) Version() int {
 	return e.evt.Version
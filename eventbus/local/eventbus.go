@@ -23,19 +23,22 @@ import (
 	eh "github.com/looplab/eventhorizon"
 )
 
-// DefaultQueueSize is the default queue size per handler for publishing events.
+// DefaultQueueSize is the default queue size per handler for publishing events,
+// used when no size is set with WithQueue or WithHandlerQueue.
 var DefaultQueueSize = 10
 
 // EventBus is a local event bus that delegates handling of published events
 // to all matching registered handlers, in order of registration.
 type EventBus struct {
 	group        *Group
-	registered   map[eh.EventHandlerType]struct{}
+	registered   map[eh.EventHandlerType]*registration
 	registeredMu sync.RWMutex
 	errCh        chan eh.EventBusError
 	wg           sync.WaitGroup
 }
 
+var _ = eh.EventBus(&EventBus{})
+
 // NewEventBus creates a EventBus.
 func NewEventBus(g *Group) *EventBus {
 	if g == nil {
@@ -43,27 +46,61 @@ func NewEventBus(g *Group) *EventBus {
 	}
 	return &EventBus{
 		group:      g,
-		registered: map[eh.EventHandlerType]struct{}{},
+		registered: map[eh.EventHandlerType]*registration{},
 		errCh:      make(chan eh.EventBusError, 100),
 	}
 }
 
 // PublishEvent implements the PublishEvent method of the eventhorizon.EventBus interface.
+// Events that are dropped because the queue of a handler is full are sent on
+// the error channel. It returns ErrBusClosed if the group has been closed.
 func (b *EventBus) PublishEvent(ctx context.Context, event eh.Event) error {
-	b.group.publish(ctx, event)
+	errs, err := b.group.publish(ctx, event)
+	if err != nil {
+		return err
+	}
+	for _, err := range errs {
+		select {
+		case b.errCh <- eh.EventBusError{Err: err, Ctx: ctx, Event: event}:
+		default:
+		}
+	}
 	return nil
 }
 
 // AddHandler implements the AddHandler method of the eventhorizon.EventBus interface.
 func (b *EventBus) AddHandler(m eh.EventMatcher, h eh.EventHandler) {
-	ch := b.channel(m, h, false)
-	go b.handle(m, h, ch)
+	r := b.register(m, h, false)
+	b.wg.Add(1)
+	go b.handle(m, h, r)
 }
 
 // AddObserver implements the AddObserver method of the eventhorizon.EventBus interface.
 func (b *EventBus) AddObserver(m eh.EventMatcher, h eh.EventHandler) {
-	ch := b.channel(m, h, true)
-	go b.handle(m, h, ch)
+	r := b.register(m, h, true)
+	b.wg.Add(1)
+	go b.handle(m, h, r)
+}
+
+// RemoveHandler implements the RemoveHandler method of the eventhorizon.EventBus interface.
+// The events in the queue of the handler are not handled, unless the handler
+// is also added to an other bus in the group.
+func (b *EventBus) RemoveHandler(t eh.EventHandlerType) error {
+	b.registeredMu.Lock()
+	r, ok := b.registered[t]
+	if !ok {
+		b.registeredMu.Unlock()
+		return eh.ErrHandlerNotFound
+	}
+	delete(b.registered, t)
+	b.registeredMu.Unlock()
+
+	// Detach the queue first, which stops publishers blocked on it when it
+	// is no longer used, before stopping the handling.
+	b.group.remove(r.id)
+	close(r.stop)
+	<-r.stopped
+	return nil
 }
 
 // Errors implements the Errors method of the eventhorizon.EventBus interface.
@@ -71,26 +108,44 @@ func (b *EventBus) Errors() <-chan eh.EventBusError {
 	return b.errCh
 }
 
-// Handles all events coming in on the channel.
-func (b *EventBus) handle(m eh.EventMatcher, h eh.EventHandler, ch <-chan evt) {
-	b.wg.Add(1)
+// registration is a handler or observer added to the bus.
+type registration struct {
+	// id is the ID of the queue in the group.
+	id      string
+	ch      <-chan evt
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Handles all events coming in on the channel, until it is closed or the
+// handler is removed.
+func (b *EventBus) handle(m eh.EventMatcher, h eh.EventHandler, r *registration) {
 	defer b.wg.Done()
+	defer close(r.stopped)
 
-	for e := range ch {
-		if !m(e.event) {
-			continue
-		}
-		if err := h.HandleEvent(e.ctx, e.event); err != nil {
-			select {
-			case b.errCh <- eh.EventBusError{Err: fmt.Errorf("could not handle event (%s): %s", h.HandlerType(), err.Error()), Ctx: e.ctx, Event: e.event}:
-			default:
+	for {
+		select {
+		case <-r.stop:
+			return
+		case e, ok := <-r.ch:
+			if !ok {
+				return
+			}
+			if !m(e.event) {
+				continue
+			}
+			if err := h.HandleEvent(e.ctx, e.event); err != nil {
+				select {
+				case b.errCh <- eh.EventBusError{Err: fmt.Errorf("could not handle event (%s): %s", h.HandlerType(), err.Error()), Ctx: e.ctx, Event: e.event}:
+				default:
+				}
 			}
 		}
 	}
 }
 
 // Checks the matcher and handler and gets the event channel from the group.
-func (b *EventBus) channel(m eh.EventMatcher, h eh.EventHandler, observer bool) <-chan evt {
+func (b *EventBus) register(m eh.EventMatcher, h eh.EventHandler, observer bool) *registration {
 	b.registeredMu.Lock()
 	defer b.registeredMu.Unlock()
 
@@ -103,18 +158,26 @@ func (b *EventBus) channel(m eh.EventMatcher, h eh.EventHandler, observer bool)
 	if _, ok := b.registered[h.HandlerType()]; ok {
 		panic(fmt.Sprintf("multiple registrations for %s", h.HandlerType()))
 	}
-	b.registered[h.HandlerType()] = struct{}{}
 
 	id := string(h.HandlerType())
 	if observer { // Generate unique ID for each observer.
 		id = fmt.Sprintf("%s-%s", id, uuid.New().String())
 	}
-	return b.group.channel(id)
+	r := &registration{
+		id:      id,
+		ch:      b.group.channel(id, h.HandlerType()),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	b.registered[h.HandlerType()] = r
+	return r
 }
 
-// Close all the channels in the events bus group
+// Close closes all the channels in the event bus group and waits for the
+// handlers of the bus to handle the queued events.
 func (b *EventBus) Close() {
 	b.group.Close()
+	b.wg.Wait()
 }
 
 // Wait for all channels to close in the event bus group
@@ -124,15 +187,23 @@ func (b *EventBus) Wait() {
 
 // Group is a publishing group shared by multiple event busses locally, if needed.
 type Group struct {
-	bus   map[string]chan evt
-	busMu sync.RWMutex
+	bus           map[string]*queue
+	busMu         sync.RWMutex
+	closed        bool
+	queue         Queue
+	handlerQueues map[eh.EventHandlerType]Queue
 }
 
 // NewGroup creates a Group.
-func NewGroup() *Group {
-	return &Group{
-		bus: map[string]chan evt{},
+func NewGroup(options ...Option) *Group {
+	g := &Group{
+		bus:           map[string]*queue{},
+		handlerQueues: map[eh.EventHandlerType]Queue{},
+	}
+	for _, option := range options {
+		option(g)
 	}
+	return g
 }
 
 type evt struct {
@@ -140,36 +211,82 @@ type evt struct {
 	event eh.Event
 }
 
-func (g *Group) channel(id string) <-chan evt {
+func (g *Group) channel(id string, t eh.EventHandlerType) <-chan evt {
 	g.busMu.Lock()
 	defer g.busMu.Unlock()
 
-	if ch, ok := g.bus[id]; ok {
+	if g.closed {
+		ch := make(chan evt)
+		close(ch)
 		return ch
 	}
 
-	ch := make(chan evt, DefaultQueueSize)
-	g.bus[id] = ch
-	return ch
+	if q, ok := g.bus[id]; ok {
+		q.refs++
+		return q.out
+	}
+
+	config, ok := g.handlerQueues[t]
+	if !ok {
+		config = g.queue
+	}
+	q := newQueue(t, config)
+	q.refs++
+	g.bus[id] = q
+	return q.out
+}
+
+// remove removes a reference to a queue, detaching it when it is no longer used.
+func (g *Group) remove(id string) {
+	g.busMu.Lock()
+	defer g.busMu.Unlock()
+
+	q, ok := g.bus[id]
+	if !ok {
+		return
+	}
+	q.refs--
+	if q.refs == 0 {
+		q.detach()
+		delete(g.bus, id)
+	}
 }
 
-func (g *Group) publish(ctx context.Context, event eh.Event) {
+// publish publishes an event to all queues, returning an error for each queue
+// that the event was dropped from. The queues are pushed to without holding the
+// lock, so that blocked publishers do not block adding or removing handlers.
+func (g *Group) publish(ctx context.Context, event eh.Event) ([]error, error) {
 	g.busMu.RLock()
-	defer g.busMu.RUnlock()
+	if g.closed {
+		g.busMu.RUnlock()
+		return nil, ErrBusClosed
+	}
+	queues := make([]*queue, 0, len(g.bus))
+	for _, q := range g.bus {
+		queues = append(queues, q)
+	}
+	g.busMu.RUnlock()
 
-	for _, ch := range g.bus {
-		select {
-		case ch <- evt{ctx, event}:
-		default:
-			// TODO: Maybe log here because queue is full.
+	var errs []error
+	for _, q := range queues {
+		if err := q.push(evt{ctx, event}); err != nil {
+			errs = append(errs, fmt.Errorf("could not publish event (%s): %w", q.handlerType, err))
 		}
 	}
+	return errs, nil
 }
 
-// Close all the open channels
+// Close closes all the open channels, the queued events are still handled.
 func (g *Group) Close() {
-	for _, ch := range g.bus {
-		close(ch)
+	g.busMu.Lock()
+	defer g.busMu.Unlock()
+
+	if g.closed {
+		return
+	}
+	for _, q := range g.bus {
+		q.close()
 	}
 	g.bus = nil
+	g.closed = true
 }
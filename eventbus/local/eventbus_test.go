@@ -15,11 +15,17 @@
 package local_test
 
 import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
+	eh "github.com/looplab/eventhorizon"
 	"github.com/looplab/eventhorizon/eventbus"
 	"github.com/looplab/eventhorizon/eventbus/local"
+	"github.com/looplab/eventhorizon/mocks"
 )
 
 func Test_EventBus(t *testing.T) {
@@ -45,3 +51,325 @@ func Test_EventBus(t *testing.T) {
 	bus1.Wait()
 	bus2.Wait()
 }
+
+func Test_EventBus_Drop(t *testing.T) {
+	bus := local.NewEventBus(local.NewGroup(local.WithQueue(local.Queue{Size: 1})))
+	h := newBlockingHandler("handler")
+	bus.AddHandler(eh.MatchAny(), h)
+
+	// The first event is handled, the second queued and the third dropped.
+	publishEvents(t, bus, 1)
+	<-h.started
+	publishEvents(t, bus, 2)
+	select {
+	case err := <-bus.Errors():
+		if !errors.Is(err.Err, local.ErrQueueFull) {
+			t.Error("there should be a queue full error:", err)
+		}
+		if err.Err.Error() != "could not publish event (handler): queue full" {
+			t.Error("the error should be correct:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("there should be an error")
+	}
+
+	close(h.release)
+	bus.Close()
+	if h.count() != 2 {
+		t.Error("there should be 2 handled events:", h.count())
+	}
+}
+
+func Test_EventBus_Block(t *testing.T) {
+	bus := local.NewEventBus(local.NewGroup(local.WithQueue(local.Queue{
+		Size:    1,
+		Policy:  local.Block,
+		Timeout: 50 * time.Millisecond,
+	})))
+	h := newBlockingHandler("handler")
+	bus.AddHandler(eh.MatchAny(), h)
+
+	// The third event times out.
+	publishEvents(t, bus, 1)
+	<-h.started
+	publishEvents(t, bus, 2)
+	select {
+	case err := <-bus.Errors():
+		if !errors.Is(err.Err, local.ErrQueueFull) {
+			t.Error("there should be a queue full error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("there should be an error")
+	}
+
+	// The fourth event waits until there is room.
+	released := make(chan struct{})
+	go func() {
+		h.release <- struct{}{}
+		close(released)
+	}()
+	publishEvents(t, bus, 1)
+	<-released
+	select {
+	case err := <-bus.Errors():
+		t.Error("there should be no error:", err)
+	default:
+	}
+
+	close(h.release)
+	bus.Close()
+	if h.count() != 3 {
+		t.Error("there should be 3 handled events:", h.count())
+	}
+}
+
+func Test_EventBus_BlockWithoutTimeout(t *testing.T) {
+	bus := local.NewEventBus(local.NewGroup(local.WithQueue(local.Queue{
+		Size:   1,
+		Policy: local.Block,
+	})))
+	h := newBlockingHandler("handler")
+	bus.AddHandler(eh.MatchAny(), h)
+
+	// Fill the queue and block a publisher.
+	publishEvents(t, bus, 1)
+	<-h.started
+	publishEvents(t, bus, 1)
+	published := make(chan struct{})
+	go func() {
+		publishEvents(t, bus, 1)
+		close(published)
+	}()
+
+	// Handlers can be added while the publisher is blocked.
+	added := make(chan struct{})
+	other := newBlockingHandler("other")
+	go func() {
+		bus.AddObserver(eh.MatchAny(), other)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("the handler should be added")
+	}
+
+	close(h.release)
+	close(other.release)
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Error("the event should be published")
+	}
+	bus.Close()
+	if h.count() != 3 {
+		t.Error("there should be 3 handled events:", h.count())
+	}
+}
+
+func Test_EventBus_RemoveBlockedHandler(t *testing.T) {
+	bus := local.NewEventBus(local.NewGroup(local.WithQueue(local.Queue{
+		Size:   1,
+		Policy: local.Block,
+	})))
+	h := newBlockingHandler("handler")
+	bus.AddHandler(eh.MatchAny(), h)
+
+	// Fill the queue and block a publisher.
+	publishEvents(t, bus, 1)
+	<-h.started
+	publishEvents(t, bus, 1)
+	published := make(chan struct{})
+	go func() {
+		publishEvents(t, bus, 1)
+		close(published)
+	}()
+
+	// Removing the handler stops the blocked publisher.
+	removed := make(chan struct{})
+	go func() {
+		if err := bus.RemoveHandler("handler"); err != nil {
+			t.Error("there should be no error:", err)
+		}
+		close(removed)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("the publisher should be stopped")
+	}
+	close(h.release)
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Error("the handler should be removed")
+	}
+	bus.Close()
+}
+
+func Test_EventBus_Grow(t *testing.T) {
+	bus := local.NewEventBus(local.NewGroup(
+		local.WithHandlerQueue("handler", local.Queue{Size: 1, Policy: local.Grow}),
+	))
+	h := newBlockingHandler("handler")
+	bus.AddHandler(eh.MatchAny(), h)
+	other := newBlockingHandler("other")
+	bus.AddObserver(eh.MatchAny(), other)
+
+	// Only the other handler with the default queue drops events.
+	publishEvents(t, bus, local.DefaultQueueSize+5)
+	select {
+	case err := <-bus.Errors():
+		if err.Err.Error() != "could not publish event (other): queue full" {
+			t.Error("the error should be correct:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("there should be an error")
+	}
+
+	close(h.release)
+	close(other.release)
+	bus.Close()
+	if h.count() != local.DefaultQueueSize+5 {
+		t.Error("all events should be handled:", h.count())
+	}
+}
+
+func Test_EventBus_RemoveGrowHandler(t *testing.T) {
+	bus := local.NewEventBus(local.NewGroup(local.WithQueue(local.Queue{
+		Size:   1,
+		Policy: local.Grow,
+	})))
+	goroutines := runtime.NumGoroutine()
+	h := newBlockingHandler("handler")
+	bus.AddHandler(eh.MatchAny(), h)
+
+	// Grow the queue with pending events.
+	publishEvents(t, bus, 1)
+	<-h.started
+	publishEvents(t, bus, 50)
+
+	removed := make(chan struct{})
+	go func() {
+		if err := bus.RemoveHandler("handler"); err != nil {
+			t.Error("there should be no error:", err)
+		}
+		close(removed)
+	}()
+	// Release the handler once it is being removed.
+	time.Sleep(50 * time.Millisecond)
+	close(h.release)
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("the handler should be removed")
+	}
+
+	// The pending events are dropped, without leaking the forwarding.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatal("the queue should be stopped:", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	bus.Close()
+}
+
+func Test_EventBus_Close(t *testing.T) {
+	bus := local.NewEventBus(local.NewGroup(local.WithQueue(local.Queue{Policy: local.Grow})))
+	h := newBlockingHandler("handler")
+	bus.AddHandler(eh.MatchAny(), h)
+	publishEvents(t, bus, 5)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(h.release)
+	}()
+	bus.Close()
+	if h.count() != 5 {
+		t.Error("the queued events should be handled when closing:", h.count())
+	}
+
+	event := eh.NewEvent(mocks.EventType, nil, time.Now())
+	if err := bus.PublishEvent(context.Background(), event); err != local.ErrBusClosed {
+		t.Error("there should be a bus closed error:", err)
+	}
+}
+
+func Test_EventBus_RemoveSharedHandler(t *testing.T) {
+	group := local.NewGroup()
+	bus1 := local.NewEventBus(group)
+	bus2 := local.NewEventBus(group)
+	h1 := mocks.NewEventHandler("handler")
+	h2 := mocks.NewEventHandler("handler")
+	bus1.AddHandler(eh.MatchAny(), h1)
+	bus2.AddHandler(eh.MatchAny(), h2)
+
+	// The handler on the other bus still receives the events.
+	if err := bus1.RemoveHandler("handler"); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	publishEvents(t, bus1, 1)
+	if !h2.Wait(time.Second) {
+		t.Error("did not receive event in time")
+	}
+	if len(h1.Events) != 0 {
+		t.Error("the removed handler should not receive events:", h1.Events)
+	}
+
+	if err := bus2.RemoveHandler("handler"); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	publishEvents(t, bus1, 1)
+	if h2.Wait(10 * time.Millisecond) {
+		t.Error("the removed handler should not receive events")
+	}
+	bus1.Close()
+	bus2.Close()
+}
+
+func publishEvents(t *testing.T, bus eh.EventBus, n int) {
+	for i := 0; i < n; i++ {
+		event := eh.NewEvent(mocks.EventType, nil, time.Now())
+		if err := bus.PublishEvent(context.Background(), event); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+}
+
+// blockingHandler blocks handling events until released.
+type blockingHandler struct {
+	handlerType eh.EventHandlerType
+	release     chan struct{}
+	started     chan struct{}
+	handled     int
+	mu          sync.Mutex
+}
+
+func newBlockingHandler(t eh.EventHandlerType) *blockingHandler {
+	return &blockingHandler{
+		handlerType: t,
+		release:     make(chan struct{}),
+		started:     make(chan struct{}, 100),
+	}
+}
+
+func (h *blockingHandler) HandlerType() eh.EventHandlerType {
+	return h.handlerType
+}
+
+func (h *blockingHandler) HandleEvent(ctx context.Context, event eh.Event) error {
+	h.started <- struct{}{}
+	<-h.release
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handled++
+	return nil
+}
+
+func (h *blockingHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.handled
+}
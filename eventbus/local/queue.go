@@ -0,0 +1,213 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrQueueFull is when an event is dropped because the queue of a handler is
+// full, it is sent on the error channel of the publishing bus.
+var ErrQueueFull = errors.New("queue full")
+
+// ErrBusClosed is when an event is published after the group has been closed.
+var ErrBusClosed = errors.New("bus closed")
+
+// Policy is what to do with an event when the queue of a handler is full.
+type Policy int
+
+const (
+	// Drop drops the event, which is sent on the error channel of the
+	// publishing bus with ErrQueueFull.
+	Drop Policy = iota
+	// Block waits until there is room in the queue, or until the timeout of
+	// the queue, if set, after which the event is dropped. Only the publisher
+	// is blocked. Handlers that publish events to their own full queue will
+	// block until the timeout, or until the queue is closed without a timeout,
+	// so a timeout should be set for such handlers.
+	Block
+	// Grow queues the event in an unbounded queue.
+	Grow
+)
+
+// Queue is the configuration of the queue of a handler.
+type Queue struct {
+	// Size is the size of the queue, or the initial size for a growing queue.
+	// The default is DefaultQueueSize.
+	Size int
+	// Policy is what to do when the queue is full. The default is Drop.
+	Policy Policy
+	// Timeout is how long to wait for room in the queue with the Block policy.
+	// Zero waits until there is room.
+	Timeout time.Duration
+}
+
+// Option is an option for a Group.
+type Option func(*Group)
+
+// WithQueue sets the queue configuration for all handlers and observers.
+func WithQueue(q Queue) Option {
+	return func(g *Group) {
+		g.queue = q
+	}
+}
+
+// WithHandlerQueue sets the queue configuration for a handler or observer
+// type, overriding the configuration set with WithQueue.
+func WithHandlerQueue(t eh.EventHandlerType, q Queue) Option {
+	return func(g *Group) {
+		g.handlerQueues[t] = q
+	}
+}
+
+// queue is the queue of events for a handler.
+type queue struct {
+	config      Queue
+	handlerType eh.EventHandlerType
+	// refs is the number of busses handling the queue.
+	refs int
+	// Events are published on in and handled from out, which is the same
+	// channel unless the queue grows.
+	in  chan evt
+	out chan evt
+	// done is closed when the queue is closed, to stop blocked publishers.
+	done chan struct{}
+	// detached is closed when the queue is removed, as the pending events of
+	// a growing queue are then no longer handled.
+	detached chan struct{}
+	// Held for reading while pushing and for writing when closing.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newQueue(t eh.EventHandlerType, config Queue) *queue {
+	if config.Size <= 0 {
+		config.Size = DefaultQueueSize
+	}
+
+	q := &queue{
+		config:      config,
+		handlerType: t,
+		done:        make(chan struct{}),
+		detached:    make(chan struct{}),
+	}
+	if config.Policy == Grow {
+		q.in = make(chan evt)
+		q.out = make(chan evt, config.Size)
+		go q.forward()
+	} else {
+		q.in = make(chan evt, config.Size)
+		q.out = q.in
+	}
+	return q
+}
+
+// push pushes an event on the queue according to the policy. The event is
+// dropped without an error if the queue is closed.
+func (q *queue) push(e evt) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return nil
+	}
+
+	switch q.config.Policy {
+	case Grow:
+		select {
+		case q.in <- e:
+		case <-q.done:
+		}
+		return nil
+	case Block:
+		// A nil channel never fires when there is no timeout.
+		var timeout <-chan time.Time
+		if q.config.Timeout > 0 {
+			timer := time.NewTimer(q.config.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case q.in <- e:
+			return nil
+		case <-q.done:
+			return nil
+		case <-timeout:
+			return ErrQueueFull
+		}
+	default:
+		select {
+		case q.in <- e:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+}
+
+// close closes the queue, the queued events are still handled. Blocked
+// publishers are stopped before closing the channel.
+func (q *queue) close() {
+	close(q.done)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	close(q.in)
+}
+
+// detach closes the queue when it is removed, dropping the pending events as
+// they are no longer handled.
+func (q *queue) detach() {
+	close(q.detached)
+	q.close()
+}
+
+// forward forwards events from the in to the out channel, keeping the events
+// that do not fit in the out channel in an unbounded slice. The pending events
+// are dropped when the queue is detached.
+func (q *queue) forward() {
+	defer close(q.out)
+
+	var pending []evt
+	in := q.in
+	for in != nil || len(pending) > 0 {
+		// Only send when there are pending events, a nil channel blocks.
+		var out chan evt
+		var next evt
+		if len(pending) > 0 {
+			out = q.out
+			next = pending[0]
+		}
+
+		select {
+		case e, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			pending = append(pending, e)
+		case out <- next:
+			pending[0] = evt{}
+			pending = pending[1:]
+		case <-q.detached:
+			return
+		}
+	}
+}
@@ -0,0 +1,591 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jpillora/backoff"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrBusClosed is when an event is published after the bus has been closed.
+var ErrBusClosed = errors.New("bus closed")
+
+// errQueueFull is when an event could not be queued to be sent to a peer.
+var errQueueFull = errors.New("queue full")
+
+// errPeerNotFound is when an event is re-routed to a peer that is removed.
+var errPeerNotFound = errors.New("peer not found")
+
+// Default values for an EventBus.
+const (
+	DefaultQueueSize    = 100
+	DefaultMaxAttempts  = 5
+	DefaultSyncInterval = 5 * time.Second
+)
+
+// Option is an option for an EventBus.
+type Option func(*EventBus)
+
+// WithPeers sets the addresses of the peers to publish events to. More peers
+// are discovered when they announce themselves to the bus.
+func WithPeers(addrs ...string) Option {
+	return func(b *EventBus) {
+		b.staticPeers = append(b.staticPeers, addrs...)
+	}
+}
+
+// WithQueueSize sets the size of the queue of events to send to each peer,
+// and of events to handle by each local handler.
+func WithQueueSize(size int) Option {
+	return func(b *EventBus) {
+		b.queueSize = size
+	}
+}
+
+// WithMaxAttempts sets the number of times to send an event to a peer,
+// including the first attempt. The default is DefaultMaxAttempts.
+func WithMaxAttempts(attempts int) Option {
+	return func(b *EventBus) {
+		b.maxAttempts = attempts
+	}
+}
+
+// WithBackoff sets the delays between the attempts to send an event, growing
+// exponentially from min to max with a random jitter. The default is 100ms
+// to 5s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(b *EventBus) {
+		b.backoff.Min = min
+		b.backoff.Max = max
+	}
+}
+
+// WithSyncInterval sets how often the bus announces its handlers to the peers
+// and gets their handlers. The default is DefaultSyncInterval.
+func WithSyncInterval(d time.Duration) Option {
+	return func(b *EventBus) {
+		b.syncInterval = d
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to send events to the peers.
+func WithHTTPClient(client *http.Client) Option {
+	return func(b *EventBus) {
+		b.client = client
+	}
+}
+
+// EventBus is an event bus that publishes events to peers over HTTP, without
+// a broker. The handler types of all nodes are announced to the peers, and
+// the publishing node sends each event to one node of each handler type,
+// chosen by the aggregate ID, while all observers on all nodes receive it.
+//
+// Events are sent in order to each peer, with retries if the peer does not
+// acknowledge the event, and duplicates of recently received events are
+// skipped. Events that could not be sent, or not queued as the queue of the
+// peer is full, are reported on the error channel and re-routed to the next
+// node of each handler type that the peer should have handled them for.
+type EventBus struct {
+	addr     string
+	listener net.Listener
+	server   *http.Server
+	client   *http.Client
+
+	handlers   map[eh.EventHandlerType]*handler
+	handlersMu sync.RWMutex
+	peers      map[string]*peer
+	peersMu    sync.RWMutex
+	received   *idCache
+	errCh      chan eh.EventBusError
+
+	staticPeers  []string
+	queueSize    int
+	maxAttempts  int
+	backoff      backoff.Backoff
+	syncInterval time.Duration
+
+	// Held for reading while publishing and for writing when closing.
+	closeMu sync.RWMutex
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+var _ = eh.EventBus(&EventBus{})
+
+// NewEventBus creates an EventBus listening for events from peers on an
+// address, which is also the address announced to the peers. A zero port
+// picks a free port, which is returned by Addr.
+func NewEventBus(addr string, options ...Option) (*EventBus, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.New("could not listen: " + err.Error())
+	}
+
+	b := &EventBus{
+		addr:        l.Addr().String(),
+		listener:    l,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		handlers:    map[eh.EventHandlerType]*handler{},
+		peers:       map[string]*peer{},
+		received:    newIDCache(1000),
+		errCh:       make(chan eh.EventBusError, 100),
+		queueSize:   DefaultQueueSize,
+		maxAttempts: DefaultMaxAttempts,
+		backoff: backoff.Backoff{
+			Min:    100 * time.Millisecond,
+			Max:    5 * time.Second,
+			Jitter: true,
+		},
+		syncInterval: DefaultSyncInterval,
+		done:         make(chan struct{}),
+	}
+	for _, option := range options {
+		option(b)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", b.serveEvents)
+	mux.HandleFunc("/announce", b.serveAnnounce)
+	b.server = &http.Server{Handler: mux}
+	go b.server.Serve(l)
+
+	for _, addr := range b.staticPeers {
+		b.AddPeer(addr)
+	}
+
+	b.wg.Add(1)
+	go b.sync()
+
+	return b, nil
+}
+
+// Addr returns the address of the bus.
+func (b *EventBus) Addr() string {
+	return b.addr
+}
+
+// PublishEvent implements the PublishEvent method of the eventhorizon.EventBus interface.
+// The event is queued to be sent to the peers, and handled by the local
+// handlers before returning.
+func (b *EventBus) PublishEvent(ctx context.Context, event eh.Event) error {
+	b.closeMu.RLock()
+	defer b.closeMu.RUnlock()
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	e, err := newEvt(ctx, event)
+	if err != nil {
+		return err
+	}
+	msg := message{
+		ID:    uuid.New().String(),
+		Event: e,
+	}
+
+	// Choose one node for each handler type, by the aggregate ID.
+	msg.key = string(event.AggregateID())
+	if msg.key == "" {
+		msg.key = msg.ID
+	}
+	nodes := map[string][]eh.EventHandlerType{}
+	for t, addrs := range b.handlerNodes() {
+		addr := choose(msg.key, addrs)
+		nodes[addr] = append(nodes[addr], t)
+	}
+
+	full := map[string]message{}
+	b.peersMu.RLock()
+	for addr, p := range b.peers {
+		m := msg
+		m.Handlers = nodes[addr]
+		select {
+		case p.queue <- m:
+		default:
+			full[addr] = m
+		}
+	}
+	b.peersMu.RUnlock()
+
+	// Re-route without holding the lock, as it queues to other peers.
+	for addr, m := range full {
+		b.reroute(m, addr, errQueueFull)
+	}
+
+	b.handle(ctx, event, nodes[b.addr], true)
+	return nil
+}
+
+// AddHandler implements the AddHandler method of the eventhorizon.EventBus interface.
+// The handler is announced to the peers before returning.
+func (b *EventBus) AddHandler(m eh.EventMatcher, h eh.EventHandler) {
+	b.add(m, h, false)
+	b.announceAll()
+}
+
+// AddObserver implements the AddObserver method of the eventhorizon.EventBus interface.
+func (b *EventBus) AddObserver(m eh.EventMatcher, h eh.EventHandler) {
+	b.add(m, h, true)
+}
+
+// RemoveHandler implements the RemoveHandler method of the eventhorizon.EventBus interface.
+// The events in the queue of the handler are not handled.
+func (b *EventBus) RemoveHandler(t eh.EventHandlerType) error {
+	b.handlersMu.Lock()
+	h, ok := b.handlers[t]
+	if !ok {
+		b.handlersMu.Unlock()
+		return eh.ErrHandlerNotFound
+	}
+	delete(b.handlers, t)
+	b.handlersMu.Unlock()
+
+	close(h.stop)
+	<-h.stopped
+
+	if !h.observer {
+		b.announceAll()
+	}
+	return nil
+}
+
+// Errors implements the Errors method of the eventhorizon.EventBus interface.
+func (b *EventBus) Errors() <-chan eh.EventBusError {
+	return b.errCh
+}
+
+// Close stops the bus after sending the queued events to the peers and
+// handling the queued events.
+func (b *EventBus) Close() error {
+	b.closeMu.Lock()
+	if b.closed {
+		b.closeMu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.closeMu.Unlock()
+
+	close(b.done)
+	b.peersMu.Lock()
+	for _, p := range b.peers {
+		close(p.queue)
+	}
+	b.peers = map[string]*peer{}
+	b.peersMu.Unlock()
+	b.wg.Wait()
+
+	err := b.server.Shutdown(context.Background())
+
+	b.handlersMu.Lock()
+	handlers := b.handlers
+	b.handlers = map[eh.EventHandlerType]*handler{}
+	b.handlersMu.Unlock()
+	for _, h := range handlers {
+		close(h.queue)
+		<-h.stopped
+	}
+
+	return err
+}
+
+// handler is a local handler or observer.
+type handler struct {
+	h        eh.EventHandler
+	m        eh.EventMatcher
+	observer bool
+	queue    chan localEvent
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+type localEvent struct {
+	ctx   context.Context
+	event eh.Event
+}
+
+// add checks the matcher and handler and starts handling events.
+func (b *EventBus) add(m eh.EventMatcher, h eh.EventHandler, observer bool) {
+	b.handlersMu.Lock()
+	defer b.handlersMu.Unlock()
+
+	if m == nil {
+		panic("matcher can't be nil")
+	}
+	if h == nil {
+		panic("handler can't be nil")
+	}
+	if _, ok := b.handlers[h.HandlerType()]; ok {
+		panic(fmt.Sprintf("multiple registrations for %s", h.HandlerType()))
+	}
+
+	r := &handler{
+		h:        h,
+		m:        m,
+		observer: observer,
+		queue:    make(chan localEvent, b.queueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	b.handlers[h.HandlerType()] = r
+	go b.run(r)
+}
+
+// run handles the events in the queue of a handler, until it is closed or
+// the handler is removed.
+func (b *EventBus) run(r *handler) {
+	defer close(r.stopped)
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case e, ok := <-r.queue:
+			if !ok {
+				return
+			}
+			if !r.m(e.event) {
+				continue
+			}
+			if err := r.h.HandleEvent(e.ctx, e.event); err != nil {
+				b.sendErr(eh.EventBusError{Err: fmt.Errorf("could not handle event (%s): %s", r.h.HandlerType(), err.Error()), Ctx: e.ctx, Event: e.event})
+			}
+		}
+	}
+}
+
+// handle queues an event for the local observers, if set, and the handlers of
+// the types, waiting if a queue is full.
+func (b *EventBus) handle(ctx context.Context, event eh.Event, types []eh.EventHandlerType, observers bool) {
+	b.handlersMu.RLock()
+	var handlers []*handler
+	for _, h := range b.handlers {
+		if h.observer && observers {
+			handlers = append(handlers, h)
+		}
+	}
+	for _, t := range types {
+		if h, ok := b.handlers[t]; ok && !h.observer {
+			handlers = append(handlers, h)
+		} else {
+			b.sendErr(eh.EventBusError{
+				Err:   fmt.Errorf("could not handle event (%s): %s", t, eh.ErrHandlerNotFound),
+				Ctx:   ctx,
+				Event: event,
+			})
+		}
+	}
+	b.handlersMu.RUnlock()
+
+	// Handlers can publish events, so the lock is not held while waiting.
+	for _, h := range handlers {
+		select {
+		case h.queue <- localEvent{ctx, event}:
+		case <-h.stop:
+		}
+	}
+}
+
+// handlerNodes returns the addresses of the nodes with each handler type,
+// including this node.
+func (b *EventBus) handlerNodes() map[eh.EventHandlerType][]string {
+	nodes := map[eh.EventHandlerType][]string{}
+
+	b.handlersMu.RLock()
+	for t, h := range b.handlers {
+		if !h.observer {
+			nodes[t] = append(nodes[t], b.addr)
+		}
+	}
+	b.handlersMu.RUnlock()
+
+	b.peersMu.RLock()
+	for addr, p := range b.peers {
+		for t := range p.handlers {
+			nodes[t] = append(nodes[t], addr)
+		}
+	}
+	b.peersMu.RUnlock()
+
+	return nodes
+}
+
+// localHandlers returns the handler types of this node.
+func (b *EventBus) localHandlers() []eh.EventHandlerType {
+	b.handlersMu.RLock()
+	defer b.handlersMu.RUnlock()
+
+	var types []eh.EventHandlerType
+	for t, h := range b.handlers {
+		if !h.observer {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// sendErr sends an error on the error channel, or drops it if it is full.
+func (b *EventBus) sendErr(err eh.EventBusError) {
+	select {
+	case b.errCh <- err:
+	default:
+	}
+}
+
+// reroute sends a message that could not be sent to a node to the next node of
+// each of its handler types, which have not already been tried. Only the
+// handlers are sent the event, as the observers of all nodes have been sent
+// it when it was published.
+func (b *EventBus) reroute(msg message, from string, err error) {
+	ctx := eh.UnmarshalContext(msg.Event.Context)
+	event, eErr := msg.Event.event()
+	if eErr != nil {
+		b.sendErr(eh.EventBusError{Err: eErr, Ctx: ctx})
+		return
+	}
+	b.sendErr(eh.EventBusError{
+		Err:   fmt.Errorf("could not send event (%s): %s", from, err.Error()),
+		Ctx:   ctx,
+		Event: event,
+	})
+
+	tried := append(append([]string{}, msg.tried...), from)
+	nodes := b.handlerNodes()
+	next := map[string][]eh.EventHandlerType{}
+	for _, t := range msg.Handlers {
+		addr := choose(msg.key, without(nodes[t], tried))
+		if addr == "" {
+			b.sendErr(eh.EventBusError{
+				Err:   fmt.Errorf("could not re-route event (%s): no other node", t),
+				Ctx:   ctx,
+				Event: event,
+			})
+			continue
+		}
+		next[addr] = append(next[addr], t)
+	}
+
+	for addr, types := range next {
+		if addr == b.addr {
+			b.handle(ctx, event, types, false)
+			continue
+		}
+
+		m := message{
+			ID:       uuid.New().String(),
+			Event:    msg.Event,
+			Handlers: types,
+			Rerouted: true,
+			key:      msg.key,
+			tried:    tried,
+		}
+		if err := b.enqueue(addr, m); err != nil {
+			b.reroute(m, addr, err)
+		}
+	}
+}
+
+// enqueue queues a message to be sent to a peer, without waiting if the queue
+// is full.
+func (b *EventBus) enqueue(addr string, msg message) error {
+	b.peersMu.RLock()
+	defer b.peersMu.RUnlock()
+
+	p, ok := b.peers[addr]
+	if !ok {
+		return errPeerNotFound
+	}
+	select {
+	case p.queue <- msg:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// without returns the addresses that are not in an exclude list.
+func without(addrs, exclude []string) []string {
+	var res []string
+	for _, addr := range addrs {
+		excluded := false
+		for _, e := range exclude {
+			if addr == e {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// choose chooses a node for a key using rendezvous hashing, which keeps the
+// choice for most keys when nodes are added or removed. Excluding the chosen
+// node chooses the next node for the key.
+func choose(key string, addrs []string) string {
+	var chosen string
+	var max uint64
+	for _, addr := range addrs {
+		h := fnv.New64a()
+		h.Write([]byte(key + "/" + addr))
+		if score := h.Sum64(); chosen == "" || score > max {
+			chosen, max = addr, score
+		}
+	}
+	return chosen
+}
+
+// idCache is a fixed size cache of recent IDs.
+type idCache struct {
+	ids   map[string]struct{}
+	order []string
+	next  int
+	mu    sync.Mutex
+}
+
+func newIDCache(size int) *idCache {
+	return &idCache{
+		ids:   map[string]struct{}{},
+		order: make([]string, size),
+	}
+}
+
+// add adds an ID, returning false if it is already in the cache.
+func (c *idCache) add(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	delete(c.ids, c.order[c.next])
+	c.order[c.next] = id
+	c.next = (c.next + 1) % len(c.order)
+	c.ids[id] = struct{}{}
+	return true
+}
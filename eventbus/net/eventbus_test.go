@@ -0,0 +1,165 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventbus"
+	ehnet "github.com/looplab/eventhorizon/eventbus/net"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func Test_EventBus(t *testing.T) {
+	bus1, err := ehnet.NewEventBus("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer bus1.Close()
+
+	// The second bus is discovered by the first when it announces itself.
+	bus2, err := ehnet.NewEventBus("127.0.0.1:0", ehnet.WithPeers(bus1.Addr()))
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer bus2.Close()
+
+	if peers := bus1.Peers(); len(peers) != 1 || peers[0] != bus2.Addr() {
+		t.Error("the peer should be discovered:", peers)
+	}
+
+	eventbus.AcceptanceTest(t, bus1, bus2, time.Second)
+}
+
+func Test_EventBus_SendFailed(t *testing.T) {
+	// Get a free address without anything listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	bus, err := ehnet.NewEventBus("127.0.0.1:0",
+		ehnet.WithMaxAttempts(2),
+		ehnet.WithBackoff(time.Millisecond, time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer bus.Close()
+
+	// The announcement to the peer fails.
+	bus.AddPeer(addr)
+	select {
+	case err := <-bus.Errors():
+		if err.Err == nil {
+			t.Error("there should be an announce error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("there should be an error")
+	}
+
+	event := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event"},
+		time.Now(), mocks.AggregateType, uuid.New().String(), 1)
+	if err := bus.PublishEvent(context.Background(), event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	select {
+	case err := <-bus.Errors():
+		if err.Err == nil || err.Ctx == nil {
+			t.Error("there should be a send error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("there should be an error")
+	}
+
+	if err := bus.Close(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := bus.PublishEvent(context.Background(), event); err != ehnet.ErrBusClosed {
+		t.Error("there should be a bus closed error:", err)
+	}
+}
+
+func Test_EventBus_Reroute(t *testing.T) {
+	bus1, err := ehnet.NewEventBus("127.0.0.1:0",
+		ehnet.WithMaxAttempts(1),
+		ehnet.WithSyncInterval(time.Hour),
+	)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer bus1.Close()
+	bus2, err := ehnet.NewEventBus("127.0.0.1:0", ehnet.WithPeers(bus1.Addr()))
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer bus2.Close()
+	bus3, err := ehnet.NewEventBus("127.0.0.1:0", ehnet.WithPeers(bus1.Addr()))
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer bus3.Close()
+
+	h2 := mocks.NewEventHandler("handler")
+	bus2.AddHandler(eh.MatchAny(), h2)
+	h3 := mocks.NewEventHandler("handler")
+	bus3.AddHandler(eh.MatchAny(), h3)
+	o3 := mocks.NewEventHandler("observer")
+	bus3.AddObserver(eh.MatchAny(), o3)
+
+	// The second bus goes away without the first bus knowing, the events
+	// chosen for it are re-routed to the third bus.
+	if err := bus2.Close(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	const n = 8
+	for i := 0; i < n; i++ {
+		event := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event"},
+			time.Now(), mocks.AggregateType, uuid.New().String(), 1)
+		if err := bus1.PublishEvent(context.Background(), event); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if !h3.Wait(time.Second) {
+			t.Fatal("the events should be handled:", i)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if !o3.Wait(time.Second) {
+			t.Fatal("the events should be observed:", i)
+		}
+	}
+
+	// The observers are not sent the re-routed events.
+	if o3.Wait(50 * time.Millisecond) {
+		t.Error("the re-routed events should not be observed")
+	}
+	select {
+	case err := <-bus1.Errors():
+		if err.Err == nil || err.Event == nil {
+			t.Error("there should be a send error:", err)
+		}
+	default:
+		t.Error("there should be an error")
+	}
+}
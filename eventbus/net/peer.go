@@ -0,0 +1,415 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// peer is an other node that events are sent to.
+type peer struct {
+	addr string
+	// handlers are the handler types of the peer, from its last announcement.
+	handlers map[eh.EventHandlerType]struct{}
+	queue    chan message
+}
+
+// message is an event sent to a peer, with the handler types that should
+// handle it on the peer. A re-routed message is only handled by the handlers,
+// as the observers have been sent the event in an other message.
+type message struct {
+	ID       string                `bson:"id"`
+	Event    evt                   `bson:"event"`
+	Handlers []eh.EventHandlerType `bson:"handlers,omitempty"`
+	Rerouted bool                  `bson:"rerouted,omitempty"`
+
+	// The key used to choose the nodes, and the nodes that have been tried,
+	// used when re-routing. Not sent to the peer.
+	key   string
+	tried []string
+}
+
+// announcement is the address and handler types of a node.
+type announcement struct {
+	Addr     string                `json:"addr"`
+	Handlers []eh.EventHandlerType `json:"handlers"`
+}
+
+// AddPeer adds a peer to send events to and announces the handlers to it.
+func (b *EventBus) AddPeer(addr string) {
+	if b.addPeer(addr) {
+		b.announce(addr)
+	}
+}
+
+// RemovePeer removes a peer, the queued events are still sent to it. The peer
+// is added again if it announces itself to the bus.
+func (b *EventBus) RemovePeer(addr string) {
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	if p, ok := b.peers[addr]; ok {
+		close(p.queue)
+		delete(b.peers, addr)
+	}
+}
+
+// Peers returns the addresses of the peers.
+func (b *EventBus) Peers() []string {
+	b.peersMu.RLock()
+	defer b.peersMu.RUnlock()
+
+	addrs := make([]string, 0, len(b.peers))
+	for addr := range b.peers {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// addPeer adds a peer and starts sending events to it, returning false if the
+// peer already exists or the bus is closed.
+func (b *EventBus) addPeer(addr string) bool {
+	b.closeMu.RLock()
+	defer b.closeMu.RUnlock()
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	if _, ok := b.peers[addr]; ok || b.closed || addr == b.addr {
+		return false
+	}
+	p := &peer{
+		addr:     addr,
+		handlers: map[eh.EventHandlerType]struct{}{},
+		queue:    make(chan message, b.queueSize),
+	}
+	b.peers[addr] = p
+	b.wg.Add(1)
+	go b.send(p)
+	return true
+}
+
+// send sends the queued events to a peer, in order, until the queue is closed.
+func (b *EventBus) send(p *peer) {
+	defer b.wg.Done()
+
+	for msg := range p.queue {
+		data, err := bson.Marshal(msg)
+		if err != nil {
+			b.sendErr(eh.EventBusError{Err: fmt.Errorf("could not marshal event (%s): %s", p.addr, err.Error())})
+			continue
+		}
+
+		// Use a backoff per message, as it is not safe for concurrent use.
+		delay := b.backoff
+		for attempt := 1; ; attempt++ {
+			if err = b.post(p.addr, "/events", "application/bson", data, nil); err == nil {
+				break
+			}
+			if attempt >= b.maxAttempts {
+				break
+			}
+
+			// Don't retry when closing.
+			select {
+			case <-time.After(delay.Duration()):
+				continue
+			case <-b.done:
+			}
+			break
+		}
+		if err != nil {
+			b.reroute(msg, p.addr, err)
+		}
+	}
+}
+
+// announceAll announces the handlers to all peers.
+func (b *EventBus) announceAll() {
+	for _, addr := range b.Peers() {
+		b.announce(addr)
+	}
+}
+
+// announce announces the handlers to a peer, and updates the handlers of the
+// peer from the response. The peer has no handlers if it does not respond.
+func (b *EventBus) announce(addr string) {
+	data, err := json.Marshal(announcement{
+		Addr:     b.addr,
+		Handlers: b.localHandlers(),
+	})
+	if err != nil {
+		b.sendErr(eh.EventBusError{Err: errors.New("could not marshal announcement: " + err.Error())})
+		return
+	}
+
+	var a announcement
+	if err := b.post(addr, "/announce", "application/json", data, &a); err != nil {
+		b.sendErr(eh.EventBusError{Err: fmt.Errorf("could not announce (%s): %s", addr, err.Error())})
+	}
+	b.setPeerHandlers(addr, a.Handlers)
+}
+
+// setPeerHandlers sets the handler types of a peer.
+func (b *EventBus) setPeerHandlers(addr string, types []eh.EventHandlerType) {
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	if p, ok := b.peers[addr]; ok {
+		p.handlers = map[eh.EventHandlerType]struct{}{}
+		for _, t := range types {
+			p.handlers[t] = struct{}{}
+		}
+	}
+}
+
+// sync announces the handlers to all peers periodically.
+func (b *EventBus) sync() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.announceAll()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// post posts data to a peer, decoding a JSON response if v is not nil.
+func (b *EventBus) post(addr, path, contentType string, data []byte, v interface{}) error {
+	resp, err := b.client.Post("http://"+addr+path, contentType, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+// serveEvents receives an event from a peer and queues it for the local
+// handlers, before acknowledging it.
+func (b *EventBus) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read event", http.StatusBadRequest)
+		return
+	}
+	var msg message
+	if err := bson.Unmarshal(data, &msg); err != nil {
+		http.Error(w, "could not unmarshal event", http.StatusBadRequest)
+		return
+	}
+
+	// Skip retries of events that have already been received.
+	if !b.received.add(msg.ID) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	event, err := msg.Event.event()
+	if err != nil {
+		b.sendErr(eh.EventBusError{Err: err})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.handle(eh.UnmarshalContext(msg.Event.Context), event, msg.Handlers, !msg.Rerouted)
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveAnnounce receives the handlers of a peer, adding the peer if it is
+// new, and responds with the local handlers.
+func (b *EventBus) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var a announcement
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil || a.Addr == "" {
+		http.Error(w, "could not decode announcement", http.StatusBadRequest)
+		return
+	}
+	b.addPeer(a.Addr)
+	b.setPeerHandlers(a.Addr, a.Handlers)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(announcement{
+		Addr:     b.addr,
+		Handlers: b.localHandlers(),
+	}); err != nil {
+		b.sendErr(eh.EventBusError{Err: errors.New("could not encode announcement: " + err.Error())})
+	}
+}
+
+// evt is the internal event used on the wire only.
+type evt struct {
+	EventType     eh.EventType           `bson:"event_type"`
+	RawData       bson.Raw               `bson:"data,omitempty"`
+	data          eh.EventData           `bson:"-"`
+	Timestamp     time.Time              `bson:"timestamp"`
+	AggregateType eh.AggregateType       `bson:"aggregate_type"`
+	AggregateID   string                 `bson:"_id"`
+	Version       int                    `bson:"version"`
+	Context       map[string]interface{} `bson:"context"`
+	SchemaVersion int                    `bson:"schema_version"`
+	Metadata      map[string]interface{} `bson:"metadata,omitempty"`
+}
+
+// newEvt creates a wire event from an event and the context it is published
+// with.
+func newEvt(ctx context.Context, event eh.Event) (evt, error) {
+	e := evt{
+		AggregateID:   event.AggregateID(),
+		AggregateType: event.AggregateType(),
+		EventType:     event.EventType(),
+		Version:       event.Version(),
+		Timestamp:     event.Timestamp(),
+		Context:       eh.MarshalContext(ctx),
+		SchemaVersion: eh.EventSchemaVersion(event.EventType()),
+		Metadata:      event.Metadata(),
+	}
+
+	// Marshal event data if there is any.
+	if event.Data() != nil {
+		rawData, err := bson.Marshal(event.Data())
+		if err != nil {
+			return evt{}, errors.New("could not marshal event data: " + err.Error())
+		}
+		e.RawData = bson.Raw{Kind: 3, Data: rawData}
+	}
+
+	return e, nil
+}
+
+// event returns an event with concrete event data from a wire event.
+func (e evt) event() (eh.Event, error) {
+	// Upcast the raw BSON data if the event was published with an older
+	// schema version.
+	if eh.EventSchemaVersion(e.EventType) > e.SchemaVersion {
+		var err error
+		if e, err = upcast(e); err != nil {
+			return nil, errors.New("could not upcast event: " + err.Error())
+		}
+	}
+
+	// Create an event of the correct type.
+	if data, err := eh.CreateEventData(e.EventType); err == nil {
+		// Manually decode the raw BSON event.
+		if err := e.RawData.Unmarshal(data); err != nil {
+			return nil, errors.New("could not unmarshal event data: " + err.Error())
+		}
+
+		// Set concrete event and zero out the decoded event.
+		e.data = data
+		e.RawData = bson.Raw{}
+	}
+
+	return event{evt: e}, nil
+}
+
+// upcast upcasts the raw BSON data of an event to the current schema version
+// of its event type.
+func upcast(e evt) (evt, error) {
+	var data []byte
+	if e.RawData.Kind != 0 {
+		data = e.RawData.Data
+	}
+
+	var err error
+	e.EventType, e.SchemaVersion, data, err = eh.UpcastRawEventData(
+		e.EventType, e.SchemaVersion, data, bson.Unmarshal, bson.Marshal)
+	if err != nil {
+		return e, err
+	}
+	e.RawData = bson.Raw{}
+	if data != nil {
+		e.RawData = bson.Raw{Kind: 3, Data: data}
+	}
+
+	return e, nil
+}
+
+// event is the private implementation of the eventhorizon.Event interface
+// for a network event bus.
+type event struct {
+	evt
+}
+
+// EventType implements the EventType method of the eventhorizon.Event interface.
+func (e event) EventType() eh.EventType {
+	return e.evt.EventType
+}
+
+// Data implements the Data method of the eventhorizon.Event interface.
+func (e event) Data() eh.EventData {
+	return e.evt.data
+}
+
+// Timestamp implements the Timestamp method of the eventhorizon.Event interface.
+func (e event) Timestamp() time.Time {
+	return e.evt.Timestamp
+}
+
+// AggregateType implements the AggregateType method of the eventhorizon.Event interface.
+func (e event) AggregateType() eh.AggregateType {
+	return e.evt.AggregateType
+}
+
+// AggrgateID implements the AggrgateID method of the eventhorizon.Event interface.
+func (e event) AggregateID() eh.ID {
+	return e.evt.AggregateID
+}
+
+// Metadata implements the Metadata method of the eventhorizon.Event interface.
+func (e event) Metadata() map[string]interface{} {
+	return e.evt.Metadata
+}
+
+// Version implements the Version method of the eventhorizon.Event interface.
+func (e event) Version() int {
+	return e.evt.Version
+}
+
+// String implements the String method of the eventhorizon.Event interface.
+func (e event) String() string {
+	return fmt.Sprintf("%s@%d", e.evt.EventType, e.evt.Version)
+}
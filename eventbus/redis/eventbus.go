@@ -0,0 +1,590 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// DefaultClaimIdle is the default time a message can be pending before it is
+// claimed by an other consumer of the same handler.
+const DefaultClaimIdle = 30 * time.Second
+
+// DefaultMaxDeliveries is the default number of times an event is delivered to
+// a failing handler before it is given up.
+const DefaultMaxDeliveries = 10
+
+// ErrMaxDeliveries is when an event is acknowledged without being handled as
+// the handler failed for the max number of deliveries. It is sent on the error
+// channel with the event, to be saved elsewhere if needed.
+var ErrMaxDeliveries = errors.New("max deliveries reached")
+
+// The time to block while reading new messages, which is also the longest
+// time it takes to remove a handler.
+const readTimeout = 100 * time.Millisecond
+
+// The number of messages to read or claim at a time.
+const readCount = 10
+
+// Option is an option for an EventBus.
+type Option func(*EventBus)
+
+// WithMaxLen trims the stream to approximately a max number of events when
+// publishing.
+func WithMaxLen(maxLen int64) Option {
+	return func(b *EventBus) {
+		b.maxLen = maxLen
+	}
+}
+
+// WithMaxAge trims the events older than approximately a max age from the
+// stream when publishing.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(b *EventBus) {
+		b.maxAge = maxAge
+	}
+}
+
+// WithClaimIdle sets the time a message can be pending before it is claimed
+// by an other consumer of the same handler, which happens when a handler
+// fails or a consumer crashes. The default is DefaultClaimIdle.
+func WithClaimIdle(d time.Duration) Option {
+	return func(b *EventBus) {
+		b.claimIdle = d
+	}
+}
+
+// WithMaxDeliveries sets the number of times an event is delivered to a failing
+// handler, after which it is acknowledged and sent on the error channel with
+// ErrMaxDeliveries. The default is DefaultMaxDeliveries.
+func WithMaxDeliveries(n int64) Option {
+	return func(b *EventBus) {
+		b.maxDeliveries = n
+	}
+}
+
+// EventBus is an event bus using Redis Streams. All events are published to
+// one stream per app ID. Each handler type is a consumer group where the
+// handlers on all busses compete for the events, while each observer is a
+// consumer group of its own. The events are acknowledged when handled, or
+// else redelivered after the claim idle time until the max deliveries. Events
+// that can not be decoded are acknowledged at once.
+type EventBus struct {
+	appID         string
+	stream        string
+	consumer      string
+	client        *redis.Client
+	registered    map[eh.EventHandlerType]*registration
+	registeredMu  sync.RWMutex
+	errCh         chan eh.EventBusError
+	maxLen        int64
+	maxAge        time.Duration
+	claimIdle     time.Duration
+	maxDeliveries int64
+}
+
+var _ = eh.EventBus(&EventBus{})
+
+// NewEventBus creates an EventBus connected to a Redis server.
+func NewEventBus(addr, appID string, options ...Option) (*EventBus, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, errors.New("could not connect to Redis: " + err.Error())
+	}
+
+	return NewEventBusWithClient(client, appID, options...)
+}
+
+// NewEventBusWithClient creates an EventBus with a Redis client.
+func NewEventBusWithClient(client *redis.Client, appID string, options ...Option) (*EventBus, error) {
+	if client == nil {
+		return nil, errors.New("no Redis client")
+	}
+
+	b := &EventBus{
+		appID:         appID,
+		stream:        appID + "_events",
+		consumer:      uuid.New().String(),
+		client:        client,
+		registered:    map[eh.EventHandlerType]*registration{},
+		errCh:         make(chan eh.EventBusError, 100),
+		claimIdle:     DefaultClaimIdle,
+		maxDeliveries: DefaultMaxDeliveries,
+	}
+	for _, option := range options {
+		option(b)
+	}
+
+	return b, nil
+}
+
+// PublishEvent implements the PublishEvent method of the eventhorizon.EventBus interface.
+func (b *EventBus) PublishEvent(ctx context.Context, event eh.Event) error {
+	e := evt{
+		AggregateID:   event.AggregateID(),
+		AggregateType: event.AggregateType(),
+		EventType:     event.EventType(),
+		Version:       event.Version(),
+		Timestamp:     event.Timestamp(),
+		Context:       eh.MarshalContext(ctx),
+		SchemaVersion: eh.EventSchemaVersion(event.EventType()),
+		Metadata:      event.Metadata(),
+	}
+
+	// Marshal event data if there is any.
+	if event.Data() != nil {
+		rawData, err := bson.Marshal(event.Data())
+		if err != nil {
+			return errors.New("could not marshal event data: " + err.Error())
+		}
+		e.RawData = bson.Raw{Kind: 3, Data: rawData}
+	}
+
+	// Marshal the event (using BSON for now).
+	data, err := bson.Marshal(e)
+	if err != nil {
+		return errors.New("could not marshal event: " + err.Error())
+	}
+
+	args := &redis.XAddArgs{
+		Stream: b.stream,
+		Values: map[string]interface{}{"event": data},
+	}
+	if b.maxLen > 0 {
+		args.MaxLen = b.maxLen
+		args.Approx = true
+	} else if b.maxAge > 0 {
+		args.MinID = b.minID()
+		args.Approx = true
+	}
+	if err := b.client.XAdd(ctx, args).Err(); err != nil {
+		return errors.New("could not publish event: " + err.Error())
+	}
+
+	// Only one trimming strategy can be used when adding.
+	if b.maxLen > 0 && b.maxAge > 0 {
+		if err := b.client.XTrimMinIDApprox(ctx, b.stream, b.minID(), 0).Err(); err != nil {
+			return errors.New("could not trim events: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// AddHandler implements the AddHandler method of the eventhorizon.EventBus interface.
+func (b *EventBus) AddHandler(m eh.EventMatcher, h eh.EventHandler) {
+	r := b.group(m, h, false)
+	go b.handle(m, h, r)
+}
+
+// AddObserver implements the AddObserver method of the eventhorizon.EventBus interface.
+func (b *EventBus) AddObserver(m eh.EventMatcher, h eh.EventHandler) {
+	r := b.group(m, h, true)
+	go b.handle(m, h, r)
+}
+
+// RemoveHandler implements the RemoveHandler method of the eventhorizon.EventBus interface.
+// The consumer group of an observer is deleted. The consumer of a handler is
+// deleted from the group if it has no pending events, or else it is kept for
+// the events to be claimed by other consumers.
+func (b *EventBus) RemoveHandler(t eh.EventHandlerType) error {
+	b.registeredMu.Lock()
+	r, ok := b.registered[t]
+	if !ok {
+		b.registeredMu.Unlock()
+		return eh.ErrHandlerNotFound
+	}
+	delete(b.registered, t)
+	b.registeredMu.Unlock()
+
+	r.cancel()
+	<-r.stopped
+
+	ctx := context.Background()
+	if r.observer {
+		if err := b.client.XGroupDestroy(ctx, b.stream, r.group).Err(); err != nil {
+			return errors.New("could not delete consumer group: " + err.Error())
+		}
+		return nil
+	}
+
+	pending, err := b.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   b.stream,
+		Group:    r.group,
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+		Consumer: b.consumer,
+	}).Result()
+	if err != nil {
+		return errors.New("could not check pending events: " + err.Error())
+	}
+	if len(pending) == 0 {
+		if err := b.client.XGroupDelConsumer(ctx, b.stream, r.group, b.consumer).Err(); err != nil {
+			return errors.New("could not delete consumer: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Errors implements the Errors method of the eventhorizon.EventBus interface.
+func (b *EventBus) Errors() <-chan eh.EventBusError {
+	return b.errCh
+}
+
+// Close removes all handlers and observers and closes the Redis client.
+func (b *EventBus) Close() error {
+	b.registeredMu.RLock()
+	types := make([]eh.EventHandlerType, 0, len(b.registered))
+	for t := range b.registered {
+		types = append(types, t)
+	}
+	b.registeredMu.RUnlock()
+
+	var err error
+	for _, t := range types {
+		if rErr := b.RemoveHandler(t); rErr != nil && err == nil {
+			err = rErr
+		}
+	}
+	if cErr := b.client.Close(); cErr != nil && err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// registration is a handler or observer added to the bus.
+type registration struct {
+	group    string
+	observer bool
+	ctx      context.Context
+	cancel   func()
+	stopped  chan struct{}
+}
+
+// Checks the matcher and handler and creates the consumer group.
+func (b *EventBus) group(m eh.EventMatcher, h eh.EventHandler, observer bool) *registration {
+	b.registeredMu.Lock()
+	defer b.registeredMu.Unlock()
+
+	if m == nil {
+		panic("matcher can't be nil")
+	}
+	if h == nil {
+		panic("handler can't be nil")
+	}
+	if _, ok := b.registered[h.HandlerType()]; ok {
+		panic(fmt.Sprintf("multiple registrations for %s", h.HandlerType()))
+	}
+
+	id := string(h.HandlerType())
+	if observer { // Generate unique ID for each observer.
+		id = fmt.Sprintf("%s-%s", id, uuid.New().String())
+	}
+
+	// Create the group if it does not exist, starting with new events.
+	group := b.appID + "_" + id
+	if err := b.client.XGroupCreateMkStream(context.Background(), b.stream, group, "$").Err(); err != nil &&
+		!strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		panic("could not create consumer group: " + err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &registration{
+		group:    group,
+		observer: observer,
+		ctx:      ctx,
+		cancel:   cancel,
+		stopped:  make(chan struct{}),
+	}
+	b.registered[h.HandlerType()] = r
+	return r
+}
+
+// Handles all events coming in on the stream, and claims the pending events
+// of other consumers, until the handler is removed.
+func (b *EventBus) handle(m eh.EventMatcher, h eh.EventHandler, r *registration) {
+	defer close(r.stopped)
+
+	lastClaim := time.Now()
+	for r.ctx.Err() == nil {
+		if time.Since(lastClaim) >= b.claimIdle {
+			b.claim(m, h, r)
+			lastClaim = time.Now()
+		}
+
+		streams, err := b.client.XReadGroup(r.ctx, &redis.XReadGroupArgs{
+			Group:    r.group,
+			Consumer: b.consumer,
+			Streams:  []string{b.stream, ">"},
+			Count:    readCount,
+			Block:    readTimeout,
+		}).Result()
+		if r.ctx.Err() != nil {
+			return
+		} else if err == redis.Nil {
+			continue
+		} else if err != nil {
+			b.sendErr(eh.EventBusError{Err: errors.New("could not receive: " + err.Error()), Ctx: r.ctx})
+			select {
+			case <-time.After(time.Second):
+			case <-r.ctx.Done():
+			}
+			continue
+		}
+
+		for _, s := range streams {
+			for _, msg := range s.Messages {
+				b.handleMessage(m, h, r, msg)
+			}
+		}
+	}
+}
+
+// claim claims and handles the events that have been pending for longer than
+// the claim idle time.
+func (b *EventBus) claim(m eh.EventMatcher, h eh.EventHandler, r *registration) {
+	start := "0-0"
+	for r.ctx.Err() == nil {
+		msgs, next, err := b.client.XAutoClaim(r.ctx, &redis.XAutoClaimArgs{
+			Stream:   b.stream,
+			Group:    r.group,
+			Consumer: b.consumer,
+			MinIdle:  b.claimIdle,
+			Start:    start,
+			Count:    readCount,
+		}).Result()
+		if err != nil {
+			if r.ctx.Err() == nil {
+				b.sendErr(eh.EventBusError{Err: errors.New("could not claim: " + err.Error()), Ctx: r.ctx})
+			}
+			return
+		}
+
+		for _, msg := range msgs {
+			b.handleMessage(m, h, r, msg)
+		}
+		if next == "0-0" {
+			return
+		}
+		start = next
+	}
+}
+
+// handleMessage handles an event message, which is acknowledged if it is
+// handled, does not match, can not be decoded or has failed for the max number
+// of deliveries.
+func (b *EventBus) handleMessage(m eh.EventMatcher, h eh.EventHandler, r *registration, msg redis.XMessage) {
+	ctx := context.Background()
+
+	raw, ok := msg.Values["event"].(string)
+	if !ok {
+		b.sendErr(eh.EventBusError{Err: errors.New("missing event in message " + msg.ID), Ctx: ctx})
+		b.ack(r, msg)
+		return
+	}
+
+	// Manually decode the raw BSON event.
+	data := bson.Raw{
+		Kind: 3,
+		Data: []byte(raw),
+	}
+	var e evt
+	if err := data.Unmarshal(&e); err != nil {
+		b.sendErr(eh.EventBusError{Err: errors.New("could not unmarshal event: " + err.Error()), Ctx: ctx})
+		b.ack(r, msg)
+		return
+	}
+
+	// Upcast the raw BSON data if the event was published with an older
+	// schema version.
+	if eh.EventSchemaVersion(e.EventType) > e.SchemaVersion {
+		var err error
+		if e, err = upcast(e); err != nil {
+			b.sendErr(eh.EventBusError{Err: errors.New("could not upcast event: " + err.Error()), Ctx: ctx})
+			b.ack(r, msg)
+			return
+		}
+	}
+
+	// Create an event of the correct type.
+	if data, err := eh.CreateEventData(e.EventType); err == nil {
+		// Manually decode the raw BSON event.
+		if err := e.RawData.Unmarshal(data); err != nil {
+			b.sendErr(eh.EventBusError{Err: errors.New("could not unmarshal event data: " + err.Error()), Ctx: ctx})
+			b.ack(r, msg)
+			return
+		}
+
+		// Set concrete event and zero out the decoded event.
+		e.data = data
+		e.RawData = bson.Raw{}
+	}
+
+	event := event{evt: e}
+	ctx = eh.UnmarshalContext(e.Context)
+
+	if !m(event) {
+		b.ack(r, msg)
+		return
+	}
+
+	if err := h.HandleEvent(ctx, event); err != nil {
+		b.sendErr(eh.EventBusError{Err: fmt.Errorf("could not handle event (%s): %s", h.HandlerType(), err.Error()), Ctx: ctx, Event: event})
+
+		// Give up the event when it has been delivered the max number of times.
+		if b.deliveries(r, msg) < b.maxDeliveries {
+			return
+		}
+		b.sendErr(eh.EventBusError{Err: fmt.Errorf("could not handle event (%s): %w", h.HandlerType(), ErrMaxDeliveries), Ctx: ctx, Event: event})
+	}
+
+	b.ack(r, msg)
+}
+
+// deliveries returns the number of times a pending message has been delivered,
+// or zero if it could not be checked.
+func (b *EventBus) deliveries(r *registration, msg redis.XMessage) int64 {
+	pending, err := b.client.XPendingExt(context.Background(), &redis.XPendingExtArgs{
+		Stream: b.stream,
+		Group:  r.group,
+		Start:  msg.ID,
+		End:    msg.ID,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		b.sendErr(eh.EventBusError{Err: errors.New("could not check deliveries: " + err.Error()), Ctx: context.Background()})
+		return 0
+	}
+	if len(pending) == 0 {
+		return 0
+	}
+	return pending[0].RetryCount
+}
+
+// ack acknowledges a message.
+func (b *EventBus) ack(r *registration, msg redis.XMessage) {
+	if err := b.client.XAck(context.Background(), b.stream, r.group, msg.ID).Err(); err != nil {
+		b.sendErr(eh.EventBusError{Err: errors.New("could not ack event: " + err.Error()), Ctx: context.Background()})
+	}
+}
+
+// sendErr sends an error on the error channel, or drops it if it is full.
+func (b *EventBus) sendErr(err eh.EventBusError) {
+	select {
+	case b.errCh <- err:
+	default:
+	}
+}
+
+// minID returns the stream ID of the oldest event to keep.
+func (b *EventBus) minID() string {
+	return fmt.Sprintf("%d-0", time.Now().Add(-b.maxAge).UnixNano()/int64(time.Millisecond))
+}
+
+// evt is the internal event used on the wire only.
+type evt struct {
+	EventType     eh.EventType           `bson:"event_type"`
+	RawData       bson.Raw               `bson:"data,omitempty"`
+	data          eh.EventData           `bson:"-"`
+	Timestamp     time.Time              `bson:"timestamp"`
+	AggregateType eh.AggregateType       `bson:"aggregate_type"`
+	AggregateID   string                 `bson:"_id"`
+	Version       int                    `bson:"version"`
+	Context       map[string]interface{} `bson:"context"`
+	SchemaVersion int                    `bson:"schema_version"`
+	Metadata      map[string]interface{} `bson:"metadata,omitempty"`
+}
+
+// upcast upcasts the raw BSON data of an event to the current schema version
+// of its event type.
+func upcast(e evt) (evt, error) {
+	var data []byte
+	if e.RawData.Kind != 0 {
+		data = e.RawData.Data
+	}
+
+	var err error
+	e.EventType, e.SchemaVersion, data, err = eh.UpcastRawEventData(
+		e.EventType, e.SchemaVersion, data, bson.Unmarshal, bson.Marshal)
+	if err != nil {
+		return e, err
+	}
+	e.RawData = bson.Raw{}
+	if data != nil {
+		e.RawData = bson.Raw{Kind: 3, Data: data}
+	}
+
+	return e, nil
+}
+
+// event is the private implementation of the eventhorizon.Event interface
+// for a Redis event bus.
+type event struct {
+	evt
+}
+
+// EventType implements the EventType method of the eventhorizon.Event interface.
+func (e event) EventType() eh.EventType {
+	return e.evt.EventType
+}
+
+// Data implements the Data method of the eventhorizon.Event interface.
+func (e event) Data() eh.EventData {
+	return e.evt.data
+}
+
+// Timestamp implements the Timestamp method of the eventhorizon.Event interface.
+func (e event) Timestamp() time.Time {
+	return e.evt.Timestamp
+}
+
+// AggregateType implements the AggregateType method of the eventhorizon.Event interface.
+func (e event) AggregateType() eh.AggregateType {
+	return e.evt.AggregateType
+}
+
+// AggrgateID implements the AggrgateID method of the eventhorizon.Event interface.
+func (e event) AggregateID() eh.ID {
+	return e.evt.AggregateID
+}
+
+// Metadata implements the Metadata method of the eventhorizon.Event interface.
+func (e event) Metadata() map[string]interface{} {
+	return e.evt.Metadata
+}
+
+// Version implements the Version method of the eventhorizon.Event interface.
+func (e event) Version() int {
+	return e.evt.Version
+}
+
+// String implements the String method of the eventhorizon.Event interface.
+func (e event) String() string {
+	return fmt.Sprintf("%s@%d", e.evt.EventType, e.evt.Version)
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventbus"
+	"github.com/looplab/eventhorizon/eventbus/redis"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func Test_EventBus(t *testing.T) {
+	s := miniredis.RunT(t)
+	bus1, bus2 := newEventBusses(t, s.Addr())
+
+	eventbus.AcceptanceTest(t, bus1, bus2, time.Second)
+}
+
+func TestIntegration_EventBus(t *testing.T) {
+	// Local Redis testing with Docker
+	addr := os.Getenv("REDIS_HOST")
+
+	if addr == "" {
+		// Default to localhost
+		addr = "localhost:6379"
+	}
+
+	bus1, bus2 := newEventBusses(t, addr)
+
+	eventbus.AcceptanceTest(t, bus1, bus2, time.Second)
+}
+
+func Test_EventBus_Redelivery(t *testing.T) {
+	s := miniredis.RunT(t)
+	bus1, bus2 := newEventBusses(t, s.Addr(), redis.WithClaimIdle(50*time.Millisecond))
+
+	// The handler on the first bus fails, the event is then claimed by either
+	// of the handlers.
+	h1 := &failingHandler{EventHandler: mocks.NewEventHandler("handler")}
+	h1.failures.Store(1)
+	bus1.AddHandler(eh.MatchAny(), h1)
+	time.Sleep(10 * time.Millisecond)
+
+	event := eh.NewEvent(mocks.EventType, &mocks.EventData{Content: "event"}, time.Now())
+	if err := bus1.PublishEvent(context.Background(), event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	select {
+	case err := <-bus1.Errors():
+		if err.Err.Error() != "could not handle event (handler): handler error" {
+			t.Error("there should be a handler error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("there should be an error")
+	}
+
+	// Remove the failed handler, which keeps its pending event for the other.
+	if err := bus1.RemoveHandler("handler"); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	h2 := mocks.NewEventHandler("handler")
+	bus2.AddHandler(eh.MatchAny(), h2)
+	if !h2.Wait(time.Second) {
+		t.Error("the event should be redelivered")
+	}
+	if len(h2.Events) != 1 || mocks.CompareEvents(h2.Events[0], event) != nil {
+		t.Error("the event should be correct:", h2.Events)
+	}
+}
+
+func Test_EventBus_MaxDeliveries(t *testing.T) {
+	s := miniredis.RunT(t)
+	bus, _ := newEventBusses(t, s.Addr(),
+		redis.WithClaimIdle(10*time.Millisecond),
+		redis.WithMaxDeliveries(2),
+	)
+
+	// The event is given up after the second delivery.
+	h := &failingHandler{EventHandler: mocks.NewEventHandler("handler")}
+	h.failures.Store(10)
+	bus.AddHandler(eh.MatchAny(), h)
+	time.Sleep(10 * time.Millisecond)
+
+	event := eh.NewEvent(mocks.EventType, &mocks.EventData{Content: "event"}, time.Now())
+	if err := bus.PublishEvent(context.Background(), event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case err := <-bus.Errors():
+			if errors.Is(err.Err, redis.ErrMaxDeliveries) {
+				if err.Event == nil || mocks.CompareEvents(err.Event, event) != nil {
+					t.Error("the event should be correct:", err.Event)
+				}
+				done = true
+			}
+		case <-timeout:
+			t.Fatal("there should be a max deliveries error")
+		}
+	}
+
+	// The event is acknowledged.
+	client := goredis.NewClient(&goredis.Options{Addr: s.Addr()})
+	defer client.Close()
+	pending, err := client.XPending(context.Background(), "test_events", "test_handler").Result()
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if pending.Count != 0 {
+		t.Error("there should be no pending events:", pending.Count)
+	}
+	if n := 10 - h.failures.Load(); n != 2 {
+		t.Error("the event should be delivered twice:", n)
+	}
+}
+
+func Test_EventBus_Undecodable(t *testing.T) {
+	s := miniredis.RunT(t)
+	bus, _ := newEventBusses(t, s.Addr())
+	h := mocks.NewEventHandler("handler")
+	bus.AddHandler(eh.MatchAny(), h)
+	time.Sleep(10 * time.Millisecond)
+
+	// An event that can not be decoded is reported and acknowledged.
+	client := goredis.NewClient(&goredis.Options{Addr: s.Addr()})
+	defer client.Close()
+	if err := client.XAdd(context.Background(), &goredis.XAddArgs{
+		Stream: "test_events",
+		Values: map[string]interface{}{"event": "invalid"},
+	}).Err(); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	select {
+	case err := <-bus.Errors():
+		if !strings.HasPrefix(err.Err.Error(), "could not unmarshal event") {
+			t.Error("there should be an unmarshal error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("there should be an error")
+	}
+	time.Sleep(10 * time.Millisecond)
+	pending, err := client.XPending(context.Background(), "test_events", "test_handler").Result()
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if pending.Count != 0 {
+		t.Error("there should be no pending events:", pending.Count)
+	}
+}
+
+func Test_EventBus_Trim(t *testing.T) {
+	s := miniredis.RunT(t)
+	bus, _ := newEventBusses(t, s.Addr(), redis.WithMaxLen(2))
+
+	for i := 0; i < 5; i++ {
+		event := eh.NewEvent(mocks.EventType, nil, time.Now())
+		if err := bus.PublishEvent(context.Background(), event); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	client := goredis.NewClient(&goredis.Options{Addr: s.Addr()})
+	defer client.Close()
+	n, err := client.XLen(context.Background(), "test_events").Result()
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if n > 2 {
+		t.Error("the stream should be trimmed:", n)
+	}
+}
+
+func newEventBusses(t *testing.T, addr string, options ...redis.Option) (*redis.EventBus, *redis.EventBus) {
+	bus1, err := redis.NewEventBus(addr, "test", options...)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	bus2, err := redis.NewEventBus(addr, "test", options...)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	t.Cleanup(func() {
+		bus1.Close()
+		bus2.Close()
+	})
+	return bus1, bus2
+}
+
+// failingHandler fails a number of times before handling events.
+type failingHandler struct {
+	*mocks.EventHandler
+	failures atomic.Int32
+}
+
+func (h *failingHandler) HandleEvent(ctx context.Context, event eh.Event) error {
+	if h.failures.Add(-1) >= 0 {
+		return errors.New("handler error")
+	}
+	return h.EventHandler.HandleEvent(ctx, event)
+}
@@ -24,7 +24,9 @@ import (
 )
 
 // EventHandler is a cron runner that inserts timed events into the event stream.
-// It uses the cron syntax from https://github.com/gorhill/cronexpr.
+// It uses the cron syntax from https://github.com/gorhill/cronexpr. For recurring
+// commands that handle missed fires on restarts, see scheduler.Scheduler.AddJob
+// in the commandhandler middleware.
 type EventHandler struct {
 	eh.EventHandler
 
@@ -0,0 +1,123 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AcceptanceTest is the acceptance test that all implementations of Store
+// should pass. It should manually be called from a test case in each
+// implementation:
+//
+//   func TestStore(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewStore()
+//       processmanager.AcceptanceTest(t, ctx, store)
+//   }
+//
+func AcceptanceTest(t *testing.T, ctx context.Context, store Store) {
+	// Times are rounded as DBs may not store them with full precision.
+	now := time.Now().Round(time.Millisecond)
+	id1, id2 := uuid.New().String(), uuid.New().String()
+
+	t.Log("find a timeout that does not exist")
+	_, err := store.FindTimeout(ctx, id1, "t1")
+	if sErr, ok := err.(StoreError); !ok || sErr.Err != ErrTimeoutNotFound {
+		t.Error("there should be a timeout not found error:", err)
+	}
+
+	t.Log("save timeouts")
+	t1 := Timeout{ProcessID: id1, Name: "t1", At: now.Add(-time.Minute)}
+	t2 := Timeout{ProcessID: id1, Name: "t2", At: now.Add(time.Hour)}
+	t3 := Timeout{ProcessID: id2, Name: "t1", At: now.Add(-time.Hour)}
+	for _, timeout := range []Timeout{t1, t2, t3} {
+		if err := store.SaveTimeout(ctx, timeout); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	timeout, err := store.FindTimeout(ctx, id1, "t1")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if timeout.ProcessID != t1.ProcessID || timeout.Name != t1.Name || !timeout.At.Equal(t1.At) {
+		t.Error("the timeout should be correct:", timeout)
+	}
+
+	t.Log("find due timeouts")
+	timeouts, err := store.FindDueTimeouts(ctx, now)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(timeouts) != 2 || timeouts[0].ProcessID != id2 || timeouts[1].ProcessID != id1 ||
+		timeouts[1].Name != "t1" {
+		t.Error("the due timeouts should be correct:", timeouts)
+	}
+
+	t.Log("reschedule a timeout")
+	t1.At = now.Add(time.Hour)
+	if err := store.SaveTimeout(ctx, t1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	timeouts, err = store.FindDueTimeouts(ctx, now)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(timeouts) != 1 || timeouts[0].ProcessID != id2 {
+		t.Error("the due timeouts should be correct:", timeouts)
+	}
+
+	t.Log("remove a timeout")
+	if err := store.RemoveTimeout(ctx, id2, "t1"); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := store.RemoveTimeout(ctx, id2, "t1"); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	_, err = store.FindTimeout(ctx, id2, "t1")
+	if sErr, ok := err.(StoreError); !ok || sErr.Err != ErrTimeoutNotFound {
+		t.Error("there should be a timeout not found error:", err)
+	}
+
+	t.Log("complete a process")
+	completed, err := store.IsCompleted(ctx, id1)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if completed {
+		t.Error("the process should not be completed")
+	}
+	if err := store.SaveCompleted(ctx, id1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	completed, err = store.IsCompleted(ctx, id1)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !completed {
+		t.Error("the process should be completed")
+	}
+	timeouts, err = store.FindDueTimeouts(ctx, now.Add(2*time.Hour))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(timeouts) != 0 {
+		t.Error("the timeouts of the completed process should be removed:", timeouts)
+	}
+}
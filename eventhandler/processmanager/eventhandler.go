@@ -0,0 +1,339 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrStateNotSet is when a state factory is not set on the EventHandler.
+var ErrStateNotSet = errors.New("state not set")
+
+// ErrInvalidState is when the repo returns an entity that is not a state.
+var ErrInvalidState = errors.New("invalid state")
+
+// ProcessManager is a stateful saga that coordinates a long running process.
+// Each instance of the process has its own state, which is loaded before and
+// saved after handling each event of the process.
+type ProcessManager interface {
+	// ProcessManagerType returns the type of the process manager.
+	ProcessManagerType() Type
+
+	// HandleProcessEvent handles an event for a process, which can update the
+	// state of the process and schedule timeouts. It returns the commands to
+	// handle, or an error to not change the process.
+	HandleProcessEvent(context.Context, eh.Event, *Process) ([]eh.Command, error)
+}
+
+// Type is the type of a process manager, used as its unique identifier.
+type Type string
+
+// Process is an instance of a process, passed to the process manager when
+// handling events.
+type Process struct {
+	// ID is the ID of the process, which new states should use as entity ID.
+	ID eh.ID
+	// State is the state of the process, created by the state factory for
+	// new processes.
+	State eh.Entity
+	// New is true if the state was created for this event.
+	New bool
+
+	completed bool
+	timeouts  map[string]time.Time
+	cancelled map[string]bool
+}
+
+// Complete marks the process as completed, which removes its state and its
+// timeouts after the event is handled. A marker of the completion is kept in
+// the store, events for the process after it has completed are ignored.
+func (p *Process) Complete() {
+	p.completed = true
+}
+
+// ScheduleTimeout schedules a timeout for the process, which is handled as a
+// TimeoutEvent after the duration. Scheduling a timeout with the same name as
+// a pending one reschedules it.
+func (p *Process) ScheduleTimeout(name string, d time.Duration) {
+	p.timeouts[name] = time.Now().Add(d)
+	delete(p.cancelled, name)
+}
+
+// CancelTimeout cancels a pending timeout of the process.
+func (p *Process) CancelTimeout(name string) {
+	p.cancelled[name] = true
+	delete(p.timeouts, name)
+}
+
+// EventHandler is a CQRS event handler to run a ProcessManager implementation.
+// The states of the processes are saved in a repo and the pending timeouts in
+// a store, which is polled for due timeouts when started.
+//
+// Events are matched to processes by their correlation ID by default, which is
+// kept for all commands and events caused by the process. Events of the same
+// process are handled one at a time.
+type EventHandler struct {
+	processManager ProcessManager
+	repo           eh.ReadWriteRepo
+	store          Store
+	commandHandler eh.CommandHandler
+	factoryFn      func() eh.Entity
+	processIDFn    func(eh.Event) eh.ID
+	pollInterval   time.Duration
+	errCh          chan Error
+
+	locks   map[processKey]*processLock
+	locksMu sync.Mutex
+
+	// The running timeout pollers, per namespace.
+	pollers   map[string]*poller
+	pollersMu sync.Mutex
+}
+
+var _ = eh.EventHandler(&EventHandler{})
+
+// NewEventHandler creates a new EventHandler, with a repo for the states and
+// a store for the timeouts and completed processes.
+func NewEventHandler(processManager ProcessManager, repo eh.ReadWriteRepo, store Store, commandHandler eh.CommandHandler) *EventHandler {
+	if processManager == nil || repo == nil || store == nil || commandHandler == nil {
+		return nil
+	}
+
+	return &EventHandler{
+		processManager: processManager,
+		repo:           repo,
+		store:          store,
+		commandHandler: commandHandler,
+		processIDFn:    CorrelationID,
+		pollInterval:   DefaultPollInterval,
+		errCh:          make(chan Error, 100),
+		locks:          map[processKey]*processLock{},
+		pollers:        map[string]*poller{},
+	}
+}
+
+// SetEntityFactory sets a factory function that creates the states of new
+// processes.
+func (h *EventHandler) SetEntityFactory(f func() eh.Entity) {
+	h.factoryFn = f
+}
+
+// SetProcessIDFunc sets a func that returns the ID of the process an event
+// belongs to, or an empty ID to ignore the event. The default is CorrelationID.
+func (h *EventHandler) SetProcessIDFunc(f func(eh.Event) eh.ID) {
+	h.processIDFn = f
+}
+
+// CorrelationID returns the correlation ID of an event, or its own ID if it
+// has no correlation ID, as it is then the start of a process.
+func CorrelationID(event eh.Event) eh.ID {
+	metadata := event.Metadata()
+	if id, ok := metadata[eh.CorrelationIDMetadataKey].(string); ok {
+		return eh.ID(id)
+	}
+	id, _ := metadata[eh.EventIDMetadataKey].(string)
+	return eh.ID(id)
+}
+
+// HandlerType implements the HandlerType method of the eventhorizon.EventHandler interface.
+func (h *EventHandler) HandlerType() eh.EventHandlerType {
+	return eh.EventHandlerType("processmanager_" + h.processManager.ProcessManagerType())
+}
+
+// HandleEvent implements the HandleEvent method of the eventhorizon.EventHandler interface.
+// The timeouts are saved and the commands are handled before the state is
+// saved, so that a failed event can be handled again without losing commands.
+func (h *EventHandler) HandleEvent(ctx context.Context, event eh.Event) error {
+	var id eh.ID
+	timeout, isTimeout := event.Data().(*TimeoutData)
+	if event.EventType() == TimeoutEvent && isTimeout {
+		id = timeout.ProcessID
+	} else {
+		isTimeout = false
+		id = h.processIDFn(event)
+	}
+	if id == "" {
+		return nil
+	}
+
+	unlock := h.lockProcess(processKey{eh.NamespaceFromContext(ctx), id})
+	defer unlock()
+
+	// Events of completed processes are ignored.
+	if completed, err := h.store.IsCompleted(ctx, id); err != nil {
+		return Error{Err: err, Ctx: ctx, Event: event}
+	} else if completed {
+		return nil
+	}
+
+	// Only handle timeouts that are still pending and due.
+	if isTimeout {
+		if due, err := h.timeoutDue(ctx, id, timeout.Name); err != nil {
+			return Error{Err: err, Ctx: ctx, Event: event}
+		} else if !due {
+			return nil
+		}
+	}
+
+	p, err := h.load(ctx, id)
+	if err != nil {
+		return Error{Err: err, Ctx: ctx, Event: event}
+	}
+
+	// Timeouts are only handled for existing processes.
+	if isTimeout && p.New {
+		if err := h.store.RemoveTimeout(ctx, id, timeout.Name); err != nil {
+			return Error{Err: err, Ctx: ctx, Event: event}
+		}
+		return nil
+	}
+
+	cmds, err := h.processManager.HandleProcessEvent(ctx, event, p)
+	if err != nil {
+		return Error{Err: err, Ctx: ctx, Event: event}
+	}
+
+	if isTimeout {
+		if _, ok := p.timeouts[timeout.Name]; !ok {
+			if err := h.store.RemoveTimeout(ctx, id, timeout.Name); err != nil {
+				return Error{Err: err, Ctx: ctx, Event: event}
+			}
+		}
+	}
+	if err := h.saveTimeouts(ctx, p); err != nil {
+		return Error{Err: err, Ctx: ctx, Event: event}
+	}
+
+	// Handle the commands with the correlation and causation of the event.
+	cmdCtx := eh.NewContextWithCausingEvent(ctx, event)
+	for _, cmd := range cmds {
+		if err := h.commandHandler.HandleCommand(cmdCtx, cmd); err != nil {
+			return Error{Err: err, Ctx: ctx, Event: event, Command: cmd}
+		}
+	}
+
+	// The process is marked as completed before its state is removed, to
+	// ignore its later events even if the state can't be removed.
+	if p.completed {
+		if err := h.store.SaveCompleted(ctx, id); err != nil {
+			return Error{Err: err, Ctx: ctx, Event: event}
+		}
+		err = h.repo.Remove(ctx, id)
+		if rrErr, ok := err.(eh.RepoError); ok && rrErr.Err == eh.ErrEntityNotFound {
+			err = nil
+		}
+	} else if p.State != nil {
+		err = h.repo.Save(ctx, p.State)
+	}
+	if err != nil {
+		return Error{Err: err, Ctx: ctx, Event: event}
+	}
+
+	return nil
+}
+
+// load loads the state of a process, or creates a new state.
+func (h *EventHandler) load(ctx context.Context, id eh.ID) (*Process, error) {
+	p := &Process{
+		ID:        id,
+		timeouts:  map[string]time.Time{},
+		cancelled: map[string]bool{},
+	}
+
+	state, err := h.repo.Find(ctx, id)
+	if rrErr, ok := err.(eh.RepoError); ok && rrErr.Err == eh.ErrEntityNotFound {
+		if h.factoryFn == nil {
+			return nil, ErrStateNotSet
+		}
+		p.State = h.factoryFn()
+		p.New = true
+	} else if err != nil {
+		return nil, err
+	} else if state == nil {
+		return nil, ErrInvalidState
+	} else {
+		p.State = state
+	}
+
+	return p, nil
+}
+
+// Errors returns an error channel where errors from handling timeouts are
+// sent. Errors are dropped if the channel is full.
+func (h *EventHandler) Errors() <-chan Error {
+	return h.errCh
+}
+
+// Error is an error in the process manager, containing the event and the
+// command, if any.
+type Error struct {
+	Err     error
+	Ctx     context.Context
+	Event   eh.Event
+	Command eh.Command
+}
+
+// Error implements the Error method of the error interface.
+func (e Error) Error() string {
+	if e.Command != nil {
+		return fmt.Sprintf("could not handle command %s from event %s: %s",
+			e.Command.CommandType(), e.Event, e.Err)
+	}
+	if e.Event == nil {
+		return fmt.Sprintf("could not handle timeouts: %s", e.Err)
+	}
+	return fmt.Sprintf("could not handle event %s: %s", e.Event, e.Err)
+}
+
+// processKey identifies a process in a namespace.
+type processKey struct {
+	namespace string
+	id        eh.ID
+}
+
+// processLock is a lock for a process, removed when it is not used.
+type processLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockProcess locks a process and returns a func to unlock it.
+func (h *EventHandler) lockProcess(key processKey) func() {
+	h.locksMu.Lock()
+	l, ok := h.locks[key]
+	if !ok {
+		l = &processLock{}
+		h.locks[key] = l
+	}
+	l.refs++
+	h.locksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		h.locksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(h.locks, key)
+		}
+		h.locksMu.Unlock()
+	}
+}
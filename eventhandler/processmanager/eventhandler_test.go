@@ -0,0 +1,217 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processmanager_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventhandler/processmanager"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/looplab/eventhorizon/repo/memory"
+)
+
+func Test_MemoryStore(t *testing.T) {
+	store := processmanager.NewMemoryStore()
+	if store == nil {
+		t.Fatal("there should be a store")
+	}
+
+	t.Log("store with default namespace")
+	processmanager.AcceptanceTest(t, context.Background(), store)
+
+	t.Log("store with other namespace")
+	processmanager.AcceptanceTest(t, eh.NewContextWithNamespace(context.Background(), "ns"), store)
+}
+
+func Test_EventHandler(t *testing.T) {
+	ctx := context.Background()
+	commandHandler := &mocks.CommandHandler{}
+	repo := memory.NewRepo()
+	handler := processmanager.NewEventHandler(&TestProcessManager{}, repo,
+		processmanager.NewMemoryStore(), commandHandler)
+	handler.SetEntityFactory(func() eh.Entity { return &mocks.SimpleModel{} })
+
+	// The first event starts the process with its own ID.
+	event := newEvent("a", "")
+	eventID := event.Metadata()[eh.EventIDMetadataKey].(string)
+	if err := handler.HandleEvent(ctx, event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := handler.HandleEvent(ctx, newEvent("b", eventID)); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertState(t, ctx, repo, eh.ID(eventID), "ab")
+	if len(commandHandler.Commands) != 2 {
+		t.Error("the commands should be handled:", commandHandler.Commands)
+	}
+	if id, _ := eh.CorrelationIDFromContext(commandHandler.Context); id != eventID {
+		t.Error("the correlation ID should be propagated:", id)
+	}
+
+	// Other processes have their own state.
+	other := newEvent("c", "other")
+	if err := handler.HandleEvent(ctx, other); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertState(t, ctx, repo, "other", "c")
+
+	// Errors are returned with the command.
+	commandHandler.Err = errors.New("command error")
+	err := handler.HandleEvent(ctx, newEvent("d", eventID))
+	if pErr, ok := err.(processmanager.Error); !ok || pErr.Err != commandHandler.Err || pErr.Command == nil {
+		t.Error("there should be a command error:", err)
+	}
+	commandHandler.Err = nil
+
+	// The state is removed when completed.
+	if err := handler.HandleEvent(ctx, newEvent("done", eventID)); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := repo.Find(ctx, eh.ID(eventID)); err == nil {
+		t.Error("the state should be removed")
+	}
+
+	// Later events of the completed process are ignored.
+	commands := len(commandHandler.Commands)
+	if err := handler.HandleEvent(ctx, newEvent("e", eventID)); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := repo.Find(ctx, eh.ID(eventID)); err == nil {
+		t.Error("the process should not be started again")
+	}
+	if len(commandHandler.Commands) != commands {
+		t.Error("there should be no new commands:", commandHandler.Commands)
+	}
+
+	// A state factory is needed for new processes.
+	handler = processmanager.NewEventHandler(&TestProcessManager{}, repo,
+		processmanager.NewMemoryStore(), commandHandler)
+	err = handler.HandleEvent(ctx, newEvent("a", ""))
+	if pErr, ok := err.(processmanager.Error); !ok || pErr.Err != processmanager.ErrStateNotSet {
+		t.Error("there should be a state not set error:", err)
+	}
+}
+
+func Test_EventHandler_Timeouts(t *testing.T) {
+	ctx := context.Background()
+	commandHandler := &mocks.CommandHandler{}
+	repo := memory.NewRepo()
+	store := processmanager.NewMemoryStore()
+	pm := &TestProcessManager{}
+	handler := processmanager.NewEventHandler(pm, repo, store, commandHandler)
+	handler.SetEntityFactory(func() eh.Entity { return &mocks.SimpleModel{} })
+
+	for _, event := range []eh.Event{
+		newEvent("timeout", "p1"),
+		newEvent("timeout", "p2"),
+		newEvent("cancel", "p2"),
+		newEvent("timeout", "p3"),
+		newEvent("done", "p3"),
+	} {
+		if err := handler.HandleEvent(ctx, event); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	// Timeouts are not handled before they are due.
+	if err := handler.HandleTimeouts(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertState(t, ctx, repo, "p1", "timeout")
+
+	// Only the pending timeout of the running process is handled.
+	time.Sleep(10 * time.Millisecond)
+	if err := handler.HandleTimeouts(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertState(t, ctx, repo, "p1", "timeout!")
+	assertState(t, ctx, repo, "p2", "timeoutcancel")
+	if cmd, ok := commandHandler.Commands[len(commandHandler.Commands)-1].(mocks.Command); !ok || cmd.ID != "p1" {
+		t.Error("the timeout command should be handled:", commandHandler.Commands)
+	}
+	if id, _ := eh.CorrelationIDFromContext(commandHandler.Context); id != "p1" {
+		t.Error("the correlation ID should be the process ID:", id)
+	}
+	if timeouts, _ := store.FindDueTimeouts(ctx, time.Now().Add(time.Hour)); len(timeouts) != 0 {
+		t.Error("there should be no pending timeouts:", timeouts)
+	}
+
+	// Timeouts are handled in the background when started.
+	if err := handler.HandleEvent(ctx, newEvent("timeout", "p1")); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	handler.SetPollInterval(5 * time.Millisecond)
+	handler.Start(ctx)
+	time.Sleep(30 * time.Millisecond)
+	handler.Close()
+	assertState(t, ctx, repo, "p1", "timeout!"+
+		"timeout!")
+}
+
+func newEvent(content, correlationID string) eh.Event {
+	metadata := map[string]interface{}{
+		eh.EventIDMetadataKey: uuid.New().String(),
+	}
+	if correlationID != "" {
+		metadata[eh.CorrelationIDMetadataKey] = correlationID
+	}
+	return eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: content},
+		time.Now(), mocks.AggregateType, uuid.New().String(), 1, eh.WithMetadata(metadata))
+}
+
+func assertState(t *testing.T, ctx context.Context, repo eh.ReadRepo, id eh.ID, content string) {
+	entity, err := repo.Find(ctx, id)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if state, ok := entity.(*mocks.SimpleModel); !ok || state.Content != content {
+		t.Error("the state should be correct:", entity)
+	}
+}
+
+// TestProcessManager appends the content of events to the state and handles a
+// command for each event.
+type TestProcessManager struct{}
+
+func (m *TestProcessManager) ProcessManagerType() processmanager.Type {
+	return "TestProcessManager"
+}
+
+func (m *TestProcessManager) HandleProcessEvent(ctx context.Context, event eh.Event, p *processmanager.Process) ([]eh.Command, error) {
+	state := p.State.(*mocks.SimpleModel)
+	state.ID = p.ID
+
+	if event.EventType() == processmanager.TimeoutEvent {
+		state.Content += "!"
+		return []eh.Command{mocks.Command{ID: p.ID}}, nil
+	}
+
+	content := event.Data().(*mocks.EventData).Content
+	switch content {
+	case "timeout":
+		p.ScheduleTimeout("t", 5*time.Millisecond)
+	case "cancel":
+		p.CancelTimeout("t")
+	case "done":
+		p.Complete()
+	}
+	state.Content += content
+	return []eh.Command{mocks.Command{ID: p.ID, Content: content}}, nil
+}
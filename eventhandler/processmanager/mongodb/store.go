@@ -0,0 +1,282 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventhandler/processmanager"
+)
+
+// ErrCouldNotDialDB is when the database could not be dialed.
+var ErrCouldNotDialDB = errors.New("could not dial database")
+
+// ErrNoDBSession is when no database session is set.
+var ErrNoDBSession = errors.New("no database session")
+
+// ErrCouldNotClearDB is when the database could not be cleared.
+var ErrCouldNotClearDB = errors.New("could not clear database")
+
+// ErrCouldNotSaveTimeout is when a timeout could not be saved.
+var ErrCouldNotSaveTimeout = errors.New("could not save timeout")
+
+// ErrCouldNotLoadTimeouts is when the timeouts could not be loaded.
+var ErrCouldNotLoadTimeouts = errors.New("could not load timeouts")
+
+// ErrCouldNotRemoveTimeout is when a timeout could not be removed.
+var ErrCouldNotRemoveTimeout = errors.New("could not remove timeout")
+
+// ErrCouldNotSaveCompleted is when a process could not be marked as completed.
+var ErrCouldNotSaveCompleted = errors.New("could not save completed process")
+
+// ErrCouldNotLoadCompleted is when a completed process could not be loaded.
+var ErrCouldNotLoadCompleted = errors.New("could not load completed process")
+
+// Store implements a processmanager.Store for MongoDB. The timeouts are kept
+// in a "process_timeouts" collection and the completed processes in a
+// "completed_processes" collection per namespace.
+type Store struct {
+	session  *mgo.Session
+	dbPrefix string
+	// The names of the DBs where the timeout index has been ensured.
+	indexed sync.Map
+}
+
+var _ = processmanager.Store(&Store{})
+
+// NewStore creates a new Store.
+func NewStore(url, dbPrefix string) (*Store, error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, ErrCouldNotDialDB
+	}
+
+	session.SetMode(mgo.Strong, true)
+	session.SetSafe(&mgo.Safe{W: 1})
+
+	return NewStoreWithSession(session, dbPrefix)
+}
+
+// NewStoreWithSession creates a new Store with a session.
+func NewStoreWithSession(session *mgo.Session, dbPrefix string) (*Store, error) {
+	if session == nil {
+		return nil, ErrNoDBSession
+	}
+
+	s := &Store{
+		session:  session,
+		dbPrefix: dbPrefix,
+	}
+
+	return s, nil
+}
+
+// SaveTimeout implements the SaveTimeout method of the processmanager.Store interface.
+func (s *Store) SaveTimeout(ctx context.Context, t processmanager.Timeout) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	if err := s.ensureIndex(ctx, sess); err != nil {
+		return processmanager.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveTimeout,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	id := timeoutID(t.ProcessID, t.Name)
+	if _, err := sess.DB(s.dbName(ctx)).C("process_timeouts").UpsertId(id, dbTimeout{
+		ID:        id,
+		ProcessID: t.ProcessID,
+		Name:      t.Name,
+		At:        t.At,
+	}); err != nil {
+		return processmanager.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveTimeout,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// FindTimeout implements the FindTimeout method of the processmanager.Store interface.
+func (s *Store) FindTimeout(ctx context.Context, processID eh.ID, name string) (processmanager.Timeout, error) {
+	timeouts, err := s.find(ctx, bson.M{"_id": timeoutID(processID, name)})
+	if err != nil {
+		return processmanager.Timeout{}, err
+	} else if len(timeouts) == 0 {
+		return processmanager.Timeout{}, processmanager.StoreError{
+			Err:       processmanager.ErrTimeoutNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return timeouts[0], nil
+}
+
+// FindDueTimeouts implements the FindDueTimeouts method of the processmanager.Store interface.
+func (s *Store) FindDueTimeouts(ctx context.Context, t time.Time) ([]processmanager.Timeout, error) {
+	return s.find(ctx, bson.M{"at": bson.M{"$lte": t}})
+}
+
+// RemoveTimeout implements the RemoveTimeout method of the processmanager.Store interface.
+func (s *Store) RemoveTimeout(ctx context.Context, processID eh.ID, name string) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	if err := sess.DB(s.dbName(ctx)).C("process_timeouts").RemoveId(
+		timeoutID(processID, name)); err != nil && err != mgo.ErrNotFound {
+		return processmanager.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotRemoveTimeout,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// SaveCompleted implements the SaveCompleted method of the processmanager.Store interface.
+func (s *Store) SaveCompleted(ctx context.Context, processID eh.ID) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	db := sess.DB(s.dbName(ctx))
+	if _, err := db.C("completed_processes").UpsertId(processID, bson.M{
+		"_id":          processID,
+		"completed_at": time.Now(),
+	}); err != nil {
+		return processmanager.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveCompleted,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if _, err := db.C("process_timeouts").RemoveAll(bson.M{"process_id": processID}); err != nil {
+		return processmanager.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotRemoveTimeout,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// IsCompleted implements the IsCompleted method of the processmanager.Store interface.
+func (s *Store) IsCompleted(ctx context.Context, processID eh.ID) (bool, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	n, err := sess.DB(s.dbName(ctx)).C("completed_processes").FindId(processID).Count()
+	if err != nil {
+		return false, processmanager.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotLoadCompleted,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return n > 0, nil
+}
+
+// Clear clears the timeouts and completed processes.
+func (s *Store) Clear(ctx context.Context) error {
+	s.indexed.Delete(s.dbName(ctx))
+	for _, name := range []string{"process_timeouts", "completed_processes"} {
+		if err := s.session.DB(s.dbName(ctx)).C(name).DropCollection(); err != nil &&
+			err.Error() != "ns not found" {
+			return processmanager.StoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotClearDB,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the database session.
+func (s *Store) Close() {
+	s.session.Close()
+}
+
+// find finds the timeouts matching a query, ordered by time.
+func (s *Store) find(ctx context.Context, query bson.M) ([]processmanager.Timeout, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var dbTimeouts []dbTimeout
+	if err := sess.DB(s.dbName(ctx)).C("process_timeouts").Find(query).
+		Sort("at").All(&dbTimeouts); err != nil {
+		return nil, processmanager.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotLoadTimeouts,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	timeouts := make([]processmanager.Timeout, len(dbTimeouts))
+	for i, t := range dbTimeouts {
+		timeouts[i] = processmanager.Timeout{
+			ProcessID: t.ProcessID,
+			Name:      t.Name,
+			At:        t.At,
+		}
+	}
+	return timeouts, nil
+}
+
+// ensureIndex ensures the indexes of the timeouts once per DB.
+func (s *Store) ensureIndex(ctx context.Context, sess *mgo.Session) error {
+	name := s.dbName(ctx)
+	if _, ok := s.indexed.Load(name); ok {
+		return nil
+	}
+	c := sess.DB(name).C("process_timeouts")
+	if err := c.EnsureIndexKey("at"); err != nil {
+		return err
+	}
+	if err := c.EnsureIndexKey("process_id"); err != nil {
+		return err
+	}
+	s.indexed.Store(name, struct{}{})
+	return nil
+}
+
+// dbName appends the namespace, if one is set, to the DB prefix to
+// get the name of the DB to use.
+func (s *Store) dbName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return s.dbPrefix + "_" + ns
+}
+
+// timeoutID returns the DB ID of a timeout.
+func timeoutID(processID eh.ID, name string) string {
+	return processID + "/" + name
+}
+
+// dbTimeout is the DB representation of a timeout.
+type dbTimeout struct {
+	ID        string    `bson:"_id"`
+	ProcessID eh.ID     `bson:"process_id"`
+	Name      string    `bson:"name"`
+	At        time.Time `bson:"at"`
+}
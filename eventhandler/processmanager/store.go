@@ -0,0 +1,185 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processmanager
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrTimeoutNotFound is when a timeout could not be found.
+var ErrTimeoutNotFound = errors.New("timeout not found")
+
+// StoreError is an error in a Store.
+type StoreError struct {
+	// Err is the error.
+	Err error
+	// BaseErr is an optional underlying error, for example from the DB driver.
+	BaseErr error
+	// Namespace is the namespace for the error.
+	Namespace string
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e StoreError) Error() string {
+	errStr := e.Err.Error()
+	if e.BaseErr != nil {
+		errStr += ": " + e.BaseErr.Error()
+	}
+	return "processmanager: " + errStr + " (" + e.Namespace + ")"
+}
+
+// Timeout is a pending timeout of a process.
+type Timeout struct {
+	// ProcessID is the ID of the process.
+	ProcessID eh.ID `json:"process_id"`
+	// Name is the name of the timeout, unique per process.
+	Name string `json:"name"`
+	// At is when the timeout is due.
+	At time.Time `json:"at"`
+}
+
+// Store is a store of the pending timeouts and the completed processes of a
+// process manager, with one set per namespace.
+type Store interface {
+	// SaveTimeout saves a timeout, replacing any timeout of the process with
+	// the same name.
+	SaveTimeout(context.Context, Timeout) error
+
+	// FindTimeout returns a pending timeout of a process.
+	FindTimeout(ctx context.Context, processID eh.ID, name string) (Timeout, error)
+
+	// FindDueTimeouts returns the timeouts that are due at or before a time,
+	// ordered by time.
+	FindDueTimeouts(context.Context, time.Time) ([]Timeout, error)
+
+	// RemoveTimeout removes a timeout of a process, if it exists.
+	RemoveTimeout(ctx context.Context, processID eh.ID, name string) error
+
+	// SaveCompleted marks a process as completed and removes its timeouts.
+	SaveCompleted(ctx context.Context, processID eh.ID) error
+
+	// IsCompleted returns true if a process has been marked as completed.
+	IsCompleted(ctx context.Context, processID eh.ID) (bool, error)
+}
+
+// MemoryStore is a Store in memory, mainly useful for testing.
+type MemoryStore struct {
+	// The outer maps are with namespace as key, the inner with process ID.
+	timeouts  map[string]map[eh.ID]map[string]Timeout
+	completed map[string]map[eh.ID]struct{}
+	mu        sync.RWMutex
+}
+
+var _ = Store(&MemoryStore{})
+
+// NewMemoryStore creates a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		timeouts:  map[string]map[eh.ID]map[string]Timeout{},
+		completed: map[string]map[eh.ID]struct{}{},
+	}
+}
+
+// SaveTimeout implements the SaveTimeout method of the Store interface.
+func (s *MemoryStore) SaveTimeout(ctx context.Context, t Timeout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.timeouts[ns]; !ok {
+		s.timeouts[ns] = map[eh.ID]map[string]Timeout{}
+	}
+	if _, ok := s.timeouts[ns][t.ProcessID]; !ok {
+		s.timeouts[ns][t.ProcessID] = map[string]Timeout{}
+	}
+	s.timeouts[ns][t.ProcessID][t.Name] = t
+	return nil
+}
+
+// FindTimeout implements the FindTimeout method of the Store interface.
+func (s *MemoryStore) FindTimeout(ctx context.Context, processID eh.ID, name string) (Timeout, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.timeouts[eh.NamespaceFromContext(ctx)][processID][name]
+	if !ok {
+		return Timeout{}, StoreError{
+			Err:       ErrTimeoutNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return t, nil
+}
+
+// FindDueTimeouts implements the FindDueTimeouts method of the Store interface.
+func (s *MemoryStore) FindDueTimeouts(ctx context.Context, at time.Time) ([]Timeout, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	timeouts := []Timeout{}
+	for _, process := range s.timeouts[eh.NamespaceFromContext(ctx)] {
+		for _, t := range process {
+			if !t.At.After(at) {
+				timeouts = append(timeouts, t)
+			}
+		}
+	}
+	sort.Slice(timeouts, func(i, j int) bool {
+		return timeouts[i].At.Before(timeouts[j].At)
+	})
+	return timeouts, nil
+}
+
+// RemoveTimeout implements the RemoveTimeout method of the Store interface.
+func (s *MemoryStore) RemoveTimeout(ctx context.Context, processID eh.ID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	delete(s.timeouts[ns][processID], name)
+	if len(s.timeouts[ns][processID]) == 0 {
+		delete(s.timeouts[ns], processID)
+	}
+	return nil
+}
+
+// SaveCompleted implements the SaveCompleted method of the Store interface.
+func (s *MemoryStore) SaveCompleted(ctx context.Context, processID eh.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.completed[ns]; !ok {
+		s.completed[ns] = map[eh.ID]struct{}{}
+	}
+	s.completed[ns][processID] = struct{}{}
+	delete(s.timeouts[ns], processID)
+	return nil
+}
+
+// IsCompleted implements the IsCompleted method of the Store interface.
+func (s *MemoryStore) IsCompleted(ctx context.Context, processID eh.ID) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.completed[eh.NamespaceFromContext(ctx)][processID]
+	return ok, nil
+}
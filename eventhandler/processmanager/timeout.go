@@ -0,0 +1,159 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processmanager
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// TimeoutEvent is the event type of timeouts scheduled by processes.
+const TimeoutEvent = eh.EventType("ProcessTimeout")
+
+// TimeoutData is the event data of a TimeoutEvent.
+type TimeoutData struct {
+	ProcessID eh.ID
+	Name      string
+}
+
+// DefaultPollInterval is the default interval between polling for due timeouts.
+const DefaultPollInterval = time.Second
+
+// SetPollInterval sets the interval between polling for due timeouts.
+func (h *EventHandler) SetPollInterval(interval time.Duration) {
+	h.pollInterval = interval
+}
+
+type poller struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start starts polling for due timeouts in the background for the namespace of
+// the context, until Close is called. It can be called once for each namespace.
+func (h *EventHandler) Start(ctx context.Context) {
+	h.pollersMu.Lock()
+	defer h.pollersMu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := h.pollers[ns]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(eh.NewContextWithNamespace(context.Background(), ns))
+	p := &poller{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	h.pollers[ns] = p
+
+	go func() {
+		defer close(p.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(h.pollInterval):
+			}
+
+			if err := h.HandleTimeouts(ctx); err != nil && ctx.Err() == nil {
+				select {
+				case h.errCh <- err.(Error):
+				default:
+				}
+			}
+		}
+	}()
+}
+
+// Close stops polling for timeouts in all namespaces and waits for the
+// background handling to finish.
+func (h *EventHandler) Close() {
+	h.pollersMu.Lock()
+	pollers := h.pollers
+	h.pollers = map[string]*poller{}
+	h.pollersMu.Unlock()
+
+	for _, p := range pollers {
+		p.cancel()
+		<-p.done
+	}
+}
+
+// HandleTimeouts handles all due timeouts in the namespace of the context. It
+// continues after errors and returns the first one. Timeouts that fail are
+// kept and handled again the next time.
+func (h *EventHandler) HandleTimeouts(ctx context.Context) error {
+	timeouts, err := h.store.FindDueTimeouts(ctx, time.Now())
+	if err != nil {
+		return Error{Err: err, Ctx: ctx}
+	}
+
+	var firstErr error
+	for _, t := range timeouts {
+		event := eh.NewEvent(TimeoutEvent, &TimeoutData{
+			ProcessID: t.ProcessID,
+			Name:      t.Name,
+		}, t.At, eh.WithMetadata(map[string]interface{}{
+			eh.EventIDMetadataKey:       uuid.New().String(),
+			eh.CorrelationIDMetadataKey: string(t.ProcessID),
+		}))
+		if err := h.HandleEvent(ctx, event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// timeoutDue returns true if a timeout is pending and due.
+func (h *EventHandler) timeoutDue(ctx context.Context, processID eh.ID, name string) (bool, error) {
+	t, err := h.store.FindTimeout(ctx, processID, name)
+	if sErr, ok := err.(StoreError); ok && sErr.Err == ErrTimeoutNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !t.At.After(time.Now()), nil
+}
+
+// saveTimeouts saves the timeouts scheduled and cancelled by a process.
+func (h *EventHandler) saveTimeouts(ctx context.Context, p *Process) error {
+	for name := range p.cancelled {
+		if err := h.store.RemoveTimeout(ctx, p.ID, name); err != nil {
+			return err
+		}
+	}
+
+	// Timeouts are not scheduled for completed processes.
+	if p.completed {
+		return nil
+	}
+	for name, at := range p.timeouts {
+		if err := h.store.SaveTimeout(ctx, Timeout{
+			ProcessID: p.ID,
+			Name:      name,
+			At:        at,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -17,6 +17,7 @@ package projector
 import (
 	"context"
 	"errors"
+	"sync"
 
 	eh "github.com/looplab/eventhorizon"
 )
@@ -26,6 +27,22 @@ type EventHandler struct {
 	projector Projector
 	repo      eh.ReadWriteRepo
 	factoryFn func() eh.Entity
+	keyFn     KeyFunc
+
+	// The state of a rebuild in progress and the lock to pause handling
+	// while a rebuild swaps the repo, per namespace.
+	rebuilds   map[string]*rebuild
+	pauses     map[string]*sync.RWMutex
+	rebuildsMu sync.Mutex
+	batchSize  int
+	matcher    eh.EventMatcher
+
+	// Handling of out of order events, per aggregate.
+	policy   OutOfOrderPolicy
+	locks    map[aggregateKey]*aggregateLock
+	buffers  map[aggregateKey]*buffer
+	bufferMu sync.Mutex
+	metrics  metrics
 }
 
 var _ = eh.EventHandler(&EventHandler{})
@@ -70,6 +87,11 @@ func NewEventHandler(projector Projector, repo eh.ReadWriteRepo) *EventHandler {
 	return &EventHandler{
 		projector: projector,
 		repo:      repo,
+		rebuilds:  map[string]*rebuild{},
+		pauses:    map[string]*sync.RWMutex{},
+		batchSize: DefaultRebuildBatchSize,
+		locks:     map[aggregateKey]*aggregateLock{},
+		buffers:   map[aggregateKey]*buffer{},
 	}
 }
 
@@ -80,31 +102,93 @@ func (h *EventHandler) HandlerType() eh.EventHandlerType {
 
 // HandleEvent implements the HandleEvent method of the eventhorizon.EventHandler interface.
 // It will try to find the correct version of the model, waiting for it if needed.
+// Events that are out of order are handled according to the OutOfOrderPolicy.
 func (h *EventHandler) HandleEvent(ctx context.Context, event eh.Event) error {
+	// Wait for any rebuild that is swapping the repo.
+	pause := h.pause(eh.NamespaceFromContext(ctx))
+	pause.RLock()
+	defer pause.RUnlock()
+
+	if h.rebuilt(ctx, event) {
+		return nil
+	}
+
+	if h.keyFn != nil {
+		return h.handleKeyed(ctx, event)
+	} else if h.policy.enabled() {
+		return h.handleOutOfOrder(ctx, event)
+	}
+
 	// Get or create the model, trying to use a waiting find with a min version
 	// if the underlying repo supports it.
 	findCtx, cancel := eh.NewContextWithMinVersionWait(ctx, event.Version()-1)
 	defer cancel()
-	entity, err := h.repo.Find(findCtx, event.AggregateID())
+	entity, err := h.findOrCreate(findCtx, h.repo, event.AggregateID())
+	if err != nil {
+		return err
+	}
+
+	newEntity, err := h.project(ctx, event, entity)
+	if err != nil {
+		return err
+	}
+
+	if err := h.saveOrRemove(ctx, event.AggregateID(), newEntity); err != nil {
+		return err
+	}
+
+	h.handled(ctx, event)
+	h.metrics.handled.Add(1)
+	return nil
+}
+
+// saveOrRemove saves a model, or removes it if it is nil.
+func (h *EventHandler) saveOrRemove(ctx context.Context, id eh.ID, entity eh.Entity) error {
+	if entity != nil {
+		if err := h.repo.Save(ctx, entity); err != nil {
+			return Error{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	} else {
+		if err := h.repo.Remove(ctx, id); err != nil {
+			return Error{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+	return nil
+}
+
+// findOrCreate finds a model in the repo, or creates a new one if not found.
+func (h *EventHandler) findOrCreate(ctx context.Context, repo eh.ReadRepo, id eh.ID) (eh.Entity, error) {
+	entity, err := repo.Find(ctx, id)
 	if rrErr, ok := err.(eh.RepoError); ok && rrErr.Err == eh.ErrEntityNotFound {
 		if h.factoryFn == nil {
-			return Error{
+			return nil, Error{
 				Err:       ErrModelNotSet,
 				Namespace: eh.NamespaceFromContext(ctx),
 			}
 		}
-		entity = h.factoryFn()
+		return h.factoryFn(), nil
 	} else if err != nil {
-		return Error{
+		return nil, Error{
 			Err:       err,
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
+	return entity, nil
+}
 
+// project projects an event onto a model, checking the versions unless a
+// KeyFunc is used.
+func (h *EventHandler) project(ctx context.Context, event eh.Event, entity eh.Entity) (eh.Entity, error) {
 	// The entity should be one version behind the event.
-	if entity, ok := entity.(eh.Versionable); ok {
+	if entity, ok := entity.(eh.Versionable); ok && h.keyFn == nil {
 		if entity.AggregateVersion()+1 != event.Version() {
-			return Error{
+			return nil, Error{
 				Err:       eh.ErrIncorrectEntityVersion,
 				Namespace: eh.NamespaceFromContext(ctx),
 			}
@@ -114,40 +198,28 @@ func (h *EventHandler) HandleEvent(ctx context.Context, event eh.Event) error {
 	// Run the projection, which will possibly increment the version.
 	newEntity, err := h.projector.Project(ctx, event, entity)
 	if err != nil {
-		return Error{
+		return nil, Error{
 			Err:       err,
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
 
 	// The model should now be at the same version as the event.
-	if newEntity, ok := newEntity.(eh.Versionable); ok {
+	if newEntity, ok := newEntity.(eh.Versionable); ok && h.keyFn == nil {
 		if newEntity.AggregateVersion() != event.Version() {
-			return Error{
+			return nil, Error{
 				Err:       eh.ErrIncorrectEntityVersion,
 				Namespace: eh.NamespaceFromContext(ctx),
 			}
 		}
 	}
 
-	// Update or remove the model.
-	if newEntity != nil {
-		if err := h.repo.Save(ctx, newEntity); err != nil {
-			return Error{
-				Err:       err,
-				Namespace: eh.NamespaceFromContext(ctx),
-			}
-		}
-	} else {
-		if err := h.repo.Remove(ctx, event.AggregateID()); err != nil {
-			return Error{
-				Err:       err,
-				Namespace: eh.NamespaceFromContext(ctx),
-			}
-		}
+	// Keyed models keep the versions of the events they have applied.
+	if newEntity, ok := newEntity.(KeyedModel); ok && h.keyFn != nil {
+		newEntity.SetAppliedVersion(event.AggregateID(), event.Version())
 	}
 
-	return nil
+	return newEntity, nil
 }
 
 // SetEntityFactory sets a factory function that creates concrete entity types.
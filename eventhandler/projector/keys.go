@@ -0,0 +1,140 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package projector
+
+import (
+	"context"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// KeyFunc returns the IDs of the models that an event should be projected onto.
+// An event can update several models, or none if no IDs are returned.
+type KeyFunc func(eh.Event) []eh.ID
+
+// SetKeyFunc sets a func that returns the IDs of the models to project events
+// onto, instead of the aggregate ID of the event. It is used for models that
+// combine events from several aggregates, for example a guest list.
+//
+// The models are not version checked, as the versions of the aggregates are
+// not related to the models, and the OutOfOrderPolicy is not used. Events for
+// the same model are projected one at a time. The ID of the model is available
+// in the context passed to the projector with KeyFromContext, which is needed
+// to set the ID of new models.
+//
+// Each model is saved separately, an event that fails for one model is thus
+// projected again onto the other models when it is redelivered. Models should
+// implement KeyedModel to skip the events that they have already applied.
+func (h *EventHandler) SetKeyFunc(f KeyFunc) {
+	h.keyFn = f
+}
+
+// KeyedModel is a model for a KeyFunc that keeps the version of the last
+// event it has applied of each aggregate, to only apply events once. The
+// versions are set by the EventHandler after projecting the event.
+type KeyedModel interface {
+	eh.Entity
+
+	// AppliedVersion returns the version of the last applied event of an
+	// aggregate, or 0 if none has been applied.
+	AppliedVersion(eh.ID) int
+
+	// SetAppliedVersion sets the version of the last applied event of an
+	// aggregate.
+	SetAppliedVersion(eh.ID, int)
+}
+
+// AppliedVersions can be embedded in a model to implement the versions of a
+// KeyedModel. It keeps one version per aggregate that the model has applied
+// events of.
+type AppliedVersions struct {
+	Versions map[eh.ID]int `json:"applied_versions" bson:"applied_versions"`
+}
+
+// AppliedVersion implements the AppliedVersion method of the KeyedModel interface.
+func (v *AppliedVersions) AppliedVersion(id eh.ID) int {
+	return v.Versions[id]
+}
+
+// SetAppliedVersion implements the SetAppliedVersion method of the KeyedModel interface.
+func (v *AppliedVersions) SetAppliedVersion(id eh.ID, version int) {
+	if v.Versions == nil {
+		v.Versions = map[eh.ID]int{}
+	}
+	v.Versions[id] = version
+}
+
+type contextKey int
+
+const keyKey contextKey = iota
+
+// KeyFromContext returns the ID of the model that is projected, when using a
+// KeyFunc.
+func KeyFromContext(ctx context.Context) (eh.ID, bool) {
+	id, ok := ctx.Value(keyKey).(eh.ID)
+	return id, ok
+}
+
+// keys returns the IDs of the models to project an event onto.
+func (h *EventHandler) keys(event eh.Event) []eh.ID {
+	if h.keyFn == nil {
+		return []eh.ID{event.AggregateID()}
+	}
+	return h.keyFn(event)
+}
+
+// keyContext adds the ID of the model to the context when using a KeyFunc.
+func (h *EventHandler) keyContext(ctx context.Context, id eh.ID) context.Context {
+	if h.keyFn == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, keyKey, id)
+}
+
+// handleKeyed handles an event for the models returned by the KeyFunc.
+func (h *EventHandler) handleKeyed(ctx context.Context, event eh.Event) error {
+	for _, id := range h.keys(event) {
+		if err := h.handleKey(ctx, event, id); err != nil {
+			return err
+		}
+	}
+
+	h.handled(ctx, event)
+	h.metrics.handled.Add(1)
+	return nil
+}
+
+// handleKey projects an event onto the model with an ID.
+func (h *EventHandler) handleKey(ctx context.Context, event eh.Event, id eh.ID) error {
+	unlock := h.lockAggregate(aggregateKey{eh.NamespaceFromContext(ctx), id})
+	defer unlock()
+
+	entity, err := h.findOrCreate(ctx, h.repo, id)
+	if err != nil {
+		return err
+	}
+
+	if m, ok := entity.(KeyedModel); ok && event.Version() <= m.AppliedVersion(event.AggregateID()) {
+		h.metrics.duplicates.Add(1)
+		return nil
+	}
+
+	entity, err = h.project(h.keyContext(ctx, id), event, entity)
+	if err != nil {
+		return err
+	}
+
+	return h.saveOrRemove(ctx, id, entity)
+}
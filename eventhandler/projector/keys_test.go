@@ -0,0 +1,143 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package projector_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventhandler/projector"
+	"github.com/looplab/eventhorizon/eventstore/memory"
+	"github.com/looplab/eventhorizon/mocks"
+	repo "github.com/looplab/eventhorizon/repo/memory"
+	"github.com/looplab/eventhorizon/repo/swap"
+)
+
+func Test_EventHandler_KeyFunc(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewEventStore()
+	id1, id2 := uuid.New().String(), uuid.New().String()
+	events := []eh.Event{
+		saveEvent(t, ctx, store, id1, 1, mocks.EventType, "a"),
+		saveEvent(t, ctx, store, id2, 1, mocks.EventType, "b"),
+		saveEvent(t, ctx, store, id1, 2, mocks.EventType, "c"),
+		saveEvent(t, ctx, store, id2, 2, mocks.EventType, "-"),
+	}
+
+	liveRepo := swap.NewRepo(repo.NewRepo())
+	handler := projector.NewEventHandler(&KeyProjector{}, liveRepo)
+	handler.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	handler.SetKeyFunc(func(event eh.Event) []eh.ID {
+		switch event.Data().(*mocks.EventData).Content {
+		case "-":
+			return nil
+		case "c":
+			return []eh.ID{"list", "other"}
+		}
+		return []eh.ID{"list"}
+	})
+
+	// The versions of the aggregates are not checked against the model.
+	for _, event := range events {
+		if err := handler.HandleEvent(ctx, event); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	assertModel(t, ctx, liveRepo, "list", 2, "abc")
+	assertModel(t, ctx, liveRepo, "other", 2, "c")
+	if _, err := liveRepo.Find(ctx, id1); err == nil {
+		t.Error("there should be no model for the aggregate")
+	}
+
+	// Rebuilds use the keys.
+	if err := handler.Rebuild(ctx, store, repo.NewRepo()); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	assertModel(t, ctx, liveRepo, "list", 2, "abc")
+	assertModel(t, ctx, liveRepo, "other", 2, "c")
+}
+
+func Test_EventHandler_KeyedModel(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewEventStore()
+	id1, id2 := uuid.New().String(), uuid.New().String()
+	event1 := saveEvent(t, ctx, store, id1, 1, mocks.EventType, "a")
+	event2 := saveEvent(t, ctx, store, id2, 1, mocks.EventType, "b")
+
+	r := repo.NewRepo()
+	handler := projector.NewEventHandler(&KeyedModelProjector{}, r)
+	handler.SetEntityFactory(func() eh.Entity { return &KeyedModel{} })
+	handler.SetKeyFunc(func(event eh.Event) []eh.ID {
+		return []eh.ID{"list", "other"}
+	})
+
+	// Redelivered events are only applied once to each model.
+	for _, event := range []eh.Event{event1, event2, event1, event2} {
+		if err := handler.HandleEvent(ctx, event); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	for _, id := range []eh.ID{"list", "other"} {
+		entity, err := r.Find(ctx, id)
+		if err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+		if m, ok := entity.(*KeyedModel); !ok || m.Content != "ab" ||
+			m.AppliedVersion(id1) != 1 || m.AppliedVersion(id2) != 1 {
+			t.Error("the model should be correct:", entity)
+		}
+	}
+	if m := handler.Metrics(); m.Duplicates != 4 {
+		t.Error("the metrics should be correct:", m)
+	}
+}
+
+// KeyedModel is a model that keeps the versions of the applied events.
+type KeyedModel struct {
+	projector.AppliedVersions
+	ID      eh.ID
+	Content string
+}
+
+func (m *KeyedModel) EntityID() eh.ID {
+	return m.ID
+}
+
+// KeyedModelProjector appends the content of events to a KeyedModel.
+type KeyedModelProjector struct {
+	ContentProjector
+}
+
+func (p *KeyedModelProjector) Project(ctx context.Context, event eh.Event, entity eh.Entity) (eh.Entity, error) {
+	model := entity.(*KeyedModel)
+	model.ID, _ = projector.KeyFromContext(ctx)
+	model.Content += event.Data().(*mocks.EventData).Content
+	return model, nil
+}
+
+// KeyProjector is a ContentProjector for models keyed by a KeyFunc.
+type KeyProjector struct {
+	ContentProjector
+}
+
+func (p *KeyProjector) Project(ctx context.Context, event eh.Event, entity eh.Entity) (eh.Entity, error) {
+	entity, err := p.ContentProjector.Project(ctx, event, entity)
+	if model, ok := entity.(*mocks.Model); ok {
+		model.ID, _ = projector.KeyFromContext(ctx)
+	}
+	return entity, err
+}
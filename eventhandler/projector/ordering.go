@@ -0,0 +1,327 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package projector
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// OutOfOrderPolicy is how events that are not exactly one version ahead of
+// their model are handled, for buses that deliver events out of order or more
+// than once. It only applies to models that are eventhorizon.Versionable.
+// The default policy is to fail with eventhorizon.ErrIncorrectEntityVersion,
+// after waiting for the model version if the repo supports it.
+//
+// Events for the same aggregate are handled one at a time when a policy is set.
+// The policy is not used with a KeyFunc.
+type OutOfOrderPolicy struct {
+	// SkipDuplicates skips events with a version that has already been
+	// applied to the model.
+	SkipDuplicates bool
+
+	// BufferTimeout is how long to buffer events that are ahead of the model,
+	// waiting for the missing events. The buffered events are projected as
+	// soon as the gap is filled. If the missing events are not handled before
+	// the timeout they are loaded from the EventStore, which is required for
+	// buffering. Without it events ahead of the model fail, to be redelivered
+	// by the bus. Zero disables buffering.
+	BufferTimeout time.Duration
+
+	// EventStore is used to load the missing events of a gap. Without
+	// buffering they are loaded as soon as a gap is detected.
+	EventStore eh.EventStore
+}
+
+func (p OutOfOrderPolicy) enabled() bool {
+	return p.SkipDuplicates || p.BufferTimeout > 0 || p.EventStore != nil
+}
+
+// Metrics are counters of how events have been handled by an EventHandler.
+type Metrics struct {
+	// Handled is the number of events projected, including buffered and
+	// loaded events.
+	Handled int64
+	// Duplicates is the number of events skipped as already applied.
+	Duplicates int64
+	// Buffered is the number of events buffered while waiting for missing events.
+	Buffered int64
+	// Loaded is the number of missing events loaded from the event store.
+	Loaded int64
+	// Failed is the number of buffered events that could not be projected
+	// after the buffer timeout.
+	Failed int64
+}
+
+type metrics struct {
+	handled, duplicates, buffered, loaded, failed atomic.Int64
+}
+
+// SetOutOfOrderPolicy sets how out of order events are handled.
+func (h *EventHandler) SetOutOfOrderPolicy(policy OutOfOrderPolicy) {
+	h.policy = policy
+}
+
+// Metrics returns the current metrics of the handler.
+func (h *EventHandler) Metrics() Metrics {
+	return Metrics{
+		Handled:    h.metrics.handled.Load(),
+		Duplicates: h.metrics.duplicates.Load(),
+		Buffered:   h.metrics.buffered.Load(),
+		Loaded:     h.metrics.loaded.Load(),
+		Failed:     h.metrics.failed.Load(),
+	}
+}
+
+// aggregateKey identifies an aggregate, or a model when using a KeyFunc, in a
+// namespace.
+type aggregateKey struct {
+	namespace string
+	id        eh.ID
+}
+
+// aggregateLock is a lock for an aggregate, removed when it is not used.
+type aggregateLock struct {
+	sync.Mutex
+	refs int
+}
+
+// buffer is the buffered events of an aggregate, by version.
+type buffer struct {
+	events map[int]bufferedEvent
+	timer  *time.Timer
+}
+
+type bufferedEvent struct {
+	ctx   context.Context
+	event eh.Event
+}
+
+// handleOutOfOrder handles an event according to the OutOfOrderPolicy.
+func (h *EventHandler) handleOutOfOrder(ctx context.Context, event eh.Event) error {
+	key := aggregateKey{eh.NamespaceFromContext(ctx), event.AggregateID()}
+	unlock := h.lockAggregate(key)
+	defer unlock()
+
+	entity, err := h.findOrCreate(ctx, h.repo, event.AggregateID())
+	if err != nil {
+		return err
+	}
+
+	if v, ok := entity.(eh.Versionable); ok {
+		version := v.AggregateVersion()
+		if event.Version() <= version && h.policy.SkipDuplicates {
+			h.metrics.duplicates.Add(1)
+			return nil
+		} else if event.Version() > version+1 {
+			if h.policy.BufferTimeout > 0 && h.policy.EventStore != nil {
+				h.bufferEvent(ctx, key, event)
+				return nil
+			} else if h.policy.EventStore != nil {
+				if entity, err = h.loadMissing(ctx, event.AggregateID(), entity, event.Version()-1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if entity, err = h.project(ctx, event, entity); err != nil {
+		return err
+	}
+	h.handled(ctx, event)
+	h.metrics.handled.Add(1)
+
+	entity, err = h.projectBuffered(key, entity)
+	if err != nil {
+		return err
+	}
+
+	return h.saveOrRemove(ctx, event.AggregateID(), entity)
+}
+
+// bufferEvent buffers an event until the missing events are handled, starting
+// the timeout for the aggregate if it is the first buffered event.
+func (h *EventHandler) bufferEvent(ctx context.Context, key aggregateKey, event eh.Event) {
+	h.bufferMu.Lock()
+	defer h.bufferMu.Unlock()
+
+	b, ok := h.buffers[key]
+	if !ok {
+		b = &buffer{events: map[int]bufferedEvent{}}
+		b.timer = time.AfterFunc(h.policy.BufferTimeout, func() {
+			h.bufferTimeout(key, b)
+		})
+		h.buffers[key] = b
+	}
+
+	if _, ok := b.events[event.Version()]; ok {
+		h.metrics.duplicates.Add(1)
+		return
+	}
+	b.events[event.Version()] = bufferedEvent{ctx, event}
+	h.metrics.buffered.Add(1)
+}
+
+// projectBuffered projects all buffered events that follow the model version.
+// Buffered events that are already applied are removed. The aggregate lock
+// must be held.
+func (h *EventHandler) projectBuffered(key aggregateKey, entity eh.Entity) (eh.Entity, error) {
+	h.bufferMu.Lock()
+	b, ok := h.buffers[key]
+	h.bufferMu.Unlock()
+	if !ok {
+		return entity, nil
+	}
+
+	for {
+		v, ok := entity.(eh.Versionable)
+		if !ok {
+			break
+		}
+		h.bufferMu.Lock()
+		for version := range b.events {
+			if version <= v.AggregateVersion() {
+				delete(b.events, version)
+				h.metrics.duplicates.Add(1)
+			}
+		}
+		next, ok := b.events[v.AggregateVersion()+1]
+		delete(b.events, v.AggregateVersion()+1)
+		h.bufferMu.Unlock()
+		if !ok {
+			break
+		}
+
+		var err error
+		if entity, err = h.project(next.ctx, next.event, entity); err != nil {
+			return nil, err
+		}
+		h.handled(next.ctx, next.event)
+		h.metrics.handled.Add(1)
+	}
+
+	h.bufferMu.Lock()
+	defer h.bufferMu.Unlock()
+	if len(b.events) == 0 && h.buffers[key] == b {
+		b.timer.Stop()
+		delete(h.buffers, key)
+	}
+	return entity, nil
+}
+
+// bufferTimeout loads the missing events for the buffered events of an
+// aggregate, or drops them if there is no event store.
+func (h *EventHandler) bufferTimeout(key aggregateKey, b *buffer) {
+	pause := h.pause(key.namespace)
+	pause.RLock()
+	defer pause.RUnlock()
+	unlock := h.lockAggregate(key)
+	defer unlock()
+
+	h.bufferMu.Lock()
+	if h.buffers[key] != b {
+		// The buffer has already been handled.
+		h.bufferMu.Unlock()
+		return
+	}
+	delete(h.buffers, key)
+	var first bufferedEvent
+	last := 0
+	for version, e := range b.events {
+		if first.event == nil || version < first.event.Version() {
+			first = e
+		}
+		if version > last {
+			last = version
+		}
+	}
+	count := int64(len(b.events))
+	h.bufferMu.Unlock()
+	if count == 0 {
+		return
+	}
+
+	// The missing events are loaded up to the last buffered event, which are
+	// also loaded from the store.
+	ctx := first.ctx
+	entity, err := h.findOrCreate(ctx, h.repo, first.event.AggregateID())
+	if err == nil {
+		entity, err = h.loadMissing(ctx, first.event.AggregateID(), entity, last)
+	}
+	if err == nil {
+		err = h.saveOrRemove(ctx, first.event.AggregateID(), entity)
+	}
+	if err != nil {
+		h.metrics.failed.Add(count)
+	}
+}
+
+// loadMissing loads the events of an aggregate after the model version up to
+// and including a version from the event store and projects them. The ID of
+// the aggregate is used, as a newly created model has no ID yet.
+func (h *EventHandler) loadMissing(ctx context.Context, id eh.ID, entity eh.Entity, version int) (eh.Entity, error) {
+	events, err := h.policy.EventStore.Load(ctx, id)
+	if esErr, ok := err.(eh.EventStoreError); ok && esErr.Err == eh.ErrAggregateNotFound {
+		events = nil
+	} else if err != nil {
+		return nil, Error{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	for _, event := range events {
+		v, ok := entity.(eh.Versionable)
+		if !ok || event.Version() <= v.AggregateVersion() {
+			continue
+		} else if event.Version() > version {
+			break
+		}
+		if entity, err = h.project(ctx, event, entity); err != nil {
+			return nil, err
+		}
+		h.handled(ctx, event)
+		h.metrics.handled.Add(1)
+		h.metrics.loaded.Add(1)
+	}
+	return entity, nil
+}
+
+// lockAggregate locks an aggregate and returns a func to unlock it.
+func (h *EventHandler) lockAggregate(key aggregateKey) func() {
+	h.bufferMu.Lock()
+	l, ok := h.locks[key]
+	if !ok {
+		l = &aggregateLock{}
+		h.locks[key] = l
+	}
+	l.refs++
+	h.bufferMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		h.bufferMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(h.locks, key)
+		}
+		h.bufferMu.Unlock()
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package projector_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventhandler/projector"
+	"github.com/looplab/eventhorizon/eventstore/memory"
+	"github.com/looplab/eventhorizon/mocks"
+	repo "github.com/looplab/eventhorizon/repo/memory"
+)
+
+func Test_EventHandler_SkipDuplicates(t *testing.T) {
+	ctx := context.Background()
+	r := repo.NewRepo()
+	handler, events := newOrderingHandler(t, r, 3)
+
+	// Without a policy duplicates fail.
+	handleEvents(t, handler, events[0], events[1])
+	err := handler.HandleEvent(ctx, events[0])
+	if pErr, ok := err.(projector.Error); !ok || pErr.Err != eh.ErrIncorrectEntityVersion {
+		t.Error("there should be an incorrect entity version error:", err)
+	}
+
+	handler.SetOutOfOrderPolicy(projector.OutOfOrderPolicy{SkipDuplicates: true})
+	handleEvents(t, handler, events[0], events[1], events[2], events[2])
+	assertModel(t, ctx, r, events[0].AggregateID(), 3, "abc")
+	if m := handler.Metrics(); m.Duplicates != 3 || m.Handled != 3 {
+		t.Error("the metrics should be correct:", m)
+	}
+
+	// Future events still fail.
+	event := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "e"},
+		time.Now(), mocks.AggregateType, events[0].AggregateID(), 5)
+	err = handler.HandleEvent(ctx, event)
+	if pErr, ok := err.(projector.Error); !ok || pErr.Err != eh.ErrIncorrectEntityVersion {
+		t.Error("there should be an incorrect entity version error:", err)
+	}
+}
+
+func Test_EventHandler_BufferEvents(t *testing.T) {
+	ctx := context.Background()
+	r := repo.NewRepo()
+	handler, events := newOrderingHandler(t, r, 4)
+	handler.SetOutOfOrderPolicy(projector.OutOfOrderPolicy{
+		SkipDuplicates: true,
+		BufferTimeout:  10 * time.Millisecond,
+		EventStore:     handler.store,
+	})
+
+	handleEvents(t, handler.EventHandler, events[0], events[3], events[2], events[2])
+	assertModel(t, ctx, r, events[0].AggregateID(), 1, "a")
+	handleEvents(t, handler.EventHandler, events[1])
+	assertModel(t, ctx, r, events[0].AggregateID(), 4, "abcd")
+	if m := handler.Metrics(); m.Buffered != 2 || m.Duplicates != 1 || m.Handled != 4 {
+		t.Error("the metrics should be correct:", m)
+	}
+
+	// The timeout should not load anything when the gap is filled.
+	time.Sleep(50 * time.Millisecond)
+	if m := handler.Metrics(); m.Loaded != 0 {
+		t.Error("there should be no loaded events:", m)
+	}
+}
+
+func Test_EventHandler_BufferWithoutEventStore(t *testing.T) {
+	ctx := context.Background()
+	r := repo.NewRepo()
+	handler, events := newOrderingHandler(t, r, 3)
+	handler.SetOutOfOrderPolicy(projector.OutOfOrderPolicy{
+		BufferTimeout: 10 * time.Millisecond,
+	})
+
+	// Events are not buffered without an event store, to be redelivered.
+	handleEvents(t, handler, events[0])
+	err := handler.HandleEvent(ctx, events[2])
+	if pErr, ok := err.(projector.Error); !ok || pErr.Err != eh.ErrIncorrectEntityVersion {
+		t.Error("there should be an incorrect entity version error:", err)
+	}
+	assertModel(t, ctx, r, events[0].AggregateID(), 1, "a")
+	if m := handler.Metrics(); m.Buffered != 0 {
+		t.Error("the metrics should be correct:", m)
+	}
+}
+
+func Test_EventHandler_BufferTimeoutLoadMissing(t *testing.T) {
+	ctx := context.Background()
+	r := repo.NewRepo()
+	handler, events := newOrderingHandler(t, r, 3)
+	handler.SetOutOfOrderPolicy(projector.OutOfOrderPolicy{
+		BufferTimeout: 10 * time.Millisecond,
+		EventStore:    handler.store,
+	})
+
+	handleEvents(t, handler.EventHandler, events[0], events[2])
+	time.Sleep(50 * time.Millisecond)
+	assertModel(t, ctx, r, events[0].AggregateID(), 3, "abc")
+	// Both the missing and the buffered event are loaded from the store.
+	if m := handler.Metrics(); m.Buffered != 1 || m.Loaded != 2 {
+		t.Error("the metrics should be correct:", m)
+	}
+}
+
+func Test_EventHandler_LoadMissing(t *testing.T) {
+	ctx := context.Background()
+	r := repo.NewRepo()
+	handler, events := newOrderingHandler(t, r, 4)
+	handler.SetOutOfOrderPolicy(projector.OutOfOrderPolicy{
+		EventStore: handler.store,
+	})
+
+	handleEvents(t, handler.EventHandler, events[0], events[3])
+	assertModel(t, ctx, r, events[0].AggregateID(), 4, "abcd")
+	if m := handler.Metrics(); m.Loaded != 2 || m.Handled != 4 {
+		t.Error("the metrics should be correct:", m)
+	}
+}
+
+func Test_EventHandler_LoadMissingFirst(t *testing.T) {
+	ctx := context.Background()
+	r := repo.NewRepo()
+	handler, events := newOrderingHandler(t, r, 2)
+	handler.SetOutOfOrderPolicy(projector.OutOfOrderPolicy{
+		EventStore: handler.store,
+	})
+
+	// The first event is missing for a model that does not exist yet.
+	handleEvents(t, handler.EventHandler, events[1])
+	assertModel(t, ctx, r, events[0].AggregateID(), 2, "ab")
+	if m := handler.Metrics(); m.Loaded != 1 || m.Handled != 2 {
+		t.Error("the metrics should be correct:", m)
+	}
+}
+
+func Test_EventHandler_BufferTimeoutLoadMissingFirst(t *testing.T) {
+	ctx := context.Background()
+	r := repo.NewRepo()
+	handler, events := newOrderingHandler(t, r, 2)
+	handler.SetOutOfOrderPolicy(projector.OutOfOrderPolicy{
+		BufferTimeout: 10 * time.Millisecond,
+		EventStore:    handler.store,
+	})
+
+	handleEvents(t, handler.EventHandler, events[1])
+	time.Sleep(50 * time.Millisecond)
+	assertModel(t, ctx, r, events[0].AggregateID(), 2, "ab")
+	if m := handler.Metrics(); m.Buffered != 1 || m.Loaded != 2 {
+		t.Error("the metrics should be correct:", m)
+	}
+}
+
+type orderingHandler struct {
+	*projector.EventHandler
+	store eh.EventStore
+}
+
+// newOrderingHandler creates a handler and saves n events for an aggregate,
+// with the content "a", "b", "c" etc.
+func newOrderingHandler(t *testing.T, r eh.ReadWriteRepo, n int) (*orderingHandler, []eh.Event) {
+	store := memory.NewEventStore()
+	id := uuid.New().String()
+	events := make([]eh.Event, n)
+	for i := range events {
+		events[i] = saveEvent(t, context.Background(), store, id, i+1,
+			mocks.EventType, string(rune('a'+i)))
+	}
+
+	handler := projector.NewEventHandler(&ContentProjector{}, r)
+	handler.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	return &orderingHandler{handler, store}, events
+}
+
+func handleEvents(t *testing.T, handler eh.EventHandler, events ...eh.Event) {
+	for _, event := range events {
+		if err := handler.HandleEvent(context.Background(), event); err != nil {
+			t.Fatal("there should be no error:", err)
+		}
+	}
+}
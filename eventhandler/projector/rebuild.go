@@ -0,0 +1,415 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package projector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/repo/swap"
+)
+
+// ErrNoSwapRepo is when a rebuild is started for an EventHandler that does not
+// use a swap.Repo.
+var ErrNoSwapRepo = errors.New("repo is not a swap repo")
+
+// ErrRebuildInProgress is when a rebuild is started while an other rebuild is
+// in progress in the same namespace.
+var ErrRebuildInProgress = errors.New("rebuild in progress")
+
+// ErrMissingPosition is when the event store loads an event without a position.
+var ErrMissingPosition = errors.New("missing event position")
+
+// DefaultRebuildBatchSize is the default number of models to keep in memory
+// before saving them when rebuilding.
+const DefaultRebuildBatchSize = 1000
+
+// The time to skip events projected by a rebuild that had not been handled
+// when the repo was swapped. Events that are not handled in time are assumed
+// to never be.
+const rebuildSkipTimeout = 10 * time.Minute
+
+// The margin for events saved while rebuilding with a timestamp before the
+// rebuild started, for example if created on a node with a clock behind.
+const rebuildClockSkew = time.Minute
+
+// rebuild is the state of a rebuild in a namespace.
+type rebuild struct {
+	// The events handled while rebuilding, or nil when the rebuild is done.
+	handled map[eventKey]struct{}
+	// The events projected when the rebuild caught up that have not yet been
+	// handled, to skip when they are until skipUntil.
+	skip      map[eventKey]struct{}
+	skipUntil time.Time
+}
+
+// eventKey identifies an event by its aggregate and version.
+type eventKey struct {
+	id      eh.ID
+	version int
+}
+
+// SetRebuildBatchSize sets the number of models to keep in memory before
+// saving them when rebuilding.
+func (h *EventHandler) SetRebuildBatchSize(size int) {
+	h.batchSize = size
+}
+
+// SetRebuildMatcher sets the matcher of the events to project when rebuilding,
+// which should be the same as the handler is added to the event bus with. The
+// default is to project all events.
+func (h *EventHandler) SetRebuildMatcher(m eh.EventMatcher) {
+	h.matcher = m
+}
+
+// Rebuild replays all events in the namespace of the context, optionally
+// filtered by aggregate types, through the projector into a new repo, which
+// replaces any models already in it. It must be used with a swap.Repo, which is swapped to the new repo when it
+// has caught up with all events.
+//
+// The events are projected in batches, saving each model only once per batch.
+// Events are handled as usual while rebuilding, until the rebuild catches up
+// with all but the last partial batch of events. Handling in the namespace is
+// then paused while the last events are projected and the repo is swapped,
+// after which the events saved while rebuilding are skipped if they are
+// handled again. Events saved before the rebuild started must have been
+// handled before the rebuild finishes, which is normally the case.
+//
+// The swap is not persisted, use RebuildIfNeeded to use the rebuilt repo
+// after a restart. Any cache in front of the swap.Repo must be cleared after
+// the swap.
+func (h *EventHandler) Rebuild(ctx context.Context, store eh.GlobalEventStore, repo eh.ReadWriteRepo, aggregateTypes ...eh.AggregateType) error {
+	return h.rebuild(ctx, store, repo, nil, aggregateTypes...)
+}
+
+// rebuild is Rebuild with an optional func that is called before swapping
+// the repo, while handling is paused. The repo is not swapped if it fails.
+func (h *EventHandler) rebuild(ctx context.Context, store eh.GlobalEventStore, repo eh.ReadWriteRepo, beforeSwap func() error, aggregateTypes ...eh.AggregateType) error {
+	swapRepo := swap.Repository(h.repo)
+	if swapRepo == nil {
+		return Error{
+			Err:       ErrNoSwapRepo,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	ns := eh.NamespaceFromContext(ctx)
+	h.rebuildsMu.Lock()
+	state, ok := h.rebuilds[ns]
+	if ok && state.handled != nil {
+		h.rebuildsMu.Unlock()
+		return Error{
+			Err:       ErrRebuildInProgress,
+			Namespace: ns,
+		}
+	} else if !ok {
+		// Keep skipping events from any previous rebuild.
+		state = &rebuild{
+			skip: map[eventKey]struct{}{},
+		}
+		h.rebuilds[ns] = state
+	}
+	state.handled = map[eventKey]struct{}{}
+	h.rebuildsMu.Unlock()
+
+	// Make sure that a failed rebuild does not keep tracking events.
+	defer func() {
+		h.rebuildsMu.Lock()
+		defer h.rebuildsMu.Unlock()
+		if state.handled != nil {
+			state.handled = nil
+			if len(state.skip) == 0 {
+				delete(h.rebuilds, ns)
+			}
+		}
+	}()
+
+	// Project the events in batches, until only a partial batch is left. The
+	// position when the rebuild started is not known, the events saved while
+	// rebuilding are instead tracked by their timestamp.
+	since := time.Now().Add(-rebuildClockSkew)
+	saved := map[eh.ID]struct{}{}
+	var position int64
+	var projected []eventKey
+	var events []eh.Event
+	var err error
+	for {
+		if events, err = store.LoadFrom(ctx, position, h.batchSize, aggregateTypes...); err != nil {
+			return Error{
+				Err:       err,
+				Namespace: ns,
+			}
+		}
+		if position, err = h.projectBatch(ctx, repo, saved, events, position); err != nil {
+			return err
+		}
+		var recent []eh.Event
+		for _, event := range events {
+			if !event.Timestamp().Before(since) {
+				recent = append(recent, event)
+			}
+		}
+		projected = append(projected, h.eventKeys(recent)...)
+		if h.batchSize <= 0 || len(events) < h.batchSize {
+			break
+		}
+	}
+
+	// Pause handling while catching up with the last events.
+	pause := h.pause(ns)
+	pause.Lock()
+	defer pause.Unlock()
+
+	if events, err = store.LoadFrom(ctx, position, 0, aggregateTypes...); err != nil {
+		return Error{
+			Err:       err,
+			Namespace: ns,
+		}
+	}
+	if _, err := h.projectBatch(ctx, repo, saved, events, position); err != nil {
+		return err
+	}
+	projected = append(projected, h.eventKeys(events)...)
+
+	if beforeSwap != nil {
+		if err := beforeSwap(); err != nil {
+			return err
+		}
+	}
+	swapRepo.Swap(ctx, repo)
+
+	// Skip the events that were projected by the rebuild when they are
+	// handled later on.
+	h.rebuildsMu.Lock()
+	defer h.rebuildsMu.Unlock()
+	for _, key := range projected {
+		if _, ok := state.handled[key]; !ok {
+			state.skip[key] = struct{}{}
+		}
+	}
+	state.skipUntil = time.Now().Add(rebuildSkipTimeout)
+	state.handled = nil
+	if len(state.skip) == 0 {
+		delete(h.rebuilds, ns)
+	}
+
+	return nil
+}
+
+// RebuildIfNeeded uses the models built with the version of the projector
+// in the version store, and rebuilds them if the projector is a
+// VersionedProjector with a newer version. It must be used with a swap.Repo
+// and is typically called on startup, after adding the handler to the event
+// bus. It returns true if the models were rebuilt.
+//
+// The models of each version are kept in their own repo, returned by repoFn,
+// for example a collection per version. Models of version 0 are kept in the
+// parent of the swap.Repo. The new version is saved once its repo has been
+// rebuilt, before it is swapped in, which is thus the repo that is used after
+// a restart. A failed rebuild is retried on the next call.
+func (h *EventHandler) RebuildIfNeeded(ctx context.Context, store eh.GlobalEventStore, versions VersionStore, repoFn func(version int) eh.ReadWriteRepo, aggregateTypes ...eh.AggregateType) (bool, error) {
+	p, ok := h.projector.(VersionedProjector)
+	if !ok {
+		return false, nil
+	}
+
+	swapRepo := swap.Repository(h.repo)
+	if swapRepo == nil {
+		return false, Error{
+			Err:       ErrNoSwapRepo,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	version, err := versions.ProjectorVersion(ctx, p.ProjectorType())
+	if err != nil {
+		return false, Error{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if version > 0 {
+		swapRepo.Swap(ctx, repoFn(version))
+	}
+	if p.ProjectorVersion() <= version {
+		return false, nil
+	}
+
+	saveVersion := func() error {
+		if err := versions.SaveProjectorVersion(ctx, p.ProjectorType(), p.ProjectorVersion()); err != nil {
+			return Error{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return nil
+	}
+	if err := h.rebuild(ctx, store, repoFn(p.ProjectorVersion()), saveVersion, aggregateTypes...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// projectBatch projects events onto the models in the repo, keeping the models
+// in memory until the batch is full. Only the models saved by the rebuild are
+// loaded from the repo, other models in it are replaced. It returns the
+// position of the last event.
+func (h *EventHandler) projectBatch(ctx context.Context, repo eh.ReadWriteRepo, saved map[eh.ID]struct{}, events []eh.Event, position int64) (int64, error) {
+	// Removed models are kept as nil until saved.
+	models := map[eh.ID]eh.Entity{}
+	save := func() error {
+		for id, entity := range models {
+			var err error
+			if entity != nil {
+				err = repo.Save(ctx, entity)
+				saved[id] = struct{}{}
+			} else if err = repo.Remove(ctx, id); err != nil {
+				// Models that were created and removed in the same batch
+				// have never been saved.
+				if rrErr, ok := err.(eh.RepoError); ok && rrErr.Err == eh.ErrEntityNotFound {
+					err = nil
+				}
+			}
+			if err != nil {
+				return Error{
+					Err:       err,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			if entity == nil {
+				delete(saved, id)
+			}
+		}
+		models = map[eh.ID]eh.Entity{}
+		return nil
+	}
+
+	for _, event := range events {
+		e, ok := event.(eh.PositionedEvent)
+		if !ok {
+			return position, Error{
+				Err:       ErrMissingPosition,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		if !h.matches(event) {
+			position = e.Position()
+			continue
+		}
+
+		for _, id := range h.keys(event) {
+			entity, inBatch := models[id]
+			_, isSaved := saved[id]
+			if !inBatch && isSaved {
+				var err error
+				if entity, err = h.findOrCreate(ctx, repo, id); err != nil {
+					return position, err
+				}
+			} else if entity == nil {
+				if h.factoryFn == nil {
+					return position, Error{
+						Err:       ErrModelNotSet,
+						Namespace: eh.NamespaceFromContext(ctx),
+					}
+				}
+				entity = h.factoryFn()
+			}
+
+			newEntity, err := h.project(h.keyContext(ctx, id), event, entity)
+			if err != nil {
+				return position, err
+			}
+			models[id] = newEntity
+		}
+		position = e.Position()
+
+		if len(models) >= h.batchSize {
+			if err := save(); err != nil {
+				return position, err
+			}
+		}
+	}
+
+	return position, save()
+}
+
+// rebuilt returns true if the event has already been projected by a rebuild,
+// and should be skipped.
+func (h *EventHandler) rebuilt(ctx context.Context, event eh.Event) bool {
+	h.rebuildsMu.Lock()
+	defer h.rebuildsMu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	r, ok := h.rebuilds[ns]
+	if !ok {
+		return false
+	}
+	if r.handled == nil && time.Now().After(r.skipUntil) {
+		delete(h.rebuilds, ns)
+		return false
+	}
+	key := eventKey{event.AggregateID(), event.Version()}
+	if _, ok := r.skip[key]; !ok {
+		return false
+	}
+	delete(r.skip, key)
+	if len(r.skip) == 0 && r.handled == nil {
+		delete(h.rebuilds, ns)
+	}
+	return true
+}
+
+// handled records an event handled while rebuilding.
+func (h *EventHandler) handled(ctx context.Context, event eh.Event) {
+	h.rebuildsMu.Lock()
+	defer h.rebuildsMu.Unlock()
+
+	if r, ok := h.rebuilds[eh.NamespaceFromContext(ctx)]; ok && r.handled != nil {
+		r.handled[eventKey{event.AggregateID(), event.Version()}] = struct{}{}
+	}
+}
+
+// matches returns true if the event should be projected when rebuilding.
+func (h *EventHandler) matches(event eh.Event) bool {
+	return h.matcher == nil || h.matcher(event)
+}
+
+// eventKeys returns the keys of the events that are projected when rebuilding.
+func (h *EventHandler) eventKeys(events []eh.Event) []eventKey {
+	keys := make([]eventKey, 0, len(events))
+	for _, event := range events {
+		if h.matches(event) {
+			keys = append(keys, eventKey{event.AggregateID(), event.Version()})
+		}
+	}
+	return keys
+}
+
+// pause returns the lock that is held for reading while handling events in a
+// namespace, and for writing while a rebuild pauses the handling.
+func (h *EventHandler) pause(ns string) *sync.RWMutex {
+	h.rebuildsMu.Lock()
+	defer h.rebuildsMu.Unlock()
+
+	l, ok := h.pauses[ns]
+	if !ok {
+		l = &sync.RWMutex{}
+		h.pauses[ns] = l
+	}
+	return l
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package projector_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventhandler/projector"
+	"github.com/looplab/eventhorizon/eventstore/memory"
+	"github.com/looplab/eventhorizon/mocks"
+	repo "github.com/looplab/eventhorizon/repo/memory"
+	"github.com/looplab/eventhorizon/repo/swap"
+)
+
+func Test_EventHandler_Rebuild(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewEventStore()
+	id1, id2, id3 := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	saveEvent(t, ctx, store, id1, 1, mocks.EventType, "a")
+	saveEvent(t, ctx, store, id2, 1, mocks.EventType, "b")
+	saveEvent(t, ctx, store, id1, 2, mocks.EventType, "c")
+	saveEvent(t, ctx, store, id3, 1, mocks.EventType, "d")
+	saveEvent(t, ctx, store, id3, 2, mocks.EventOtherType, "")
+
+	// The live repo has a stale model.
+	oldRepo := repo.NewRepo()
+	if err := oldRepo.Save(ctx, &mocks.Model{ID: id1, Version: 2, Content: "stale"}); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	liveRepo := swap.NewRepo(oldRepo)
+	handler := projector.NewEventHandler(&ContentProjector{}, liveRepo)
+	handler.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	handler.SetRebuildBatchSize(1)
+
+	newRepo := repo.NewRepo()
+	if err := handler.Rebuild(ctx, store, newRepo); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if liveRepo.Parent() != oldRepo {
+		t.Error("the original repo should not be changed")
+	}
+	assertModel(t, ctx, liveRepo, id1, 2, "ac")
+	assertModel(t, ctx, liveRepo, id2, 1, "b")
+	if _, err := liveRepo.Find(ctx, id3); err == nil {
+		t.Error("the removed model should not be found")
+	}
+	if _, err := newRepo.Find(ctx, id1); err != nil {
+		t.Error("the model should be in the new repo:", err)
+	}
+
+	// New events are handled into the new repo.
+	event := saveEvent(t, ctx, store, id2, 2, mocks.EventType, "e")
+	if err := handler.HandleEvent(ctx, event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertModel(t, ctx, newRepo, id2, 2, "be")
+
+	// A rebuild needs a swap repo.
+	handler = projector.NewEventHandler(&ContentProjector{}, repo.NewRepo())
+	err := handler.Rebuild(ctx, store, repo.NewRepo())
+	if pErr, ok := err.(projector.Error); !ok || pErr.Err != projector.ErrNoSwapRepo {
+		t.Error("there should be a no swap repo error:", err)
+	}
+}
+
+func Test_EventHandler_RebuildMatcher(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewEventStore()
+	id := uuid.New().String()
+	saveEvent(t, ctx, store, id, 1, mocks.EventType, "a")
+	saveEvent(t, ctx, store, id, 2, mocks.EventOtherType, "")
+
+	liveRepo := swap.NewRepo(repo.NewRepo())
+	handler := projector.NewEventHandler(&ContentProjector{}, liveRepo)
+	handler.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	handler.SetRebuildMatcher(eh.MatchEvent(mocks.EventType))
+
+	// Only matching events are projected, the model is not removed.
+	if err := handler.Rebuild(ctx, store, repo.NewRepo()); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	assertModel(t, ctx, liveRepo, id, 1, "a")
+}
+
+func Test_EventHandler_RebuildCatchUp(t *testing.T) {
+	ctx := context.Background()
+	store := &concurrentStore{EventStore: memory.NewEventStore()}
+	id := uuid.New().String()
+	liveRepo := swap.NewRepo(repo.NewRepo())
+	handler := projector.NewEventHandler(&ContentProjector{}, liveRepo)
+	handler.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	// Catch up in batches of one event.
+	handler.SetRebuildBatchSize(1)
+
+	event1 := saveEvent(t, ctx, store, id, 1, mocks.EventType, "a")
+	if err := handler.HandleEvent(ctx, event1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// Events are saved while rebuilding, one is handled before the rebuild
+	// catches up and one after.
+	var event2, event3 eh.Event
+	store.onLoadFrom = func() {
+		event2 = saveEvent(t, ctx, store.EventStore, id, 2, mocks.EventType, "b")
+		if err := handler.HandleEvent(ctx, event2); err != nil {
+			t.Error("there should be no error:", err)
+		}
+		event3 = saveEvent(t, ctx, store.EventStore, id, 3, mocks.EventType, "c")
+	}
+	if err := handler.Rebuild(ctx, store, repo.NewRepo()); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	assertModel(t, ctx, liveRepo, id, 3, "abc")
+
+	// The event projected by the rebuild is skipped.
+	if err := handler.HandleEvent(ctx, event3); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertModel(t, ctx, liveRepo, id, 3, "abc")
+
+	event4 := saveEvent(t, ctx, store, id, 4, mocks.EventType, "d")
+	if err := handler.HandleEvent(ctx, event4); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertModel(t, ctx, liveRepo, id, 4, "abcd")
+}
+
+func Test_EventHandler_RebuildIfNeeded(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewEventStore()
+	id := uuid.New().String()
+	saveEvent(t, ctx, store, id, 1, mocks.EventType, "a")
+
+	// One repo per version.
+	repos := map[int]eh.ReadWriteRepo{}
+	repoFn := func(version int) eh.ReadWriteRepo {
+		if _, ok := repos[version]; !ok {
+			repos[version] = repo.NewRepo()
+		}
+		return repos[version]
+	}
+
+	proj := &ContentProjector{version: 1}
+	parent := repo.NewRepo()
+	liveRepo := swap.NewRepo(parent)
+	handler := projector.NewEventHandler(proj, liveRepo)
+	handler.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	versions := projector.NewRepoVersionStore(repo.NewRepo())
+
+	rebuilt, err := handler.RebuildIfNeeded(ctx, store, versions, repoFn)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !rebuilt {
+		t.Error("the models should be rebuilt")
+	}
+	if v, _ := versions.ProjectorVersion(ctx, proj.ProjectorType()); v != 1 {
+		t.Error("the version should be saved:", v)
+	}
+	assertModel(t, ctx, repos[1], id, 1, "a")
+
+	// The rebuilt repo is used after a restart.
+	liveRepo = swap.NewRepo(parent)
+	handler = projector.NewEventHandler(proj, liveRepo)
+	handler.SetEntityFactory(func() eh.Entity { return &mocks.Model{} })
+	rebuilt, err = handler.RebuildIfNeeded(ctx, store, versions, repoFn)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if rebuilt {
+		t.Error("the models should not be rebuilt for the same version")
+	}
+	assertModel(t, ctx, liveRepo, id, 1, "a")
+
+	// The repo is not swapped if the version can't be saved.
+	proj.version = 2
+	failing := &failingVersionStore{VersionStore: versions}
+	_, err = handler.RebuildIfNeeded(ctx, store, failing, repoFn)
+	if pErr, ok := err.(projector.Error); !ok || pErr.Err != errSaveVersion {
+		t.Error("there should be a version store error:", err)
+	}
+	event := saveEvent(t, ctx, store, id, 2, mocks.EventType, "b")
+	if err := handler.HandleEvent(ctx, event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertModel(t, ctx, repos[1], id, 2, "ab")
+
+	rebuilt, err = handler.RebuildIfNeeded(ctx, store, versions, repoFn)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !rebuilt {
+		t.Error("the models should be rebuilt for a new version")
+	}
+	assertModel(t, ctx, liveRepo, id, 2, "ab")
+
+	// Versions are kept per namespace.
+	otherCtx := eh.NewContextWithNamespace(context.Background(), "other")
+	if v, _ := versions.ProjectorVersion(otherCtx, proj.ProjectorType()); v != 0 {
+		t.Error("there should be no version in the other namespace:", v)
+	}
+}
+
+var errSaveVersion = errors.New("could not save version")
+
+// failingVersionStore fails to save versions.
+type failingVersionStore struct {
+	projector.VersionStore
+}
+
+func (s *failingVersionStore) SaveProjectorVersion(ctx context.Context, t projector.Type, version int) error {
+	return errSaveVersion
+}
+
+func saveEvent(t *testing.T, ctx context.Context, store eh.EventStore, id eh.ID, version int, eventType eh.EventType, content string) eh.Event {
+	event := eh.NewEventForAggregate(eventType, &mocks.EventData{Content: content},
+		time.Now(), mocks.AggregateType, id, version)
+	if err := store.Save(ctx, []eh.Event{event}, version-1); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	return event
+}
+
+func assertModel(t *testing.T, ctx context.Context, r eh.ReadRepo, id eh.ID, version int, content string) {
+	entity, err := r.Find(ctx, id)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	model, ok := entity.(*mocks.Model)
+	if !ok || model.Version != version || model.Content != content {
+		t.Error("the model should be correct:", entity)
+	}
+}
+
+// ContentProjector appends the content of events to the model, and removes
+// the model on other events.
+type ContentProjector struct {
+	version int
+}
+
+func (p *ContentProjector) ProjectorType() projector.Type {
+	return "ContentProjector"
+}
+
+func (p *ContentProjector) ProjectorVersion() int {
+	return p.version
+}
+
+func (p *ContentProjector) Project(ctx context.Context, event eh.Event, entity eh.Entity) (eh.Entity, error) {
+	if event.EventType() == mocks.EventOtherType {
+		return nil, nil
+	}
+	model := entity.(*mocks.Model)
+	model.ID = event.AggregateID()
+	model.Version = event.Version()
+	model.Content += event.Data().(*mocks.EventData).Content
+	return model, nil
+}
+
+// concurrentStore calls a func after the first load of events, to simulate
+// events saved while rebuilding. All events must be loaded in batches.
+type concurrentStore struct {
+	*memory.EventStore
+	onLoadFrom func()
+}
+
+func (s *concurrentStore) LoadAll(ctx context.Context, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	return nil, errors.New("all events should not be loaded at once")
+}
+
+func (s *concurrentStore) LoadFrom(ctx context.Context, position int64, limit int, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	events, err := s.EventStore.LoadFrom(ctx, position, limit, aggregateTypes...)
+	if s.onLoadFrom != nil {
+		s.onLoadFrom()
+		s.onLoadFrom = nil
+	}
+	return events, err
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package projector
+
+import (
+	"context"
+	"errors"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidVersion is when a repo returns an entity that is not a Version.
+var ErrInvalidVersion = errors.New("invalid projector version")
+
+// VersionedProjector is a projector with a version, which should be increased
+// when the projection changes to rebuild the models with
+// EventHandler.RebuildIfNeeded.
+type VersionedProjector interface {
+	Projector
+
+	// ProjectorVersion returns the version of the projector.
+	ProjectorVersion() int
+}
+
+// VersionStore is a store of the versions of projectors that the models were
+// last built with, with one version per projector type and namespace. The
+// version also selects the repo of the models used by EventHandler.RebuildIfNeeded.
+type VersionStore interface {
+	// ProjectorVersion returns the version of a projector, or 0 if the models
+	// have never been built by a VersionedProjector.
+	ProjectorVersion(context.Context, Type) (int, error)
+
+	// SaveProjectorVersion saves the version of a projector.
+	SaveProjectorVersion(context.Context, Type, int) error
+}
+
+// Version is the entity saved by a RepoVersionStore.
+type Version struct {
+	ProjectorType Type `json:"id"      bson:"_id"`
+	Version       int  `json:"version" bson:"version"`
+}
+
+var _ = eh.Entity(&Version{})
+
+// EntityID implements the EntityID method of the eventhorizon.Entity interface.
+func (v *Version) EntityID() eh.ID {
+	return eh.ID(v.ProjectorType)
+}
+
+// RepoVersionStore is a VersionStore that saves the versions as entities in a
+// read repository, which should not be the repository of the models. Repos
+// that need an entity factory must create *Version entities:
+//   repo.SetEntityFactory(func() eh.Entity { return &projector.Version{} })
+type RepoVersionStore struct {
+	repo eh.ReadWriteRepo
+}
+
+var _ = VersionStore(&RepoVersionStore{})
+
+// NewRepoVersionStore creates a new RepoVersionStore.
+func NewRepoVersionStore(repo eh.ReadWriteRepo) *RepoVersionStore {
+	if repo == nil {
+		return nil
+	}
+
+	return &RepoVersionStore{
+		repo: repo,
+	}
+}
+
+// ProjectorVersion implements the ProjectorVersion method of the VersionStore interface.
+func (s *RepoVersionStore) ProjectorVersion(ctx context.Context, t Type) (int, error) {
+	entity, err := s.repo.Find(ctx, eh.ID(t))
+	if rrErr, ok := err.(eh.RepoError); ok && rrErr.Err == eh.ErrEntityNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	v, ok := entity.(*Version)
+	if !ok {
+		return 0, eh.RepoError{
+			Err:       ErrInvalidVersion,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return v.Version, nil
+}
+
+// SaveProjectorVersion implements the SaveProjectorVersion method of the VersionStore interface.
+func (s *RepoVersionStore) SaveProjectorVersion(ctx context.Context, t Type, version int) error {
+	return s.repo.Save(ctx, &Version{
+		ProjectorType: t,
+		Version:       version,
+	})
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saga
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jpillora/backoff"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// DefaultMaxAttempts is the default number of times to try a command with a
+// transient error.
+const DefaultMaxAttempts = 3
+
+// StatusEvent is the event published with the outcome of a saga, when it has
+// handled commands for an event.
+const StatusEvent = eh.EventType("SagaStatus")
+
+func init() {
+	eh.RegisterEventData(StatusEvent, func() eh.EventData {
+		return &StatusData{}
+	})
+}
+
+// Status is the final status of a saga for an event.
+type Status string
+
+const (
+	// StatusCompleted is when all commands were handled.
+	StatusCompleted Status = "completed"
+	// StatusCompensated is when a command failed and the compensations of
+	// the earlier commands were handled.
+	StatusCompensated Status = "compensated"
+	// StatusFailed is when a command failed and a compensation also failed.
+	StatusFailed Status = "failed"
+)
+
+// StatusData is the event data of a StatusEvent.
+type StatusData struct {
+	SagaType  Type         `json:"saga_type"  bson:"saga_type"`
+	EventType eh.EventType `json:"event_type" bson:"event_type"`
+	Status    Status       `json:"status"     bson:"status"`
+	Steps     []StepResult `json:"steps"      bson:"steps"`
+}
+
+// StepResult is the outcome of handling a command, or a compensation.
+type StepResult struct {
+	CommandType  eh.CommandType `json:"command_type"  bson:"command_type"`
+	AggregateID  eh.ID          `json:"aggregate_id"  bson:"aggregate_id"`
+	Compensation bool           `json:"compensation"  bson:"compensation"`
+	Attempts     int            `json:"attempts"      bson:"attempts"`
+	Err          string         `json:"err,omitempty" bson:"err,omitempty"`
+}
+
+// CompensatedCommand is a command with a compensating command, which undoes
+// the command if a later command of the saga fails. Commands can implement it
+// directly, or be wrapped with CommandWithCompensation.
+type CompensatedCommand interface {
+	eh.Command
+
+	// Compensation returns the compensating command.
+	Compensation() eh.Command
+}
+
+// CommandWithCompensation returns a wrapped command with a compensating command
+// set. Only the wrapped command is handled by the command handler.
+func CommandWithCompensation(cmd, compensation eh.Command) CompensatedCommand {
+	return &command{Command: cmd, compensation: compensation}
+}
+
+// private implementation to wrap ordinary commands and add a compensation.
+type command struct {
+	eh.Command
+	compensation eh.Command
+}
+
+// Compensation implements the Compensation method of the CompensatedCommand interface.
+func (c *command) Compensation() eh.Command {
+	return c.compensation
+}
+
+// SetRetry sets the number of times to try commands with transient errors,
+// and the min and max delay between the attempts.
+func (h *EventHandler) SetRetry(maxAttempts int, min, max time.Duration) {
+	h.maxAttempts = maxAttempts
+	h.backoff.Min = min
+	h.backoff.Max = max
+}
+
+// SetRetryable sets a func that returns true for transient errors that should
+// be retried, the default is IsTransient.
+func (h *EventHandler) SetRetryable(f func(error) bool) {
+	h.retryable = f
+}
+
+// SetEventBus sets an event bus to publish StatusEvents on.
+func (h *EventHandler) SetEventBus(bus eh.EventBus) {
+	h.bus = bus
+}
+
+// IsTransient returns true for version conflicts and errors with a Temporary
+// method that returns true.
+func IsTransient(err error) bool {
+	if t, ok := err.(interface{ Temporary() bool }); ok && t.Temporary() {
+		return true
+	}
+	return eh.IsVersionConflict(err)
+}
+
+// handleCommand handles a command, retrying transient errors.
+func (h *EventHandler) handleCommand(ctx context.Context, cmd eh.Command, compensation bool) (StepResult, error) {
+	result := StepResult{
+		CommandType:  cmd.CommandType(),
+		AggregateID:  cmd.AggregateID(),
+		Compensation: compensation,
+	}
+
+	// Use a backoff per command, as it is not safe for concurrent use.
+	delay := h.backoff
+	for {
+		result.Attempts++
+		err := h.commandHandler.HandleCommand(ctx, cmd)
+		if err == nil {
+			return result, nil
+		} else if !h.retryable(err) || result.Attempts >= h.maxAttempts {
+			result.Err = err.Error()
+			return result, err
+		}
+
+		select {
+		case <-time.After(delay.Duration()):
+		case <-ctx.Done():
+			result.Err = ctx.Err().Error()
+			return result, ctx.Err()
+		}
+	}
+}
+
+// publishStatus publishes the status of the saga, if there is an event bus.
+// Errors are sent on the error channel.
+func (h *EventHandler) publishStatus(ctx context.Context, event eh.Event, status Status, steps []StepResult) {
+	if h.bus == nil {
+		return
+	}
+
+	statusEvent := eh.NewEvent(StatusEvent, &StatusData{
+		SagaType:  h.saga.SagaType(),
+		EventType: event.EventType(),
+		Status:    status,
+		Steps:     steps,
+	}, time.Now(), eh.WithMetadata(eh.MetadataFromContext(ctx)),
+		eh.WithMetadata(map[string]interface{}{
+			eh.EventIDMetadataKey: uuid.New().String(),
+		}))
+	if err := h.bus.PublishEvent(ctx, statusEvent); err != nil {
+		select {
+		case h.errCh <- Error{
+			Err:      err,
+			SagaType: h.saga.SagaType(),
+			Status:   status,
+		}:
+		default:
+		}
+	}
+}
+
+var defaultBackoff = backoff.Backoff{
+	Min:    10 * time.Millisecond,
+	Max:    time.Second,
+	Jitter: true,
+}
@@ -16,7 +16,8 @@ package saga
 
 import (
 	"context"
-	"errors"
+
+	"github.com/jpillora/backoff"
 
 	eh "github.com/looplab/eventhorizon"
 )
@@ -25,6 +26,11 @@ import (
 type EventHandler struct {
 	saga           Saga
 	commandHandler eh.CommandHandler
+	bus            eh.EventBus
+	maxAttempts    int
+	backoff        backoff.Backoff
+	retryable      func(error) bool
+	errCh          chan Error
 }
 
 var _ = eh.EventHandler(&EventHandler{})
@@ -36,7 +42,9 @@ type Saga interface {
 	// SagaType returns the type of the saga.
 	SagaType() Type
 
-	// RunSaga handles an event in the saga that can return commands.
+	// RunSaga handles an event in the saga that can return commands. Commands
+	// can be wrapped with CommandWithCompensation to be compensated if a later
+	// command fails.
 	RunSaga(context.Context, eh.Event) []eh.Command
 }
 
@@ -48,6 +56,10 @@ func NewEventHandler(saga Saga, commandHandler eh.CommandHandler) *EventHandler
 	return &EventHandler{
 		saga:           saga,
 		commandHandler: commandHandler,
+		maxAttempts:    DefaultMaxAttempts,
+		backoff:        defaultBackoff,
+		retryable:      IsTransient,
+		errCh:          make(chan Error, 100),
 	}
 }
 
@@ -57,18 +69,90 @@ func (h *EventHandler) HandlerType() eh.EventHandlerType {
 }
 
 // HandleEvent implements the HandleEvent method of the eventhorizon.EventHandler interface.
+// The commands are handled in order, retrying transient errors. If a command
+// fails the compensations of the earlier commands are handled in reverse order
+// and the error is returned. The outcome is published as a StatusEvent, errors
+// from publishing it are sent on the Errors channel.
 func (h *EventHandler) HandleEvent(ctx context.Context, event eh.Event) error {
 	// Run the saga and collect commands.
 	cmds := h.saga.RunSaga(ctx, event)
+	if len(cmds) == 0 {
+		return nil
+	}
 
-	// Dispatch commands back on the command bus.
+	// Dispatch commands back on the command bus, with the correlation and
+	// causation taken from the event.
+	ctx = eh.NewContextWithCausingEvent(ctx, event)
+	steps := make([]StepResult, 0, len(cmds))
+	var compensations []eh.Command
 	for _, cmd := range cmds {
-		if err := h.commandHandler.HandleCommand(ctx, cmd); err != nil {
-			return errors.New("could not handle command '" +
-				string(cmd.CommandType()) + "' from saga '" +
-				string(h.saga.SagaType()) + "': " + err.Error())
+		var compensation eh.Command
+		if c, ok := cmd.(CompensatedCommand); ok {
+			compensation = c.Compensation()
+		}
+		// Only the wrapped command of CommandWithCompensation is handled.
+		if c, ok := cmd.(*command); ok {
+			cmd = c.Command
+		}
+
+		step, err := h.handleCommand(ctx, cmd, false)
+		steps = append(steps, step)
+		if err != nil {
+			status := StatusCompensated
+			for i := len(compensations) - 1; i >= 0; i-- {
+				step, cErr := h.handleCommand(ctx, compensations[i], true)
+				steps = append(steps, step)
+				if cErr != nil {
+					status = StatusFailed
+				}
+			}
+
+			h.publishStatus(ctx, event, status, steps)
+			return Error{
+				Err:      err,
+				SagaType: h.saga.SagaType(),
+				Command:  cmd,
+				Status:   status,
+			}
+		}
+
+		if compensation != nil {
+			compensations = append(compensations, compensation)
 		}
 	}
 
+	h.publishStatus(ctx, event, StatusCompleted, steps)
+
 	return nil
 }
+
+// Errors returns an error channel where errors from publishing the status are
+// sent. The commands have been handled when the status could not be published,
+// so the event is not failed. Errors are dropped if the channel is full.
+func (h *EventHandler) Errors() <-chan Error {
+	return h.errCh
+}
+
+// Error is an error in a saga, with the command that failed, if any.
+type Error struct {
+	// Err is the error.
+	Err error
+	// SagaType is the type of the saga.
+	SagaType Type
+	// Command is the command that failed, nil if the status could not be
+	// published.
+	Command eh.Command
+	// Status is the final status of the saga.
+	Status Status
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e Error) Error() string {
+	if e.Command == nil {
+		return "could not publish status from saga '" +
+			string(e.SagaType) + "': " + e.Err.Error()
+	}
+	return "could not handle command '" +
+		string(e.Command.CommandType()) + "' from saga '" +
+		string(e.SagaType) + "': " + e.Err.Error()
+}
@@ -16,6 +16,7 @@ package saga_test
 
 import (
 	"context"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -23,6 +24,7 @@ import (
 	"github.com/google/uuid"
 	eh "github.com/looplab/eventhorizon"
 	"github.com/looplab/eventhorizon/eventhandler/saga"
+	"github.com/looplab/eventhorizon/middleware/commandhandler/dedup"
 	"github.com/looplab/eventhorizon/mocks"
 )
 
@@ -38,8 +40,12 @@ func Test_EventHandler(t *testing.T) {
 	id := uuid.New().String()
 	eventData := &mocks.EventData{Content: "event1"}
 	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	eventID := uuid.New().String()
 	event := eh.NewEventForAggregate(mocks.EventType, eventData, timestamp,
-		mocks.AggregateType, id, 1)
+		mocks.AggregateType, id, 1, eh.WithMetadata(map[string]interface{}{
+			eh.EventIDMetadataKey:       eventID,
+			eh.CorrelationIDMetadataKey: "correlation",
+		}))
 	sg.commands = []eh.Command{&mocks.Command{ID: uuid.New().String(), Content: "content"}}
 	handler.HandleEvent(ctx, event)
 	if sg.event != event {
@@ -48,6 +54,189 @@ func Test_EventHandler(t *testing.T) {
 	if !reflect.DeepEqual(commandHandler.Commands, sg.commands) {
 		t.Error("the produced commands should be correct:", commandHandler.Commands)
 	}
+	if id, _ := eh.CorrelationIDFromContext(commandHandler.Context); id != "correlation" {
+		t.Error("the correlation ID should be propagated:", id)
+	}
+	if id, _ := eh.CausationIDFromContext(commandHandler.Context); id != eventID {
+		t.Error("the causation ID should be the event ID:", id)
+	}
+}
+
+func Test_EventHandler_Dedup(t *testing.T) {
+	handled := 0
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		handled++
+		return nil
+	})
+	commandHandler := eh.UseCommandHandlerMiddleware(inner,
+		dedup.NewMiddleware(dedup.NewMemoryStore()))
+	sg := &TestSaga{}
+	handler := saga.NewEventHandler(sg, commandHandler)
+
+	// The command ID of the command that caused the event, for example from
+	// an Idempotency-Key header, should not be used for the saga's commands.
+	ctx := eh.NewContextWithCommandID(context.Background(), uuid.New().String())
+
+	id := uuid.New().String()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	event := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1, eh.WithMetadata(map[string]interface{}{
+			eh.EventIDMetadataKey: uuid.New().String(),
+		}))
+	sg.commands = []eh.Command{
+		mocks.Command{ID: uuid.New().String(), Content: "content1"},
+		mocks.Command{ID: uuid.New().String(), Content: "content2"},
+	}
+	if err := handler.HandleEvent(ctx, event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if handled != 2 {
+		t.Error("both commands should have been handled:", handled)
+	}
+}
+
+func Test_EventHandler_Compensation(t *testing.T) {
+	var handled []string
+	failErr := errors.New("command error")
+	attempts := map[string]int{}
+	commandHandler := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		if c, ok := cmd.(compensatedCommand); ok {
+			cmd = c.Command
+		}
+		content := cmd.(mocks.Command).Content
+		attempts[content]++
+		switch {
+		case content == "fail":
+			return failErr
+		case content == "flaky" && attempts[content] == 1:
+			return eh.EventStoreError{Err: eh.ErrVersionConflict}
+		}
+		handled = append(handled, content)
+		return nil
+	})
+	sg := &TestSaga{}
+	handler := saga.NewEventHandler(sg, commandHandler)
+	handler.SetRetry(2, time.Millisecond, time.Millisecond)
+	bus := &mocks.EventBus{}
+	handler.SetEventBus(bus)
+
+	ctx := context.Background()
+	id := uuid.New().String()
+	event := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		time.Now(), mocks.AggregateType, id, 1, eh.WithMetadata(map[string]interface{}{
+			eh.CorrelationIDMetadataKey: "correlation",
+		}))
+
+	// All commands are handled, with the transient error retried.
+	sg.commands = []eh.Command{
+		saga.CommandWithCompensation(mocks.Command{ID: id, Content: "a"}, mocks.Command{ID: id, Content: "undo a"}),
+		saga.CommandWithCompensation(mocks.Command{ID: id, Content: "flaky"}, mocks.Command{ID: id, Content: "undo flaky"}),
+	}
+	if err := handler.HandleEvent(ctx, event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(handled, []string{"a", "flaky"}) {
+		t.Error("the commands should be handled:", handled)
+	}
+	assertStatus(t, bus, saga.StatusCompleted, []saga.StepResult{
+		{CommandType: mocks.CommandType, AggregateID: id, Attempts: 1},
+		{CommandType: mocks.CommandType, AggregateID: id, Attempts: 2},
+	})
+	if id, ok := bus.Events[0].Metadata()[eh.CorrelationIDMetadataKey]; !ok || id != "correlation" {
+		t.Error("the status event should have the correlation ID:", id)
+	}
+
+	// A failed command is compensated in reverse order, without retrying.
+	handled = nil
+	attempts = map[string]int{}
+	bus.Events = nil
+	sg.commands = append(sg.commands, mocks.Command{ID: id, Content: "fail"})
+	err := handler.HandleEvent(ctx, event)
+	if sErr, ok := err.(saga.Error); !ok || sErr.Err != failErr || sErr.Status != saga.StatusCompensated {
+		t.Error("there should be a command error:", err)
+	}
+	if !reflect.DeepEqual(handled, []string{"a", "flaky", "undo flaky", "undo a"}) {
+		t.Error("the commands should be compensated:", handled)
+	}
+	assertStatus(t, bus, saga.StatusCompensated, []saga.StepResult{
+		{CommandType: mocks.CommandType, AggregateID: id, Attempts: 1},
+		{CommandType: mocks.CommandType, AggregateID: id, Attempts: 2},
+		{CommandType: mocks.CommandType, AggregateID: id, Attempts: 1, Err: failErr.Error()},
+		{CommandType: mocks.CommandType, AggregateID: id, Attempts: 1, Compensation: true},
+		{CommandType: mocks.CommandType, AggregateID: id, Attempts: 1, Compensation: true},
+	})
+
+	// A failed compensation fails the saga.
+	bus.Events = nil
+	sg.commands = []eh.Command{
+		saga.CommandWithCompensation(mocks.Command{ID: id, Content: "a"}, mocks.Command{ID: id, Content: "fail"}),
+		mocks.Command{ID: id, Content: "fail"},
+	}
+	err = handler.HandleEvent(ctx, event)
+	if sErr, ok := err.(saga.Error); !ok || sErr.Status != saga.StatusFailed {
+		t.Error("there should be a failed error:", err)
+	}
+	if len(bus.Events) != 1 || bus.Events[0].Data().(*saga.StatusData).Status != saga.StatusFailed {
+		t.Error("the status should be failed:", bus.Events)
+	}
+
+	// Commands implementing CompensatedCommand are compensated.
+	handled = nil
+	bus.Events = nil
+	sg.commands = []eh.Command{
+		compensatedCommand{mocks.Command{ID: id, Content: "b"}, mocks.Command{ID: id, Content: "undo b"}},
+		mocks.Command{ID: id, Content: "fail"},
+	}
+	err = handler.HandleEvent(ctx, event)
+	if sErr, ok := err.(saga.Error); !ok || sErr.Status != saga.StatusCompensated {
+		t.Error("there should be a compensated error:", err)
+	}
+	if !reflect.DeepEqual(handled, []string{"b", "undo b"}) {
+		t.Error("the command should be compensated:", handled)
+	}
+
+	// A status that could not be published is reported without failing the event.
+	handled = nil
+	bus.Events = nil
+	busErr := errors.New("bus error")
+	bus.Err = busErr
+	sg.commands = []eh.Command{mocks.Command{ID: id, Content: "a"}}
+	if err := handler.HandleEvent(ctx, event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(handled, []string{"a"}) {
+		t.Error("the command should be handled:", handled)
+	}
+	select {
+	case err := <-handler.Errors():
+		if err.Err != busErr || err.Command != nil || err.Status != saga.StatusCompleted {
+			t.Error("there should be a status error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("there should be an error")
+	}
+}
+
+type compensatedCommand struct {
+	mocks.Command
+	undo eh.Command
+}
+
+func (c compensatedCommand) Compensation() eh.Command {
+	return c.undo
+}
+
+func assertStatus(t *testing.T, bus *mocks.EventBus, status saga.Status, steps []saga.StepResult) {
+	if len(bus.Events) != 1 || bus.Events[0].EventType() != saga.StatusEvent {
+		t.Fatal("there should be a status event:", bus.Events)
+	}
+	data, ok := bus.Events[0].Data().(*saga.StatusData)
+	if !ok || data.SagaType != TestSagaType || data.EventType != mocks.EventType || data.Status != status {
+		t.Error("the status should be correct:", data)
+	}
+	if !reflect.DeepEqual(data.Steps, steps) {
+		t.Error("the steps should be correct:", data.Steps)
+	}
 }
 
 const (
@@ -0,0 +1,135 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subscription
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrInvalidCheckpoint is when a repo returns an entity that is not a Checkpoint.
+var ErrInvalidCheckpoint = errors.New("invalid checkpoint")
+
+// CheckpointStore is a store of the positions of the last handled events of
+// subscriptions, with one position per subscription name and namespace.
+type CheckpointStore interface {
+	// Checkpoint returns the position of the last handled event, or 0 if no
+	// event has been handled.
+	Checkpoint(ctx context.Context, name string) (int64, error)
+
+	// SaveCheckpoint saves the position of the last handled event.
+	SaveCheckpoint(ctx context.Context, name string, position int64) error
+}
+
+// MemoryCheckpointStore is a CheckpointStore in memory, mainly useful for testing.
+type MemoryCheckpointStore struct {
+	// The outer map is with namespace as key, the inner with name.
+	checkpoints   map[string]map[string]int64
+	checkpointsMu sync.RWMutex
+}
+
+var _ = CheckpointStore(&MemoryCheckpointStore{})
+
+// NewMemoryCheckpointStore creates a new MemoryCheckpointStore.
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{
+		checkpoints: map[string]map[string]int64{},
+	}
+}
+
+// Checkpoint implements the Checkpoint method of the CheckpointStore interface.
+func (s *MemoryCheckpointStore) Checkpoint(ctx context.Context, name string) (int64, error) {
+	s.checkpointsMu.RLock()
+	defer s.checkpointsMu.RUnlock()
+
+	return s.checkpoints[eh.NamespaceFromContext(ctx)][name], nil
+}
+
+// SaveCheckpoint implements the SaveCheckpoint method of the CheckpointStore interface.
+func (s *MemoryCheckpointStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	s.checkpointsMu.Lock()
+	defer s.checkpointsMu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.checkpoints[ns]; !ok {
+		s.checkpoints[ns] = map[string]int64{}
+	}
+	s.checkpoints[ns][name] = position
+	return nil
+}
+
+// Checkpoint is the entity saved by a RepoCheckpointStore.
+type Checkpoint struct {
+	Name     string `json:"id"       bson:"_id"`
+	Position int64  `json:"position" bson:"position"`
+}
+
+var _ = eh.Entity(&Checkpoint{})
+
+// EntityID implements the EntityID method of the eventhorizon.Entity interface.
+func (c *Checkpoint) EntityID() eh.ID {
+	return c.Name
+}
+
+// RepoCheckpointStore is a CheckpointStore that saves the checkpoints as
+// entities in a read repository, for example a MongoDB repo. Repos that need
+// an entity factory must create *Checkpoint entities:
+//   repo.SetEntityFactory(func() eh.Entity { return &subscription.Checkpoint{} })
+type RepoCheckpointStore struct {
+	repo eh.ReadWriteRepo
+}
+
+var _ = CheckpointStore(&RepoCheckpointStore{})
+
+// NewRepoCheckpointStore creates a new RepoCheckpointStore.
+func NewRepoCheckpointStore(repo eh.ReadWriteRepo) *RepoCheckpointStore {
+	if repo == nil {
+		return nil
+	}
+
+	return &RepoCheckpointStore{
+		repo: repo,
+	}
+}
+
+// Checkpoint implements the Checkpoint method of the CheckpointStore interface.
+func (s *RepoCheckpointStore) Checkpoint(ctx context.Context, name string) (int64, error) {
+	entity, err := s.repo.Find(ctx, name)
+	if rrErr, ok := err.(eh.RepoError); ok && rrErr.Err == eh.ErrEntityNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	c, ok := entity.(*Checkpoint)
+	if !ok {
+		return 0, eh.RepoError{
+			Err:       ErrInvalidCheckpoint,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return c.Position, nil
+}
+
+// SaveCheckpoint implements the SaveCheckpoint method of the CheckpointStore interface.
+func (s *RepoCheckpointStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	return s.repo.Save(ctx, &Checkpoint{
+		Name:     name,
+		Position: position,
+	})
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subscription
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrMissingPosition is when the event store loads an event without a position.
+var ErrMissingPosition = errors.New("missing event position")
+
+// DefaultPollInterval is the default interval between reading new events from
+// the event store when no events are published on the bus.
+const DefaultPollInterval = time.Second
+
+// DefaultBatchSize is the default number of events to load from the event
+// store at a time.
+const DefaultBatchSize = 100
+
+// Subscription delivers all events of an event store to a handler in the order
+// they were saved, starting after the position of the last handled event which
+// is saved as a checkpoint. A new or restarted handler first catches up with
+// the historical events and then continues with new events as they are saved.
+//
+// Events published on the bus are only used to notice new events, which are
+// always read from the event store after the checkpoint. Live events are thus
+// handled in the same order as historical ones, even if the bus drops or
+// reorders events. The event store is also polled periodically, to handle
+// events that were not published. An event that becomes visible in the event
+// store after an event with a higher position has been handled is skipped,
+// which the event store must prevent as described for LoadFrom.
+//
+// The handler should not be added to the bus itself. Events are handled at
+// least once, as the handler can succeed before the checkpoint is saved.
+type Subscription struct {
+	store          eh.GlobalEventStore
+	bus            eh.EventBus
+	handler        eh.EventHandler
+	checkpoints    CheckpointStore
+	aggregateTypes []eh.AggregateType
+	pollInterval   time.Duration
+	maxBackoff     time.Duration
+	batchSize      int
+	errCh          chan Error
+
+	// Serializes catching up from the background and CatchUp.
+	catchUpMu sync.Mutex
+
+	// The running subscriptions, per namespace.
+	runners   map[string]*runner
+	runnersMu sync.Mutex
+	// If the notifier is added to the bus. Guarded by runnersMu.
+	notifying bool
+}
+
+type runner struct {
+	notify chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewSubscription creates a new Subscription for a handler, using the handler
+// type as the name of its checkpoint. If the bus is not nil the subscription
+// is added to it as an observer when started, to handle new events as soon as
+// they are published, and removed from it when closed.
+func NewSubscription(store eh.GlobalEventStore, bus eh.EventBus, handler eh.EventHandler, checkpoints CheckpointStore) *Subscription {
+	if store == nil || handler == nil || checkpoints == nil {
+		return nil
+	}
+
+	s := &Subscription{
+		store:        store,
+		bus:          bus,
+		handler:      handler,
+		checkpoints:  checkpoints,
+		pollInterval: DefaultPollInterval,
+		maxBackoff:   time.Minute,
+		batchSize:    DefaultBatchSize,
+		errCh:        make(chan Error, 100),
+		runners:      map[string]*runner{},
+	}
+	return s
+}
+
+// SetAggregateTypes sets the aggregate types to subscribe to, the default is
+// all aggregate types.
+func (s *Subscription) SetAggregateTypes(aggregateTypes ...eh.AggregateType) {
+	s.aggregateTypes = aggregateTypes
+}
+
+// SetPollInterval sets the interval between polling the event store for new
+// events, it is also the first delay before retrying after an error.
+func (s *Subscription) SetPollInterval(interval time.Duration) {
+	s.pollInterval = interval
+}
+
+// SetMaxBackoff sets the longest delay before retrying after repeated errors.
+func (s *Subscription) SetMaxBackoff(max time.Duration) {
+	s.maxBackoff = max
+}
+
+// SetBatchSize sets the number of events to load from the event store at a
+// time, the default is DefaultBatchSize.
+func (s *Subscription) SetBatchSize(size int) {
+	s.batchSize = size
+}
+
+// Errors returns an error channel where async errors are sent. Errors are
+// dropped if the channel is full.
+func (s *Subscription) Errors() <-chan Error {
+	return s.errCh
+}
+
+// Start starts handling events in the background for the namespace of the
+// context, until Close is called. It can be called once for each namespace.
+func (s *Subscription) Start(ctx context.Context) {
+	s.runnersMu.Lock()
+	defer s.runnersMu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.runners[ns]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(eh.NewContextWithNamespace(context.Background(), ns))
+	r := &runner{
+		notify: make(chan struct{}, 1),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	s.runners[ns] = r
+
+	if s.bus != nil && !s.notifying {
+		s.bus.AddObserver(eh.MatchAny(), &notifier{s})
+		s.notifying = true
+	}
+
+	go s.run(ctx, r)
+}
+
+// Close stops handling events in all namespaces and waits for the background
+// handling to finish. The subscription is removed from the bus, an error when
+// removing it is sent on the error channel.
+func (s *Subscription) Close() {
+	s.runnersMu.Lock()
+	runners := s.runners
+	s.runners = map[string]*runner{}
+	notifying := s.notifying
+	s.notifying = false
+	s.runnersMu.Unlock()
+
+	// Removed without holding the lock, as the bus can wait for the notifier.
+	if notifying {
+		if err := s.bus.RemoveHandler((&notifier{s}).HandlerType()); err != nil {
+			select {
+			case s.errCh <- Error{Err: err, Ctx: context.Background()}:
+			default:
+			}
+		}
+	}
+
+	for _, r := range runners {
+		r.cancel()
+		<-r.done
+	}
+}
+
+// CatchUp handles all events after the checkpoint in the namespace of the
+// context, saving the checkpoint after each event. The events are loaded in
+// batches. It stops at the first error, which leaves the checkpoint at the
+// last handled event.
+func (s *Subscription) CatchUp(ctx context.Context) error {
+	s.catchUpMu.Lock()
+	defer s.catchUpMu.Unlock()
+
+	name := string(s.handler.HandlerType())
+	position, err := s.checkpoints.Checkpoint(ctx, name)
+	if err != nil {
+		return Error{Err: err, Ctx: ctx}
+	}
+
+	for {
+		events, err := s.store.LoadFrom(ctx, position, s.batchSize, s.aggregateTypes...)
+		if err != nil {
+			return Error{Err: err, Ctx: ctx}
+		}
+
+		for _, event := range events {
+			select {
+			case <-ctx.Done():
+				return Error{Err: ctx.Err(), Ctx: ctx}
+			default:
+			}
+
+			e, ok := event.(eh.PositionedEvent)
+			if !ok {
+				return Error{Err: ErrMissingPosition, Ctx: ctx, Event: event}
+			}
+			if err := s.handler.HandleEvent(ctx, event); err != nil {
+				return Error{Err: err, Ctx: ctx, Event: event}
+			}
+			if err := s.checkpoints.SaveCheckpoint(ctx, name, e.Position()); err != nil {
+				return Error{Err: err, Ctx: ctx, Event: event}
+			}
+			position = e.Position()
+		}
+
+		// A partial batch, or all events without a limit, is the end.
+		if s.batchSize <= 0 || len(events) < s.batchSize {
+			return nil
+		}
+	}
+}
+
+func (s *Subscription) run(ctx context.Context, r *runner) {
+	defer close(r.done)
+
+	delay := &backoff.Backoff{
+		Min: s.pollInterval,
+		Max: s.maxBackoff,
+	}
+	for {
+		if err := s.CatchUp(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case s.errCh <- err.(Error):
+			default:
+			}
+
+			// Only retry after the backoff, ignoring notifications.
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay.Duration()):
+			}
+			continue
+		}
+		delay.Reset()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.notify:
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+// notifier is added to the bus to notify the running subscription of the
+// namespace when events are published.
+type notifier struct {
+	s *Subscription
+}
+
+// HandlerType implements the HandlerType method of the eventhorizon.EventHandler interface.
+func (n *notifier) HandlerType() eh.EventHandlerType {
+	return eh.EventHandlerType("subscription_" + string(n.s.handler.HandlerType()))
+}
+
+// HandleEvent implements the HandleEvent method of the eventhorizon.EventHandler interface.
+func (n *notifier) HandleEvent(ctx context.Context, event eh.Event) error {
+	n.s.runnersMu.Lock()
+	r, ok := n.s.runners[eh.NamespaceFromContext(ctx)]
+	n.s.runnersMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// Notifications are coalesced, as all new events are read when catching up.
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Error is an async error containing the error and the event, if any.
+type Error struct {
+	Err   error
+	Ctx   context.Context
+	Event eh.Event
+}
+
+// Error implements the Error method of the error interface.
+func (e Error) Error() string {
+	if e.Event == nil {
+		return fmt.Sprintf("could not handle events: %s", e.Err)
+	}
+	return fmt.Sprintf("could not handle event %s: %s", e.Event, e.Err)
+}
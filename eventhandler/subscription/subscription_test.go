@@ -0,0 +1,274 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subscription_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventbus/local"
+	"github.com/looplab/eventhorizon/eventhandler/subscription"
+	"github.com/looplab/eventhorizon/eventstore/memory"
+	"github.com/looplab/eventhorizon/mocks"
+	repo "github.com/looplab/eventhorizon/repo/memory"
+)
+
+func Test_NewSubscription(t *testing.T) {
+	s := subscription.NewSubscription(nil, nil, mocks.NewEventHandler("handler"),
+		subscription.NewMemoryCheckpointStore())
+	if s != nil {
+		t.Error("there should be no subscription:", s)
+	}
+
+	s = subscription.NewSubscription(memory.NewEventStore(), nil, mocks.NewEventHandler("handler"),
+		subscription.NewMemoryCheckpointStore())
+	if s == nil {
+		t.Error("there should be a subscription")
+	}
+}
+
+func Test_Subscription_CatchUp(t *testing.T) {
+	store := memory.NewEventStore()
+	checkpoints := subscription.NewMemoryCheckpointStore()
+	handler := mocks.NewEventHandler("handler")
+	handler.Recv = make(chan eh.Event, 100)
+	s := subscription.NewSubscription(store, nil, handler, checkpoints)
+	ctx := context.Background()
+
+	t.Log("catch up with historical events")
+	id1, id2 := uuid.New().String(), uuid.New().String()
+	events := saveEvents(t, ctx, store, nil, id1, 0, 2)
+	events = append(events, saveEvents(t, ctx, store, nil, id2, 0, 1)...)
+	if err := s.CatchUp(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertEvents(t, handler.Events, events)
+	position, err := checkpoints.Checkpoint(ctx, "handler")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if position != handler.Events[2].(eh.PositionedEvent).Position() {
+		t.Error("the checkpoint should be the last handled event:", position)
+	}
+
+	t.Log("only handle new events")
+	events = append(events, saveEvents(t, ctx, store, nil, id1, 2, 1)...)
+	if err := s.CatchUp(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertEvents(t, handler.Events, events)
+
+	t.Log("keep the checkpoint on errors")
+	handler.Err = errors.New("handler error")
+	saveEvents(t, ctx, store, nil, id2, 1, 1)
+	err = s.CatchUp(ctx)
+	if sErr, ok := err.(subscription.Error); !ok || sErr.Err != handler.Err {
+		t.Error("there should be a handler error:", err)
+	}
+	handler.Err = nil
+	if err := s.CatchUp(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(handler.Events) != 5 || handler.Events[4].AggregateID() != id2 {
+		t.Error("the failed event should be handled again:", handler.Events)
+	}
+
+	t.Log("filter by aggregate type")
+	handler = mocks.NewEventHandler("filtered")
+	s = subscription.NewSubscription(store, nil, handler, checkpoints)
+	s.SetAggregateTypes("OtherAggregate")
+	if err := s.CatchUp(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(handler.Events) != 0 {
+		t.Error("there should be no events:", handler.Events)
+	}
+}
+
+func Test_Subscription_CatchUpBatches(t *testing.T) {
+	store := memory.NewEventStore()
+	checkpoints := subscription.NewMemoryCheckpointStore()
+	handler := mocks.NewEventHandler("handler")
+	s := subscription.NewSubscription(store, nil, handler, checkpoints)
+	s.SetBatchSize(2)
+	ctx := context.Background()
+
+	// Both full and partial batches are handled.
+	events := saveEvents(t, ctx, store, nil, uuid.New().String(), 0, 5)
+	if err := s.CatchUp(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertEvents(t, handler.Events, events)
+	events = append(events, saveEvents(t, ctx, store, nil, uuid.New().String(), 0, 1)...)
+	if err := s.CatchUp(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertEvents(t, handler.Events, events)
+}
+
+func Test_Subscription_Live(t *testing.T) {
+	store := memory.NewEventStore()
+	bus := local.NewEventBus(nil)
+	checkpoints := subscription.NewMemoryCheckpointStore()
+	handler := newNamespaceHandler()
+	s := subscription.NewSubscription(store, bus, handler, checkpoints)
+	// Only published events should wake up the subscription.
+	s.SetPollInterval(time.Hour)
+
+	ctx := context.Background()
+	otherCtx := eh.NewContextWithNamespace(context.Background(), "other")
+	id := uuid.New().String()
+	events := saveEvents(t, ctx, store, nil, id, 0, 2)
+	otherEvents := saveEvents(t, otherCtx, store, nil, id, 0, 1)
+
+	t.Log("start with historical events")
+	s.Start(ctx)
+	s.Start(otherCtx)
+	handler.wait(t, 3)
+
+	t.Log("continue with live events")
+	events = append(events, saveEvents(t, ctx, store, bus, id, 2, 2)...)
+	otherEvents = append(otherEvents, saveEvents(t, otherCtx, store, bus, id, 1, 1)...)
+	handler.wait(t, 3)
+	s.Close()
+	assertEvents(t, handler.events[eh.DefaultNamespace], events)
+	assertEvents(t, handler.events["other"], otherEvents)
+
+	// The subscription is removed from the bus when closed.
+	notifierType := eh.EventHandlerType("subscription_" + string(handler.HandlerType()))
+	if err := bus.RemoveHandler(notifierType); err != eh.ErrHandlerNotFound {
+		t.Error("the subscription should be removed from the bus:", err)
+	}
+
+	t.Log("resume from the checkpoint after a restart")
+	events = saveEvents(t, ctx, store, nil, id, 4, 1)
+	handler = newNamespaceHandler()
+	s = subscription.NewSubscription(store, local.NewEventBus(nil), handler, checkpoints)
+	s.SetPollInterval(time.Hour)
+	s.Start(ctx)
+	handler.wait(t, 1)
+	s.Close()
+	assertEvents(t, handler.events[eh.DefaultNamespace], events)
+}
+
+func Test_RepoCheckpointStore(t *testing.T) {
+	if s := subscription.NewRepoCheckpointStore(nil); s != nil {
+		t.Error("there should be no store:", s)
+	}
+
+	s := subscription.NewRepoCheckpointStore(repo.NewRepo())
+	ctx := context.Background()
+	otherCtx := eh.NewContextWithNamespace(context.Background(), "other")
+
+	position, err := s.Checkpoint(ctx, "handler")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if position != 0 {
+		t.Error("there should be no checkpoint:", position)
+	}
+
+	if err := s.SaveCheckpoint(ctx, "handler", 3); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := s.SaveCheckpoint(ctx, "handler", 5); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	position, err = s.Checkpoint(ctx, "handler")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if position != 5 {
+		t.Error("the checkpoint should be correct:", position)
+	}
+
+	position, err = s.Checkpoint(otherCtx, "handler")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if position != 0 {
+		t.Error("there should be no checkpoint in the other namespace:", position)
+	}
+}
+
+func saveEvents(t *testing.T, ctx context.Context, store eh.EventStore, bus eh.EventBus, id eh.ID, version, n int) []eh.Event {
+	events := make([]eh.Event, n)
+	for i := range events {
+		events[i] = eh.NewEventForAggregate(mocks.EventType,
+			&mocks.EventData{Content: uuid.New().String()},
+			time.Now().UTC(), mocks.AggregateType, id, version+i+1)
+	}
+	if err := store.Save(ctx, events, version); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if bus != nil {
+		for _, e := range events {
+			if err := bus.PublishEvent(ctx, e); err != nil {
+				t.Fatal("there should be no error:", err)
+			}
+		}
+	}
+	return events
+}
+
+// namespaceHandler records the handled events per namespace.
+type namespaceHandler struct {
+	events map[string][]eh.Event
+	recv   chan eh.Event
+}
+
+func newNamespaceHandler() *namespaceHandler {
+	return &namespaceHandler{
+		events: map[string][]eh.Event{},
+		recv:   make(chan eh.Event, 10),
+	}
+}
+
+func (h *namespaceHandler) HandlerType() eh.EventHandlerType {
+	return "handler"
+}
+
+func (h *namespaceHandler) HandleEvent(ctx context.Context, event eh.Event) error {
+	ns := eh.NamespaceFromContext(ctx)
+	h.events[ns] = append(h.events[ns], event)
+	h.recv <- event
+	return nil
+}
+
+func (h *namespaceHandler) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-h.recv:
+		case <-time.After(time.Second):
+			t.Fatal("the events should be handled")
+		}
+	}
+}
+
+func assertEvents(t *testing.T, events, expected []eh.Event) {
+	if len(events) != len(expected) {
+		t.Fatalf("there should be %d events: %v", len(expected), events)
+	}
+	for i, event := range events {
+		if err := mocks.CompareEvents(event, expected[i]); err != nil {
+			t.Error("the event was incorrect:", err)
+		}
+	}
+}
@@ -17,6 +17,7 @@ package eventhorizon
 import (
 	"context"
 	"errors"
+	"time"
 )
 
 // EventStoreError is an error in the event store, with the namespace.
@@ -47,6 +48,35 @@ var ErrInvalidEvent = errors.New("invalid event")
 // ErrIncorrectEventVersion is when an event is for an other version of the aggregate.
 var ErrIncorrectEventVersion = errors.New("mismatching event version")
 
+// ErrVersionConflict is when the events of an aggregate could not be saved
+// because the aggregate has been changed since it was loaded, typically by a
+// concurrent command. Loading the aggregate again and retrying can succeed.
+var ErrVersionConflict = errors.New("aggregate version conflict")
+
+// IsVersionConflict returns true if the error is an ErrVersionConflict, either
+// directly or in an EventStoreError.
+func IsVersionConflict(err error) bool {
+	if esErr, ok := err.(EventStoreError); ok {
+		return esErr.Err == ErrVersionConflict
+	}
+	return err == ErrVersionConflict
+}
+
+// ErrAggregateArchived is when events are saved for an archived aggregate.
+var ErrAggregateArchived = errors.New("aggregate archived")
+
+// ErrNoArchive is when an aggregate is archived, or loaded from the archive,
+// without an archive store.
+var ErrNoArchive = errors.New("no archive store")
+
+// ErrArchiveMismatch is when the events already in the archive store are not
+// the first events of the aggregate being archived.
+var ErrArchiveMismatch = errors.New("archived events do not match")
+
+// ErrArchiveNotMaintainer is when an archived aggregate is deleted, but the
+// archive store is not an EventStreamMaintainer to delete the events from.
+var ErrArchiveNotMaintainer = errors.New("archive store is not a stream maintainer")
+
 // EventStore is an interface for an event sourcing event store.
 type EventStore interface {
 	// Save appends all events in the event stream to the store.
@@ -56,6 +86,17 @@ type EventStore interface {
 	Load(context.Context, ID) ([]Event, error)
 }
 
+// VersionedEventStore is an optional interface for event stores that can load
+// the events of an aggregate after a version, to only load the events that are
+// not already part of a snapshot.
+type VersionedEventStore interface {
+	EventStore
+
+	// LoadFromVersion loads the events for the aggregate id with a version
+	// after the given version.
+	LoadFromVersion(ctx context.Context, id ID, version int) ([]Event, error)
+}
+
 // EventStoreMaintainer is an interface for a maintainer of an EventStore.
 // NOTE: Should not be used in apps, useful for migration tools etc.
 type EventStoreMaintainer interface {
@@ -68,3 +109,142 @@ type EventStoreMaintainer interface {
 	// RenameEvent renames all instances of the event type.
 	RenameEvent(ctx context.Context, from, to EventType) error
 }
+
+// EventStreamMaintainer is an EventStoreMaintainer that can also retire the
+// event streams of aggregates. Every maintenance operation, including Replace
+// and RenameEvent, writes an audit record.
+// NOTE: Should not be used in apps, useful for migration tools etc.
+type EventStreamMaintainer interface {
+	EventStoreMaintainer
+
+	// Delete permanently deletes all events of an aggregate, including any
+	// archived events. Returns ErrAggregateNotFound if there is no aggregate.
+	Delete(context.Context, ID) error
+
+	// Tombstone marks an aggregate as deleted while keeping its events. Loading
+	// or saving events for it afterwards fails with ErrAggregateDeleted.
+	// Returns ErrAggregateNotFound if there is no aggregate.
+	Tombstone(context.Context, ID) error
+
+	// Archive moves all events of an aggregate to the archive store, from where
+	// they are still loaded on demand. The events of an archived aggregate can
+	// no longer be appended to, it fails with ErrAggregateArchived.
+	// Returns ErrAggregateNotFound if there is no aggregate.
+	Archive(context.Context, ID) error
+
+	// AuditLog returns the audit records of all maintenance operations in the
+	// namespace, in the order they were made.
+	AuditLog(context.Context) ([]AuditRecord, error)
+}
+
+// MaintenanceOperation is the type of a maintenance operation.
+type MaintenanceOperation string
+
+const (
+	// ReplaceOperation is when an event has been replaced.
+	ReplaceOperation MaintenanceOperation = "replace"
+	// RenameEventOperation is when all events of a type have been renamed.
+	RenameEventOperation MaintenanceOperation = "rename_event"
+	// DeleteOperation is when an aggregate has been deleted.
+	DeleteOperation MaintenanceOperation = "delete"
+	// TombstoneOperation is when an aggregate has been tombstoned.
+	TombstoneOperation MaintenanceOperation = "tombstone"
+	// ArchiveOperation is when an aggregate has been archived.
+	ArchiveOperation MaintenanceOperation = "archive"
+)
+
+// AuditRecord is a record of a maintenance operation in an event store.
+type AuditRecord struct {
+	// Operation is the maintenance operation.
+	Operation MaintenanceOperation
+	// AggregateID is the aggregate that was maintained, if any.
+	AggregateID ID
+	// Details is a description of the operation, for example the renamed
+	// event types.
+	Details string
+	// UserID is the user from the context of the operation, if any.
+	UserID string
+	// Timestamp is when the operation was made.
+	Timestamp time.Time
+}
+
+// ArchiveEvents saves the events of an aggregate to an archive store, for use
+// by implementations of EventStreamMaintainer.Archive. Any events that are
+// already archived, for example by an earlier attempt that failed before the
+// aggregate was marked as archived, are kept if they are the first events of
+// the aggregate. It is therefore safe to retry with the same or more events.
+func ArchiveEvents(ctx context.Context, archive EventStore, id ID, events []Event) error {
+	archived, err := archive.Load(ctx, id)
+	if esErr, ok := err.(EventStoreError); err == ErrAggregateNotFound ||
+		(ok && esErr.Err == ErrAggregateNotFound) {
+		archived = nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(archived) > len(events) {
+		return EventStoreError{
+			Err:       ErrArchiveMismatch,
+			Namespace: NamespaceFromContext(ctx),
+		}
+	}
+	for i, e := range archived {
+		if e.Version() != events[i].Version() || e.EventType() != events[i].EventType() {
+			return EventStoreError{
+				Err:       ErrArchiveMismatch,
+				Namespace: NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	if len(events) == len(archived) {
+		return nil
+	}
+	version := 0
+	if len(archived) > 0 {
+		version = archived[len(archived)-1].Version()
+	}
+	return archive.Save(ctx, events[len(archived):], version)
+}
+
+// NewAuditRecord creates a new AuditRecord for an operation, with the user
+// from the context.
+func NewAuditRecord(ctx context.Context, op MaintenanceOperation, id ID, details string) AuditRecord {
+	userID, _ := UserIDFromContext(ctx)
+	return AuditRecord{
+		Operation:   op,
+		AggregateID: id,
+		Details:     details,
+		UserID:      userID,
+		Timestamp:   time.Now(),
+	}
+}
+
+// PositionedEvent is an event loaded from the global event stream of a
+// namespace, with its position in that stream.
+type PositionedEvent interface {
+	Event
+
+	// Position returns the global position of the event. Positions are unique
+	// and monotonically increasing within a namespace, but not necessarily
+	// contiguous.
+	Position() int64
+}
+
+// GlobalEventStore is an optional interface for event stores that can load the
+// events of all aggregates in a namespace, in the order they were saved. All
+// events returned are PositionedEvents.
+type GlobalEventStore interface {
+	EventStore
+
+	// LoadAll loads all events in the namespace, optionally filtered by one or
+	// more aggregate types.
+	LoadAll(ctx context.Context, aggregateTypes ...AggregateType) ([]Event, error)
+
+	// LoadFrom loads the events with a position after the given position, at
+	// most limit events if limit is larger than 0, optionally filtered by one
+	// or more aggregate types. Use the position of the last handled event to
+	// continue reading the stream. An event is not loaded until all events
+	// with a lower position are visible, so that no event is skipped.
+	LoadFrom(ctx context.Context, position int64, limit int, aggregateTypes ...AggregateType) ([]Event, error)
+}
@@ -16,6 +16,8 @@ package eventstore
 
 import (
 	"context"
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -66,15 +68,30 @@ func AcceptanceTest(t *testing.T, ctx context.Context, store eh.EventStore) []eh
 		t.Error("there should be a ErrIncerrectEventVersion error:", err)
 	}
 
-	t.Log("save event, version 2")
+	t.Log("save event with metadata, version 2")
 	event2 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
-		timestamp, mocks.AggregateType, id, 2)
+		timestamp, mocks.AggregateType, id, 2, eh.WithMetadata(map[string]interface{}{
+			eh.EventIDMetadataKey:       "ad2b7a0c-0c85-4b9e-bb3c-8d9e2b0e1f35",
+			eh.CorrelationIDMetadataKey: "9f5e7d1a-2f1c-4e5b-a3c2-6d4b8e7f0a12",
+		}))
 	err = store.Save(ctx, []eh.Event{event2}, 1)
 	if err != nil {
 		t.Error("there should be no error:", err)
 	}
 	savedEvents = append(savedEvents, event2)
 
+	t.Log("try to save events with a version conflict")
+	err = store.Save(ctx, []eh.Event{event1}, 0)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != eh.ErrVersionConflict {
+		t.Error("there should be a ErrVersionConflict error:", err)
+	}
+	conflictingEvent := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "conflict"},
+		timestamp, mocks.AggregateType, id, 2)
+	err = store.Save(ctx, []eh.Event{conflictingEvent}, 1)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != eh.ErrVersionConflict {
+		t.Error("there should be a ErrVersionConflict error:", err)
+	}
+
 	t.Log("save event without data, version 3")
 	event3 := eh.NewEventForAggregate(mocks.EventOtherType, nil, timestamp,
 		mocks.AggregateType, id, 3)
@@ -151,6 +168,35 @@ func AcceptanceTest(t *testing.T, ctx context.Context, store eh.EventStore) []eh
 		}
 	}
 
+	if store, ok := store.(eh.VersionedEventStore); ok {
+		t.Log("load events from a version")
+		events, err = store.LoadFromVersion(ctx, id, 4)
+		if err != nil {
+			t.Error("there should be no error:", err)
+		}
+		expectedEvents = []eh.Event{event5, event6}
+		if len(events) != len(expectedEvents) {
+			t.Error("there should be 2 loaded events:", eventsToString(events))
+		}
+		for i, event := range events {
+			if err := mocks.CompareEvents(event, expectedEvents[i]); err != nil {
+				t.Error("the event was incorrect:", err)
+			}
+			if event.Version() != i+5 {
+				t.Error("the event version should be correct:", event, event.Version())
+			}
+		}
+
+		t.Log("load events from the last version")
+		events, err = store.LoadFromVersion(ctx, id, 6)
+		if err != nil {
+			t.Error("there should be no error:", err)
+		}
+		if len(events) != 0 {
+			t.Error("there should be no loaded events:", eventsToString(events))
+		}
+	}
+
 	return savedEvents
 }
 
@@ -264,6 +310,652 @@ func MaintainerAcceptanceTest(t *testing.T, ctx context.Context, store eh.EventS
 	}
 }
 
+// StreamMaintainerAcceptanceTest is the acceptance test that all
+// implementations of EventStreamMaintainer should pass. The store must have an
+// archive store set. It should manually be called from a test case in each
+// implementation:
+//
+//   func Test_EventStore(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewEventStore()
+//       store.SetArchive(NewArchiveStore())
+//       eventstore.StreamMaintainerAcceptanceTest(t, ctx, store)
+//   }
+//
+func StreamMaintainerAcceptanceTest(t *testing.T, ctx context.Context, store eh.EventStreamMaintainer) {
+	ctx = eh.NewContextWithUserID(ctx, "maintainer")
+
+	records, err := store.AuditLog(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	numRecords := len(records)
+
+	t.Log("save some events")
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	ids := []eh.ID{uuid.New().String(), uuid.New().String(), uuid.New().String()}
+	saved := map[eh.ID][]eh.Event{}
+	for _, id := range ids {
+		event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1)
+		event2 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			timestamp, mocks.AggregateType, id, 2)
+		if err := store.Save(ctx, []eh.Event{event1, event2}, 0); err != nil {
+			t.Error("there should be no error:", err)
+		}
+		saved[id] = []eh.Event{event1, event2}
+	}
+	event3 := func(id eh.ID) eh.Event {
+		return eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			timestamp, mocks.AggregateType, id, 3)
+	}
+
+	t.Log("delete, tombstone and archive, no aggregate")
+	if err := store.Delete(ctx, uuid.New().String()); err != eh.ErrAggregateNotFound {
+		t.Error("there should be an aggregate not found error:", err)
+	}
+	if err := store.Tombstone(ctx, uuid.New().String()); err != eh.ErrAggregateNotFound {
+		t.Error("there should be an aggregate not found error:", err)
+	}
+	if err := store.Archive(ctx, uuid.New().String()); err != eh.ErrAggregateNotFound {
+		t.Error("there should be an aggregate not found error:", err)
+	}
+
+	t.Log("delete aggregate")
+	if err := store.Delete(ctx, ids[0]); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	events, err := store.Load(ctx, ids[0])
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 0 {
+		t.Error("there should be no events:", events)
+	}
+
+	t.Log("tombstone aggregate")
+	if err := store.Tombstone(ctx, ids[1]); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	_, err = store.Load(ctx, ids[1])
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != eh.ErrAggregateDeleted {
+		t.Error("there should be an aggregate deleted error:", err)
+	}
+	err = store.Save(ctx, []eh.Event{event3(ids[1])}, 2)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != eh.ErrAggregateDeleted {
+		t.Error("there should be an aggregate deleted error:", err)
+	}
+
+	t.Log("archive aggregate")
+	if err := store.Archive(ctx, ids[2]); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	events, err = store.Load(ctx, ids[2])
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != len(saved[ids[2]]) {
+		t.Fatal("there should be archived events:", eventsToString(events))
+	}
+	for i, event := range events {
+		if err := mocks.CompareEvents(event, saved[ids[2]][i]); err != nil {
+			t.Error("the event was incorrect:", err)
+		}
+	}
+	err = store.Save(ctx, []eh.Event{event3(ids[2])}, 2)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != eh.ErrAggregateArchived {
+		t.Error("there should be an aggregate archived error:", err)
+	}
+
+	t.Log("delete archived aggregate")
+	if err := store.Delete(ctx, ids[2]); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	events, err = store.Load(ctx, ids[2])
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 0 {
+		t.Error("there should be no events:", events)
+	}
+
+	t.Log("audit records")
+	records, err = store.AuditLog(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(records) != numRecords+4 {
+		t.Fatal("there should be 4 new audit records:", records)
+	}
+	expected := []struct {
+		op eh.MaintenanceOperation
+		id eh.ID
+	}{
+		{eh.DeleteOperation, ids[0]},
+		{eh.TombstoneOperation, ids[1]},
+		{eh.ArchiveOperation, ids[2]},
+		{eh.DeleteOperation, ids[2]},
+	}
+	for i, r := range records[numRecords:] {
+		if r.Operation != expected[i].op || r.AggregateID != expected[i].id {
+			t.Error("the audit record should be correct:", r)
+		}
+		if r.UserID != "maintainer" {
+			t.Error("the audit record should have the user:", r.UserID)
+		}
+		if r.Timestamp.IsZero() {
+			t.Error("the audit record should have a timestamp")
+		}
+	}
+}
+
+// GlobalAcceptanceTest is the acceptance test that all implementations of
+// GlobalEventStore should pass. It should manually be called from a test case
+// in each implementation:
+//
+//   func Test_EventStore(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewEventStore()
+//       eventstore.GlobalAcceptanceTest(t, ctx, store)
+//   }
+//
+func GlobalAcceptanceTest(t *testing.T, ctx context.Context, store eh.GlobalEventStore) {
+	ctx = context.WithValue(ctx, "testkey", "testval")
+
+	t.Log("load all existing events")
+	existing, err := store.LoadAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	var lastPosition int64
+	for _, event := range existing {
+		p, ok := event.(eh.PositionedEvent)
+		if !ok {
+			t.Fatal("the event should have a position:", event)
+		}
+		if p.Position() <= lastPosition {
+			t.Error("the positions should be increasing:", p.Position(), lastPosition)
+		}
+		lastPosition = p.Position()
+	}
+
+	t.Log("save events for multiple aggregates")
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	otherAggregateType := eh.AggregateType("OtherAggregate")
+	id1 := uuid.New().String()
+	id2 := uuid.New().String()
+	event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id1, 1)
+	event2 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+		timestamp, otherAggregateType, id2, 1)
+	event3 := eh.NewEventForAggregate(mocks.EventOtherType, nil,
+		timestamp, mocks.AggregateType, id1, 2)
+	event4 := eh.NewEventForAggregate(mocks.EventOtherType, nil,
+		timestamp, otherAggregateType, id2, 2)
+	if err := store.Save(ctx, []eh.Event{event1}, 0); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := store.Save(ctx, []eh.Event{event2}, 0); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := store.Save(ctx, []eh.Event{event3}, 1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := store.Save(ctx, []eh.Event{event4}, 1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	t.Log("load events from the last position")
+	events, err := store.LoadFrom(ctx, lastPosition, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	expectedEvents := []eh.Event{event1, event2, event3, event4}
+	if len(events) != len(expectedEvents) {
+		t.Fatal("there should be 4 events:", eventsToString(events))
+	}
+	positions := make([]int64, len(events))
+	for i, event := range events {
+		if err := mocks.CompareEvents(event, expectedEvents[i]); err != nil {
+			t.Error("the event was incorrect:", err)
+		}
+		if event.Version() != expectedEvents[i].Version() {
+			t.Error("the event version should be correct:", event, event.Version())
+		}
+		positions[i] = event.(eh.PositionedEvent).Position()
+		if positions[i] <= lastPosition {
+			t.Error("the positions should be increasing:", positions[i], lastPosition)
+		}
+		lastPosition = positions[i]
+	}
+
+	t.Log("load events from a position in the middle")
+	events, err = store.LoadFrom(ctx, positions[1], 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	expectedEvents = []eh.Event{event3, event4}
+	if len(events) != len(expectedEvents) {
+		t.Fatal("there should be 2 events:", eventsToString(events))
+	}
+	for i, event := range events {
+		if err := mocks.CompareEvents(event, expectedEvents[i]); err != nil {
+			t.Error("the event was incorrect:", err)
+		}
+	}
+
+	t.Log("load events with a limit")
+	events, err = store.LoadFrom(ctx, positions[0]-1, 3)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	expectedEvents = []eh.Event{event1, event2, event3}
+	if len(events) != len(expectedEvents) {
+		t.Fatal("there should be 3 events:", eventsToString(events))
+	}
+	for i, event := range events {
+		if err := mocks.CompareEvents(event, expectedEvents[i]); err != nil {
+			t.Error("the event was incorrect:", err)
+		}
+	}
+
+	t.Log("load events filtered by aggregate type with a limit")
+	events, err = store.LoadFrom(ctx, positions[0]-1, 1, otherAggregateType)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 1 {
+		t.Fatal("there should be 1 event:", eventsToString(events))
+	}
+	if err := mocks.CompareEvents(events[0], event2); err != nil {
+		t.Error("the event was incorrect:", err)
+	}
+
+	t.Log("load events filtered by aggregate type")
+	events, err = store.LoadFrom(ctx, positions[0]-1, 0, otherAggregateType)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	expectedEvents = []eh.Event{event2, event4}
+	if len(events) != len(expectedEvents) {
+		t.Fatal("there should be 2 events:", eventsToString(events))
+	}
+	for i, event := range events {
+		if err := mocks.CompareEvents(event, expectedEvents[i]); err != nil {
+			t.Error("the event was incorrect:", err)
+		}
+	}
+
+	t.Log("load all events filtered by aggregate type")
+	events, err = store.LoadAll(ctx, otherAggregateType)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) < 2 {
+		t.Fatal("there should be at least 2 events:", eventsToString(events))
+	}
+	for _, event := range events {
+		if event.AggregateType() != otherAggregateType {
+			t.Error("the aggregate type should be correct:", event.AggregateType())
+		}
+	}
+
+	t.Log("load events from the end of the stream")
+	events, err = store.LoadFrom(ctx, lastPosition, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 0 {
+		t.Error("there should be no events:", eventsToString(events))
+	}
+}
+
+// SnapshotAcceptanceTest is the acceptance test that all implementations of
+// SnapshotStore should pass, when implemented together with an EventStore.
+// It should manually be called from a test case in each implementation:
+//
+//   func Test_EventStore(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewEventStore()
+//       eventstore.SnapshotAcceptanceTest(t, ctx, store, store)
+//   }
+//
+func SnapshotAcceptanceTest(t *testing.T, ctx context.Context, store eh.EventStore, snapshots eh.SnapshotStore) {
+	ctx = context.WithValue(ctx, "testkey", "testval")
+
+	t.Log("save snapshot, no aggregate")
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	if err := snapshots.SaveSnapshot(ctx, uuid.New().String(), eh.Snapshot{
+		Version:       1,
+		AggregateType: mocks.AggregateType,
+		Timestamp:     timestamp,
+		State:         []byte("state1"),
+	}); err != eh.ErrAggregateNotFound {
+		t.Error("there should be an aggregate not found error:", err)
+	}
+
+	t.Log("save some events")
+	id := uuid.New().String()
+	event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1)
+	event2 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+		timestamp, mocks.AggregateType, id, 2)
+	if err := store.Save(ctx, []eh.Event{event1, event2}, 0); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	t.Log("load snapshot, no snapshot")
+	snapshot, err := snapshots.LoadSnapshot(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if snapshot != nil {
+		t.Error("there should be no snapshot:", snapshot)
+	}
+
+	t.Log("save and load snapshot")
+	snapshot2 := eh.Snapshot{
+		Version:       2,
+		AggregateType: mocks.AggregateType,
+		Timestamp:     timestamp,
+		State:         []byte("state2"),
+	}
+	if err := snapshots.SaveSnapshot(ctx, id, snapshot2); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	snapshot, err = snapshots.LoadSnapshot(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if snapshot == nil {
+		t.Fatal("there should be a snapshot")
+	}
+	if !equalSnapshots(*snapshot, snapshot2) {
+		t.Error("the snapshot should be correct:", snapshot)
+	}
+
+	t.Log("save older snapshot")
+	if err := snapshots.SaveSnapshot(ctx, id, eh.Snapshot{
+		Version:       1,
+		AggregateType: mocks.AggregateType,
+		Timestamp:     timestamp,
+		State:         []byte("state1"),
+	}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	snapshot, err = snapshots.LoadSnapshot(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if snapshot == nil || !equalSnapshots(*snapshot, snapshot2) {
+		t.Error("the newer snapshot should be kept:", snapshot)
+	}
+
+	t.Log("events are kept after snapshot")
+	event3 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+		timestamp, mocks.AggregateType, id, 3)
+	if err := store.Save(ctx, []eh.Event{event3}, 2); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	events, err := store.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	expectedEvents := []eh.Event{event1, event2, event3}
+	if len(events) != len(expectedEvents) {
+		t.Fatal("there should be 3 events:", eventsToString(events))
+	}
+	for i, event := range events {
+		if err := mocks.CompareEvents(event, expectedEvents[i]); err != nil {
+			t.Error("the event was incorrect:", err)
+		}
+	}
+}
+
+// UpcastAcceptanceTest is the acceptance test that all implementations of
+// EventStore should pass to support upcasting of stored events. It should
+// manually be called from a test case in each implementation:
+//
+//   func Test_EventStore(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewEventStore()
+//       eventstore.UpcastAcceptanceTest(t, ctx, store)
+//   }
+//
+func UpcastAcceptanceTest(t *testing.T, ctx context.Context, store eh.EventStore) {
+	ctx = context.WithValue(ctx, "testkey", "testval")
+
+	// Use unique event types as the upcasters are registered globally.
+	oldEventType := eh.EventType("UpcastOldEvent-" + uuid.New().String())
+	newEventType := eh.EventType("UpcastNewEvent-" + uuid.New().String())
+	eh.RegisterEventData(oldEventType, func() eh.EventData { return &upcastEventData{} })
+	defer eh.UnregisterEventData(oldEventType)
+	eh.RegisterEventData(newEventType, func() eh.EventData { return &upcastEventData{} })
+	defer eh.UnregisterEventData(newEventType)
+
+	t.Log("save events before upcasters are registered")
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	id := uuid.New().String()
+	event1 := eh.NewEventForAggregate(oldEventType, &upcastEventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1)
+	event2 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+		timestamp, mocks.AggregateType, id, 2)
+	if err := store.Save(ctx, []eh.Event{event1, event2}, 0); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	t.Log("register upcasters, changing the data and then the type")
+	eh.RegisterEventUpcaster(oldEventType, 0,
+		func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+			data["content"] = data["content"].(string) + " v1"
+			return t, data, nil
+		})
+	defer eh.UnregisterEventUpcaster(oldEventType, 0)
+	eh.RegisterEventUpcaster(oldEventType, 1,
+		func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+			return newEventType, data, nil
+		})
+	defer eh.UnregisterEventUpcaster(oldEventType, 1)
+
+	t.Log("load upcasted events")
+	events, err := store.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	expectedEvents := []eh.Event{
+		eh.NewEventForAggregate(newEventType, &upcastEventData{Content: "event1 v1"},
+			timestamp, mocks.AggregateType, id, 1),
+		event2,
+	}
+	if len(events) != len(expectedEvents) {
+		t.Fatal("there should be 2 events:", eventsToString(events))
+	}
+	for i, event := range events {
+		if err := mocks.CompareEvents(event, expectedEvents[i]); err != nil {
+			t.Error("the event was incorrect:", err)
+		}
+		if event.Version() != i+1 {
+			t.Error("the event version should be correct:", event, event.Version())
+		}
+	}
+
+	t.Log("save and load events with the current schema version")
+	event3 := eh.NewEventForAggregate(oldEventType, &upcastEventData{Content: "event3 v2"},
+		timestamp, mocks.AggregateType, id, 3)
+	if err := store.Save(ctx, []eh.Event{event3}, 2); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	events, err = store.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 3 {
+		t.Fatal("there should be 3 events:", eventsToString(events))
+	}
+	if err := mocks.CompareEvents(events[2], event3); err != nil {
+		t.Error("the event should not be upcasted:", err)
+	}
+
+	t.Log("upcaster error")
+	eh.RegisterEventUpcaster(newEventType, 2,
+		func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+			return t, data, errors.New("upcast error")
+		})
+	defer eh.UnregisterEventUpcaster(newEventType, 2)
+	if _, err := store.Load(ctx, id); err == nil {
+		t.Error("there should be an error")
+	}
+}
+
+// upcastEventData is event data with the same field names in all encodings,
+// for the upcasters to use.
+type upcastEventData struct {
+	Content string `json:"content" bson:"content"`
+}
+
+// OutboxAcceptanceTest is the acceptance test that all implementations of
+// OutboxEventStore should pass. It should manually be called from a test case
+// in each implementation:
+//
+//   func Test_EventStore(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewEventStore()
+//       eventstore.OutboxAcceptanceTest(t, ctx, store)
+//   }
+//
+func OutboxAcceptanceTest(t *testing.T, ctx context.Context, store eh.OutboxEventStore) {
+	// Publish any events from earlier tests.
+	markAllPublished(t, ctx, store)
+
+	t.Log("save events without outbox")
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	id := uuid.New().String()
+	event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1)
+	if err := store.Save(ctx, []eh.Event{event1}, 0); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	entries, err := store.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 0 {
+		t.Error("there should be no unpublished events:", entries)
+	}
+
+	t.Log("save events with outbox")
+	event2 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+		timestamp, mocks.AggregateType, id, 2)
+	event3 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+		timestamp, mocks.AggregateType, id, 3)
+	if err := store.SaveWithOutbox(ctx, []eh.Event{event2, event3}, 1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	otherID := uuid.New().String()
+	event4 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event4"},
+		timestamp, mocks.AggregateType, otherID, 1)
+	if err := store.SaveWithOutbox(ctx, []eh.Event{event4}, 0); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	t.Log("save events with outbox, incorrect event version")
+	event5 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event5"},
+		timestamp, mocks.AggregateType, uuid.New().String(), 2)
+	err = store.SaveWithOutbox(ctx, []eh.Event{event5}, 0)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != eh.ErrIncorrectEventVersion {
+		t.Error("there should be a ErrIncorrectEventVersion error:", err)
+	}
+
+	events, err := store.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 3 {
+		t.Error("the events should be saved:", eventsToString(events))
+	}
+
+	t.Log("load unpublished events")
+	expectedEvents := []eh.Event{event2, event3, event4}
+	entries, err = store.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != len(expectedEvents) {
+		t.Fatal("there should be unpublished events:", entries)
+	}
+	for i, entry := range entries {
+		if err := mocks.CompareEvents(entry.Event, expectedEvents[i]); err != nil {
+			t.Error("the unpublished event was incorrect:", err)
+		}
+	}
+	entries, err = store.UnpublishedEvents(ctx, 2)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 2 {
+		t.Error("the unpublished events should be limited:", entries)
+	}
+
+	t.Log("outbox namespaces")
+	namespaces, err := store.OutboxNamespaces(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	found := false
+	for _, ns := range namespaces {
+		if ns == eh.NamespaceFromContext(ctx) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("the namespace should be in the outbox namespaces:", namespaces)
+	}
+
+	t.Log("mark events as published")
+	if err := store.MarkPublished(ctx, entries[0].ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	entries, err = store.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 2 {
+		t.Fatal("there should be 2 unpublished events:", entries)
+	}
+	for i, entry := range entries {
+		if err := mocks.CompareEvents(entry.Event, expectedEvents[i+1]); err != nil {
+			t.Error("the unpublished event was incorrect:", err)
+		}
+	}
+	markAllPublished(t, ctx, store)
+	entries, err = store.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 0 {
+		t.Error("there should be no unpublished events:", entries)
+	}
+}
+
+func markAllPublished(t *testing.T, ctx context.Context, store eh.Outbox) {
+	entries, err := store.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	for _, entry := range entries {
+		if err := store.MarkPublished(ctx, entry.ID); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+}
+
+func equalSnapshots(s1, s2 eh.Snapshot) bool {
+	return s1.Version == s2.Version &&
+		s1.AggregateType == s2.AggregateType &&
+		s1.Timestamp.Equal(s2.Timestamp) &&
+		reflect.DeepEqual(s1.State, s2.State)
+}
+
 func eventsToString(events []eh.Event) string {
 	parts := make([]string, len(events))
 	for i, e := range events {
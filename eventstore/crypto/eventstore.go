@@ -0,0 +1,388 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotEncrypt is when event data could not be encrypted.
+var ErrCouldNotEncrypt = errors.New("could not encrypt event data")
+
+// ErrCouldNotDecrypt is when event data could not be decrypted with an
+// existing key.
+var ErrCouldNotDecrypt = errors.New("could not decrypt event data")
+
+// ErrUnsupportedField is when an encrypted or subject field is not an exported
+// string field.
+var ErrUnsupportedField = errors.New("unsupported field, must be an exported string")
+
+// ErrNotGlobal is when the global stream is loaded from a store that is not an
+// eventhorizon.GlobalEventStore.
+var ErrNotGlobal = errors.New("event store is not a global event store")
+
+// ErrNotMaintainer is when maintenance is used on a store that is not an
+// eventhorizon.EventStoreMaintainer.
+var ErrNotMaintainer = errors.New("event store is not a maintainer")
+
+// Redacted is the value of encrypted fields when the key of the subject has
+// been deleted.
+const Redacted = "[redacted]"
+
+// The prefix of encrypted values, to tell them apart from plaintext values
+// saved before a field was encrypted.
+const encryptedPrefix = "eh-aes-gcm:"
+
+// EventStore wraps an EventStore and encrypts tagged fields of the event data
+// with a key per subject, also called crypto-shredding. Deleting the key of a
+// subject makes its encrypted fields unreadable, and they are loaded with the
+// Redacted value instead. Events with encrypted fields can not be saved for a
+// subject after its key has been deleted.
+//
+// The fields to encrypt must be string fields of the event data struct tagged
+// with `eh:"encrypted"`. The subject is taken from a string field tagged with
+// `eh:"subject"`, or the aggregate ID if there is none:
+//   type UserCreatedData struct {
+//       UserID eh.ID  `eh:"subject"`
+//       Name   string `eh:"encrypted"`
+//       Email  string `eh:"encrypted"`
+//   }
+type EventStore struct {
+	eh.EventStore
+	keys KeyStore
+}
+
+// NewEventStore creates a new EventStore.
+func NewEventStore(eventStore eh.EventStore, keys KeyStore) *EventStore {
+	if eventStore == nil || keys == nil {
+		return nil
+	}
+
+	return &EventStore{
+		EventStore: eventStore,
+		keys:       keys,
+	}
+}
+
+// Save implements the Save method of the eventhorizon.EventStore interface.
+func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersion int) error {
+	encrypted := make([]eh.Event, len(events))
+	for i, e := range events {
+		var err error
+		if encrypted[i], err = s.encrypt(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	return s.EventStore.Save(ctx, encrypted, originalVersion)
+}
+
+// Load implements the Load method of the eventhorizon.EventStore interface.
+func (s *EventStore) Load(ctx context.Context, id eh.ID) ([]eh.Event, error) {
+	return s.LoadFromVersion(ctx, id, 0)
+}
+
+// LoadFromVersion implements the LoadFromVersion method of the eventhorizon.VersionedEventStore interface.
+// The events are loaded from the version if the wrapped store is also an
+// eventhorizon.VersionedEventStore, else all events are loaded but only the
+// events after the version are decrypted.
+func (s *EventStore) LoadFromVersion(ctx context.Context, id eh.ID, version int) ([]eh.Event, error) {
+	var events []eh.Event
+	var err error
+	if store, ok := s.EventStore.(eh.VersionedEventStore); ok {
+		events, err = store.LoadFromVersion(ctx, id, version)
+	} else {
+		events, err = s.EventStore.Load(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for len(events) > 0 && events[0].Version() <= version {
+		events = events[1:]
+	}
+
+	// Cache the keys for all events of the aggregate.
+	keys := map[string][]byte{}
+	for i, e := range events {
+		if events[i], err = s.decrypt(ctx, e, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// LoadAll implements the LoadAll method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadAll(ctx context.Context, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	return s.LoadFrom(ctx, 0, 0, aggregateTypes...)
+}
+
+// LoadFrom implements the LoadFrom method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadFrom(ctx context.Context, position int64, limit int, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	store, ok := s.EventStore.(eh.GlobalEventStore)
+	if !ok {
+		return nil, eh.EventStoreError{
+			Err:       ErrNotGlobal,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	events, err := store.LoadFrom(ctx, position, limit, aggregateTypes...)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string][]byte{}
+	for i, e := range events {
+		if events[i], err = s.decrypt(ctx, e, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// Replace implements the Replace method of the eventhorizon.EventStoreMaintainer interface.
+func (s *EventStore) Replace(ctx context.Context, event eh.Event) error {
+	store, ok := s.EventStore.(eh.EventStoreMaintainer)
+	if !ok {
+		return eh.EventStoreError{
+			Err:       ErrNotMaintainer,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	encrypted, err := s.encrypt(ctx, event)
+	if err != nil {
+		return err
+	}
+	return store.Replace(ctx, encrypted)
+}
+
+// RenameEvent implements the RenameEvent method of the eventhorizon.EventStoreMaintainer interface.
+func (s *EventStore) RenameEvent(ctx context.Context, from, to eh.EventType) error {
+	store, ok := s.EventStore.(eh.EventStoreMaintainer)
+	if !ok {
+		return eh.EventStoreError{
+			Err:       ErrNotMaintainer,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return store.RenameEvent(ctx, from, to)
+}
+
+// encrypt returns the event with a copy of its data where all tagged fields
+// are encrypted, or the event itself if there are no tagged fields.
+func (s *EventStore) encrypt(ctx context.Context, e eh.Event) (eh.Event, error) {
+	data, fields, subject, err := copyData(e)
+	if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotEncrypt,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if len(fields) == 0 {
+		return e, nil
+	}
+
+	key, err := s.keys.GetOrCreateKey(ctx, subject)
+	if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotEncrypt,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotEncrypt,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	for _, f := range fields {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotEncrypt,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		sealed := aead.Seal(nonce, nonce, []byte(f.String()), []byte(subject))
+		f.SetString(encryptedPrefix + base64.StdEncoding.EncodeToString(sealed))
+	}
+
+	return event{Event: e, data: data.Interface()}, nil
+}
+
+// decrypt returns the event with a copy of its data where all tagged fields
+// are decrypted, or redacted if the key of the subject is deleted.
+func (s *EventStore) decrypt(ctx context.Context, e eh.Event, keys map[string][]byte) (eh.Event, error) {
+	data, fields, subject, err := copyData(e)
+	if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotDecrypt,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if len(fields) == 0 {
+		return e, nil
+	}
+
+	key, ok := keys[subject]
+	if !ok {
+		if key, err = s.keys.Key(ctx, subject); err != nil && err != ErrKeyNotFound {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotDecrypt,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		keys[subject] = key
+	}
+
+	var aead cipher.AEAD
+	if key != nil {
+		if aead, err = newAEAD(key); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotDecrypt,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	for _, f := range fields {
+		// Values saved before the field was encrypted are kept.
+		if !strings.HasPrefix(f.String(), encryptedPrefix) {
+			continue
+		}
+		if aead == nil {
+			f.SetString(Redacted)
+			continue
+		}
+
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(f.String(), encryptedPrefix))
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotDecrypt,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(subject))
+		if err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotDecrypt,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		f.SetString(string(plaintext))
+	}
+
+	if p, ok := e.(eh.PositionedEvent); ok {
+		return positionedEvent{
+			event:    event{Event: e, data: data.Interface()},
+			position: p.Position(),
+		}, nil
+	}
+	return event{Event: e, data: data.Interface()}, nil
+}
+
+// copyData makes a shallow copy of the event data and returns it together
+// with its encrypted fields and the subject. No fields are returned if the
+// data is not a struct, or a pointer to one, with encrypted fields.
+func copyData(e eh.Event) (reflect.Value, []reflect.Value, string, error) {
+	v := reflect.ValueOf(e.Data())
+	if v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Kind() == reflect.Struct {
+		c := reflect.New(v.Elem().Type())
+		c.Elem().Set(v.Elem())
+		fields, subject, err := taggedFields(c.Elem(), e.AggregateID())
+		return c, fields, subject, err
+	} else if v.Kind() == reflect.Struct {
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		fields, subject, err := taggedFields(c, e.AggregateID())
+		return c, fields, subject, err
+	}
+	return v, nil, "", nil
+}
+
+// taggedFields returns the encrypted fields and the subject of a struct.
+func taggedFields(v reflect.Value, aggregateID eh.ID) ([]reflect.Value, string, error) {
+	fields := []reflect.Value{}
+	subject := aggregateID
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("eh")
+		if tag != "encrypted" && tag != "subject" {
+			continue
+		}
+		if f.Type.Kind() != reflect.String || f.PkgPath != "" {
+			return nil, "", ErrUnsupportedField
+		}
+		if tag == "encrypted" {
+			fields = append(fields, v.Field(i))
+		} else {
+			subject = v.Field(i).String()
+		}
+	}
+	return fields, subject, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// event is an event with encrypted or decrypted data.
+type event struct {
+	eh.Event
+	data eh.EventData
+}
+
+// Data implements the Data method of the eventhorizon.Event interface.
+func (e event) Data() eh.EventData {
+	return e.data
+}
+
+// positionedEvent is an event with decrypted data from the global stream.
+type positionedEvent struct {
+	event
+	position int64
+}
+
+// Position implements the Position method of the eventhorizon.PositionedEvent interface.
+func (e positionedEvent) Position() int64 {
+	return e.position
+}
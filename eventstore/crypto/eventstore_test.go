@@ -0,0 +1,213 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventstore"
+	"github.com/looplab/eventhorizon/eventstore/crypto"
+	"github.com/looplab/eventhorizon/eventstore/file"
+	"github.com/looplab/eventhorizon/eventstore/memory"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func Test_EventStore(t *testing.T) {
+	store := crypto.NewEventStore(memory.NewEventStore(), crypto.NewMemoryKeyStore())
+	if store == nil {
+		t.Fatal("there should be a store")
+	}
+
+	ctx := eh.NewContextWithNamespace(context.Background(), "ns")
+
+	// Run the actual test suite, without encrypted fields.
+
+	t.Log("event store with default namespace")
+	eventstore.AcceptanceTest(t, context.Background(), store)
+
+	t.Log("event store with other namespace")
+	eventstore.AcceptanceTest(t, ctx, store)
+
+	t.Log("event store maintainer")
+	eventstore.MaintainerAcceptanceTest(t, context.Background(), store)
+
+	t.Log("global event store")
+	eventstore.GlobalAcceptanceTest(t, context.Background(), store)
+}
+
+func Test_EventStore_Encryption(t *testing.T) {
+	baseStore := memory.NewEventStore()
+	testEncryption(t, baseStore)
+}
+
+func Test_EventStore_EncryptionFile(t *testing.T) {
+	// The file store encodes the data as JSON.
+	baseStore, err := file.NewEventStore(t.TempDir())
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer baseStore.Close()
+	testEncryption(t, baseStore)
+}
+
+func Test_EventStore_UnsupportedField(t *testing.T) {
+	store := crypto.NewEventStore(memory.NewEventStore(), crypto.NewMemoryKeyStore())
+	event := eh.NewEventForAggregate(mocks.EventType, &struct {
+		Age int `eh:"encrypted"`
+	}{42}, time.Now(), mocks.AggregateType, uuid.New().String(), 1)
+	err := store.Save(context.Background(), []eh.Event{event}, 0)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.BaseErr != crypto.ErrUnsupportedField {
+		t.Error("there should be an unsupported field error:", err)
+	}
+}
+
+func testEncryption(t *testing.T, baseStore eh.EventStore) {
+	keys := crypto.NewMemoryKeyStore()
+	store := crypto.NewEventStore(baseStore, keys)
+	ctx := context.Background()
+
+	id := uuid.New().String()
+	subject1 := uuid.New().String()
+	subject2 := uuid.New().String()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	data1 := &PersonalData{Subject: subject1, Name: "Alice", Email: "alice@example.com", Note: "note"}
+	data2 := &PersonalData{Subject: subject2, Name: "Bob", Email: "bob@example.com", Note: "note"}
+	event1 := eh.NewEventForAggregate(PersonalEventType, data1,
+		timestamp, mocks.AggregateType, id, 1)
+	event2 := eh.NewEventForAggregate(PersonalEventType, data2,
+		timestamp, mocks.AggregateType, id, 2)
+	if err := store.Save(ctx, []eh.Event{event1, event2}, 0); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if data1.Name != "Alice" {
+		t.Error("the saved event data should not be modified:", data1)
+	}
+
+	t.Log("the data should be encrypted in the underlying store")
+	events, err := baseStore.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 2 {
+		t.Fatal("there should be 2 events:", events)
+	}
+	stored, ok := events[0].Data().(*PersonalData)
+	if !ok {
+		t.Fatal("the event data should be correct:", events[0].Data())
+	}
+	if stored.Name == "Alice" || strings.Contains(stored.Email, "alice") {
+		t.Error("the fields should be encrypted:", stored)
+	}
+	if stored.Subject != subject1 || stored.Note != "note" {
+		t.Error("the other fields should not be encrypted:", stored)
+	}
+
+	t.Log("load decrypted events")
+	events, err = store.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	for i, event := range []eh.Event{event1, event2} {
+		if err := mocks.CompareEvents(events[i], event); err != nil {
+			t.Error("the event should be correct:", err)
+		}
+	}
+
+	t.Log("load redacted events after deleting a key")
+	if err := keys.DeleteKey(ctx, subject1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	events, err = store.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	redacted := eh.NewEventForAggregate(PersonalEventType, &PersonalData{
+		Subject: subject1, Name: crypto.Redacted, Email: crypto.Redacted, Note: "note",
+	}, timestamp, mocks.AggregateType, id, 1)
+	if err := mocks.CompareEvents(events[0], redacted); err != nil {
+		t.Error("the event should be redacted:", err)
+	}
+	if err := mocks.CompareEvents(events[1], event2); err != nil {
+		t.Error("the event of the other subject should be correct:", err)
+	}
+
+	t.Log("no new key should be created for a deleted subject")
+	event3 := eh.NewEventForAggregate(PersonalEventType, &PersonalData{
+		Subject: subject1, Name: "Alice",
+	}, timestamp, mocks.AggregateType, id, 3)
+	err = store.Save(ctx, []eh.Event{event3}, 2)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.BaseErr != crypto.ErrKeyDeleted {
+		t.Error("there should be a key deleted error:", err)
+	}
+	if events, err = store.Load(ctx, id); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 2 {
+		t.Fatal("there should be 2 events:", events)
+	}
+	if err := mocks.CompareEvents(events[0], redacted); err != nil {
+		t.Error("the event should still be redacted:", err)
+	}
+
+	t.Log("load decrypted events from the global stream")
+	if _, ok := baseStore.(eh.GlobalEventStore); !ok {
+		return
+	}
+	events, err = store.LoadAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	var found int
+	for _, e := range events {
+		if e.AggregateID() != id {
+			continue
+		}
+		if _, ok := e.(eh.PositionedEvent); !ok {
+			t.Error("the event should have a position:", e)
+		}
+		if e.Version() == 1 {
+			if err := mocks.CompareEvents(e, redacted); err != nil {
+				t.Error("the event should be redacted:", err)
+			}
+		} else if err := mocks.CompareEvents(e, event2); err != nil {
+			t.Error("the event should be decrypted:", err)
+		}
+		found++
+	}
+	if found != 2 {
+		t.Error("there should be 2 events:", events)
+	}
+}
+
+const PersonalEventType eh.EventType = "PersonalEvent"
+
+func init() {
+	eh.RegisterEventData(PersonalEventType, func() eh.EventData {
+		return &PersonalData{}
+	})
+}
+
+type PersonalData struct {
+	Subject string `eh:"subject"`
+	Name    string `eh:"encrypted"`
+	Email   string `eh:"encrypted"`
+	Note    string
+}
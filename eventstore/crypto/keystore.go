@@ -0,0 +1,117 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrKeyNotFound is when there is no key for a subject, because it has never
+// been created or because it has been deleted.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrKeyDeleted is when a key is created for a subject whose key has been
+// deleted.
+var ErrKeyDeleted = errors.New("key deleted")
+
+// KeySize is the size of the keys in bytes, for AES-256.
+const KeySize = 32
+
+// KeyStore is a store of encryption keys, with one key per subject. The
+// subject is typically a person whose personal data should be erasable.
+type KeyStore interface {
+	// Key returns the key for a subject, or ErrKeyNotFound if there is none.
+	Key(ctx context.Context, subject string) ([]byte, error)
+
+	// GetOrCreateKey returns the key for a subject, creating a new random key
+	// if there is none. It returns ErrKeyDeleted if the key of the subject has
+	// been deleted, a new key is never created for it.
+	GetOrCreateKey(ctx context.Context, subject string) ([]byte, error)
+
+	// DeleteKey deletes the key of a subject, after which all data encrypted
+	// with it is unreadable. A tombstone is kept for the subject to prevent
+	// a new key from being created.
+	DeleteKey(ctx context.Context, subject string) error
+}
+
+// MemoryKeyStore is a KeyStore in memory, mainly useful for testing.
+type MemoryKeyStore struct {
+	// The outer map is with namespace as key, the inner with subject. Deleted
+	// keys are kept as nil.
+	keys   map[string]map[string][]byte
+	keysMu sync.RWMutex
+}
+
+var _ = KeyStore(&MemoryKeyStore{})
+
+// NewMemoryKeyStore creates a new MemoryKeyStore.
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		keys: map[string]map[string][]byte{},
+	}
+}
+
+// Key implements the Key method of the KeyStore interface.
+func (s *MemoryKeyStore) Key(ctx context.Context, subject string) ([]byte, error) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
+	key := s.keys[eh.NamespaceFromContext(ctx)][subject]
+	if key == nil {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// GetOrCreateKey implements the GetOrCreateKey method of the KeyStore interface.
+func (s *MemoryKeyStore) GetOrCreateKey(ctx context.Context, subject string) ([]byte, error) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if key, ok := s.keys[ns][subject]; ok && key == nil {
+		return nil, ErrKeyDeleted
+	} else if ok {
+		return key, nil
+	}
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, ok := s.keys[ns]; !ok {
+		s.keys[ns] = map[string][]byte{}
+	}
+	s.keys[ns][subject] = key
+	return key, nil
+}
+
+// DeleteKey implements the DeleteKey method of the KeyStore interface.
+func (s *MemoryKeyStore) DeleteKey(ctx context.Context, subject string) error {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.keys[ns]; !ok {
+		s.keys[ns] = map[string][]byte{}
+	}
+	s.keys[ns][subject] = nil
+	return nil
+}
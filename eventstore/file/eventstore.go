@@ -0,0 +1,683 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotOpenLog is when the log files could not be opened or recovered.
+var ErrCouldNotOpenLog = errors.New("could not open log")
+
+// ErrCorruptLog is when a record in the log is corrupt, other than a torn
+// write at the end of the log.
+var ErrCorruptLog = errors.New("corrupt log")
+
+// ErrCouldNotMarshalEvent is when an event could not be marshaled into JSON.
+var ErrCouldNotMarshalEvent = errors.New("could not marshal event")
+
+// ErrCouldNotUnmarshalEvent is when an event could not be unmarshaled into a concrete type.
+var ErrCouldNotUnmarshalEvent = errors.New("could not unmarshal event")
+
+// ErrCouldNotUpcastEvent is when an event could not be upcasted.
+var ErrCouldNotUpcastEvent = errors.New("could not upcast event")
+
+// ErrCouldNotLoadAggregate is when an aggregate could not be loaded.
+var ErrCouldNotLoadAggregate = errors.New("could not load aggregate")
+
+// ErrCouldNotSaveAggregate is when an aggregate could not be saved.
+var ErrCouldNotSaveAggregate = errors.New("could not save aggregate")
+
+// ErrClosed is when the event store is used after being closed.
+var ErrClosed = errors.New("event store closed")
+
+// DefaultMaxSegmentSize is the default size in bytes after which a new log
+// segment is started.
+const DefaultMaxSegmentSize = 64 * 1024 * 1024
+
+// DefaultSyncInterval is the default interval for SyncPeriodically.
+const DefaultSyncInterval = time.Second
+
+// SyncPolicy is the policy for when to sync the log to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the log to disk before Save returns, which is the
+	// default. No saved events are lost on a crash.
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodically syncs the log to disk in the background. The events
+	// saved since the last sync can be lost on a crash.
+	SyncPeriodically
+	// SyncNever leaves the syncing to the OS, and when closing the store.
+	SyncNever
+)
+
+// EventStore implements an EventStore as an append-only log on local disk.
+//
+// The log is split into segment files. Each record in the log is one event,
+// with a length and a CRC checksum. Replacing or renaming events appends new
+// records for the events, where the last record of an event version wins.
+// The index from aggregates to records is kept in memory and rebuilt from the
+// log when opening the store. A torn write at the end of the log, from a crash
+// while saving, is truncated when opening.
+//
+// The directory must only be used by one EventStore at a time.
+type EventStore struct {
+	dir            string
+	maxSegmentSize int64
+
+	segments []*segment
+	// The index of all events, with namespace as key.
+	index    map[string]*nsIndex
+	position int64
+	closed   bool
+	mu       sync.RWMutex
+
+	syncPolicy SyncPolicy
+	dirty      bool
+	syncDone   chan struct{}
+	syncWg     sync.WaitGroup
+}
+
+// nsIndex is the index of the events in a namespace.
+type nsIndex struct {
+	// The location of all events of an aggregate, by version.
+	aggregates map[eh.ID][]location
+	// The location of all events, in position order.
+	stream []location
+}
+
+// location is the location of a record in the log.
+type location struct {
+	segment  int
+	offset   int64
+	size     int64
+	position int64
+}
+
+// NewEventStore creates a new EventStore in a directory, which is created if
+// needed. Any existing log is recovered and indexed.
+func NewEventStore(dir string) (*EventStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr: err,
+			Err:     ErrCouldNotOpenLog,
+		}
+	}
+
+	s := &EventStore{
+		dir:            dir,
+		maxSegmentSize: DefaultMaxSegmentSize,
+		index:          map[string]*nsIndex{},
+	}
+	if err := s.open(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// SetMaxSegmentSize sets the size in bytes after which a new log segment is
+// started. A single save is never split between segments.
+func (s *EventStore) SetMaxSegmentSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxSegmentSize = size
+}
+
+// SetSyncPolicy sets the policy for syncing the log to disk. The interval is
+// only used for SyncPeriodically, DefaultSyncInterval is used if it is zero.
+func (s *EventStore) SetSyncPolicy(policy SyncPolicy, interval time.Duration) {
+	s.mu.Lock()
+	s.syncPolicy = policy
+	if s.syncDone != nil {
+		close(s.syncDone)
+		s.syncDone = nil
+	}
+	if policy == SyncPeriodically {
+		if interval == 0 {
+			interval = DefaultSyncInterval
+		}
+		s.syncDone = make(chan struct{})
+		s.syncWg.Add(1)
+		go s.syncPeriodically(interval, s.syncDone)
+	}
+	s.mu.Unlock()
+
+	// Wait for any previous syncer outside of the lock.
+	if policy != SyncPeriodically {
+		s.syncWg.Wait()
+	}
+}
+
+// Save implements the Save method of the eventhorizon.EventStore interface.
+func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersion int) error {
+	if len(events) == 0 {
+		return eh.EventStoreError{
+			Err:       eh.ErrNoEventsToAppend,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	ns := eh.NamespaceFromContext(ctx)
+
+	// Build all event records, with incrementing versions starting from the
+	// original aggregate version.
+	dbEvents := make([]dbEvent, len(events))
+	aggregateID := events[0].AggregateID()
+	version := originalVersion
+	for i, event := range events {
+		// Only accept events belonging to the same aggregate.
+		if event.AggregateID() != aggregateID {
+			return eh.EventStoreError{
+				Err:       eh.ErrInvalidEvent,
+				Namespace: ns,
+			}
+		}
+
+		// Only accept events that apply to the correct aggregate version.
+		if event.Version() != version+1 {
+			return eh.EventStoreError{
+				Err:       eh.ErrIncorrectEventVersion,
+				Namespace: ns,
+			}
+		}
+
+		// Create the event record.
+		e, err := newDBEvent(ctx, event)
+		if err != nil {
+			return err
+		}
+		dbEvents[i] = *e
+		version++
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return eh.EventStoreError{
+			Err:       ErrClosed,
+			Namespace: ns,
+		}
+	}
+
+	// Only append if the version of the aggregate is matching (ie not changed
+	// since loading the aggregate).
+	if len(s.nsIndex(ns).aggregates[aggregateID]) != originalVersion {
+		return eh.EventStoreError{
+			Err:       eh.ErrVersionConflict,
+			Namespace: ns,
+		}
+	}
+
+	// Assign global positions to the events, only kept if they are saved.
+	position := s.position
+	for i := range dbEvents {
+		position++
+		dbEvents[i].Position = position
+	}
+
+	locations, err := s.append(dbEvents)
+	if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: ns,
+		}
+	}
+	for i, e := range dbEvents {
+		s.indexRecord(e, locations[i])
+	}
+
+	return nil
+}
+
+// Load implements the Load method of the eventhorizon.EventStore interface.
+func (s *EventStore) Load(ctx context.Context, id eh.ID) ([]eh.Event, error) {
+	return s.LoadFromVersion(ctx, id, 0)
+}
+
+// LoadFromVersion implements the LoadFromVersion method of the eventhorizon.VersionedEventStore interface.
+// The events before the version are not read, as the events of an aggregate
+// are indexed in order of version, starting at 1.
+func (s *EventStore) LoadFromVersion(ctx context.Context, id eh.ID, version int) ([]eh.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	var locations []location
+	if idx, ok := s.index[ns]; ok {
+		locations = idx.aggregates[id]
+	}
+	if version > len(locations) {
+		version = len(locations)
+	}
+	if version > 0 {
+		locations = locations[version:]
+	}
+
+	return s.readEvents(ctx, locations)
+}
+
+// LoadAll implements the LoadAll method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadAll(ctx context.Context, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	return s.LoadFrom(ctx, 0, 0, aggregateTypes...)
+}
+
+// LoadFrom implements the LoadFrom method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadFrom(ctx context.Context, position int64, limit int, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	var locations []location
+	if idx, ok := s.index[ns]; ok {
+		i := sort.Search(len(idx.stream), func(i int) bool {
+			return idx.stream[i].position > position
+		})
+		locations = idx.stream[i:]
+	}
+
+	if len(aggregateTypes) == 0 {
+		if limit > 0 && len(locations) > limit {
+			locations = locations[:limit]
+		}
+		return s.readEvents(ctx, locations)
+	}
+
+	// Read the events one at a time when filtering, to stop at the limit.
+	filtered := []eh.Event{}
+	for _, loc := range locations {
+		if limit > 0 && len(filtered) >= limit {
+			break
+		}
+		events, err := s.readEvents(ctx, []location{loc})
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range aggregateTypes {
+			if events[0].AggregateType() == t {
+				filtered = append(filtered, events[0])
+				break
+			}
+		}
+	}
+	return filtered, nil
+}
+
+// Replace implements the Replace method of the eventhorizon.EventStore interface.
+func (s *EventStore) Replace(ctx context.Context, event eh.Event) error {
+	ns := eh.NamespaceFromContext(ctx)
+
+	e, err := newDBEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return eh.EventStoreError{
+			Err:       ErrClosed,
+			Namespace: ns,
+		}
+	}
+
+	locations, ok := s.nsIndex(ns).aggregates[event.AggregateID()]
+	if !ok {
+		return eh.ErrAggregateNotFound
+	}
+	if event.Version() < 1 || event.Version() > len(locations) {
+		return eh.ErrInvalidEvent
+	}
+
+	// Append the new record, keeping the position in the global stream.
+	e.Position = locations[event.Version()-1].position
+	newLocations, err := s.append([]dbEvent{*e})
+	if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: ns,
+		}
+	}
+	s.indexRecord(*e, newLocations[0])
+
+	return nil
+}
+
+// RenameEvent implements the RenameEvent method of the eventhorizon.EventStore interface.
+func (s *EventStore) RenameEvent(ctx context.Context, from, to eh.EventType) error {
+	ns := eh.NamespaceFromContext(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return eh.EventStoreError{
+			Err:       ErrClosed,
+			Namespace: ns,
+		}
+	}
+
+	// Find all matching events and append renamed records for them.
+	renamed := []dbEvent{}
+	for _, loc := range s.nsIndex(ns).stream {
+		e, err := s.readRecord(loc)
+		if err != nil {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotLoadAggregate,
+				Namespace: ns,
+			}
+		}
+		if e.EventType == from {
+			e.EventType = to
+			renamed = append(renamed, e)
+		}
+	}
+	if len(renamed) == 0 {
+		return nil
+	}
+
+	locations, err := s.append(renamed)
+	if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: ns,
+		}
+	}
+	for i, e := range renamed {
+		s.indexRecord(e, locations[i])
+	}
+
+	return nil
+}
+
+// Close syncs and closes the log files.
+func (s *EventStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.syncDone != nil {
+		close(s.syncDone)
+		s.syncDone = nil
+	}
+	s.mu.Unlock()
+	s.syncWg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.sync()
+	if closeErr := s.closeSegments(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Sync syncs the log to disk, useful with the SyncNever policy.
+func (s *EventStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sync()
+}
+
+// sync syncs the active segment if there are unsynced writes. Older segments
+// are synced when a new segment is started. The lock must be held.
+func (s *EventStore) sync() error {
+	if !s.dirty || len(s.segments) == 0 {
+		return nil
+	}
+	if err := s.segments[len(s.segments)-1].file.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// syncPeriodically syncs the log with an interval until done is closed.
+func (s *EventStore) syncPeriodically(interval time.Duration, done <-chan struct{}) {
+	defer s.syncWg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.sync()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// nsIndex returns the index of a namespace, creating it if needed. The write
+// lock must be held.
+func (s *EventStore) nsIndex(ns string) *nsIndex {
+	idx, ok := s.index[ns]
+	if !ok {
+		idx = &nsIndex{
+			aggregates: map[eh.ID][]location{},
+		}
+		s.index[ns] = idx
+	}
+	return idx
+}
+
+// indexRecord adds a record to the index, replacing any previous record for
+// the same event version.
+func (s *EventStore) indexRecord(e dbEvent, loc location) {
+	idx := s.nsIndex(e.Namespace)
+
+	locations := idx.aggregates[e.AggregateID]
+	if e.Version <= len(locations) {
+		locations[e.Version-1] = loc
+		i := sort.Search(len(idx.stream), func(i int) bool {
+			return idx.stream[i].position >= loc.position
+		})
+		if i < len(idx.stream) && idx.stream[i].position == loc.position {
+			idx.stream[i] = loc
+		}
+		return
+	}
+	idx.aggregates[e.AggregateID] = append(locations, loc)
+	idx.stream = append(idx.stream, loc)
+
+	if loc.position > s.position {
+		s.position = loc.position
+	}
+}
+
+// readEvents reads the events at the locations. The read lock must be held.
+func (s *EventStore) readEvents(ctx context.Context, locations []location) ([]eh.Event, error) {
+	events := make([]eh.Event, len(locations))
+	for i, loc := range locations {
+		e, err := s.readRecord(loc)
+		if err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotLoadAggregate,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		if events[i], err = newEvent(ctx, e); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// dbEvent is the internal event record for the file event store, stored as
+// JSON in the log records.
+type dbEvent struct {
+	Namespace     string                 `json:"namespace"`
+	Position      int64                  `json:"position"`
+	EventType     eh.EventType           `json:"event_type"`
+	RawData       json.RawMessage        `json:"data,omitempty"`
+	data          eh.EventData           `json:"-"`
+	Timestamp     time.Time              `json:"timestamp"`
+	AggregateType eh.AggregateType       `json:"aggregate_type"`
+	AggregateID   eh.ID                  `json:"aggregate_id"`
+	Version       int                    `json:"version"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	SchemaVersion int                    `json:"schema_version,omitempty"`
+}
+
+// newDBEvent returns a new dbEvent for an event.
+func newDBEvent(ctx context.Context, event eh.Event) (*dbEvent, error) {
+	// Marshal event data if there is any.
+	var rawData json.RawMessage
+	if event.Data() != nil {
+		var err error
+		if rawData, err = json.Marshal(event.Data()); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotMarshalEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	return &dbEvent{
+		Namespace:     eh.NamespaceFromContext(ctx),
+		EventType:     event.EventType(),
+		RawData:       rawData,
+		Timestamp:     event.Timestamp(),
+		AggregateType: event.AggregateType(),
+		AggregateID:   event.AggregateID(),
+		Version:       event.Version(),
+		Metadata:      event.Metadata(),
+		SchemaVersion: eh.EventSchemaVersion(event.EventType()),
+	}, nil
+}
+
+// newEvent returns an event with concrete event data from a dbEvent.
+func newEvent(ctx context.Context, e dbEvent) (eh.Event, error) {
+	// Upcast the raw JSON data if there is a newer schema version.
+	if eh.EventSchemaVersion(e.EventType) > e.SchemaVersion {
+		var err error
+		if e, err = upcast(e); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotUpcastEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	// Create an event of the correct type.
+	if len(e.RawData) > 0 {
+		if data, err := eh.CreateEventData(e.EventType); err == nil {
+			if err := json.Unmarshal(e.RawData, data); err != nil {
+				return nil, eh.EventStoreError{
+					BaseErr:   err,
+					Err:       ErrCouldNotUnmarshalEvent,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			e.data = data
+		}
+	}
+
+	return event{dbEvent: e}, nil
+}
+
+// upcast upcasts the raw JSON data of an event record to the current schema
+// version of its event type.
+func upcast(e dbEvent) (dbEvent, error) {
+	var data []byte
+	if len(e.RawData) > 0 {
+		data = e.RawData
+	}
+
+	var err error
+	e.EventType, e.SchemaVersion, data, err = eh.UpcastRawEventData(
+		e.EventType, e.SchemaVersion, data, json.Unmarshal, json.Marshal)
+	if err != nil {
+		return e, err
+	}
+	e.RawData = data
+
+	return e, nil
+}
+
+// event is the private implementation of the eventhorizon.Event interface
+// for a file event store.
+type event struct {
+	dbEvent
+}
+
+// AggrgateID implements the AggrgateID method of the eventhorizon.Event interface.
+func (e event) AggregateID() eh.ID {
+	return e.dbEvent.AggregateID
+}
+
+// AggregateType implements the AggregateType method of the eventhorizon.Event interface.
+func (e event) AggregateType() eh.AggregateType {
+	return e.dbEvent.AggregateType
+}
+
+// EventType implements the EventType method of the eventhorizon.Event interface.
+func (e event) EventType() eh.EventType {
+	return e.dbEvent.EventType
+}
+
+// Data implements the Data method of the eventhorizon.Event interface.
+func (e event) Data() eh.EventData {
+	return e.dbEvent.data
+}
+
+// Metadata implements the Metadata method of the eventhorizon.Event interface.
+func (e event) Metadata() map[string]interface{} {
+	return e.dbEvent.Metadata
+}
+
+// Version implements the Version method of the eventhorizon.Event interface.
+func (e event) Version() int {
+	return e.dbEvent.Version
+}
+
+// Timestamp implements the Timestamp method of the eventhorizon.Event interface.
+func (e event) Timestamp() time.Time {
+	return e.dbEvent.Timestamp
+}
+
+// Position implements the Position method of the eventhorizon.PositionedEvent interface.
+func (e event) Position() int64 {
+	return e.dbEvent.Position
+}
+
+// String implements the String method of the eventhorizon.Event interface.
+func (e event) String() string {
+	return fmt.Sprintf("%s@%d", e.dbEvent.EventType, e.dbEvent.Version)
+}
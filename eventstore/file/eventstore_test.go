@@ -0,0 +1,278 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventstore"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func TestEventStore(t *testing.T) {
+	store, err := NewEventStore(t.TempDir())
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if store == nil {
+		t.Fatal("there should be a store")
+	}
+	defer store.Close()
+
+	ctx := eh.NewContextWithNamespace(context.Background(), "ns")
+
+	t.Log("event store with default namespace")
+	eventstore.AcceptanceTest(t, context.Background(), store)
+
+	t.Log("event store with other namespace")
+	eventstore.AcceptanceTest(t, ctx, store)
+
+	t.Log("global event store with default namespace")
+	eventstore.GlobalAcceptanceTest(t, context.Background(), store)
+
+	t.Log("global event store with other namespace")
+	eventstore.GlobalAcceptanceTest(t, ctx, store)
+
+	t.Log("upcasting event store with default namespace")
+	eventstore.UpcastAcceptanceTest(t, context.Background(), store)
+
+	t.Log("upcasting event store with other namespace")
+	eventstore.UpcastAcceptanceTest(t, ctx, store)
+
+	t.Log("event store maintainer")
+	eventstore.MaintainerAcceptanceTest(t, context.Background(), store)
+}
+
+func TestEventStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewEventStore(dir)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	store.SetMaxSegmentSize(512)
+
+	ctx := context.Background()
+	id := uuid.New().String()
+	saved := saveEvents(t, store, id, 0, 10)
+
+	// Replace one event, which should be kept after reopening.
+	replaced := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "replaced"},
+		time.Now().UTC(), mocks.AggregateType, id, 3)
+	if err := store.Replace(ctx, replaced); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	saved[2] = replaced
+	if err := store.Close(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	segments, err := segmentIDs(dir)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(segments) < 2 {
+		t.Error("there should be multiple segments:", segments)
+	}
+
+	store, err = NewEventStore(dir)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer store.Close()
+	assertEvents(t, store, id, saved)
+
+	// The positions should continue after reopening.
+	events, err := store.LoadAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	last := events[len(events)-1].(eh.PositionedEvent).Position()
+	saved = append(saved, saveEvents(t, store, id, 10, 1)...)
+	events, err = store.LoadFrom(ctx, last, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 1 {
+		t.Fatal("there should be one new event:", events)
+	}
+	if err := mocks.CompareEvents(events[0], saved[10]); err != nil {
+		t.Error("the event should be correct:", err)
+	}
+}
+
+func TestEventStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewEventStore(dir)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	id := uuid.New().String()
+	saved := saveEvents(t, store, id, 0, 2)
+	saveEvents(t, store, id, 2, 3)
+	if err := store.Close(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// Cut the last batch in the middle of its last record, as if the process
+	// crashed while writing.
+	path := filepath.Join(dir, "00000000000000000000.log")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := os.Truncate(path, fi.Size()-10); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	store, err = NewEventStore(dir)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	defer store.Close()
+
+	// The whole partially written batch should be removed.
+	assertEvents(t, store, id, saved)
+	saved = append(saved, saveEvents(t, store, id, 2, 1)...)
+	assertEvents(t, store, id, saved)
+}
+
+func TestEventStoreCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewEventStore(dir)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	id := uuid.New().String()
+	saved := saveEvents(t, store, id, 0, 1)
+	saveEvents(t, store, id, 1, 1)
+	if err := store.Close(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// Flip a byte in the payload of the last record.
+	path := filepath.Join(dir, "00000000000000000000.log")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	b[len(b)-2] ^= 0xff
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	store, err = NewEventStore(dir)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	assertEvents(t, store, id, saved)
+	if err := store.Close(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// A corrupt record in an older segment can not be recovered.
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001.log"), nil, 0644); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	b, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	b[len(b)-2] ^= 0xff
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	_, err = NewEventStore(dir)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != ErrCorruptLog {
+		t.Error("there should be a corrupt log error:", err)
+	}
+}
+
+func TestEventStoreSyncPolicies(t *testing.T) {
+	store, err := NewEventStore(t.TempDir())
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	id := uuid.New().String()
+
+	store.SetSyncPolicy(SyncNever, 0)
+	saved := saveEvents(t, store, id, 0, 1)
+	if !store.dirty {
+		t.Error("the log should not be synced")
+	}
+	if err := store.Sync(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if store.dirty {
+		t.Error("the log should be synced")
+	}
+
+	store.SetSyncPolicy(SyncPeriodically, time.Millisecond)
+	saved = append(saved, saveEvents(t, store, id, 1, 1)...)
+	time.Sleep(20 * time.Millisecond)
+	store.mu.RLock()
+	dirty := store.dirty
+	store.mu.RUnlock()
+	if dirty {
+		t.Error("the log should be synced in the background")
+	}
+
+	assertEvents(t, store, id, saved)
+	if err := store.Close(); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := store.Save(context.Background(), []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, nil, time.Now(), mocks.AggregateType, id, 3),
+	}, 2); err == nil {
+		t.Error("there should be an error when closed")
+	}
+}
+
+func saveEvents(t *testing.T, store *EventStore, id eh.ID, version, n int) []eh.Event {
+	events := make([]eh.Event, n)
+	for i := range events {
+		events[i] = eh.NewEventForAggregate(mocks.EventType,
+			&mocks.EventData{Content: uuid.New().String()},
+			time.Now().UTC(), mocks.AggregateType, id, version+i+1)
+	}
+	if err := store.Save(context.Background(), events, version); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	return events
+}
+
+func assertEvents(t *testing.T, store *EventStore, id eh.ID, expected []eh.Event) {
+	events, err := store.Load(context.Background(), id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("there should be %d events: %v", len(expected), events)
+	}
+	for i, event := range events {
+		if err := mocks.CompareEvents(event, expected[i]); err != nil {
+			t.Error("the event was incorrect:", err)
+		}
+		if event.Version() != i+1 {
+			t.Error("the event version should be correct:", event, event.Version())
+		}
+	}
+}
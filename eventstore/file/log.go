@@ -0,0 +1,336 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// Each record is written as a header with the length and the CRC of the
+// payload, followed by the payload.
+const headerSize = 8
+
+// The extension of the log segment files.
+const segmentExt = ".log"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord is when a record is incomplete or has an incorrect checksum.
+var errTornRecord = errors.New("torn record")
+
+// segment is a log segment file.
+type segment struct {
+	id   int
+	file *os.File
+	size int64
+}
+
+// record is the payload of a log record.
+type record struct {
+	dbEvent
+	// Remaining is the number of records after this one that were written
+	// in the same batch, used to not recover partially written batches.
+	Remaining int `json:"remaining,omitempty"`
+}
+
+// open opens all segments, indexing the records and truncating any torn
+// write at the end of the last segment.
+func (s *EventStore) open() error {
+	ids, err := segmentIDs(s.dir)
+	if err != nil {
+		return eh.EventStoreError{
+			BaseErr: err,
+			Err:     ErrCouldNotOpenLog,
+		}
+	}
+
+	for i, id := range ids {
+		f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0644)
+		if err != nil {
+			return eh.EventStoreError{
+				BaseErr: err,
+				Err:     ErrCouldNotOpenLog,
+			}
+		}
+		seg := &segment{id: id, file: f}
+		s.segments = append(s.segments, seg)
+
+		if err := s.recover(seg, len(s.segments)-1, i == len(ids)-1); err != nil {
+			return err
+		}
+	}
+
+	if len(s.segments) == 0 {
+		if err := s.newSegment(0); err != nil {
+			return eh.EventStoreError{
+				BaseErr: err,
+				Err:     ErrCouldNotOpenLog,
+			}
+		}
+	}
+
+	return nil
+}
+
+// recover reads and indexes all records in a segment. If the segment is the
+// last one any torn write is truncated, otherwise it is a corrupt log.
+func (s *EventStore) recover(seg *segment, idx int, last bool) error {
+	fi, err := seg.file.Stat()
+	if err != nil {
+		return eh.EventStoreError{
+			BaseErr: err,
+			Err:     ErrCouldNotOpenLog,
+		}
+	}
+	fileSize := fi.Size()
+
+	// Records are only indexed when their whole batch has been read.
+	var batch []record
+	var batchLocations []location
+	var batchStart, offset int64
+	for offset < fileSize {
+		r, size, err := readRecordAt(seg.file, offset, fileSize)
+		if err == errTornRecord {
+			break
+		} else if err != nil {
+			return eh.EventStoreError{
+				BaseErr: err,
+				Err:     ErrCouldNotOpenLog,
+			}
+		}
+
+		if len(batch) == 0 {
+			batchStart = offset
+		}
+		batch = append(batch, r)
+		batchLocations = append(batchLocations, location{
+			segment:  idx,
+			offset:   offset,
+			size:     size,
+			position: r.Position,
+		})
+		offset += size
+
+		if r.Remaining == 0 {
+			for i, r := range batch {
+				s.indexRecord(r.dbEvent, batchLocations[i])
+			}
+			batch, batchLocations = nil, nil
+		}
+	}
+	if len(batch) == 0 {
+		batchStart = offset
+	}
+
+	if batchStart == fileSize {
+		seg.size = fileSize
+		return nil
+	}
+	if !last {
+		return eh.EventStoreError{
+			BaseErr: fmt.Errorf("segment %d at offset %d", seg.id, batchStart),
+			Err:     ErrCorruptLog,
+		}
+	}
+
+	// Truncate the torn write, including the partially written batch.
+	if err := seg.file.Truncate(batchStart); err != nil {
+		return eh.EventStoreError{
+			BaseErr: err,
+			Err:     ErrCouldNotOpenLog,
+		}
+	}
+	if err := seg.file.Sync(); err != nil {
+		return eh.EventStoreError{
+			BaseErr: err,
+			Err:     ErrCouldNotOpenLog,
+		}
+	}
+	seg.size = batchStart
+
+	return nil
+}
+
+// append writes the events as one batch at the end of the log, starting a new
+// segment if needed, and returns their locations. The lock must be held.
+func (s *EventStore) append(events []dbEvent) ([]location, error) {
+	buf := []byte{}
+	sizes := make([]int64, len(events))
+	for i, e := range events {
+		payload, err := json.Marshal(record{
+			dbEvent:   e,
+			Remaining: len(events) - 1 - i,
+		})
+		if err != nil {
+			return nil, err
+		}
+		header := make([]byte, headerSize)
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, crcTable))
+		buf = append(buf, header...)
+		buf = append(buf, payload...)
+		sizes[i] = int64(headerSize + len(payload))
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	if seg.size > 0 && seg.size+int64(len(buf)) > s.maxSegmentSize {
+		// Sync the full segment before starting a new one, as it will not be
+		// synced later on.
+		if err := s.sync(); err != nil {
+			return nil, err
+		}
+		if err := s.newSegment(seg.id + 1); err != nil {
+			return nil, err
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+		// Remove any partial write.
+		seg.file.Truncate(seg.size)
+		return nil, err
+	}
+	if s.syncPolicy == SyncAlways {
+		if err := seg.file.Sync(); err != nil {
+			seg.file.Truncate(seg.size)
+			return nil, err
+		}
+	} else {
+		s.dirty = true
+	}
+
+	locations := make([]location, len(events))
+	offset := seg.size
+	for i, e := range events {
+		locations[i] = location{
+			segment:  len(s.segments) - 1,
+			offset:   offset,
+			size:     sizes[i],
+			position: e.Position,
+		}
+		offset += sizes[i]
+	}
+	seg.size = offset
+
+	return locations, nil
+}
+
+// readRecord reads and verifies the record at a location.
+func (s *EventStore) readRecord(loc location) (dbEvent, error) {
+	seg := s.segments[loc.segment]
+	r, _, err := readRecordAt(seg.file, loc.offset, loc.offset+loc.size)
+	if err != nil {
+		return dbEvent{}, err
+	}
+	return r.dbEvent, nil
+}
+
+// newSegment creates a new empty segment and makes it the active one.
+func (s *EventStore) newSegment(id int) error {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, &segment{id: id, file: f})
+
+	// Sync the directory to persist the new file.
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// closeSegments closes all segment files.
+func (s *EventStore) closeSegments() error {
+	var err error
+	for _, seg := range s.segments {
+		if closeErr := seg.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	s.segments = nil
+	return err
+}
+
+func (s *EventStore) segmentPath(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// readRecordAt reads a record at an offset, not reading past the end. It
+// returns errTornRecord if the record is incomplete or corrupt.
+func readRecordAt(r io.ReaderAt, offset, end int64) (record, int64, error) {
+	if end-offset < headerSize {
+		return record{}, 0, errTornRecord
+	}
+	header := make([]byte, headerSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return record{}, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > end-offset-headerSize {
+		return record{}, 0, errTornRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+headerSize); err != nil {
+		return record{}, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return record{}, 0, errTornRecord
+	}
+
+	var rec record
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return record{}, 0, errTornRecord
+	}
+	return rec, headerSize + length, nil
+}
+
+// segmentIDs returns the IDs of all segments in the directory, in order.
+func segmentIDs(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
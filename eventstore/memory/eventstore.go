@@ -16,8 +16,11 @@ package memory
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -27,23 +30,55 @@ import (
 // ErrCouldNotSaveAggregate is when an aggregate could not be saved.
 var ErrCouldNotSaveAggregate = errors.New("could not save aggregate")
 
+// ErrCouldNotUpcastEvent is when an event could not be upcasted.
+var ErrCouldNotUpcastEvent = errors.New("could not upcast event")
+
 // EventStore implements EventStore as an in memory structure.
 type EventStore struct {
 	// The outer map is with namespace as key, the inner with aggregate ID.
 	db   map[string]map[eh.ID]aggregateRecord
 	dbMu sync.RWMutex
+
+	// The last global event position, with namespace as key.
+	positions map[string]int64
+
+	// The audit records of maintenance operations, with namespace as key.
+	audit map[string][]eh.AuditRecord
+
+	// The unpublished events, with namespace as key.
+	outbox map[string][]dbEvent
+
+	archive eh.EventStore
 }
 
 // NewEventStore creates a new EventStore using memory as storage.
 func NewEventStore() *EventStore {
 	s := &EventStore{
-		db: map[string]map[eh.ID]aggregateRecord{},
+		db:        map[string]map[eh.ID]aggregateRecord{},
+		positions: map[string]int64{},
+		audit:     map[string][]eh.AuditRecord{},
+		outbox:    map[string][]dbEvent{},
 	}
 	return s
 }
 
+// SetArchive sets the store that aggregates are archived to, it must not be
+// the store itself.
+func (s *EventStore) SetArchive(archive eh.EventStore) {
+	s.archive = archive
+}
+
 // Save implements the Save method of the eventhorizon.EventStore interface.
 func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersion int) error {
+	return s.save(ctx, events, originalVersion, false)
+}
+
+// SaveWithOutbox implements the SaveWithOutbox method of the eventhorizon.OutboxEventStore interface.
+func (s *EventStore) SaveWithOutbox(ctx context.Context, events []eh.Event, originalVersion int) error {
+	return s.save(ctx, events, originalVersion, true)
+}
+
+func (s *EventStore) save(ctx context.Context, events []eh.Event, originalVersion int, outbox bool) error {
 	if len(events) == 0 {
 		return eh.EventStoreError{
 			Err:       eh.ErrNoEventsToAppend,
@@ -83,8 +118,38 @@ func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersio
 	s.dbMu.Lock()
 	defer s.dbMu.Unlock()
 
+	// Retired aggregates can not be saved to.
+	if aggregate, ok := s.db[ns][aggregateID]; ok {
+		if aggregate.Tombstoned {
+			return eh.EventStoreError{
+				Err:       eh.ErrAggregateDeleted,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		} else if aggregate.Archived {
+			return eh.EventStoreError{
+				Err:       eh.ErrAggregateArchived,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	// Assign global positions to the events, only kept if they are saved.
+	position := s.positions[ns]
+	for i := range dbEvents {
+		position++
+		dbEvents[i].Position = position
+	}
+
 	// Either insert a new aggregate or append to an existing.
 	if originalVersion == 0 {
+		// Only insert if the aggregate does not already exist.
+		if _, ok := s.db[ns][aggregateID]; ok {
+			return eh.EventStoreError{
+				Err:       eh.ErrVersionConflict,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
 		aggregate := aggregateRecord{
 			AggregateID: aggregateID,
 			Version:     len(dbEvents),
@@ -92,30 +157,42 @@ func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersio
 		}
 
 		s.db[ns][aggregateID] = aggregate
+		if outbox {
+			s.outbox[ns] = append(s.outbox[ns], dbEvents...)
+		}
 	} else {
 		// Increment aggregate version on insert of new event record, and
 		// only insert if version of aggregate is matching (ie not changed
 		// since loading the aggregate).
-		if aggregate, ok := s.db[ns][aggregateID]; ok {
-			if aggregate.Version != originalVersion {
-				return eh.EventStoreError{
-					Err:       ErrCouldNotSaveAggregate,
-					Namespace: eh.NamespaceFromContext(ctx),
-				}
+		aggregate, ok := s.db[ns][aggregateID]
+		if !ok || aggregate.Version != originalVersion {
+			return eh.EventStoreError{
+				Err:       eh.ErrVersionConflict,
+				Namespace: eh.NamespaceFromContext(ctx),
 			}
+		}
 
-			aggregate.Version += len(dbEvents)
-			aggregate.Events = append(aggregate.Events, dbEvents...)
+		aggregate.Version += len(dbEvents)
+		aggregate.Events = append(aggregate.Events, dbEvents...)
 
-			s.db[ns][aggregateID] = aggregate
+		s.db[ns][aggregateID] = aggregate
+		if outbox {
+			s.outbox[ns] = append(s.outbox[ns], dbEvents...)
 		}
 	}
 
+	s.positions[ns] = position
+
 	return nil
 }
 
 // Load implements the Load method of the eventhorizon.EventStore interface.
 func (s *EventStore) Load(ctx context.Context, id eh.ID) ([]eh.Event, error) {
+	return s.LoadFromVersion(ctx, id, 0)
+}
+
+// LoadFromVersion implements the LoadFromVersion method of the eventhorizon.VersionedEventStore interface.
+func (s *EventStore) LoadFromVersion(ctx context.Context, id eh.ID, version int) ([]eh.Event, error) {
 	s.dbMu.RLock()
 	defer s.dbMu.RUnlock()
 
@@ -127,11 +204,86 @@ func (s *EventStore) Load(ctx context.Context, id eh.ID) ([]eh.Event, error) {
 	aggregate, ok := s.db[ns][id]
 	if !ok {
 		return []eh.Event{}, nil
+	} else if aggregate.Tombstoned {
+		return nil, eh.EventStoreError{
+			Err:       eh.ErrAggregateDeleted,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if aggregate.Archived {
+		if s.archive == nil {
+			return nil, eh.EventStoreError{
+				Err:       eh.ErrNoArchive,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		events, err := s.archive.Load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		for len(events) > 0 && events[0].Version() <= version {
+			events = events[1:]
+		}
+		return events, nil
 	}
 
-	events := make([]eh.Event, len(aggregate.Events))
-	for i, dbEvent := range aggregate.Events {
-		events[i] = event{dbEvent: dbEvent}
+	events := make([]eh.Event, 0, len(aggregate.Events))
+	for _, dbEvent := range aggregate.Events {
+		if dbEvent.Version <= version {
+			continue
+		}
+		e, err := upcast(dbEvent)
+		if err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotUpcastEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		events = append(events, event{dbEvent: e})
+	}
+
+	return events, nil
+}
+
+// LoadAll implements the LoadAll method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadAll(ctx context.Context, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	return s.LoadFrom(ctx, 0, 0, aggregateTypes...)
+}
+
+// LoadFrom implements the LoadFrom method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadFrom(ctx context.Context, position int64, limit int, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	// Ensure that the namespace exists.
+	ns := s.namespace(ctx)
+
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	dbEvents := []dbEvent{}
+	for _, aggregate := range s.db[ns] {
+		for _, e := range aggregate.Events {
+			if e.Position > position && matchAggregateType(e.AggregateType, aggregateTypes) {
+				dbEvents = append(dbEvents, e)
+			}
+		}
+	}
+	sort.Slice(dbEvents, func(i, j int) bool {
+		return dbEvents[i].Position < dbEvents[j].Position
+	})
+	if limit > 0 && len(dbEvents) > limit {
+		dbEvents = dbEvents[:limit]
+	}
+
+	events := make([]eh.Event, len(dbEvents))
+	for i, dbEvent := range dbEvents {
+		e, err := upcast(dbEvent)
+		if err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotUpcastEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		events[i] = event{dbEvent: e}
 	}
 
 	return events, nil
@@ -162,10 +314,15 @@ func (s *EventStore) Replace(ctx context.Context, event eh.Event) error {
 		return eh.ErrInvalidEvent
 	}
 
-	// Replace event.
+	// Replace event, keeping its position in the global event stream.
 	s.dbMu.Lock()
 	defer s.dbMu.Unlock()
-	aggregate.Events[idx] = newDBEvent(event)
+	e := newDBEvent(event)
+	e.Position = aggregate.Events[idx].Position
+	aggregate.Events[idx] = e
+
+	s.audit[ns] = append(s.audit[ns], eh.NewAuditRecord(ctx, eh.ReplaceOperation,
+		event.AggregateID(), fmt.Sprintf("version %d", event.Version())))
 
 	return nil
 }
@@ -196,6 +353,236 @@ func (s *EventStore) RenameEvent(ctx context.Context, from, to eh.EventType) err
 		s.db[ns][id] = aggregate
 	}
 
+	s.audit[ns] = append(s.audit[ns], eh.NewAuditRecord(ctx, eh.RenameEventOperation,
+		"", fmt.Sprintf("%s to %s", from, to)))
+
+	return nil
+}
+
+// Delete implements the Delete method of the eventhorizon.EventStreamMaintainer interface.
+func (s *EventStore) Delete(ctx context.Context, id eh.ID) error {
+	// Ensure that the namespace exists.
+	ns := s.namespace(ctx)
+
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	aggregate, ok := s.db[ns][id]
+	if !ok {
+		return eh.ErrAggregateNotFound
+	}
+
+	// Also delete the archived events, which must be possible to not leave
+	// them behind.
+	if aggregate.Archived {
+		if s.archive == nil {
+			return eh.EventStoreError{
+				Err:       eh.ErrNoArchive,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		archive, ok := s.archive.(eh.EventStreamMaintainer)
+		if !ok {
+			return eh.EventStoreError{
+				Err:       eh.ErrArchiveNotMaintainer,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		if err := archive.Delete(ctx, id); err != nil && err != eh.ErrAggregateNotFound {
+			return err
+		}
+	}
+
+	delete(s.db[ns], id)
+
+	s.audit[ns] = append(s.audit[ns], eh.NewAuditRecord(ctx, eh.DeleteOperation,
+		id, fmt.Sprintf("version %d", aggregate.Version)))
+
+	return nil
+}
+
+// Tombstone implements the Tombstone method of the eventhorizon.EventStreamMaintainer interface.
+func (s *EventStore) Tombstone(ctx context.Context, id eh.ID) error {
+	// Ensure that the namespace exists.
+	ns := s.namespace(ctx)
+
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	aggregate, ok := s.db[ns][id]
+	if !ok {
+		return eh.ErrAggregateNotFound
+	}
+
+	aggregate.Tombstoned = true
+	s.db[ns][id] = aggregate
+
+	s.audit[ns] = append(s.audit[ns], eh.NewAuditRecord(ctx, eh.TombstoneOperation,
+		id, fmt.Sprintf("version %d", aggregate.Version)))
+
+	return nil
+}
+
+// Archive implements the Archive method of the eventhorizon.EventStreamMaintainer interface.
+func (s *EventStore) Archive(ctx context.Context, id eh.ID) error {
+	if s.archive == nil {
+		return eh.EventStoreError{
+			Err:       eh.ErrNoArchive,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	// Ensure that the namespace exists.
+	ns := s.namespace(ctx)
+
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	aggregate, ok := s.db[ns][id]
+	if !ok {
+		return eh.ErrAggregateNotFound
+	} else if aggregate.Archived {
+		return nil
+	}
+
+	// Save the events to the archive before removing them.
+	events := make([]eh.Event, len(aggregate.Events))
+	for i, dbEvent := range aggregate.Events {
+		e, err := upcast(dbEvent)
+		if err != nil {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotUpcastEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		events[i] = event{dbEvent: e}
+	}
+	if len(events) > 0 {
+		if err := eh.ArchiveEvents(ctx, s.archive, id, events); err != nil {
+			return err
+		}
+	}
+
+	aggregate.Archived = true
+	aggregate.Events = nil
+	s.db[ns][id] = aggregate
+
+	s.audit[ns] = append(s.audit[ns], eh.NewAuditRecord(ctx, eh.ArchiveOperation,
+		id, fmt.Sprintf("version %d", aggregate.Version)))
+
+	return nil
+}
+
+// AuditLog implements the AuditLog method of the eventhorizon.EventStreamMaintainer interface.
+func (s *EventStore) AuditLog(ctx context.Context) ([]eh.AuditRecord, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	records := make([]eh.AuditRecord, len(s.audit[eh.NamespaceFromContext(ctx)]))
+	copy(records, s.audit[eh.NamespaceFromContext(ctx)])
+	return records, nil
+}
+
+// OutboxNamespaces implements the OutboxNamespaces method of the eventhorizon.Outbox interface.
+func (s *EventStore) OutboxNamespaces(ctx context.Context) ([]string, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	namespaces := []string{}
+	for ns, events := range s.outbox {
+		if len(events) > 0 {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// UnpublishedEvents implements the UnpublishedEvents method of the eventhorizon.Outbox interface.
+func (s *EventStore) UnpublishedEvents(ctx context.Context, limit int) ([]eh.OutboxEntry, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	dbEvents := s.outbox[eh.NamespaceFromContext(ctx)]
+	if limit > 0 && len(dbEvents) > limit {
+		dbEvents = dbEvents[:limit]
+	}
+
+	entries := make([]eh.OutboxEntry, len(dbEvents))
+	for i, dbEvent := range dbEvents {
+		e, err := upcast(dbEvent)
+		if err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotUpcastEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		entries[i] = eh.OutboxEntry{
+			ID:    strconv.FormatInt(dbEvent.Position, 10),
+			Event: event{dbEvent: e},
+		}
+	}
+
+	return entries, nil
+}
+
+// MarkPublished implements the MarkPublished method of the eventhorizon.Outbox interface.
+func (s *EventStore) MarkPublished(ctx context.Context, id string) error {
+	ns := eh.NamespaceFromContext(ctx)
+
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	for i, e := range s.outbox[ns] {
+		if strconv.FormatInt(e.Position, 10) == id {
+			s.outbox[ns] = append(s.outbox[ns][:i:i], s.outbox[ns][i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// LoadSnapshot implements the LoadSnapshot method of the eventhorizon.SnapshotStore interface.
+func (s *EventStore) LoadSnapshot(ctx context.Context, id eh.ID) (*eh.Snapshot, error) {
+	// Ensure that the namespace exists.
+	ns := s.namespace(ctx)
+
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	aggregate, ok := s.db[ns][id]
+	if !ok || aggregate.Snapshot == nil {
+		return nil, nil
+	}
+
+	snapshot := *aggregate.Snapshot
+	return &snapshot, nil
+}
+
+// SaveSnapshot implements the SaveSnapshot method of the eventhorizon.SnapshotStore interface.
+func (s *EventStore) SaveSnapshot(ctx context.Context, id eh.ID, snapshot eh.Snapshot) error {
+	// Ensure that the namespace exists.
+	ns := s.namespace(ctx)
+
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	aggregate, ok := s.db[ns][id]
+	if !ok {
+		return eh.ErrAggregateNotFound
+	}
+
+	// Never replace a newer snapshot.
+	if aggregate.Snapshot != nil && aggregate.Snapshot.Version > snapshot.Version {
+		return nil
+	}
+
+	aggregate.Snapshot = &snapshot
+	s.db[ns][id] = aggregate
+
 	return nil
 }
 
@@ -210,11 +597,27 @@ func (s *EventStore) namespace(ctx context.Context) string {
 	return ns
 }
 
+// Helper to check if an aggregate type is one of the types to match, an empty
+// list matches all types.
+func matchAggregateType(t eh.AggregateType, types []eh.AggregateType) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, at := range types {
+		if t == at {
+			return true
+		}
+	}
+	return false
+}
+
 type aggregateRecord struct {
 	AggregateID eh.ID
 	Version     int
 	Events      []dbEvent
-	// Snapshot    eh.Aggregate
+	Snapshot    *eh.Snapshot
+	Tombstoned  bool
+	Archived    bool
 }
 
 // dbEvent is the internal event record for the memory event store.
@@ -225,6 +628,9 @@ type dbEvent struct {
 	AggregateType eh.AggregateType
 	AggregateID   eh.ID
 	Version       int
+	Position      int64
+	SchemaVersion int
+	Metadata      map[string]interface{}
 }
 
 // newDBEvent returns a new dbEvent for an event.
@@ -236,9 +642,69 @@ func newDBEvent(event eh.Event) dbEvent {
 		AggregateType: event.AggregateType(),
 		AggregateID:   event.AggregateID(),
 		Version:       event.Version(),
+		SchemaVersion: eh.EventSchemaVersion(event.EventType()),
+		Metadata:      copyMetadata(event.Metadata()),
 	}
 }
 
+// copyMetadata makes a shallow copy of the metadata, to not share it with the
+// saved or loaded events.
+func copyMetadata(metadata map[string]interface{}) map[string]interface{} {
+	if metadata == nil {
+		return nil
+	}
+	m := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		m[k] = v
+	}
+	return m
+}
+
+// upcast upcasts an event record if there is a newer schema version of its
+// event type. JSON is used to convert the data to and from its raw form.
+func upcast(e dbEvent) (dbEvent, error) {
+	if eh.EventSchemaVersion(e.EventType) <= e.SchemaVersion {
+		return e, nil
+	}
+
+	var raw []byte
+	if e.Data != nil {
+		var err error
+		if raw, err = json.Marshal(e.Data); err != nil {
+			return e, err
+		}
+	}
+
+	var err error
+	e.EventType, e.SchemaVersion, raw, err = eh.UpcastRawEventData(
+		e.EventType, e.SchemaVersion, raw, json.Unmarshal, json.Marshal)
+	if err != nil {
+		return e, err
+	}
+	e.Data = nil
+	if raw == nil {
+		return e, nil
+	}
+
+	// Decode into the concrete data of the new type, or keep the raw data if
+	// it is not registered.
+	data, err := eh.CreateEventData(e.EventType)
+	if err != nil {
+		var rawData map[string]interface{}
+		if err := json.Unmarshal(raw, &rawData); err != nil {
+			return e, err
+		}
+		e.Data = rawData
+		return e, nil
+	}
+	if err := json.Unmarshal(raw, data); err != nil {
+		return e, err
+	}
+	e.Data = data
+
+	return e, nil
+}
+
 // event is the private implementation of the eventhorizon.Event interface
 // for a memory event store.
 type event struct {
@@ -275,6 +741,16 @@ func (e event) Version() int {
 	return e.dbEvent.Version
 }
 
+// Metadata implements the Metadata method of the eventhorizon.Event interface.
+func (e event) Metadata() map[string]interface{} {
+	return copyMetadata(e.dbEvent.Metadata)
+}
+
+// Position implements the Position method of the eventhorizon.PositionedEvent interface.
+func (e event) Position() int64 {
+	return e.dbEvent.Position
+}
+
 // String implements the String method of the eventhorizon.Event interface.
 func (e event) String() string {
 	return fmt.Sprintf("%s@%d", e.dbEvent.EventType, e.dbEvent.Version)
@@ -17,10 +17,14 @@ package memory_test
 import (
 	"context"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
 
 	eh "github.com/looplab/eventhorizon"
 	"github.com/looplab/eventhorizon/eventstore"
 	"github.com/looplab/eventhorizon/eventstore/memory"
+	"github.com/looplab/eventhorizon/mocks"
 )
 
 func Test_EventStore(t *testing.T) {
@@ -38,6 +42,114 @@ func Test_EventStore(t *testing.T) {
 	ctx := eh.NewContextWithNamespace(context.Background(), "ns")
 	eventstore.AcceptanceTest(t, ctx, store)
 
+	t.Log("global event store with default namespace")
+	eventstore.GlobalAcceptanceTest(t, context.Background(), store)
+
+	t.Log("global event store with other namespace")
+	eventstore.GlobalAcceptanceTest(t, ctx, store)
+
+	t.Log("snapshot store with default namespace")
+	eventstore.SnapshotAcceptanceTest(t, context.Background(), store, store)
+
+	t.Log("snapshot store with other namespace")
+	eventstore.SnapshotAcceptanceTest(t, ctx, store, store)
+
+	t.Log("upcasting event store with default namespace")
+	eventstore.UpcastAcceptanceTest(t, context.Background(), store)
+
+	t.Log("upcasting event store with other namespace")
+	eventstore.UpcastAcceptanceTest(t, ctx, store)
+
+	t.Log("outbox event store with default namespace")
+	eventstore.OutboxAcceptanceTest(t, context.Background(), store)
+
+	t.Log("outbox event store with other namespace")
+	eventstore.OutboxAcceptanceTest(t, ctx, store)
+
 	t.Log("event store maintainer")
 	eventstore.MaintainerAcceptanceTest(t, context.Background(), store)
+
+	t.Log("event stream maintainer with default namespace")
+	store.SetArchive(memory.NewEventStore())
+	eventstore.StreamMaintainerAcceptanceTest(t, context.Background(), store)
+
+	t.Log("event stream maintainer with other namespace")
+	eventstore.StreamMaintainerAcceptanceTest(t, ctx, store)
+}
+
+func Test_EventStore_ArchiveRetry(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewEventStore()
+	archive := memory.NewEventStore()
+	store.SetArchive(archive)
+
+	id := uuid.New().String()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1)
+	event2 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+		timestamp, mocks.AggregateType, id, 2)
+	if err := store.Save(ctx, []eh.Event{event1, event2}, 0); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	// The first event is left in the archive by an earlier attempt.
+	if err := archive.Save(ctx, []eh.Event{event1}, 0); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := store.Archive(ctx, id); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	events, err := archive.Load(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 2 {
+		t.Error("there should be 2 archived events:", events)
+	}
+
+	// Events in the archive that don't match.
+	id = uuid.New().String()
+	event1 = eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1)
+	if err := store.Save(ctx, []eh.Event{event1}, 0); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	other := eh.NewEventForAggregate(mocks.EventOtherType, nil,
+		timestamp, mocks.AggregateType, id, 1)
+	if err := archive.Save(ctx, []eh.Event{other}, 0); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	err = store.Archive(ctx, id)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != eh.ErrArchiveMismatch {
+		t.Error("there should be an archive mismatch error:", err)
+	}
+	if events, err := store.Load(ctx, id); err != nil || len(events) != 1 {
+		t.Error("the aggregate should not be archived:", events, err)
+	}
+}
+
+func Test_EventStore_DeleteArchivedNotMaintainer(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewEventStore()
+	store.SetArchive(struct{ eh.EventStore }{memory.NewEventStore()})
+
+	id := uuid.New().String()
+	event := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		time.Now(), mocks.AggregateType, id, 1)
+	if err := store.Save(ctx, []eh.Event{event}, 0); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if err := store.Archive(ctx, id); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	// The archived events can't be deleted.
+	err := store.Delete(ctx, id)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != eh.ErrArchiveNotMaintainer {
+		t.Error("there should be an archive not maintainer error:", err)
+	}
+	if events, err := store.Load(ctx, id); err != nil || len(events) != 1 {
+		t.Error("the archived aggregate should not be deleted:", events, err)
+	}
 }
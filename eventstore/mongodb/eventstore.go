@@ -18,6 +18,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/globalsign/mgo"
@@ -47,10 +51,35 @@ var ErrCouldNotLoadAggregate = errors.New("could not load aggregate")
 // ErrCouldNotSaveAggregate is when an aggregate could not be saved.
 var ErrCouldNotSaveAggregate = errors.New("could not save aggregate")
 
+// ErrCouldNotSaveSnapshot is when a snapshot could not be saved.
+var ErrCouldNotSaveSnapshot = errors.New("could not save snapshot")
+
+// ErrCouldNotUpcastEvent is when an event could not be upcasted.
+var ErrCouldNotUpcastEvent = errors.New("could not upcast event")
+
+// ErrCouldNotEnsureIndex is when the indexes could not be ensured.
+var ErrCouldNotEnsureIndex = errors.New("could not ensure index")
+
+// ErrCouldNotWriteAudit is when an audit record could not be written.
+var ErrCouldNotWriteAudit = errors.New("could not write audit record")
+
+// ReservationTimeout is how long positions reserved by a save are waited for
+// when loading the global stream, after which the save is assumed to have
+// failed without releasing them.
+const ReservationTimeout = time.Minute
+
 // EventStore implements an EventStore for MongoDB.
+//
+// The global positions are reserved from a counter before the events are
+// saved. The reservations in flight are kept with the counter, and events are
+// only loaded from the global stream up to the oldest reservation, so that a
+// lower position can never become visible after a higher one.
 type EventStore struct {
 	session  *mgo.Session
 	dbPrefix string
+	archive  eh.EventStore
+	// The DBs that the indexes have been ensured for.
+	indexed sync.Map
 }
 
 // NewEventStore creates a new EventStore.
@@ -80,8 +109,25 @@ func NewEventStoreWithSession(session *mgo.Session, dbPrefix string) (*EventStor
 	return s, nil
 }
 
+// SetArchive sets the store that aggregates are archived to, it must not be
+// the store itself.
+func (s *EventStore) SetArchive(archive eh.EventStore) {
+	s.archive = archive
+}
+
 // Save implements the Save method of the eventhorizon.EventStore interface.
 func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersion int) error {
+	return s.save(ctx, events, originalVersion, false)
+}
+
+// SaveWithOutbox implements the SaveWithOutbox method of the eventhorizon.OutboxEventStore interface.
+// The positions of the unpublished events are kept in the aggregate document,
+// to be saved atomically with the events.
+func (s *EventStore) SaveWithOutbox(ctx context.Context, events []eh.Event, originalVersion int) error {
+	return s.save(ctx, events, originalVersion, true)
+}
+
+func (s *EventStore) save(ctx context.Context, events []eh.Event, originalVersion int, outbox bool) error {
 	if len(events) == 0 {
 		return eh.EventStoreError{
 			Err:       eh.ErrNoEventsToAppend,
@@ -123,15 +169,46 @@ func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersio
 		version++
 	}
 
+	if err := s.ensureIndexes(ctx, sess); err != nil {
+		return err
+	}
+
+	// Reserve global positions for the events. Positions reserved by a failed
+	// save are never used, leaving a gap in the stream.
+	position, err := s.reservePositions(ctx, sess, len(dbEvents))
+	if err != nil {
+		return err
+	}
+	defer s.releasePositions(ctx, sess, position+1)
+	var positions []int64
+	for i := range dbEvents {
+		position++
+		dbEvents[i].Position = position
+		if outbox {
+			positions = append(positions, position)
+		}
+	}
+
 	// Either insert a new aggregate or append to an existing.
 	if originalVersion == 0 {
 		aggregate := aggregateRecord{
 			AggregateID: aggregateID,
 			Version:     len(dbEvents),
 			Events:      dbEvents,
+			Outbox:      positions,
 		}
 
 		if err := sess.DB(s.dbName(ctx)).C("events").Insert(aggregate); err != nil {
+			if err := s.retiredError(ctx, sess, aggregateID); err != nil {
+				return err
+			}
+			if mgo.IsDup(err) {
+				return eh.EventStoreError{
+					BaseErr:   err,
+					Err:       eh.ErrVersionConflict,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
 			return eh.EventStoreError{
 				BaseErr:   err,
 				Err:       ErrCouldNotSaveAggregate,
@@ -142,16 +219,30 @@ func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersio
 		// Increment aggregate version on insert of new event record, and
 		// only insert if version of aggregate is matching (ie not changed
 		// since loading the aggregate).
+		push := bson.M{"events": bson.M{"$each": dbEvents}}
+		if outbox {
+			push["outbox"] = bson.M{"$each": positions}
+		}
 		if err := sess.DB(s.dbName(ctx)).C("events").Update(
 			bson.M{
 				"_id":     aggregateID,
 				"version": originalVersion,
 			},
 			bson.M{
-				"$push": bson.M{"events": bson.M{"$each": dbEvents}},
+				"$push": push,
 				"$inc":  bson.M{"version": len(dbEvents)},
 			},
 		); err != nil {
+			if err := s.retiredError(ctx, sess, aggregateID); err != nil {
+				return err
+			}
+			if err == mgo.ErrNotFound {
+				return eh.EventStoreError{
+					BaseErr:   err,
+					Err:       eh.ErrVersionConflict,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
 			return eh.EventStoreError{
 				BaseErr:   err,
 				Err:       ErrCouldNotSaveAggregate,
@@ -165,11 +256,22 @@ func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersio
 
 // Load implements the Load method of the eventhorizon.EventStore interface.
 func (s *EventStore) Load(ctx context.Context, id eh.ID) ([]eh.Event, error) {
+	return s.LoadFromVersion(ctx, id, 0)
+}
+
+// LoadFromVersion implements the LoadFromVersion method of the eventhorizon.VersionedEventStore interface.
+// The events before the version are not read from the DB, as the events of an
+// aggregate are stored in order of version.
+func (s *EventStore) LoadFromVersion(ctx context.Context, id eh.ID, version int) ([]eh.Event, error) {
 	sess := s.session.Copy()
 	defer sess.Close()
 
+	query := sess.DB(s.dbName(ctx)).C("events").FindId(id)
+	if version > 0 {
+		query = query.Select(bson.M{"events": bson.M{"$slice": []int{version, math.MaxInt32}}})
+	}
 	var aggregate aggregateRecord
-	err := sess.DB(s.dbName(ctx)).C("events").FindId(id).One(&aggregate)
+	err := query.One(&aggregate)
 	if err == mgo.ErrNotFound {
 		return []eh.Event{}, nil
 	} else if err != nil {
@@ -180,25 +282,98 @@ func (s *EventStore) Load(ctx context.Context, id eh.ID) ([]eh.Event, error) {
 		}
 	}
 
-	events := make([]eh.Event, len(aggregate.Events))
-	for i, dbEvent := range aggregate.Events {
-		// Create an event of the correct type.
-		if data, err := eh.CreateEventData(dbEvent.EventType); err == nil {
-			// Manually decode the raw BSON event.
-			if err := dbEvent.RawData.Unmarshal(data); err != nil {
-				return nil, eh.EventStoreError{
-					BaseErr:   err,
-					Err:       ErrCouldNotUnmarshalEvent,
-					Namespace: eh.NamespaceFromContext(ctx),
-				}
+	if aggregate.Tombstoned {
+		return nil, eh.EventStoreError{
+			Err:       eh.ErrAggregateDeleted,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if aggregate.Archived {
+		if s.archive == nil {
+			return nil, eh.EventStoreError{
+				Err:       eh.ErrNoArchive,
+				Namespace: eh.NamespaceFromContext(ctx),
 			}
+		}
+		events, err := s.archive.Load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		for len(events) > 0 && events[0].Version() <= version {
+			events = events[1:]
+		}
+		return events, nil
+	}
 
-			// Set conrcete event and zero out the decoded event.
-			dbEvent.data = data
-			dbEvent.RawData = bson.Raw{}
+	events := make([]eh.Event, len(aggregate.Events))
+	for i, dbEvent := range aggregate.Events {
+		e, err := newEvent(ctx, dbEvent)
+		if err != nil {
+			return nil, err
 		}
+		events[i] = e
+	}
+
+	return events, nil
+}
+
+// LoadAll implements the LoadAll method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadAll(ctx context.Context, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	return s.LoadFrom(ctx, 0, 0, aggregateTypes...)
+}
+
+// LoadFrom implements the LoadFrom method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadFrom(ctx context.Context, position int64, limit int, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	if err := s.ensureIndexes(ctx, sess); err != nil {
+		return nil, err
+	}
 
-		events[i] = event{dbEvent: dbEvent}
+	// Only load the events before the oldest reservation in flight, which
+	// must be read before the events.
+	pos := bson.M{"$gt": position}
+	if reserved, err := s.oldestReservation(ctx, sess); err != nil {
+		return nil, err
+	} else if reserved > 0 {
+		pos["$lt"] = reserved
+	}
+	match := bson.M{"events.position": pos}
+	if len(aggregateTypes) > 0 {
+		match["events.aggregate_type"] = bson.M{"$in": aggregateTypes}
+	}
+
+	// Match the aggregates first to be able to use the index, then unwind and
+	// match the individual events.
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$unwind": "$events"},
+		{"$match": match},
+		{"$sort": bson.M{"events.position": 1}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+	pipeline = append(pipeline, bson.M{"$replaceRoot": bson.M{"newRoot": "$events"}})
+	iter := sess.DB(s.dbName(ctx)).C("events").Pipe(pipeline).AllowDiskUse().Iter()
+
+	events := []eh.Event{}
+	var e dbEvent
+	for iter.Next(&e) {
+		event, err := newEvent(ctx, e)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		events = append(events, event)
+		e = dbEvent{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
 	}
 
 	return events, nil
@@ -228,14 +403,21 @@ func (s *EventStore) Replace(ctx context.Context, event eh.Event) error {
 		return err
 	}
 
-	// Find and replace the event.
+	// Find and replace the event, keeping its position in the global stream.
 	err = sess.DB(s.dbName(ctx)).C("events").Update(
 		bson.M{
 			"_id":            event.AggregateID(),
 			"events.version": event.Version(),
 		},
 		bson.M{
-			"$set": bson.M{"events.$": *e},
+			"$set": bson.M{
+				"events.$.event_type":     e.EventType,
+				"events.$.data":           e.RawData,
+				"events.$.timestamp":      e.Timestamp,
+				"events.$.aggregate_type": e.AggregateType,
+				"events.$.schema_version": e.SchemaVersion,
+				"events.$.metadata":       e.Metadata,
+			},
 		},
 	)
 	if err == mgo.ErrNotFound {
@@ -248,7 +430,8 @@ func (s *EventStore) Replace(ctx context.Context, event eh.Event) error {
 		}
 	}
 
-	return nil
+	return s.writeAudit(ctx, sess, eh.NewAuditRecord(ctx, eh.ReplaceOperation,
+		event.AggregateID(), fmt.Sprintf("version %d", event.Version())))
 }
 
 // RenameEvent implements the RenameEvent method of the eventhorizon.EventStore interface.
@@ -273,11 +456,367 @@ func (s *EventStore) RenameEvent(ctx context.Context, from, to eh.EventType) err
 		}
 	}
 
+	return s.writeAudit(ctx, sess, eh.NewAuditRecord(ctx, eh.RenameEventOperation,
+		"", fmt.Sprintf("%s to %s", from, to)))
+}
+
+// Delete implements the Delete method of the eventhorizon.EventStreamMaintainer interface.
+func (s *EventStore) Delete(ctx context.Context, id eh.ID) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var aggregate aggregateRecord
+	err := sess.DB(s.dbName(ctx)).C("events").FindId(id).
+		Select(bson.M{"version": 1, "archived": 1}).One(&aggregate)
+	if err == mgo.ErrNotFound {
+		return eh.ErrAggregateNotFound
+	} else if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	// Also delete the archived events, which must be possible to not leave
+	// them behind.
+	if aggregate.Archived {
+		if s.archive == nil {
+			return eh.EventStoreError{
+				Err:       eh.ErrNoArchive,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		archive, ok := s.archive.(eh.EventStreamMaintainer)
+		if !ok {
+			return eh.EventStoreError{
+				Err:       eh.ErrArchiveNotMaintainer,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		if err := archive.Delete(ctx, id); err != nil && err != eh.ErrAggregateNotFound {
+			return err
+		}
+	}
+
+	if err := sess.DB(s.dbName(ctx)).C("events").RemoveId(id); err == mgo.ErrNotFound {
+		return eh.ErrAggregateNotFound
+	} else if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return s.writeAudit(ctx, sess, eh.NewAuditRecord(ctx, eh.DeleteOperation,
+		id, fmt.Sprintf("version %d", aggregate.Version)))
+}
+
+// Tombstone implements the Tombstone method of the eventhorizon.EventStreamMaintainer interface.
+func (s *EventStore) Tombstone(ctx context.Context, id eh.ID) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var aggregate aggregateRecord
+	if _, err := sess.DB(s.dbName(ctx)).C("events").FindId(id).
+		Select(bson.M{"version": 1}).Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{"tombstoned": true}},
+	}, &aggregate); err == mgo.ErrNotFound {
+		return eh.ErrAggregateNotFound
+	} else if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return s.writeAudit(ctx, sess, eh.NewAuditRecord(ctx, eh.TombstoneOperation,
+		id, fmt.Sprintf("version %d", aggregate.Version)))
+}
+
+// Archive implements the Archive method of the eventhorizon.EventStreamMaintainer interface.
+func (s *EventStore) Archive(ctx context.Context, id eh.ID) error {
+	if s.archive == nil {
+		return eh.EventStoreError{
+			Err:       eh.ErrNoArchive,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var aggregate aggregateRecord
+	err := sess.DB(s.dbName(ctx)).C("events").FindId(id).One(&aggregate)
+	if err == mgo.ErrNotFound {
+		return eh.ErrAggregateNotFound
+	} else if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if aggregate.Archived {
+		return nil
+	}
+
+	// Save the events to the archive before removing them.
+	events := make([]eh.Event, len(aggregate.Events))
+	for i, dbEvent := range aggregate.Events {
+		e, err := newEvent(ctx, dbEvent)
+		if err != nil {
+			return err
+		}
+		events[i] = e
+	}
+	if len(events) > 0 {
+		if err := eh.ArchiveEvents(ctx, s.archive, id, events); err != nil {
+			return err
+		}
+	}
+
+	// Only remove the events if no events have been saved since loading them.
+	// Otherwise the archived events are rolled back, if possible, and the
+	// aggregate can be archived again. Events that can't be rolled back are
+	// kept by the next attempt.
+	if err := sess.DB(s.dbName(ctx)).C("events").Update(
+		bson.M{
+			"_id":     id,
+			"version": aggregate.Version,
+		},
+		bson.M{
+			"$set": bson.M{
+				"archived": true,
+				"events":   []dbEvent{},
+			},
+		},
+	); err == mgo.ErrNotFound {
+		if archive, ok := s.archive.(eh.EventStreamMaintainer); ok {
+			if err := archive.Delete(ctx, id); err != nil && err != eh.ErrAggregateNotFound {
+				return err
+			}
+		}
+		return eh.EventStoreError{
+			Err:       eh.ErrVersionConflict,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return s.writeAudit(ctx, sess, eh.NewAuditRecord(ctx, eh.ArchiveOperation,
+		id, fmt.Sprintf("version %d", aggregate.Version)))
+}
+
+// AuditLog implements the AuditLog method of the eventhorizon.EventStreamMaintainer interface.
+func (s *EventStore) AuditLog(ctx context.Context) ([]eh.AuditRecord, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var dbRecords []dbAuditRecord
+	if err := sess.DB(s.dbName(ctx)).C("audit").Find(nil).Sort("_id").All(&dbRecords); err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	records := make([]eh.AuditRecord, len(dbRecords))
+	for i, r := range dbRecords {
+		records[i] = eh.AuditRecord{
+			Operation:   r.Operation,
+			AggregateID: r.AggregateID,
+			Details:     r.Details,
+			UserID:      r.UserID,
+			Timestamp:   r.Timestamp,
+		}
+	}
+
+	return records, nil
+}
+
+// OutboxNamespaces implements the OutboxNamespaces method of the eventhorizon.Outbox interface.
+// It returns the namespaces of all databases of the store.
+func (s *EventStore) OutboxNamespaces(ctx context.Context) ([]string, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	names, err := sess.DatabaseNames()
+	if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	namespaces := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, s.dbPrefix+"_") {
+			namespaces = append(namespaces, strings.TrimPrefix(name, s.dbPrefix+"_"))
+		}
+	}
+	return namespaces, nil
+}
+
+// UnpublishedEvents implements the UnpublishedEvents method of the eventhorizon.Outbox interface.
+func (s *EventStore) UnpublishedEvents(ctx context.Context, limit int) ([]eh.OutboxEntry, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"outbox.0": bson.M{"$exists": true}}},
+		{"$project": bson.M{"events": bson.M{"$filter": bson.M{
+			"input": "$events",
+			"cond":  bson.M{"$in": []interface{}{"$$this.position", "$outbox"}},
+		}}}},
+		{"$unwind": "$events"},
+		{"$sort": bson.M{"events.position": 1}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+	pipeline = append(pipeline, bson.M{"$replaceRoot": bson.M{"newRoot": "$events"}})
+	iter := sess.DB(s.dbName(ctx)).C("events").Pipe(pipeline).AllowDiskUse().Iter()
+
+	entries := []eh.OutboxEntry{}
+	var e dbEvent
+	for iter.Next(&e) {
+		event, err := newEvent(ctx, e)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		entries = append(entries, eh.OutboxEntry{
+			ID:    strconv.FormatInt(e.Position, 10),
+			Event: event,
+		})
+		e = dbEvent{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return entries, nil
+}
+
+// MarkPublished implements the MarkPublished method of the eventhorizon.Outbox interface.
+func (s *EventStore) MarkPublished(ctx context.Context, id string) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	position, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       eh.ErrInvalidEvent,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if err := sess.DB(s.dbName(ctx)).C("events").Update(
+		bson.M{"outbox": position},
+		bson.M{"$pull": bson.M{"outbox": position}},
+	); err != nil && err != mgo.ErrNotFound {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// LoadSnapshot implements the LoadSnapshot method of the eventhorizon.SnapshotStore interface.
+func (s *EventStore) LoadSnapshot(ctx context.Context, id eh.ID) (*eh.Snapshot, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var aggregate aggregateRecord
+	err := sess.DB(s.dbName(ctx)).C("events").FindId(id).
+		Select(bson.M{"snapshot": 1}).One(&aggregate)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if aggregate.Snapshot == nil {
+		return nil, nil
+	}
+
+	return &eh.Snapshot{
+		Version:       aggregate.Snapshot.Version,
+		AggregateType: aggregate.Snapshot.AggregateType,
+		Timestamp:     aggregate.Snapshot.Timestamp,
+		State:         aggregate.Snapshot.State,
+	}, nil
+}
+
+// SaveSnapshot implements the SaveSnapshot method of the eventhorizon.SnapshotStore interface.
+func (s *EventStore) SaveSnapshot(ctx context.Context, id eh.ID, snapshot eh.Snapshot) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	n, err := sess.DB(s.dbName(ctx)).C("events").FindId(id).Count()
+	if n == 0 {
+		return eh.ErrAggregateNotFound
+	} else if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	// Only save the snapshot if there is no newer one.
+	err = sess.DB(s.dbName(ctx)).C("events").Update(
+		bson.M{
+			"_id": id,
+			"$or": []bson.M{
+				{"snapshot": bson.M{"$exists": false}},
+				{"snapshot.version": bson.M{"$lte": snapshot.Version}},
+			},
+		},
+		bson.M{
+			"$set": bson.M{"snapshot": dbSnapshot{
+				Version:       snapshot.Version,
+				AggregateType: snapshot.AggregateType,
+				Timestamp:     snapshot.Timestamp,
+				State:         snapshot.State,
+			}},
+		},
+	)
+	if err != nil && err != mgo.ErrNotFound {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveSnapshot,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
 	return nil
 }
 
 // Clear clears the event storage.
 func (s *EventStore) Clear(ctx context.Context) error {
+	s.indexed.Delete(s.dbName(ctx))
 	if err := s.session.DB(s.dbName(ctx)).C("events").DropCollection(); err != nil {
 		return eh.EventStoreError{
 			BaseErr:   err,
@@ -285,6 +824,21 @@ func (s *EventStore) Clear(ctx context.Context) error {
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
+	if err := s.session.DB(s.dbName(ctx)).C("counters").DropCollection(); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotClearDB,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if err := s.session.DB(s.dbName(ctx)).C("audit").DropCollection(); err != nil &&
+		err.Error() != "ns not found" {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotClearDB,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
 	return nil
 }
 
@@ -293,6 +847,170 @@ func (s *EventStore) Close() {
 	s.session.Close()
 }
 
+// ensureIndexes ensures the indexes of the DB of the namespace, once per DB.
+func (s *EventStore) ensureIndexes(ctx context.Context, sess *mgo.Session) error {
+	name := s.dbName(ctx)
+	if _, ok := s.indexed.Load(name); ok {
+		return nil
+	}
+	if err := sess.DB(name).C("events").EnsureIndexKey("events.position"); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotEnsureIndex,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	s.indexed.Store(name, struct{}{})
+	return nil
+}
+
+// counterRecord is the DB representation of the position counter, with the
+// reservations in flight.
+type counterRecord struct {
+	ID           string              `bson:"_id"`
+	Position     int64               `bson:"position"`
+	Reservations []reservationRecord `bson:"reservations"`
+}
+
+// reservationRecord is a reservation of positions by a save in flight.
+type reservationRecord struct {
+	Position int64     `bson:"position"`
+	Created  time.Time `bson:"created"`
+}
+
+// reservePositions reserves n global positions in the namespace and returns
+// the position before the first reserved one. The reservation is kept until
+// it is released, atomically with the counter.
+func (s *EventStore) reservePositions(ctx context.Context, sess *mgo.Session, n int) (int64, error) {
+	c := sess.DB(s.dbName(ctx)).C("counters")
+	for {
+		var counter counterRecord
+		err := c.FindId("events").Select(bson.M{"position": 1}).One(&counter)
+		if err != nil && err != mgo.ErrNotFound {
+			return 0, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotSaveAggregate,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		reservation := reservationRecord{
+			Position: counter.Position + 1,
+			Created:  time.Now(),
+		}
+		if err == mgo.ErrNotFound {
+			err = c.Insert(counterRecord{
+				ID:           "events",
+				Position:     int64(n),
+				Reservations: []reservationRecord{reservation},
+			})
+			if mgo.IsDup(err) {
+				continue
+			}
+		} else {
+			// Only update the counter if no other save has reserved positions
+			// since it was read.
+			err = c.Update(
+				bson.M{"_id": "events", "position": counter.Position},
+				bson.M{
+					"$inc":  bson.M{"position": n},
+					"$push": bson.M{"reservations": reservation},
+				},
+			)
+			if err == mgo.ErrNotFound {
+				continue
+			}
+		}
+		if err != nil {
+			return 0, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotSaveAggregate,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return counter.Position, nil
+	}
+}
+
+// releasePositions releases the reservation starting at a position, after
+// the save has either succeeded or failed. Timed out reservations of saves
+// that never released them are also removed.
+func (s *EventStore) releasePositions(ctx context.Context, sess *mgo.Session, position int64) {
+	// A reservation that can't be released is ignored after the timeout.
+	_ = sess.DB(s.dbName(ctx)).C("counters").UpdateId("events", bson.M{
+		"$pull": bson.M{"reservations": bson.M{"$or": []bson.M{
+			{"position": position},
+			{"created": bson.M{"$lt": time.Now().Add(-ReservationTimeout)}},
+		}}},
+	})
+}
+
+// oldestReservation returns the first position of the oldest reservation
+// that has not timed out, or 0 if there is none.
+func (s *EventStore) oldestReservation(ctx context.Context, sess *mgo.Session) (int64, error) {
+	var counter counterRecord
+	err := sess.DB(s.dbName(ctx)).C("counters").FindId("events").One(&counter)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotLoadAggregate,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	var oldest int64
+	timeout := time.Now().Add(-ReservationTimeout)
+	for _, r := range counter.Reservations {
+		if r.Created.After(timeout) && (oldest == 0 || r.Position < oldest) {
+			oldest = r.Position
+		}
+	}
+	return oldest, nil
+}
+
+// retiredError returns an ErrAggregateDeleted or ErrAggregateArchived error
+// if the aggregate is tombstoned or archived, used to tell why a save failed.
+func (s *EventStore) retiredError(ctx context.Context, sess *mgo.Session, id eh.ID) error {
+	var aggregate aggregateRecord
+	if err := sess.DB(s.dbName(ctx)).C("events").FindId(id).
+		Select(bson.M{"tombstoned": 1, "archived": 1}).One(&aggregate); err != nil {
+		return nil
+	}
+	if aggregate.Tombstoned {
+		return eh.EventStoreError{
+			Err:       eh.ErrAggregateDeleted,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if aggregate.Archived {
+		return eh.EventStoreError{
+			Err:       eh.ErrAggregateArchived,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// writeAudit writes an audit record of a maintenance operation.
+func (s *EventStore) writeAudit(ctx context.Context, sess *mgo.Session, record eh.AuditRecord) error {
+	if err := sess.DB(s.dbName(ctx)).C("audit").Insert(dbAuditRecord{
+		ID:          bson.NewObjectId(),
+		Operation:   record.Operation,
+		AggregateID: record.AggregateID,
+		Details:     record.Details,
+		UserID:      record.UserID,
+		Timestamp:   record.Timestamp,
+	}); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotWriteAudit,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
 // dbName appends the namespace, if one is set, to the DB prefix to
 // get the name of the DB to use.
 func (s *EventStore) dbName(ctx context.Context) string {
@@ -302,23 +1020,46 @@ func (s *EventStore) dbName(ctx context.Context) string {
 
 // aggregateRecord is the DB representation of an aggregate.
 type aggregateRecord struct {
-	AggregateID string    `bson:"_id"`
-	Version     int       `bson:"version"`
-	Events      []dbEvent `bson:"events"`
-	// Type        string        `bson:"type"`
-	// Snapshot    bson.Raw      `bson:"snapshot"`
+	AggregateID string      `bson:"_id"`
+	Version     int         `bson:"version"`
+	Events      []dbEvent   `bson:"events"`
+	Snapshot    *dbSnapshot `bson:"snapshot,omitempty"`
+	Tombstoned  bool        `bson:"tombstoned,omitempty"`
+	Archived    bool        `bson:"archived,omitempty"`
+	Outbox      []int64     `bson:"outbox,omitempty"`
+}
+
+// dbAuditRecord is the DB representation of an audit record.
+type dbAuditRecord struct {
+	ID          bson.ObjectId           `bson:"_id"`
+	Operation   eh.MaintenanceOperation `bson:"operation"`
+	AggregateID string                  `bson:"aggregate_id,omitempty"`
+	Details     string                  `bson:"details"`
+	UserID      string                  `bson:"user_id,omitempty"`
+	Timestamp   time.Time               `bson:"timestamp"`
+}
+
+// dbSnapshot is the DB representation of an aggregate snapshot.
+type dbSnapshot struct {
+	Version       int              `bson:"version"`
+	AggregateType eh.AggregateType `bson:"aggregate_type"`
+	Timestamp     time.Time        `bson:"timestamp"`
+	State         []byte           `bson:"state"`
 }
 
 // dbEvent is the internal event record for the MongoDB event store used
 // to save and load events from the DB.
 type dbEvent struct {
-	EventType     eh.EventType     `bson:"event_type"`
-	RawData       bson.Raw         `bson:"data,omitempty"`
-	data          eh.EventData     `bson:"-"`
-	Timestamp     time.Time        `bson:"timestamp"`
-	AggregateType eh.AggregateType `bson:"aggregate_type"`
-	AggregateID   string           `bson:"_id"`
-	Version       int              `bson:"version"`
+	EventType     eh.EventType           `bson:"event_type"`
+	RawData       bson.Raw               `bson:"data,omitempty"`
+	data          eh.EventData           `bson:"-"`
+	Timestamp     time.Time              `bson:"timestamp"`
+	AggregateType eh.AggregateType       `bson:"aggregate_type"`
+	AggregateID   string                 `bson:"_id"`
+	Version       int                    `bson:"version"`
+	Position      int64                  `bson:"position"`
+	SchemaVersion int                    `bson:"schema_version"`
+	Metadata      map[string]interface{} `bson:"metadata,omitempty"`
 }
 
 // newDBEvent returns a new dbEvent for an event.
@@ -344,9 +1085,44 @@ func newDBEvent(ctx context.Context, event eh.Event) (*dbEvent, error) {
 		AggregateType: event.AggregateType(),
 		AggregateID:   event.AggregateID(),
 		Version:       event.Version(),
+		SchemaVersion: eh.EventSchemaVersion(event.EventType()),
+		Metadata:      event.Metadata(),
 	}, nil
 }
 
+// newEvent returns an event with concrete event data from a dbEvent.
+func newEvent(ctx context.Context, e dbEvent) (eh.Event, error) {
+	// Upcast the raw BSON data if there is a newer schema version.
+	if eh.EventSchemaVersion(e.EventType) > e.SchemaVersion {
+		var err error
+		if e, err = upcast(e); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotUpcastEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	// Create an event of the correct type.
+	if data, err := eh.CreateEventData(e.EventType); err == nil {
+		// Manually decode the raw BSON event.
+		if err := e.RawData.Unmarshal(data); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotUnmarshalEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		// Set conrcete event and zero out the decoded event.
+		e.data = data
+		e.RawData = bson.Raw{}
+	}
+
+	return event{dbEvent: e}, nil
+}
+
 // event is the private implementation of the eventhorizon.Event interface
 // for a MongoDB event store.
 type event struct {
@@ -373,6 +1149,11 @@ func (e event) Data() eh.EventData {
 	return e.dbEvent.data
 }
 
+// Metadata implements the Metadata method of the eventhorizon.Event interface.
+func (e event) Metadata() map[string]interface{} {
+	return e.dbEvent.Metadata
+}
+
 // Version implements the Version method of the eventhorizon.Event interface.
 func (e event) Version() int {
 	return e.dbEvent.Version
@@ -383,7 +1164,34 @@ func (e event) Timestamp() time.Time {
 	return e.dbEvent.Timestamp
 }
 
+// Position implements the Position method of the eventhorizon.PositionedEvent interface.
+func (e event) Position() int64 {
+	return e.dbEvent.Position
+}
+
 // String implements the String method of the eventhorizon.Event interface.
 func (e event) String() string {
 	return fmt.Sprintf("%s@%d", e.dbEvent.EventType, e.dbEvent.Version)
 }
+
+// upcast upcasts the raw BSON data of an event record to the current schema
+// version of its event type.
+func upcast(e dbEvent) (dbEvent, error) {
+	var data []byte
+	if e.RawData.Kind != 0 {
+		data = e.RawData.Data
+	}
+
+	var err error
+	e.EventType, e.SchemaVersion, data, err = eh.UpcastRawEventData(
+		e.EventType, e.SchemaVersion, data, bson.Unmarshal, bson.Marshal)
+	if err != nil {
+		return e, err
+	}
+	e.RawData = bson.Raw{}
+	if data != nil {
+		e.RawData = bson.Raw{Kind: 3, Data: data}
+	}
+
+	return e, nil
+}
@@ -21,6 +21,7 @@ import (
 
 	eh "github.com/looplab/eventhorizon"
 	"github.com/looplab/eventhorizon/eventstore"
+	"github.com/looplab/eventhorizon/eventstore/memory"
 	"github.com/looplab/eventhorizon/eventstore/mongodb"
 )
 
@@ -62,6 +63,37 @@ func TestIntegration_EventStore(t *testing.T) {
 	t.Log("event store with other namespace")
 	eventstore.AcceptanceTest(t, ctx, store)
 
+	t.Log("global event store with default namespace")
+	eventstore.GlobalAcceptanceTest(t, context.Background(), store)
+
+	t.Log("global event store with other namespace")
+	eventstore.GlobalAcceptanceTest(t, ctx, store)
+
+	t.Log("snapshot store with default namespace")
+	eventstore.SnapshotAcceptanceTest(t, context.Background(), store, store)
+
+	t.Log("snapshot store with other namespace")
+	eventstore.SnapshotAcceptanceTest(t, ctx, store, store)
+
+	t.Log("upcasting event store with default namespace")
+	eventstore.UpcastAcceptanceTest(t, context.Background(), store)
+
+	t.Log("upcasting event store with other namespace")
+	eventstore.UpcastAcceptanceTest(t, ctx, store)
+
+	t.Log("outbox event store with default namespace")
+	eventstore.OutboxAcceptanceTest(t, context.Background(), store)
+
+	t.Log("outbox event store with other namespace")
+	eventstore.OutboxAcceptanceTest(t, ctx, store)
+
 	t.Log("event store maintainer")
 	eventstore.MaintainerAcceptanceTest(t, context.Background(), store)
+
+	t.Log("event stream maintainer with default namespace")
+	store.SetArchive(memory.NewEventStore())
+	eventstore.StreamMaintainerAcceptanceTest(t, context.Background(), store)
+
+	t.Log("event stream maintainer with other namespace")
+	eventstore.StreamMaintainerAcceptanceTest(t, ctx, store)
 }
@@ -0,0 +1,116 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect is the SQL dialect of the database used by the event store.
+type Dialect int
+
+const (
+	// SQLite is the dialect for SQLite 3.
+	SQLite Dialect = iota
+	// PostgreSQL is the dialect for PostgreSQL 9.5 or later.
+	PostgreSQL
+)
+
+// String implements the String method of the fmt.Stringer interface.
+func (d Dialect) String() string {
+	switch d {
+	case SQLite:
+		return "sqlite"
+	case PostgreSQL:
+		return "postgresql"
+	default:
+		return "unknown"
+	}
+}
+
+// schema returns the statements to create the tables and indexes, which can be
+// run multiple times.
+func (d Dialect) schema() []string {
+	var position, timestamp, data string
+	switch d {
+	case PostgreSQL:
+		position = "BIGSERIAL PRIMARY KEY"
+		timestamp = "TIMESTAMPTZ"
+		data = "TEXT"
+	default:
+		position = "INTEGER PRIMARY KEY AUTOINCREMENT"
+		timestamp = "TIMESTAMP"
+		data = "TEXT"
+	}
+
+	return []string{
+		`CREATE TABLE IF NOT EXISTS events (
+			position       ` + position + `,
+			namespace      TEXT NOT NULL,
+			aggregate_id   TEXT NOT NULL,
+			aggregate_type TEXT NOT NULL,
+			event_type     TEXT NOT NULL,
+			version        INTEGER NOT NULL,
+			timestamp      ` + timestamp + ` NOT NULL,
+			data           ` + data + `,
+			metadata       ` + data + `,
+			schema_version INTEGER NOT NULL DEFAULT 0,
+			UNIQUE (namespace, aggregate_id, version)
+		)`,
+		`CREATE INDEX IF NOT EXISTS events_event_type
+			ON events (namespace, event_type)`,
+		`CREATE INDEX IF NOT EXISTS events_position
+			ON events (namespace, position)`,
+	}
+}
+
+// lockPositions returns the statement to lock the assignment of positions
+// until the transaction ends, or an empty string if not needed. SQLite only
+// allows one writer at a time.
+func (d Dialect) lockPositions() string {
+	if d != PostgreSQL {
+		return ""
+	}
+	return `SELECT pg_advisory_xact_lock(hashtext('eventhorizon.events'))`
+}
+
+// rebind replaces the ? placeholders in a query with the placeholders of the
+// dialect.
+func (d Dialect) rebind(query string) string {
+	if d != PostgreSQL {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isUniqueViolation returns true if the error is a violation of a unique
+// constraint, without depending on a specific driver.
+func isUniqueViolation(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique constraint") ||
+		strings.Contains(msg, "duplicate key")
+}
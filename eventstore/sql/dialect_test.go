@@ -0,0 +1,29 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"testing"
+)
+
+func TestDialectRebind(t *testing.T) {
+	query := `SELECT * FROM events WHERE namespace = ? AND version > ?`
+	if q := SQLite.rebind(query); q != query {
+		t.Error("the SQLite query should not change:", q)
+	}
+	if q := PostgreSQL.rebind(query); q != `SELECT * FROM events WHERE namespace = $1 AND version > $2` {
+		t.Error("the PostgreSQL query should be correct:", q)
+	}
+}
@@ -0,0 +1,549 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrNoDB is when no database is provided.
+var ErrNoDB = errors.New("no database")
+
+// ErrCouldNotCreateSchema is when the tables could not be created.
+var ErrCouldNotCreateSchema = errors.New("could not create schema")
+
+// ErrCouldNotClearDB is when the database could not be cleared.
+var ErrCouldNotClearDB = errors.New("could not clear database")
+
+// ErrCouldNotMarshalEvent is when an event could not be marshaled into JSON.
+var ErrCouldNotMarshalEvent = errors.New("could not marshal event")
+
+// ErrCouldNotUnmarshalEvent is when an event could not be unmarshaled into a concrete type.
+var ErrCouldNotUnmarshalEvent = errors.New("could not unmarshal event")
+
+// ErrCouldNotUpcastEvent is when an event could not be upcasted.
+var ErrCouldNotUpcastEvent = errors.New("could not upcast event")
+
+// ErrCouldNotLoadAggregate is when an aggregate could not be loaded.
+var ErrCouldNotLoadAggregate = errors.New("could not load aggregate")
+
+// ErrCouldNotSaveAggregate is when an aggregate could not be saved.
+var ErrCouldNotSaveAggregate = errors.New("could not save aggregate")
+
+// EventStore implements an EventStore for SQL databases using database/sql,
+// with one row per event. The event data and metadata is stored as JSON.
+//
+// The global positions are taken from an auto incremented column. With
+// PostgreSQL the saves are serialized by an advisory lock, so that a lower
+// position can never become visible after a higher one.
+type EventStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewEventStore creates a new EventStore using a database, which must be
+// opened with a driver for the dialect. The tables are created if needed.
+func NewEventStore(db *sql.DB, dialect Dialect) (*EventStore, error) {
+	if db == nil {
+		return nil, ErrNoDB
+	}
+
+	s := &EventStore{
+		db:      db,
+		dialect: dialect,
+	}
+
+	for _, stmt := range dialect.schema() {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr: err,
+				Err:     ErrCouldNotCreateSchema,
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Save implements the Save method of the eventhorizon.EventStore interface.
+func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersion int) error {
+	if len(events) == 0 {
+		return eh.EventStoreError{
+			Err:       eh.ErrNoEventsToAppend,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	// Build all event records, with incrementing versions starting from the
+	// original aggregate version.
+	dbEvents := make([]dbEvent, len(events))
+	aggregateID := events[0].AggregateID()
+	version := originalVersion
+	for i, event := range events {
+		// Only accept events belonging to the same aggregate.
+		if event.AggregateID() != aggregateID {
+			return eh.EventStoreError{
+				Err:       eh.ErrInvalidEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		// Only accept events that apply to the correct aggregate version.
+		if event.Version() != version+1 {
+			return eh.EventStoreError{
+				Err:       eh.ErrIncorrectEventVersion,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		// Create the event record for the DB.
+		e, err := newDBEvent(ctx, event)
+		if err != nil {
+			return err
+		}
+		dbEvents[i] = *e
+		version++
+	}
+
+	ns := eh.NamespaceFromContext(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: ns,
+		}
+	}
+	defer tx.Rollback()
+
+	// Only insert if the version of the aggregate is matching (ie not changed
+	// since loading the aggregate). Concurrent inserts are also prevented by
+	// the unique constraint on the version.
+	var currentVersion int
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT COALESCE(MAX(version), 0) FROM events
+		WHERE namespace = ? AND aggregate_id = ?`),
+		ns, aggregateID,
+	).Scan(&currentVersion); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: ns,
+		}
+	}
+	if currentVersion != originalVersion {
+		return eh.EventStoreError{
+			Err:       eh.ErrVersionConflict,
+			Namespace: ns,
+		}
+	}
+
+	// Hold the position lock until commit, to make the events visible in
+	// position order.
+	if stmt := s.dialect.lockPositions(); stmt != "" {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotSaveAggregate,
+				Namespace: ns,
+			}
+		}
+	}
+
+	insert := s.dialect.rebind(
+		`INSERT INTO events (namespace, aggregate_id, aggregate_type, event_type,
+			version, timestamp, data, metadata, schema_version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	for _, e := range dbEvents {
+		if _, err := tx.ExecContext(ctx, insert,
+			ns, e.AggregateID, e.AggregateType, e.EventType,
+			e.Version, e.Timestamp, e.RawData, e.RawMetadata, e.SchemaVersion,
+		); err != nil && isUniqueViolation(err) {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       eh.ErrVersionConflict,
+				Namespace: ns,
+			}
+		} else if err != nil {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotSaveAggregate,
+				Namespace: ns,
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: ns,
+		}
+	}
+
+	return nil
+}
+
+// Load implements the Load method of the eventhorizon.EventStore interface.
+func (s *EventStore) Load(ctx context.Context, id eh.ID) ([]eh.Event, error) {
+	return s.LoadFromVersion(ctx, id, 0)
+}
+
+// LoadFromVersion implements the LoadFromVersion method of the eventhorizon.VersionedEventStore interface.
+func (s *EventStore) LoadFromVersion(ctx context.Context, id eh.ID, version int) ([]eh.Event, error) {
+	return s.query(ctx,
+		`WHERE namespace = ? AND aggregate_id = ? AND version > ? ORDER BY version`,
+		eh.NamespaceFromContext(ctx), id, version)
+}
+
+// LoadAll implements the LoadAll method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadAll(ctx context.Context, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	return s.LoadFrom(ctx, 0, 0, aggregateTypes...)
+}
+
+// LoadFrom implements the LoadFrom method of the eventhorizon.GlobalEventStore interface.
+func (s *EventStore) LoadFrom(ctx context.Context, position int64, limit int, aggregateTypes ...eh.AggregateType) ([]eh.Event, error) {
+	where := `WHERE namespace = ? AND position > ?`
+	args := []interface{}{eh.NamespaceFromContext(ctx), position}
+	if len(aggregateTypes) > 0 {
+		placeholders := make([]string, len(aggregateTypes))
+		for i, t := range aggregateTypes {
+			placeholders[i] = "?"
+			args = append(args, t)
+		}
+		where += ` AND aggregate_type IN (` + strings.Join(placeholders, ", ") + `)`
+	}
+	where += ` ORDER BY position`
+	if limit > 0 {
+		where += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	return s.query(ctx, where, args...)
+}
+
+// Replace implements the Replace method of the eventhorizon.EventStore interface.
+func (s *EventStore) Replace(ctx context.Context, event eh.Event) error {
+	ns := eh.NamespaceFromContext(ctx)
+
+	// First check if the aggregate exists, no updated rows can mean both that
+	// the aggregate or the event is not found.
+	var n int
+	if err := s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT COUNT(*) FROM events WHERE namespace = ? AND aggregate_id = ?`),
+		ns, event.AggregateID(),
+	).Scan(&n); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: ns,
+		}
+	} else if n == 0 {
+		return eh.ErrAggregateNotFound
+	}
+
+	// Create the event record for the DB.
+	e, err := newDBEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	// Replace the event, keeping its position in the global stream.
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`UPDATE events SET aggregate_type = ?, event_type = ?, timestamp = ?,
+			data = ?, metadata = ?, schema_version = ?
+		WHERE namespace = ? AND aggregate_id = ? AND version = ?`),
+		e.AggregateType, e.EventType, e.Timestamp,
+		e.RawData, e.RawMetadata, e.SchemaVersion,
+		ns, e.AggregateID, e.Version,
+	)
+	if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: ns,
+		}
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: ns,
+		}
+	} else if n == 0 {
+		return eh.ErrInvalidEvent
+	}
+
+	return nil
+}
+
+// RenameEvent implements the RenameEvent method of the eventhorizon.EventStore interface.
+func (s *EventStore) RenameEvent(ctx context.Context, from, to eh.EventType) error {
+	ns := eh.NamespaceFromContext(ctx)
+
+	// Find and rename all events.
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`UPDATE events SET event_type = ? WHERE namespace = ? AND event_type = ?`),
+		to, ns, from,
+	); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveAggregate,
+			Namespace: ns,
+		}
+	}
+
+	return nil
+}
+
+// Clear clears the event storage of the namespace.
+func (s *EventStore) Clear(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`DELETE FROM events WHERE namespace = ?`),
+		eh.NamespaceFromContext(ctx),
+	); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotClearDB,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Close closes the database.
+func (s *EventStore) Close() error {
+	return s.db.Close()
+}
+
+// query loads the events matching a where clause, including its ordering.
+func (s *EventStore) query(ctx context.Context, where string, args ...interface{}) ([]eh.Event, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT position, aggregate_id, aggregate_type, event_type, version,
+			timestamp, data, metadata, schema_version
+		FROM events `+where), args...)
+	if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotLoadAggregate,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	defer rows.Close()
+
+	events := []eh.Event{}
+	for rows.Next() {
+		var e dbEvent
+		if err := rows.Scan(&e.Position, &e.AggregateID, &e.AggregateType, &e.EventType,
+			&e.Version, &e.Timestamp, &e.RawData, &e.RawMetadata, &e.SchemaVersion,
+		); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotLoadAggregate,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		event, err := newEvent(ctx, e)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotLoadAggregate,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return events, nil
+}
+
+// dbEvent is the internal event record for the SQL event store used to save
+// and load events from the DB.
+type dbEvent struct {
+	Position      int64
+	EventType     eh.EventType
+	RawData       sql.NullString
+	data          eh.EventData
+	Timestamp     time.Time
+	AggregateType eh.AggregateType
+	AggregateID   eh.ID
+	Version       int
+	RawMetadata   sql.NullString
+	metadata      map[string]interface{}
+	SchemaVersion int
+}
+
+// newDBEvent returns a new dbEvent for an event.
+func newDBEvent(ctx context.Context, event eh.Event) (*dbEvent, error) {
+	e := &dbEvent{
+		EventType:     event.EventType(),
+		Timestamp:     event.Timestamp().UTC(),
+		AggregateType: event.AggregateType(),
+		AggregateID:   event.AggregateID(),
+		Version:       event.Version(),
+		SchemaVersion: eh.EventSchemaVersion(event.EventType()),
+	}
+
+	// Marshal event data and metadata if there is any.
+	if event.Data() != nil {
+		b, err := json.Marshal(event.Data())
+		if err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotMarshalEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		e.RawData = sql.NullString{String: string(b), Valid: true}
+	}
+	if event.Metadata() != nil {
+		b, err := json.Marshal(event.Metadata())
+		if err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotMarshalEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		e.RawMetadata = sql.NullString{String: string(b), Valid: true}
+	}
+
+	return e, nil
+}
+
+// newEvent returns an event with concrete event data from a dbEvent.
+func newEvent(ctx context.Context, e dbEvent) (eh.Event, error) {
+	// Upcast the raw JSON data if there is a newer schema version.
+	if eh.EventSchemaVersion(e.EventType) > e.SchemaVersion {
+		var err error
+		if e, err = upcast(e); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotUpcastEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	// Create an event of the correct type.
+	if e.RawData.Valid {
+		if data, err := eh.CreateEventData(e.EventType); err == nil {
+			if err := json.Unmarshal([]byte(e.RawData.String), data); err != nil {
+				return nil, eh.EventStoreError{
+					BaseErr:   err,
+					Err:       ErrCouldNotUnmarshalEvent,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			e.data = data
+		}
+	}
+
+	if e.RawMetadata.Valid {
+		if err := json.Unmarshal([]byte(e.RawMetadata.String), &e.metadata); err != nil {
+			return nil, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotUnmarshalEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	return event{dbEvent: e}, nil
+}
+
+// upcast upcasts the raw JSON data of an event record to the current schema
+// version of its event type.
+func upcast(e dbEvent) (dbEvent, error) {
+	var data []byte
+	if e.RawData.Valid {
+		data = []byte(e.RawData.String)
+	}
+
+	var err error
+	e.EventType, e.SchemaVersion, data, err = eh.UpcastRawEventData(
+		e.EventType, e.SchemaVersion, data, json.Unmarshal, json.Marshal)
+	if err != nil {
+		return e, err
+	}
+	e.RawData = sql.NullString{}
+	if data != nil {
+		e.RawData = sql.NullString{String: string(data), Valid: true}
+	}
+
+	return e, nil
+}
+
+// event is the private implementation of the eventhorizon.Event interface
+// for a SQL event store.
+type event struct {
+	dbEvent
+}
+
+// AggrgateID implements the AggrgateID method of the eventhorizon.Event interface.
+func (e event) AggregateID() eh.ID {
+	return e.dbEvent.AggregateID
+}
+
+// AggregateType implements the AggregateType method of the eventhorizon.Event interface.
+func (e event) AggregateType() eh.AggregateType {
+	return e.dbEvent.AggregateType
+}
+
+// EventType implements the EventType method of the eventhorizon.Event interface.
+func (e event) EventType() eh.EventType {
+	return e.dbEvent.EventType
+}
+
+// Data implements the Data method of the eventhorizon.Event interface.
+func (e event) Data() eh.EventData {
+	return e.dbEvent.data
+}
+
+// Metadata implements the Metadata method of the eventhorizon.Event interface.
+func (e event) Metadata() map[string]interface{} {
+	return e.dbEvent.metadata
+}
+
+// Version implements the Version method of the eventhorizon.Event interface.
+func (e event) Version() int {
+	return e.dbEvent.Version
+}
+
+// Timestamp implements the Timestamp method of the eventhorizon.Event interface.
+func (e event) Timestamp() time.Time {
+	return e.dbEvent.Timestamp
+}
+
+// Position implements the Position method of the eventhorizon.PositionedEvent interface.
+func (e event) Position() int64 {
+	return e.dbEvent.Position
+}
+
+// String implements the String method of the eventhorizon.Event interface.
+func (e event) String() string {
+	return fmt.Sprintf("%s@%d", e.dbEvent.EventType, e.dbEvent.Version)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sql_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventstore"
+	sqlstore "github.com/looplab/eventhorizon/eventstore/sql"
+)
+
+func TestEventStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	// Every connection gets its own in memory database.
+	db.SetMaxOpenConns(1)
+
+	store, err := sqlstore.NewEventStore(db, sqlstore.SQLite)
+	if err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	if store == nil {
+		t.Fatal("there should be a store")
+	}
+	defer store.Close()
+
+	// Creating the schema again should work.
+	if _, err := sqlstore.NewEventStore(db, sqlstore.SQLite); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	ctx := eh.NewContextWithNamespace(context.Background(), "ns")
+
+	t.Log("event store with default namespace")
+	eventstore.AcceptanceTest(t, context.Background(), store)
+
+	t.Log("event store with other namespace")
+	eventstore.AcceptanceTest(t, ctx, store)
+
+	t.Log("global event store with default namespace")
+	eventstore.GlobalAcceptanceTest(t, context.Background(), store)
+
+	t.Log("global event store with other namespace")
+	eventstore.GlobalAcceptanceTest(t, ctx, store)
+
+	t.Log("upcasting event store with default namespace")
+	eventstore.UpcastAcceptanceTest(t, context.Background(), store)
+
+	t.Log("upcasting event store with other namespace")
+	eventstore.UpcastAcceptanceTest(t, ctx, store)
+
+	t.Log("event store maintainer")
+	eventstore.MaintainerAcceptanceTest(t, context.Background(), store)
+
+	t.Log("clear namespace")
+	if err := store.Clear(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	events, err := store.LoadAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) != 0 {
+		t.Error("there should be no events:", events)
+	}
+	events, err = store.LoadAll(context.Background())
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(events) == 0 {
+		t.Error("the events in the default namespace should be kept")
+	}
+}
+
+func TestNewEventStoreNoDB(t *testing.T) {
+	store, err := sqlstore.NewEventStore(nil, sqlstore.SQLite)
+	if err != sqlstore.ErrNoDB {
+		t.Error("there should be a no DB error:", err)
+	}
+	if store != nil {
+		t.Error("there should be no store:", store)
+	}
+}
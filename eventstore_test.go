@@ -0,0 +1,36 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventhorizon_test
+
+import (
+	"testing"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+func Test_IsVersionConflict(t *testing.T) {
+	if !eh.IsVersionConflict(eh.EventStoreError{Err: eh.ErrVersionConflict}) {
+		t.Error("the event store error should be a version conflict")
+	}
+	if !eh.IsVersionConflict(eh.ErrVersionConflict) {
+		t.Error("the error should be a version conflict")
+	}
+	if eh.IsVersionConflict(eh.EventStoreError{Err: eh.ErrInvalidEvent}) {
+		t.Error("the error should not be a version conflict")
+	}
+	if eh.IsVersionConflict(nil) {
+		t.Error("no error should not be a version conflict")
+	}
+}
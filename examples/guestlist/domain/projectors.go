@@ -18,7 +18,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sync"
 
 	eh "github.com/looplab/eventhorizon"
 	"github.com/looplab/eventhorizon/eventhandler/projector"
@@ -98,8 +97,11 @@ func (p *InvitationProjector) Project(ctx context.Context, event eh.Event, entit
 	return i, nil
 }
 
-// GuestList is a read model object for the guest list.
+// GuestList is a read model object for the guest list. It keeps the versions
+// of the applied invitation events, to count each event once.
 type GuestList struct {
+	projector.AppliedVersions `bson:",inline"`
+
 	ID           eh.ID `bson:"_id"`
 	NumGuests    int
 	NumAccepted  int
@@ -108,56 +110,36 @@ type GuestList struct {
 	NumDenied    int
 }
 
-var _ = eh.Entity(&Invitation{})
+var _ = projector.KeyedModel(&GuestList{})
 
 // EntityID implements the EntityID method of the eventhorizon.Entity interface.
 func (g *GuestList) EntityID() eh.ID {
 	return g.ID
 }
 
-// GuestListProjector is a projector that updates the guest list. It is
-// implemented as a manual projector, not using the Projector interface.
-type GuestListProjector struct {
-	repo    eh.ReadWriteRepo
-	repoMu  sync.Mutex
-	eventID eh.ID
-}
+// GuestListProjector is a projector that updates the guest list, combining the
+// events of all invitations. It should be used with a KeyFunc that returns the
+// ID of the guest list.
+type GuestListProjector struct{}
 
 // NewGuestListProjector creates a new GuestListProjector.
-func NewGuestListProjector(repo eh.ReadWriteRepo, eventID eh.ID) *GuestListProjector {
-	p := &GuestListProjector{
-		repo:    repo,
-		eventID: eventID,
-	}
-	return p
+func NewGuestListProjector() *GuestListProjector {
+	return &GuestListProjector{}
 }
 
-// HandlerType implements the HandlerType method of the eventhorizon.EventHandler interface.
-func (p *GuestListProjector) HandlerType() eh.EventHandlerType {
-	return eh.EventHandlerType("GuestListProjector")
+// ProjectorType implements the ProjectorType method of the Projector interface.
+func (p *GuestListProjector) ProjectorType() projector.Type {
+	return projector.Type("GuestListProjector")
 }
 
-// HandleEvent implements the HandleEvent method of the EventHandler interface.
-func (p *GuestListProjector) HandleEvent(ctx context.Context, event eh.Event) error {
-	// NOTE: Temp fix because we need to count the guests atomically.
-	p.repoMu.Lock()
-	defer p.repoMu.Unlock()
-
-	// Load or create the guest list.
-	var g *GuestList
-	m, err := p.repo.Find(ctx, p.eventID)
-	if rrErr, ok := err.(eh.RepoError); ok && rrErr.Err == eh.ErrEntityNotFound {
-		g = &GuestList{
-			ID: p.eventID,
-		}
-	} else if err != nil {
-		return err
-	} else {
-		var ok bool
-		g, ok = m.(*GuestList)
-		if !ok {
-			return errors.New("projector: incorrect entity type")
-		}
+// Project implements the Project method of the Projector interface.
+func (p *GuestListProjector) Project(ctx context.Context, event eh.Event, entity eh.Entity) (eh.Entity, error) {
+	g, ok := entity.(*GuestList)
+	if !ok {
+		return nil, errors.New("model is of incorrect type")
+	}
+	if id, ok := projector.KeyFromContext(ctx); ok {
+		g.ID = id
 	}
 
 	// Apply the count of the guests.
@@ -177,12 +159,8 @@ func (p *GuestListProjector) HandleEvent(ctx context.Context, event eh.Event) er
 		g.NumDenied++
 
 	default:
-		return errors.New("could not handle event: " + event.String())
-	}
-
-	if err := p.repo.Save(ctx, g); err != nil {
-		return errors.New("projector: could not save: " + err.Error())
+		return nil, errors.New("could not handle event: " + event.String())
 	}
 
-	return nil
+	return g, nil
 }
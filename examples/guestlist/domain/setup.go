@@ -67,7 +67,10 @@ func Setup(
 	), invitationProjector)
 
 	// Create and register a read model for a guest list.
-	guestListProjector := NewGuestListProjector(guestListRepo, eventID)
+	guestListProjector := projector.NewEventHandler(
+		NewGuestListProjector(), guestListRepo)
+	guestListProjector.SetEntityFactory(func() eh.Entity { return &GuestList{} })
+	guestListProjector.SetKeyFunc(func(eh.Event) []eh.ID { return []eh.ID{eventID} })
 	eventBus.AddHandler(eh.MatchAnyEventOf(
 		InviteAcceptedEvent,
 		InviteDeclinedEvent,
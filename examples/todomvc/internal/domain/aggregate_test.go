@@ -416,7 +416,7 @@ func Test_AggregateHandleCommand(t *testing.T) {
 				t.Log("exp:", tc.expectedErr)
 				t.Log("got:", err)
 			}
-			events := tc.agg.Events()
+			events := withoutEventIDs(t, tc.agg.Events())
 			if !reflect.DeepEqual(events, tc.expectedEvents) {
 				t.Errorf("test case '%s': incorrect events", name)
 				t.Log("exp:\n", pretty.Sprint(tc.expectedEvents))
@@ -426,6 +426,20 @@ func Test_AggregateHandleCommand(t *testing.T) {
 	}
 }
 
+// withoutEventIDs checks that all events have a unique event ID in their
+// metadata, and returns the events without it to be able to compare them.
+func withoutEventIDs(t *testing.T, events []eh.Event) []eh.Event {
+	var stripped []eh.Event
+	for _, e := range events {
+		if id, ok := e.Metadata()[eh.EventIDMetadataKey].(string); !ok || id == "" {
+			t.Error("the event should have an event ID:", e)
+		}
+		stripped = append(stripped, eh.NewEventForAggregate(e.EventType(), e.Data(),
+			e.Timestamp(), e.AggregateType(), e.AggregateID(), e.Version()))
+	}
+	return stripped
+}
+
 func Test_AggregateApplyEvent(t *testing.T) {
 	TimeNow = func() time.Time {
 		return time.Date(2017, time.July, 10, 23, 0, 0, 0, time.Local)
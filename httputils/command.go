@@ -25,7 +25,9 @@ import (
 
 // CommandHandler is a HTTP handler for eventhorizon.Commands. Commands must be
 // registered with eventhorizon.RegisterCommand(). It expects a POST with a JSON
-// body that will be unmarshalled into the command.
+// body that will be unmarshalled into the command. An optional Idempotency-Key
+// header is used as the command ID, to deduplicate retried requests. The key
+// only needs to be unique per command type.
 func CommandHandler(commandHandler eh.CommandHandler, commandType eh.CommandType) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
@@ -53,6 +55,9 @@ func CommandHandler(commandHandler eh.CommandHandler, commandType eh.CommandType
 		// the HTTP request which will cause projectors etc to fail if they run
 		// async in goroutines past the request.
 		ctx := context.Background()
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			ctx = eh.NewContextWithCommandID(ctx, key)
+		}
 		if err := commandHandler.HandleCommand(ctx, cmd); err != nil {
 			http.Error(w, "could not handle command: "+err.Error(), http.StatusBadRequest)
 			return
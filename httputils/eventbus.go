@@ -20,6 +20,7 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	eh "github.com/looplab/eventhorizon"
 )
@@ -48,7 +49,9 @@ func (h *handler) HandleEvent(ctx context.Context, event eh.Event) error {
 }
 
 // EventBusHandler is a Websocket handler for eventhorizon.Events. Events will
-// be forwarded to all requests that have been upgraded to websockets.
+// be forwarded to all requests that have been upgraded to websockets. Each
+// websocket is added as an observer with a unique type, which is removed when
+// the client disconnects.
 // TODO: Send events as JSON.
 func EventBusHandler(eventBus eh.EventBus, m eh.EventMatcher, id string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -60,15 +63,37 @@ func EventBusHandler(eventBus eh.EventBus, m eh.EventMatcher, id string) http.Ha
 		defer c.Close()
 
 		h := &handler{
-			id: id,
+			id: id + "_" + uuid.New().String(),
 			ch: make(chan eh.Event, 10),
 		}
 		eventBus.AddObserver(m, h)
+		defer func() {
+			if err := eventBus.RemoveHandler(h.HandlerType()); err != nil {
+				log.Println("remove handler:", err)
+			}
+		}()
+
+		// Read until the client disconnects, as messages from the client are
+		// not used.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
 
-		for event := range h.ch {
-			if err := c.WriteMessage(websocket.TextMessage, []byte(event.String())); err != nil {
-				log.Println("write:", err)
-				break
+		for {
+			select {
+			case event := <-h.ch:
+				if err := c.WriteMessage(websocket.TextMessage, []byte(event.String())); err != nil {
+					log.Println("write:", err)
+					return
+				}
+			case <-done:
+				return
 			}
 		}
 	})
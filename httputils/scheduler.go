@@ -0,0 +1,126 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/commandhandler/scheduler"
+)
+
+// SchedulerHandler is a HTTP handler for the commands of a scheduler.Scheduler.
+// If the URL ends with a / a GET returns all scheduled commands, otherwise the
+// last part of the path is used as the ID of a scheduled command. A GET returns
+// the command, a PUT with a JSON body like {"execute_at": "2006-01-02T15:04:05Z"}
+// reschedules it and a DELETE cancels it.
+func SchedulerHandler(s *scheduler.Scheduler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, id := path.Split(r.URL.Path)
+		if id == "" && r.Method != "GET" {
+			http.Error(w, "missing command ID", http.StatusBadRequest)
+			return
+		}
+
+		var (
+			data interface{}
+			err  error
+		)
+		switch r.Method {
+		case "GET":
+			if id == "" {
+				var cmds []scheduler.ScheduledCommand
+				if cmds, err = s.Commands(r.Context()); err != nil {
+					break
+				}
+				results := make([]scheduledCommand, len(cmds))
+				for i, cmd := range cmds {
+					results[i] = newScheduledCommand(cmd)
+				}
+				data = results
+			} else {
+				var cmd scheduler.ScheduledCommand
+				if cmd, err = s.Command(r.Context(), id); err == nil {
+					data = newScheduledCommand(cmd)
+				}
+			}
+
+		case "PUT":
+			b, rErr := ioutil.ReadAll(r.Body)
+			if rErr != nil {
+				http.Error(w, "could not read request: "+rErr.Error(), http.StatusBadRequest)
+				return
+			}
+			var req struct {
+				ExecuteAt time.Time `json:"execute_at"`
+			}
+			if jErr := json.Unmarshal(b, &req); jErr != nil || req.ExecuteAt.IsZero() {
+				http.Error(w, "could not decode execution time", http.StatusBadRequest)
+				return
+			}
+			err = s.Reschedule(r.Context(), id, req.ExecuteAt)
+
+		case "DELETE":
+			err = s.Cancel(r.Context(), id)
+
+		default:
+			http.Error(w, "unsuported method: "+r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if sErr, ok := err.(scheduler.StoreError); ok && sErr.Err == scheduler.ErrCommandNotFound {
+			http.Error(w, "could not find command", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "could not handle request: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if data == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		b, err := json.Marshal(data)
+		if err != nil {
+			http.Error(w, "could not encode result: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	})
+}
+
+// scheduledCommand is the JSON representation of a scheduled command, without
+// the context.
+type scheduledCommand struct {
+	ID          eh.ID          `json:"id"`
+	CommandType eh.CommandType `json:"command_type"`
+	Command     eh.Command     `json:"command"`
+	ExecuteAt   time.Time      `json:"execute_at"`
+	Created     time.Time      `json:"created"`
+}
+
+func newScheduledCommand(cmd scheduler.ScheduledCommand) scheduledCommand {
+	return scheduledCommand{
+		ID:          cmd.ID,
+		CommandType: cmd.Command.CommandType(),
+		Command:     cmd.Command,
+		ExecuteAt:   cmd.ExecuteAt,
+		Created:     cmd.Created,
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package async
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrQueueFull is when a command is rejected because the queue is full.
+var ErrQueueFull = errors.New("queue full")
+
+// ErrDropped is when a queued command is dropped for a newer command, it is
+// sent on the error channel.
+var ErrDropped = errors.New("command dropped")
+
+// ErrPoolClosed is when a command is handled after the pool has been closed.
+var ErrPoolClosed = errors.New("pool closed")
+
+// Default values for a Pool.
+const (
+	DefaultWorkers   = 10
+	DefaultQueueSize = 100
+)
+
+// Policy is what to do with a command when the queue of its worker is full.
+type Policy int
+
+const (
+	// Block waits until there is room in the queue, or the context is done.
+	Block Policy = iota
+	// Reject returns ErrQueueFull.
+	Reject
+	// DropOldest drops the oldest command in the queue, which is sent on the
+	// error channel with ErrDropped.
+	DropOldest
+)
+
+// Option is an option for a Pool.
+type Option func(*Pool)
+
+// WithWorkers sets the number of workers.
+func WithWorkers(workers int) Option {
+	return func(p *Pool) {
+		p.workers = workers
+	}
+}
+
+// WithQueueSize sets the size of the queue of each worker, which is at least 1.
+func WithQueueSize(size int) Option {
+	return func(p *Pool) {
+		p.queueSize = size
+	}
+}
+
+// WithPolicy sets the policy for when the queue of a worker is full.
+func WithPolicy(policy Policy) Option {
+	return func(p *Pool) {
+		p.policy = policy
+	}
+}
+
+// Pool is a pool of workers that handle commands async, with a bounded queue
+// per worker. Commands are sharded by aggregate ID, so that the commands of
+// an aggregate are handled in order by the same worker.
+type Pool struct {
+	workers   int
+	queueSize int
+	policy    Policy
+	queues    []chan item
+	errCh     chan Error
+	wg        sync.WaitGroup
+
+	// Held for reading while queueing and for writing when closing.
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+type item struct {
+	ctx context.Context
+	cmd eh.Command
+	h   eh.CommandHandler
+}
+
+// NewPool creates a new Pool and starts its workers.
+func NewPool(options ...Option) *Pool {
+	p := &Pool{
+		workers:   DefaultWorkers,
+		queueSize: DefaultQueueSize,
+		errCh:     make(chan Error, 100),
+	}
+	for _, option := range options {
+		option(p)
+	}
+	if p.workers < 1 {
+		p.workers = 1
+	}
+	if p.queueSize < 1 {
+		p.queueSize = 1
+	}
+
+	p.queues = make([]chan item, p.workers)
+	for i := range p.queues {
+		p.queues[i] = make(chan item, p.queueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+
+	return p
+}
+
+// Middleware returns a middleware that queues commands to be handled by the
+// workers of the pool.
+func (p *Pool) Middleware() eh.CommandHandlerMiddleware {
+	return eh.CommandHandlerMiddleware(func(h eh.CommandHandler) eh.CommandHandler {
+		return eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+			return p.queue(item{ctx, cmd, h})
+		})
+	})
+}
+
+// Errors returns an error channel where errors from handling commands and
+// dropped commands are sent. Errors are dropped if the channel is full.
+func (p *Pool) Errors() <-chan Error {
+	return p.errCh
+}
+
+// QueueDepth returns the number of queued commands for all workers.
+func (p *Pool) QueueDepth() int {
+	depth := 0
+	for _, q := range p.queues {
+		depth += len(q)
+	}
+	return depth
+}
+
+// Close stops accepting new commands and waits for all queued commands to be
+// handled.
+func (p *Pool) Close() {
+	p.closeMu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, q := range p.queues {
+			close(q)
+		}
+	}
+	p.closeMu.Unlock()
+
+	p.wg.Wait()
+}
+
+func (p *Pool) queue(i item) error {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(i.cmd.AggregateID()))
+	q := p.queues[hash.Sum32()%uint32(len(p.queues))]
+
+	switch p.policy {
+	case Reject:
+		select {
+		case q <- i:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	case DropOldest:
+		for {
+			select {
+			case q <- i:
+				return nil
+			default:
+			}
+			select {
+			case old := <-q:
+				p.sendErr(Error{ErrDropped, old.ctx, old.cmd})
+			default:
+			}
+		}
+	default:
+		select {
+		case q <- i:
+			return nil
+		case <-i.ctx.Done():
+			return i.ctx.Err()
+		}
+	}
+}
+
+func (p *Pool) work(q chan item) {
+	defer p.wg.Done()
+
+	for i := range q {
+		if err := i.h.HandleCommand(i.ctx, i.cmd); err != nil {
+			p.sendErr(Error{err, i.ctx, i.cmd})
+		}
+	}
+}
+
+func (p *Pool) sendErr(err Error) {
+	select {
+	case p.errCh <- err:
+	default:
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package async_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/commandhandler/async"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func Test_Pool_Ordering(t *testing.T) {
+	var handled []mocks.Command
+	var handledMu sync.Mutex
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		handledMu.Lock()
+		defer handledMu.Unlock()
+		handled = append(handled, cmd.(mocks.Command))
+		return nil
+	})
+	p := async.NewPool(async.WithWorkers(4), async.WithQueueSize(10))
+	h := eh.UseCommandHandlerMiddleware(inner, p.Middleware())
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		cmd := mocks.Command{ID: fmt.Sprintf("id%d", i%5), Content: fmt.Sprint(i)}
+		if err := h.HandleCommand(ctx, cmd); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	// Closing waits for all queued commands.
+	p.Close()
+	if len(handled) != 100 {
+		t.Error("all commands should be handled:", len(handled))
+	}
+	if p.QueueDepth() != 0 {
+		t.Error("the queue should be empty:", p.QueueDepth())
+	}
+	last := map[eh.ID]int{}
+	for _, cmd := range handled {
+		var i int
+		fmt.Sscan(cmd.Content, &i)
+		if l, ok := last[cmd.ID]; ok && i < l {
+			t.Error("the commands of an aggregate should be handled in order:", cmd)
+		}
+		last[cmd.ID] = i
+	}
+
+	if err := h.HandleCommand(ctx, mocks.Command{ID: "id"}); err != async.ErrPoolClosed {
+		t.Error("there should be a pool closed error:", err)
+	}
+}
+
+func Test_Pool_Policies(t *testing.T) {
+	for name, policy := range map[string]async.Policy{
+		"block":       async.Block,
+		"reject":      async.Reject,
+		"drop oldest": async.DropOldest,
+	} {
+		t.Run(name, func(t *testing.T) {
+			started := make(chan struct{}, 10)
+			release := make(chan struct{})
+			handleErr := errors.New("handling error")
+			inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+				started <- struct{}{}
+				<-release
+				return handleErr
+			})
+			p := async.NewPool(async.WithWorkers(1), async.WithQueueSize(1), async.WithPolicy(policy))
+			h := eh.UseCommandHandlerMiddleware(inner, p.Middleware())
+
+			// Fill the worker and the queue.
+			ctx := context.Background()
+			cmd1 := mocks.Command{ID: "id", Content: "cmd1"}
+			cmd2 := mocks.Command{ID: "id", Content: "cmd2"}
+			cmd3 := mocks.Command{ID: "id", Content: "cmd3"}
+			if err := h.HandleCommand(ctx, cmd1); err != nil {
+				t.Error("there should be no error:", err)
+			}
+			<-started
+			if err := h.HandleCommand(ctx, cmd2); err != nil {
+				t.Error("there should be no error:", err)
+			}
+			if p.QueueDepth() != 1 {
+				t.Error("there should be a queued command:", p.QueueDepth())
+			}
+
+			timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			err := h.HandleCommand(timeoutCtx, cmd3)
+			switch policy {
+			case async.Block:
+				if err != context.DeadlineExceeded {
+					t.Error("there should be a deadline exceeded error:", err)
+				}
+			case async.Reject:
+				if err != async.ErrQueueFull {
+					t.Error("there should be a queue full error:", err)
+				}
+			case async.DropOldest:
+				if err != nil {
+					t.Error("there should be no error:", err)
+				}
+				select {
+				case err := <-p.Errors():
+					if err.Err != async.ErrDropped || err.Command != cmd2 {
+						t.Error("the oldest command should be dropped:", err)
+					}
+				case <-time.After(time.Second):
+					t.Error("there should be a dropped error")
+				}
+			}
+
+			close(release)
+			p.Close()
+			select {
+			case err := <-p.Errors():
+				if err.Err != handleErr || err.Command != cmd1 {
+					t.Error("the handling error should be correct:", err)
+				}
+			default:
+				t.Error("there should be a handling error")
+			}
+		})
+	}
+}
+
+func Test_Pool_QueueSize(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	p := async.NewPool(async.WithWorkers(1), async.WithQueueSize(0), async.WithPolicy(async.DropOldest))
+	h := eh.UseCommandHandlerMiddleware(inner, p.Middleware())
+	defer p.Close()
+	defer close(release)
+
+	// A queue size below 1 is clamped, so that commands can be queued.
+	ctx := context.Background()
+	if err := h.HandleCommand(ctx, mocks.Command{ID: "id", Content: "cmd1"}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	<-started
+	if err := h.HandleCommand(ctx, mocks.Command{ID: "id", Content: "cmd2"}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if p.QueueDepth() != 1 {
+		t.Error("there should be a queued command:", p.QueueDepth())
+	}
+}
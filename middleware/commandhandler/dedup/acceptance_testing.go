@@ -0,0 +1,145 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// AcceptanceTest is the acceptance test that all implementations of Store
+// should pass. It should manually be called from a test case in each
+// implementation:
+//
+//   func TestStore(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewStore()
+//       dedup.AcceptanceTest(t, ctx, store)
+//   }
+//
+func AcceptanceTest(t *testing.T, ctx context.Context, store Store) {
+	id := uuid.New().String()
+	cmdType := eh.CommandType("Command")
+
+	t.Log("begin a new command")
+	r, err := store.Begin(ctx, cmdType, id, time.Hour)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if r != nil {
+		t.Error("there should be no record:", r)
+	}
+
+	t.Log("begin a command in progress")
+	r, err = store.Begin(ctx, cmdType, id, time.Hour)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if r == nil || r.CommandType != cmdType || r.ID != id || r.Done {
+		t.Fatal("there should be a record in progress:", r)
+	}
+	if !r.ExpiresAt.After(r.Created) {
+		t.Error("the record should expire after it was created:", r)
+	}
+
+	t.Log("begin a command in an other namespace")
+	otherCtx := eh.NewContextWithNamespace(ctx, "other")
+	r, err = store.Begin(otherCtx, cmdType, id, time.Hour)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if r != nil {
+		t.Error("there should be no record:", r)
+	}
+
+	t.Log("begin a command of an other type")
+	r, err = store.Begin(ctx, eh.CommandType("OtherCommand"), id, time.Hour)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if r != nil {
+		t.Error("there should be no record:", r)
+	}
+
+	t.Log("complete a command")
+	if err := store.Complete(ctx, cmdType, id, "failed", time.Hour); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	r, err = store.Begin(ctx, cmdType, id, time.Hour)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if r == nil || !r.Done || r.Err != "failed" {
+		t.Error("there should be a completed record:", r)
+	}
+
+	t.Log("complete an unknown command")
+	err = store.Complete(ctx, cmdType, uuid.New().String(), "", time.Hour)
+	if dedupErr, ok := err.(Error); !ok || dedupErr.Err != ErrRecordNotFound {
+		t.Error("there should be a record not found error:", err)
+	}
+
+	t.Log("release a command")
+	id = uuid.New().String()
+	if _, err := store.Begin(ctx, cmdType, id, time.Hour); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := store.Release(ctx, cmdType, id); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	r, err = store.Begin(ctx, cmdType, id, time.Hour)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if r != nil {
+		t.Error("there should be no record:", r)
+	}
+
+	t.Log("reclaim a command with an expired lease")
+	id = uuid.New().String()
+	if _, err := store.Begin(ctx, cmdType, id, time.Millisecond); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	r, err = store.Begin(ctx, cmdType, id, time.Hour)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if r != nil {
+		t.Error("there should be no record:", r)
+	}
+
+	t.Log("reclaim an expired command")
+	id = uuid.New().String()
+	if _, err := store.Begin(ctx, cmdType, id, time.Hour); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := store.Complete(ctx, cmdType, id, "", time.Millisecond); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	r, err = store.Begin(ctx, cmdType, id, time.Hour)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if r != nil {
+		t.Error("there should be no record:", r)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dedup
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCommandInProgress is when a command with the same ID is being handled.
+var ErrCommandInProgress = errors.New("command with the same ID is in progress")
+
+// ErrRecordNotFound is when a command record could not be found.
+var ErrRecordNotFound = errors.New("command record not found")
+
+// DefaultTTL is the default time to keep the records of handled commands.
+const DefaultTTL = 24 * time.Hour
+
+// DefaultLease is the default time that a command in progress is claimed.
+const DefaultLease = time.Minute
+
+// Error is an error in the dedup store.
+type Error struct {
+	// Err is the error.
+	Err error
+	// BaseErr is an optional underlying error, for example from the DB driver.
+	BaseErr error
+	// Namespace is the namespace for the error.
+	Namespace string
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e Error) Error() string {
+	errStr := e.Err.Error()
+	if e.BaseErr != nil {
+		errStr += ": " + e.BaseErr.Error()
+	}
+	return errStr + " (" + e.Namespace + ")"
+}
+
+// DuplicateError is returned for a duplicate of a command that failed when it
+// was first handled, with the original error message.
+type DuplicateError struct {
+	// CommandID is the ID of the command.
+	CommandID eh.ID
+	// Message is the error message of the original command.
+	Message string
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e DuplicateError) Error() string {
+	return e.Message
+}
+
+// Option is an option for the dedup middleware.
+type Option func(*options)
+
+type options struct {
+	ttl       time.Duration
+	lease     time.Duration
+	retryable func(error) bool
+}
+
+// WithTTL sets the time to keep the records of handled commands. The default
+// is DefaultTTL.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithLease sets the time that a command in progress is claimed, after which
+// a duplicate is handled again. It should be longer than it takes to handle
+// any command, as a duplicate can else be handled concurrently. The default
+// is DefaultLease.
+func WithLease(lease time.Duration) Option {
+	return func(o *options) {
+		o.lease = lease
+	}
+}
+
+// WithRetryable sets the function that decides if an error from handling a
+// command is retryable, in which case it is not recorded and a duplicate is
+// handled again. The default is IsRetryable.
+func WithRetryable(retryable func(error) bool) Option {
+	return func(o *options) {
+		o.retryable = retryable
+	}
+}
+
+// IsRetryable returns true for errors that don't come from the command itself
+// and for which nothing is saved: context errors and errors from saving
+// events or entities.
+func IsRetryable(err error) bool {
+	switch err.(type) {
+	case eh.EventStoreError, eh.RepoError:
+		return true
+	}
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// NewMiddleware returns a new middleware that handles commands with the same
+// type and ID only once, recording them in the store. The ID is taken from
+// commands implementing eventhorizon.IdentifiableCommand or from the context,
+// other commands are always handled.
+//
+// A duplicate of a command that has been handled returns the original outcome,
+// nil or a DuplicateError with the original error message. A duplicate of a
+// command that is still being handled returns ErrCommandInProgress. Commands
+// that fail with a retryable error are not recorded.
+func NewMiddleware(store Store, opts ...Option) eh.CommandHandlerMiddleware {
+	o := options{
+		ttl:       DefaultTTL,
+		lease:     DefaultLease,
+		retryable: IsRetryable,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return eh.CommandHandlerMiddleware(func(h eh.CommandHandler) eh.CommandHandler {
+		return eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+			id, ok := eh.CommandID(ctx, cmd)
+			if !ok {
+				return h.HandleCommand(ctx, cmd)
+			}
+
+			r, err := store.Begin(ctx, cmd.CommandType(), id, o.lease)
+			if err != nil {
+				return err
+			}
+			if r != nil {
+				if !r.Done {
+					return ErrCommandInProgress
+				} else if r.Err != "" {
+					return DuplicateError{CommandID: id, Message: r.Err}
+				}
+				return nil
+			}
+
+			handlerErr := h.HandleCommand(ctx, cmd)
+			if handlerErr != nil && o.retryable(handlerErr) {
+				// Let the command be handled again. If the release fails the
+				// claim expires with the lease instead.
+				_ = store.Release(ctx, cmd.CommandType(), id)
+				return handlerErr
+			}
+			errMsg := ""
+			if handlerErr != nil {
+				errMsg = handlerErr.Error()
+			}
+			if err := store.Complete(ctx, cmd.CommandType(), id, errMsg, o.ttl); err != nil && handlerErr == nil {
+				return err
+			}
+			return handlerErr
+		})
+	})
+}
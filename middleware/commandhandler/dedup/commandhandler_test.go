@@ -0,0 +1,201 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dedup_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/commandhandler/dedup"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func Test_MemoryStore(t *testing.T) {
+	store := dedup.NewMemoryStore()
+	if store == nil {
+		t.Fatal("there should be a store")
+	}
+
+	t.Log("store with default namespace")
+	dedup.AcceptanceTest(t, context.Background(), store)
+
+	t.Log("store with other namespace")
+	dedup.AcceptanceTest(t, eh.NewContextWithNamespace(context.Background(), "ns"), store)
+}
+
+func Test_CommandHandler(t *testing.T) {
+	handled := 0
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		handled++
+		return nil
+	})
+	h := eh.UseCommandHandlerMiddleware(inner, dedup.NewMiddleware(dedup.NewMemoryStore()))
+
+	cmd := &IdentifiableCommand{ID: uuid.New().String(), CmdID: uuid.New().String()}
+	for i := 0; i < 3; i++ {
+		if err := h.HandleCommand(context.Background(), cmd); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	if handled != 1 {
+		t.Error("the command should have been handled once:", handled)
+	}
+
+	// Commands with other IDs are handled.
+	cmd = &IdentifiableCommand{ID: cmd.ID, CmdID: uuid.New().String()}
+	if err := h.HandleCommand(context.Background(), cmd); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if handled != 2 {
+		t.Error("the command should have been handled:", handled)
+	}
+}
+
+func Test_CommandHandler_ContextID(t *testing.T) {
+	handled := 0
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		handled++
+		return nil
+	})
+	h := eh.UseCommandHandlerMiddleware(inner, dedup.NewMiddleware(dedup.NewMemoryStore()))
+
+	cmd := mocks.Command{ID: uuid.New().String()}
+	ctx := eh.NewContextWithCommandID(context.Background(), uuid.New().String())
+	for i := 0; i < 2; i++ {
+		if err := h.HandleCommand(ctx, cmd); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	if handled != 1 {
+		t.Error("the command should have been handled once:", handled)
+	}
+
+	// Commands without an ID are always handled.
+	for i := 0; i < 2; i++ {
+		if err := h.HandleCommand(context.Background(), cmd); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	if handled != 3 {
+		t.Error("the command should have been handled every time:", handled)
+	}
+}
+
+func Test_CommandHandler_OriginalError(t *testing.T) {
+	handled := 0
+	handlerErr := errors.New("handler error")
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		handled++
+		return handlerErr
+	})
+	h := eh.UseCommandHandlerMiddleware(inner, dedup.NewMiddleware(dedup.NewMemoryStore()))
+
+	cmd := &IdentifiableCommand{ID: uuid.New().String(), CmdID: uuid.New().String()}
+	if err := h.HandleCommand(context.Background(), cmd); err != handlerErr {
+		t.Error("there should be a handler error:", err)
+	}
+	err := h.HandleCommand(context.Background(), cmd)
+	if dupErr, ok := err.(dedup.DuplicateError); !ok ||
+		dupErr.Message != handlerErr.Error() || dupErr.CommandID != cmd.CmdID {
+		t.Error("there should be a duplicate error:", err)
+	}
+	if handled != 1 {
+		t.Error("the command should have been handled once:", handled)
+	}
+}
+
+func Test_CommandHandler_RetryableError(t *testing.T) {
+	handled := 0
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		handled++
+		if handled == 1 {
+			return eh.EventStoreError{Err: eh.ErrVersionConflict}
+		}
+		return nil
+	})
+	h := eh.UseCommandHandlerMiddleware(inner, dedup.NewMiddleware(dedup.NewMemoryStore()))
+
+	// The retryable error is not recorded.
+	cmd := &IdentifiableCommand{ID: uuid.New().String(), CmdID: uuid.New().String()}
+	err := h.HandleCommand(context.Background(), cmd)
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != eh.ErrVersionConflict {
+		t.Error("there should be a version conflict error:", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := h.HandleCommand(context.Background(), cmd); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	if handled != 2 {
+		t.Error("the command should have been handled twice:", handled)
+	}
+}
+
+func Test_CommandHandler_CommandType(t *testing.T) {
+	handled := 0
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		handled++
+		return nil
+	})
+	h := eh.UseCommandHandlerMiddleware(inner, dedup.NewMiddleware(dedup.NewMemoryStore()))
+
+	// The same ID is used for commands of different types.
+	ctx := eh.NewContextWithCommandID(context.Background(), uuid.New().String())
+	if err := h.HandleCommand(ctx, mocks.Command{ID: uuid.New().String()}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := h.HandleCommand(ctx, &IdentifiableCommand{ID: uuid.New().String()}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if handled != 2 {
+		t.Error("the commands should have been handled:", handled)
+	}
+}
+
+func Test_CommandHandler_InProgress(t *testing.T) {
+	var h eh.CommandHandler
+	var innerErr error
+	cmd := &IdentifiableCommand{ID: uuid.New().String(), CmdID: uuid.New().String()}
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		// Handle the same command while it is being handled.
+		innerErr = h.HandleCommand(ctx, cmd)
+		return nil
+	})
+	h = eh.UseCommandHandlerMiddleware(inner, dedup.NewMiddleware(dedup.NewMemoryStore()))
+
+	if err := h.HandleCommand(context.Background(), cmd); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if innerErr != dedup.ErrCommandInProgress {
+		t.Error("there should be a command in progress error:", innerErr)
+	}
+}
+
+const IdentifiableCommandType eh.CommandType = "IdentifiableCommand"
+
+type IdentifiableCommand struct {
+	ID    eh.ID
+	CmdID eh.ID
+}
+
+var _ = eh.IdentifiableCommand(&IdentifiableCommand{})
+
+func (c *IdentifiableCommand) AggregateID() eh.ID              { return c.ID }
+func (c *IdentifiableCommand) AggregateType() eh.AggregateType { return mocks.AggregateType }
+func (c *IdentifiableCommand) CommandType() eh.CommandType     { return IdentifiableCommandType }
+func (c *IdentifiableCommand) CommandID() eh.ID                { return c.CmdID }
@@ -0,0 +1,265 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/commandhandler/dedup"
+)
+
+// ErrCouldNotDialDB is when the database could not be dialed.
+var ErrCouldNotDialDB = errors.New("could not dial database")
+
+// ErrNoDBSession is when no database session is set.
+var ErrNoDBSession = errors.New("no database session")
+
+// ErrCouldNotClearDB is when the database could not be cleared.
+var ErrCouldNotClearDB = errors.New("could not clear database")
+
+// ErrCouldNotBeginCommand is when a command ID could not be claimed.
+var ErrCouldNotBeginCommand = errors.New("could not begin command")
+
+// ErrCouldNotCompleteCommand is when a command could not be marked as handled.
+var ErrCouldNotCompleteCommand = errors.New("could not complete command")
+
+// ErrCouldNotReleaseCommand is when the claim of a command could not be removed.
+var ErrCouldNotReleaseCommand = errors.New("could not release command")
+
+// The number of times to try to claim a command ID, when its record is
+// removed concurrently.
+const beginAttempts = 3
+
+// Store implements a dedup.Store for MongoDB. The records are kept in a
+// "commands" collection per namespace and removed by a TTL index when they
+// expire.
+type Store struct {
+	session  *mgo.Session
+	dbPrefix string
+	// The names of the DBs where the TTL index has been ensured.
+	indexed sync.Map
+}
+
+var _ = dedup.Store(&Store{})
+
+// NewStore creates a new Store.
+func NewStore(url, dbPrefix string) (*Store, error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, ErrCouldNotDialDB
+	}
+
+	session.SetMode(mgo.Strong, true)
+	session.SetSafe(&mgo.Safe{W: 1})
+
+	return NewStoreWithSession(session, dbPrefix)
+}
+
+// NewStoreWithSession creates a new Store with a session.
+func NewStoreWithSession(session *mgo.Session, dbPrefix string) (*Store, error) {
+	if session == nil {
+		return nil, ErrNoDBSession
+	}
+
+	s := &Store{
+		session:  session,
+		dbPrefix: dbPrefix,
+	}
+
+	return s, nil
+}
+
+// Begin implements the Begin method of the dedup.Store interface.
+func (s *Store) Begin(ctx context.Context, commandType eh.CommandType, id eh.ID, lease time.Duration) (*dedup.Record, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	if err := s.ensureIndex(ctx, sess); err != nil {
+		return nil, dedup.Error{
+			BaseErr:   err,
+			Err:       ErrCouldNotBeginCommand,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	c := sess.DB(s.dbName(ctx)).C("commands")
+	key := recordID(commandType, id)
+	for i := 0; i < beginAttempts; i++ {
+		now := time.Now()
+		r := dbRecord{
+			Key:         key,
+			CommandType: commandType,
+			ID:          id,
+			Created:     now,
+			ExpiresAt:   now.Add(lease),
+		}
+		err := c.Insert(r)
+		if err == nil {
+			return nil, nil
+		} else if !mgo.IsDup(err) {
+			return nil, dedup.Error{
+				BaseErr:   err,
+				Err:       ErrCouldNotBeginCommand,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		// Reclaim an expired record that has not been removed yet.
+		err = c.Update(
+			bson.M{"_id": key, "expires_at": bson.M{"$lte": now}},
+			r,
+		)
+		if err == nil {
+			return nil, nil
+		} else if err != mgo.ErrNotFound {
+			return nil, dedup.Error{
+				BaseErr:   err,
+				Err:       ErrCouldNotBeginCommand,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		var existing dbRecord
+		err = c.FindId(key).One(&existing)
+		if err == nil {
+			return &dedup.Record{
+				CommandType: existing.CommandType,
+				ID:          existing.ID,
+				Done:        existing.Done,
+				Err:         existing.Err,
+				Created:     existing.Created,
+				ExpiresAt:   existing.ExpiresAt,
+			}, nil
+		} else if err != mgo.ErrNotFound {
+			return nil, dedup.Error{
+				BaseErr:   err,
+				Err:       ErrCouldNotBeginCommand,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	return nil, dedup.Error{
+		Err:       ErrCouldNotBeginCommand,
+		Namespace: eh.NamespaceFromContext(ctx),
+	}
+}
+
+// Complete implements the Complete method of the dedup.Store interface.
+func (s *Store) Complete(ctx context.Context, commandType eh.CommandType, id eh.ID, errMsg string, ttl time.Duration) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	if err := sess.DB(s.dbName(ctx)).C("commands").UpdateId(recordID(commandType, id),
+		bson.M{"$set": bson.M{
+			"done":       true,
+			"err":        errMsg,
+			"expires_at": time.Now().Add(ttl),
+		}},
+	); err == mgo.ErrNotFound {
+		return dedup.Error{
+			Err:       dedup.ErrRecordNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if err != nil {
+		return dedup.Error{
+			BaseErr:   err,
+			Err:       ErrCouldNotCompleteCommand,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Release implements the Release method of the dedup.Store interface.
+func (s *Store) Release(ctx context.Context, commandType eh.CommandType, id eh.ID) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	if err := sess.DB(s.dbName(ctx)).C("commands").RemoveId(
+		recordID(commandType, id)); err != nil && err != mgo.ErrNotFound {
+		return dedup.Error{
+			BaseErr:   err,
+			Err:       ErrCouldNotReleaseCommand,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Clear clears the command records.
+func (s *Store) Clear(ctx context.Context) error {
+	s.indexed.Delete(s.dbName(ctx))
+	if err := s.session.DB(s.dbName(ctx)).C("commands").DropCollection(); err != nil &&
+		err.Error() != "ns not found" {
+		return dedup.Error{
+			BaseErr:   err,
+			Err:       ErrCouldNotClearDB,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Close closes the database session.
+func (s *Store) Close() {
+	s.session.Close()
+}
+
+// dbName appends the namespace, if one is set, to the DB prefix to
+// get the name of the DB to use.
+func (s *Store) dbName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return s.dbPrefix + "_" + ns
+}
+
+// ensureIndex ensures the TTL index once per DB.
+func (s *Store) ensureIndex(ctx context.Context, sess *mgo.Session) error {
+	name := s.dbName(ctx)
+	if _, ok := s.indexed.Load(name); ok {
+		return nil
+	}
+	if err := sess.DB(name).C("commands").EnsureIndex(mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second,
+	}); err != nil {
+		return err
+	}
+	s.indexed.Store(name, struct{}{})
+	return nil
+}
+
+// recordID is the ID of the record of a command, scoped by command type.
+func recordID(commandType eh.CommandType, id eh.ID) string {
+	return string(commandType) + ":" + id
+}
+
+// dbRecord is the DB representation of a command record.
+type dbRecord struct {
+	Key         string         `bson:"_id"`
+	CommandType eh.CommandType `bson:"command_type"`
+	ID          eh.ID          `bson:"id"`
+	Done        bool           `bson:"done"`
+	Err         string         `bson:"err"`
+	Created     time.Time      `bson:"created"`
+	ExpiresAt   time.Time      `bson:"expires_at"`
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dedup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// Record is a record of a handled command.
+type Record struct {
+	// CommandType is the type of the command.
+	CommandType eh.CommandType
+	// ID is the ID of the command.
+	ID eh.ID
+	// Done is true when the command has been handled, and false while it is
+	// being handled.
+	Done bool
+	// Err is the error message of the command if it failed, or empty.
+	Err string
+	// Created is when the command was first handled.
+	Created time.Time
+	// ExpiresAt is when the record expires and the ID can be used again. For
+	// a command in progress it is when the claim expires.
+	ExpiresAt time.Time
+}
+
+// Store is a store of handled command IDs, with one set of IDs per namespace.
+// The IDs are scoped by command type, the same ID can be used by commands of
+// different types.
+type Store interface {
+	// Begin claims a command ID for the lease before handling the command. It
+	// returns the record of the command if the ID is already claimed and not
+	// expired, or nil if it was claimed by this call and the command should be
+	// handled.
+	Begin(ctx context.Context, commandType eh.CommandType, id eh.ID, lease time.Duration) (*Record, error)
+
+	// Complete marks a claimed command as handled, with the error message if
+	// it failed, keeping the record for the TTL.
+	Complete(ctx context.Context, commandType eh.CommandType, id eh.ID, errMsg string, ttl time.Duration) error
+
+	// Release removes the claim of a command, to let it be handled again.
+	Release(ctx context.Context, commandType eh.CommandType, id eh.ID) error
+}
+
+// MemoryStore is a Store in memory, mainly useful for testing. Expired records
+// are removed periodically when claiming new IDs.
+type MemoryStore struct {
+	// The outer map is with namespace as key, the inner with command type and ID.
+	records   map[string]map[recordKey]Record
+	lastPurge time.Time
+	mu        sync.Mutex
+}
+
+var _ = Store(&MemoryStore{})
+
+type recordKey struct {
+	commandType eh.CommandType
+	id          eh.ID
+}
+
+// The interval at which the memory store removes expired records.
+const purgeInterval = time.Minute
+
+// NewMemoryStore creates a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records:   map[string]map[recordKey]Record{},
+		lastPurge: time.Now(),
+	}
+}
+
+// Begin implements the Begin method of the Store interface.
+func (s *MemoryStore) Begin(ctx context.Context, commandType eh.CommandType, id eh.ID, lease time.Duration) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPurge) > purgeInterval {
+		s.purge(now)
+	}
+
+	ns := eh.NamespaceFromContext(ctx)
+	key := recordKey{commandType, id}
+	if r, ok := s.records[ns][key]; ok && now.Before(r.ExpiresAt) {
+		return &r, nil
+	}
+
+	if _, ok := s.records[ns]; !ok {
+		s.records[ns] = map[recordKey]Record{}
+	}
+	s.records[ns][key] = Record{
+		CommandType: commandType,
+		ID:          id,
+		Created:     now,
+		ExpiresAt:   now.Add(lease),
+	}
+	return nil, nil
+}
+
+// Complete implements the Complete method of the Store interface.
+func (s *MemoryStore) Complete(ctx context.Context, commandType eh.CommandType, id eh.ID, errMsg string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	key := recordKey{commandType, id}
+	r, ok := s.records[ns][key]
+	if !ok {
+		return Error{
+			Err:       ErrRecordNotFound,
+			Namespace: ns,
+		}
+	}
+	r.Done = true
+	r.Err = errMsg
+	r.ExpiresAt = time.Now().Add(ttl)
+	s.records[ns][key] = r
+	return nil
+}
+
+// Release implements the Release method of the Store interface.
+func (s *MemoryStore) Release(ctx context.Context, commandType eh.CommandType, id eh.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records[eh.NamespaceFromContext(ctx)], recordKey{commandType, id})
+	return nil
+}
+
+// purge removes all expired records. The lock must be held.
+func (s *MemoryStore) purge(now time.Time) {
+	for _, records := range s.records {
+		for key, r := range records {
+			if !now.Before(r.ExpiresAt) {
+				delete(records, key)
+			}
+		}
+	}
+	s.lastPurge = now
+}
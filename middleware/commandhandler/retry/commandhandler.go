@@ -0,0 +1,90 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"time"
+
+	"github.com/jpillora/backoff"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// DefaultMaxAttempts is the default number of times to handle a command.
+const DefaultMaxAttempts = 5
+
+// Option is an option for the retry middleware.
+type Option func(*options)
+
+type options struct {
+	maxAttempts int
+	backoff     backoff.Backoff
+}
+
+// WithMaxAttempts sets the number of times to handle a command, including the
+// first attempt. The default is DefaultMaxAttempts.
+func WithMaxAttempts(attempts int) Option {
+	return func(o *options) {
+		o.maxAttempts = attempts
+	}
+}
+
+// WithBackoff sets the delays between the attempts, growing exponentially
+// from min to max with a random jitter. The default is 10ms to 1s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.backoff.Min = min
+		o.backoff.Max = max
+	}
+}
+
+// NewMiddleware returns a new middleware that retries commands failing with an
+// eventhorizon.ErrVersionConflict, which happens when an aggregate is changed
+// by a concurrent command. The handler must load the aggregate again for each
+// attempt, as the aggregate command handler does. The last error is returned
+// if all attempts fail, or the context error if it is done while waiting.
+func NewMiddleware(opts ...Option) eh.CommandHandlerMiddleware {
+	o := options{
+		maxAttempts: DefaultMaxAttempts,
+		backoff: backoff.Backoff{
+			Min:    10 * time.Millisecond,
+			Max:    time.Second,
+			Jitter: true,
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return eh.CommandHandlerMiddleware(func(h eh.CommandHandler) eh.CommandHandler {
+		return eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+			// Use a backoff per command, as it is not safe for concurrent use.
+			delay := o.backoff
+			for attempt := 1; ; attempt++ {
+				err := h.HandleCommand(ctx, cmd)
+				if !eh.IsVersionConflict(err) || attempt >= o.maxAttempts {
+					return err
+				}
+
+				select {
+				case <-time.After(delay.Duration()):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		})
+	})
+}
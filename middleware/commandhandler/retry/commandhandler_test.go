@@ -0,0 +1,100 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/commandhandler/retry"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+var conflictErr = eh.EventStoreError{Err: eh.ErrVersionConflict}
+
+func Test_CommandHandler_Retry(t *testing.T) {
+	attempts := 0
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		attempts++
+		if attempts < 3 {
+			return conflictErr
+		}
+		return nil
+	})
+	m := retry.NewMiddleware(retry.WithBackoff(time.Millisecond, time.Millisecond))
+	h := eh.UseCommandHandlerMiddleware(inner, m)
+	cmd := mocks.Command{ID: uuid.New().String()}
+	if err := h.HandleCommand(context.Background(), cmd); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if attempts != 3 {
+		t.Error("the command should have been retried:", attempts)
+	}
+}
+
+func Test_CommandHandler_MaxAttempts(t *testing.T) {
+	attempts := 0
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		attempts++
+		return conflictErr
+	})
+	m := retry.NewMiddleware(
+		retry.WithMaxAttempts(4),
+		retry.WithBackoff(time.Millisecond, time.Millisecond),
+	)
+	h := eh.UseCommandHandlerMiddleware(inner, m)
+	cmd := mocks.Command{ID: uuid.New().String()}
+	if err := h.HandleCommand(context.Background(), cmd); err != conflictErr {
+		t.Error("there should be a version conflict error:", err)
+	}
+	if attempts != 4 {
+		t.Error("the command should have been handled 4 times:", attempts)
+	}
+}
+
+func Test_CommandHandler_OtherError(t *testing.T) {
+	attempts := 0
+	handlerErr := errors.New("handler error")
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		attempts++
+		return handlerErr
+	})
+	h := eh.UseCommandHandlerMiddleware(inner, retry.NewMiddleware())
+	cmd := mocks.Command{ID: uuid.New().String()}
+	if err := h.HandleCommand(context.Background(), cmd); err != handlerErr {
+		t.Error("there should be a handler error:", err)
+	}
+	if attempts != 1 {
+		t.Error("the command should not have been retried:", attempts)
+	}
+}
+
+func Test_CommandHandler_ContextDone(t *testing.T) {
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		return conflictErr
+	})
+	m := retry.NewMiddleware(retry.WithBackoff(time.Second, time.Second))
+	h := eh.UseCommandHandlerMiddleware(inner, m)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	cmd := mocks.Command{ID: uuid.New().String()}
+	if err := h.HandleCommand(ctx, cmd); err != context.DeadlineExceeded {
+		t.Error("there should be a deadline exceeded error:", err)
+	}
+}
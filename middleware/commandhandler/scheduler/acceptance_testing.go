@@ -0,0 +1,177 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+// AcceptanceTest is the acceptance test that all implementations of Store
+// should pass. It should manually be called from a test case in each
+// implementation, with *mocks.Command registered as a command:
+//
+//   func TestStore(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewStore()
+//       scheduler.AcceptanceTest(t, ctx, store)
+//   }
+//
+func AcceptanceTest(t *testing.T, ctx context.Context, store Store) {
+	// Times are rounded as DBs may not store them with full precision.
+	now := time.Now().Round(time.Millisecond)
+
+	t.Log("find all with no commands")
+	cmds, err := store.FindAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(cmds) != 0 {
+		t.Error("there should be no commands:", cmds)
+	}
+
+	t.Log("save commands")
+	cmd1 := ScheduledCommand{
+		ID:        uuid.New().String(),
+		Command:   &mocks.Command{ID: uuid.New().String(), Content: "cmd1"},
+		Context:   map[string]interface{}{"key": "value"},
+		ExecuteAt: now.Add(time.Hour),
+		Created:   now,
+	}
+	cmd2 := ScheduledCommand{
+		ID:        uuid.New().String(),
+		Command:   &mocks.Command{ID: uuid.New().String(), Content: "cmd2"},
+		ExecuteAt: now.Add(-time.Minute),
+		Created:   now,
+		Attempts:  2,
+	}
+	for _, cmd := range []ScheduledCommand{cmd1, cmd2} {
+		if err := store.Save(ctx, cmd); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	t.Log("find a command")
+	cmd, err := store.Find(ctx, cmd1.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertCommands(t, []ScheduledCommand{cmd}, []ScheduledCommand{cmd1})
+
+	t.Log("find an unknown command")
+	_, err = store.Find(ctx, uuid.New().String())
+	if sErr, ok := err.(StoreError); !ok || sErr.Err != ErrCommandNotFound {
+		t.Error("there should be a command not found error:", err)
+	}
+
+	t.Log("find all commands")
+	cmds, err = store.FindAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertCommands(t, cmds, []ScheduledCommand{cmd2, cmd1})
+
+	t.Log("find due commands")
+	cmds, err = store.FindDue(ctx, now)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertCommands(t, cmds, []ScheduledCommand{cmd2})
+
+	t.Log("find commands in an other namespace")
+	cmds, err = store.FindAll(eh.NewContextWithNamespace(ctx, "other"))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(cmds) != 0 {
+		t.Error("there should be no commands:", cmds)
+	}
+
+	t.Log("reschedule a command")
+	cmd1.ExecuteAt = now.Add(-time.Hour)
+	if err := store.Save(ctx, cmd1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	cmds, err = store.FindDue(ctx, now)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertCommands(t, cmds, []ScheduledCommand{cmd1, cmd2})
+
+	t.Log("complete a rescheduled command")
+	if err := store.Complete(ctx, cmd1.ID, now.Add(time.Hour)); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := store.Find(ctx, cmd1.ID); err != nil {
+		t.Error("the command should not be removed:", err)
+	}
+
+	t.Log("complete a command")
+	if err := store.Complete(ctx, cmd1.ID, cmd1.ExecuteAt); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	_, err = store.Find(ctx, cmd1.ID)
+	if sErr, ok := err.(StoreError); !ok || sErr.Err != ErrCommandNotFound {
+		t.Error("there should be a command not found error:", err)
+	}
+
+	t.Log("remove a command")
+	if err := store.Remove(ctx, cmd2.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	cmds, err = store.FindAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(cmds) != 0 {
+		t.Error("there should be no commands:", cmds)
+	}
+
+	t.Log("remove an unknown command")
+	err = store.Remove(ctx, cmd2.ID)
+	if sErr, ok := err.(StoreError); !ok || sErr.Err != ErrCommandNotFound {
+		t.Error("there should be a command not found error:", err)
+	}
+}
+
+func assertCommands(t *testing.T, cmds, expected []ScheduledCommand) {
+	if len(cmds) != len(expected) {
+		t.Error("the commands should be correct:", cmds)
+		return
+	}
+	for i, cmd := range cmds {
+		e := expected[i]
+		if cmd.ID != e.ID ||
+			!reflect.DeepEqual(cmd.Command, e.Command) ||
+			!cmd.ExecuteAt.Equal(e.ExecuteAt) ||
+			!cmd.Created.Equal(e.Created) ||
+			cmd.Attempts != e.Attempts ||
+			len(cmd.Context) != len(e.Context) {
+			t.Error("the command should be correct:", cmd)
+		}
+		for k, v := range e.Context {
+			if cmd.Context[k] != v {
+				t.Error("the context should be correct:", cmd.Context)
+			}
+		}
+	}
+}
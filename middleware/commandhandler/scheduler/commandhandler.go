@@ -23,7 +23,8 @@ import (
 )
 
 // NewMiddleware returns a new async handling middleware that returns any errors
-// on a error channel.
+// on a error channel. The delayed commands are only kept in memory, use a
+// Scheduler to keep them on restarts.
 func NewMiddleware() (eh.CommandHandlerMiddleware, chan Error) {
 	errCh := make(chan Error, 20)
 	return eh.CommandHandlerMiddleware(func(h eh.CommandHandler) eh.CommandHandler {
@@ -89,5 +90,8 @@ type Error struct {
 
 // Error implements the Error method of the error interface.
 func (e Error) Error() string {
+	if e.Command == nil {
+		return e.Err.Error()
+	}
 	return fmt.Sprintf("%s (%s): %s", e.Command.CommandType(), e.Command.AggregateID(), e.Err.Error())
 }
@@ -0,0 +1,363 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrJobNotFound is when a job could not be found.
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrInvalidJob is when a job is missing a name or a command factory.
+var ErrInvalidJob = errors.New("invalid job")
+
+// ErrJobNotAdded is when a fire of a job was missed because the job is not
+// added in this process, and possibly not in any other process.
+var ErrJobNotAdded = errors.New("job not added")
+
+// DefaultMissedFireThreshold is the default delay after which a fire is
+// considered missed, and handled according to the MissedFirePolicy.
+const DefaultMissedFireThreshold = time.Minute
+
+// MissedFirePolicy is how fires of a job that were missed, typically while the
+// process was down, are handled.
+type MissedFirePolicy int
+
+const (
+	// MissedFireRunOnce runs the job once for all missed fires, with the time
+	// of the last missed fire.
+	MissedFireRunOnce MissedFirePolicy = iota
+	// MissedFireRunAll runs the job for each missed fire, in order.
+	MissedFireRunAll
+	// MissedFireSkip skips the missed fires.
+	MissedFireSkip
+)
+
+// Job is a recurring job that handles commands at the times of a cron
+// expression, using the syntax from https://github.com/gorhill/cronexpr.
+type Job struct {
+	// Name is the unique name of the job.
+	Name string
+	// Schedule is the cron expression of the job.
+	Schedule string
+	// Location is the time zone of the schedule, the default is UTC.
+	Location *time.Location
+	// Commands creates the commands to handle for a fire time, in the time
+	// zone of the job.
+	Commands func(time.Time) []eh.Command
+	// MissedFires is the policy for missed fires, the default is to run the
+	// job once.
+	MissedFires MissedFirePolicy
+	// MissedFireThreshold is the delay after which a fire is considered
+	// missed, the default is DefaultMissedFireThreshold.
+	MissedFireThreshold time.Duration
+}
+
+// JobInfo is a job and the time of its next fire.
+type JobInfo struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Location string    `json:"location"`
+	Next     time.Time `json:"next"`
+}
+
+// JobCommandType is the type of the commands used to keep track of the next
+// fire of each job in the store.
+const JobCommandType = eh.CommandType("SchedulerJob")
+
+func init() {
+	eh.RegisterCommand(func() eh.Command { return &JobCommand{} })
+}
+
+// JobCommand is the command saved in the store for the next fire of a job. It
+// is handled by the Scheduler and never by a command handler.
+type JobCommand struct {
+	Job      string `json:"job"      bson:"job"`
+	Schedule string `json:"schedule" bson:"schedule"`
+	Location string `json:"location" bson:"location"`
+	// Fire is the failed fire that is retried, if any.
+	Fire time.Time `json:"fire"     bson:"fire,omitempty"`
+}
+
+var _ = eh.Command(&JobCommand{})
+
+// AggregateID implements the AggregateID method of the eventhorizon.Command interface.
+func (c *JobCommand) AggregateID() eh.ID { return "" }
+
+// AggregateType implements the AggregateType method of the eventhorizon.Command interface.
+func (c *JobCommand) AggregateType() eh.AggregateType { return "" }
+
+// CommandType implements the CommandType method of the eventhorizon.Command interface.
+func (c *JobCommand) CommandType() eh.CommandType { return JobCommandType }
+
+// jobID returns the ID of the scheduled command of a job.
+func jobID(name string) eh.ID {
+	return eh.ID("job_" + name)
+}
+
+// AddJob adds a recurring job in the namespace of the context. The next fire
+// is kept in the store, so that fires missed while the process was down are
+// handled according to the policy of the job when it is added again. Adding a
+// job with the same name replaces it.
+func (s *Scheduler) AddJob(ctx context.Context, job Job) error {
+	if job.Name == "" || job.Commands == nil {
+		return ErrInvalidJob
+	}
+	expr, err := cronexpr.Parse(job.Schedule)
+	if err != nil {
+		return err
+	}
+	if job.Location == nil {
+		job.Location = time.UTC
+	}
+	if job.MissedFireThreshold == 0 {
+		job.MissedFireThreshold = DefaultMissedFireThreshold
+	}
+
+	ns := eh.NamespaceFromContext(ctx)
+	s.jobsMu.Lock()
+	if _, ok := s.jobs[ns]; !ok {
+		s.jobs[ns] = map[string]Job{}
+	}
+	s.jobs[ns][job.Name] = job
+	delete(s.orphans[ns], job.Name)
+	s.jobsMu.Unlock()
+
+	// Keep the next fire of a job with the same schedule.
+	cmd := &JobCommand{
+		Job:      job.Name,
+		Schedule: job.Schedule,
+		Location: job.Location.String(),
+	}
+	existing, err := s.store.Find(ctx, jobID(job.Name))
+	if sErr, ok := err.(StoreError); ok && sErr.Err == ErrCommandNotFound {
+		// Schedule the first fire below.
+	} else if err != nil {
+		return err
+	} else if c, ok := existing.Command.(*JobCommand); ok &&
+		c.Job == cmd.Job && c.Schedule == cmd.Schedule && c.Location == cmd.Location {
+		return nil
+	}
+
+	next := expr.Next(time.Now().In(job.Location))
+	if next.IsZero() {
+		return nil
+	}
+	return s.store.Save(ctx, ScheduledCommand{
+		ID:        jobID(job.Name),
+		Command:   cmd,
+		Context:   eh.MarshalContext(ctx),
+		ExecuteAt: next,
+		Created:   time.Now(),
+	})
+}
+
+// RemoveJob removes a job in the namespace of the context.
+func (s *Scheduler) RemoveJob(ctx context.Context, name string) error {
+	ns := eh.NamespaceFromContext(ctx)
+	s.jobsMu.Lock()
+	_, ok := s.jobs[ns][name]
+	delete(s.jobs[ns], name)
+	s.jobsMu.Unlock()
+	if !ok {
+		return ErrJobNotFound
+	}
+
+	err := s.store.Remove(ctx, jobID(name))
+	if sErr, ok := err.(StoreError); ok && sErr.Err == ErrCommandNotFound {
+		return nil
+	}
+	return err
+}
+
+// Jobs returns the jobs in the namespace of the context, ordered by name.
+func (s *Scheduler) Jobs(ctx context.Context) ([]JobInfo, error) {
+	ns := eh.NamespaceFromContext(ctx)
+	s.jobsMu.RLock()
+	jobs := make([]Job, 0, len(s.jobs[ns]))
+	for _, job := range s.jobs[ns] {
+		jobs = append(jobs, job)
+	}
+	s.jobsMu.RUnlock()
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Name < jobs[j].Name
+	})
+
+	infos := make([]JobInfo, len(jobs))
+	for i, job := range jobs {
+		infos[i] = JobInfo{
+			Name:     job.Name,
+			Schedule: job.Schedule,
+			Location: job.Location.String(),
+		}
+		cmd, err := s.store.Find(ctx, jobID(job.Name))
+		if sErr, ok := err.(StoreError); ok && sErr.Err == ErrCommandNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos[i].Next = cmd.ExecuteAt.In(job.Location)
+	}
+	return infos, nil
+}
+
+// handleJob handles a due fire of a job and saves its next fire. A failed fire
+// is retried after a backoff, or skipped after the max number of attempts,
+// with the errors sent on the error channel. Jobs that are not added in this
+// process are left for an other process, but are reported once with
+// ErrJobNotAdded when the fire is missed, as they stay due forever if no
+// process adds them.
+func (s *Scheduler) handleJob(ctx context.Context, cmd ScheduledCommand, jc *JobCommand) error {
+	s.jobsMu.RLock()
+	job, ok := s.jobs[eh.NamespaceFromContext(ctx)][jc.Job]
+	s.jobsMu.RUnlock()
+	if !ok {
+		if time.Since(cmd.ExecuteAt) > DefaultMissedFireThreshold && s.reportOrphan(ctx, cmd, jc) {
+			return Error{Err: ErrJobNotAdded, Ctx: ctx, Command: jc}
+		}
+		return nil
+	}
+	expr, err := cronexpr.Parse(job.Schedule)
+	if err != nil {
+		return Error{Err: err, Ctx: ctx, Command: jc}
+	}
+
+	now := time.Now().In(job.Location)
+	fire := cmd.ExecuteAt.In(job.Location)
+	var fires []time.Time
+	if !jc.Fire.IsZero() {
+		// A failed fire is retried regardless of the missed fire policy.
+		fires = []time.Time{jc.Fire.In(job.Location)}
+	} else if now.Sub(fire) <= job.MissedFireThreshold {
+		fires = []time.Time{fire}
+	} else {
+		switch job.MissedFires {
+		case MissedFireRunAll:
+			for t := fire; !t.IsZero() && !t.After(now); t = expr.Next(t) {
+				fires = append(fires, t)
+			}
+		case MissedFireRunOnce:
+			last := fire
+			for t := fire; !t.IsZero() && !t.After(now); t = expr.Next(t) {
+				last = t
+			}
+			fires = []time.Time{last}
+		}
+	}
+
+	// Save the progress after each fire, so that a failed fire is retried after
+	// a backoff. After the max number of attempts the fire is skipped.
+	for _, t := range fires {
+		if err := s.handleFire(ctx, cmd, job, t); err != nil {
+			s.report(err.(Error))
+			if err := s.retryFire(ctx, cmd, jc, t); err == nil {
+				return nil
+			} else if err != ErrMaxAttempts {
+				return Error{Err: err, Ctx: ctx, Command: jc}
+			}
+			s.report(Error{Err: ErrMaxAttempts, Ctx: ctx, Command: jc})
+		}
+
+		next := expr.Next(t)
+		if !next.After(now) && job.MissedFires != MissedFireRunAll {
+			next = expr.Next(now)
+		}
+		if err := s.saveNextFire(ctx, cmd, next); err != nil {
+			return Error{Err: err, Ctx: ctx, Command: jc}
+		}
+		cmd.ExecuteAt = next
+		cmd.Attempts = 0
+	}
+	if len(fires) == 0 {
+		if err := s.saveNextFire(ctx, cmd, expr.Next(now)); err != nil {
+			return Error{Err: err, Ctx: ctx, Command: jc}
+		}
+	}
+
+	return nil
+}
+
+// handleFire handles the commands of a fire of a job. The command IDs are the
+// same for each attempt of the fire, to be used with the dedup middleware.
+func (s *Scheduler) handleFire(ctx context.Context, cmd ScheduledCommand, job Job, t time.Time) error {
+	cmdCtx := eh.NewContextWithNamespace(eh.UnmarshalContext(cmd.Context),
+		eh.NamespaceFromContext(ctx))
+	for i, c := range job.Commands(t) {
+		cmdCtx := eh.NewContextWithCommandID(cmdCtx,
+			eh.ID(fmt.Sprintf("%s_%d_%d", cmd.ID, t.Unix(), i)))
+		if err := s.handler.HandleCommand(cmdCtx, c); err != nil {
+			return Error{Err: err, Ctx: cmdCtx, Command: c}
+		}
+	}
+	return nil
+}
+
+// retryFire reschedules a failed fire of a job after a backoff, keeping the
+// time of the fire in the job command. ErrMaxAttempts is returned if it has
+// reached the max number of attempts.
+func (s *Scheduler) retryFire(ctx context.Context, cmd ScheduledCommand, jc *JobCommand, fire time.Time) error {
+	if s.maxAttempts > 0 && cmd.Attempts+1 >= s.maxAttempts {
+		return ErrMaxAttempts
+	}
+
+	c := *jc
+	c.Fire = fire
+	cmd.Command = &c
+	cmd.ExecuteAt = time.Now().Add(s.retry.ForAttempt(float64(cmd.Attempts)))
+	cmd.Attempts++
+	return s.store.Save(ctx, cmd)
+}
+
+// reportOrphan returns true the first time a missed fire of a job that is not
+// added in this process should be reported.
+func (s *Scheduler) reportOrphan(ctx context.Context, cmd ScheduledCommand, jc *JobCommand) bool {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if reported, ok := s.orphans[ns][jc.Job]; ok && reported.Equal(cmd.ExecuteAt) {
+		return false
+	}
+	if _, ok := s.orphans[ns]; !ok {
+		s.orphans[ns] = map[string]time.Time{}
+	}
+	s.orphans[ns][jc.Job] = cmd.ExecuteAt
+	return true
+}
+
+// saveNextFire saves the next fire of a job, or removes it if there is none.
+// The retries of a failed fire are reset.
+func (s *Scheduler) saveNextFire(ctx context.Context, cmd ScheduledCommand, next time.Time) error {
+	if next.IsZero() {
+		return s.store.Complete(ctx, cmd.ID, cmd.ExecuteAt)
+	}
+	if jc, ok := cmd.Command.(*JobCommand); ok && !jc.Fire.IsZero() {
+		c := *jc
+		c.Fire = time.Time{}
+		cmd.Command = &c
+	}
+	cmd.ExecuteAt = next
+	cmd.Attempts = 0
+	return s.store.Save(ctx, cmd)
+}
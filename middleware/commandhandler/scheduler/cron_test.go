@@ -0,0 +1,357 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/commandhandler/scheduler"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func Test_Scheduler_Jobs(t *testing.T) {
+	ctx := context.Background()
+	inner := &mocks.CommandHandler{}
+	s := scheduler.NewScheduler(scheduler.NewMemoryStore(), inner)
+
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	var fires []time.Time
+	job := scheduler.Job{
+		Name:     "nightly",
+		Schedule: "0 2 * * *",
+		Location: zone,
+		Commands: func(t time.Time) []eh.Command {
+			fires = append(fires, t)
+			return []eh.Command{
+				mocks.Command{ID: "list1"},
+				mocks.Command{ID: "list2"},
+			}
+		},
+	}
+	if err := s.AddJob(ctx, job); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := s.AddJob(ctx, scheduler.Job{Name: "invalid", Schedule: "0 2 * * *"}); err != scheduler.ErrInvalidJob {
+		t.Error("there should be an invalid job error:", err)
+	}
+	if err := s.AddJob(ctx, scheduler.Job{Name: "invalid", Schedule: "invalid", Commands: job.Commands}); err == nil {
+		t.Error("there should be an error for an invalid schedule")
+	}
+
+	// The next fire is at 02:00 in the time zone of the job.
+	jobs, err := s.Jobs(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(jobs) != 1 || jobs[0].Name != "nightly" || jobs[0].Location != "UTC+5" {
+		t.Fatal("the jobs should be correct:", jobs)
+	}
+	if next := jobs[0].Next; next.Hour() != 2 || next.Minute() != 0 || next.Location() != zone {
+		t.Error("the next fire should be correct:", next)
+	}
+	if next := jobs[0].Next; !next.After(time.Now()) || next.Sub(time.Now()) > 24*time.Hour {
+		t.Error("the next fire should be within a day:", next)
+	}
+
+	// Nothing is due yet.
+	if err := s.HandleDue(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(fires) != 0 {
+		t.Error("the job should not fire:", fires)
+	}
+
+	// Jobs in other namespaces are separate.
+	if jobs, _ := s.Jobs(eh.NewContextWithNamespace(ctx, "other")); len(jobs) != 0 {
+		t.Error("there should be no jobs in the other namespace:", jobs)
+	}
+
+	if err := s.RemoveJob(ctx, "nightly"); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if cmds, _ := s.Commands(ctx); len(cmds) != 0 {
+		t.Error("the job should be removed from the store:", cmds)
+	}
+	if err := s.RemoveJob(ctx, "nightly"); err != scheduler.ErrJobNotFound {
+		t.Error("there should be a job not found error:", err)
+	}
+}
+
+func Test_Scheduler_JobFires(t *testing.T) {
+	ctx := context.Background()
+	inner := &mocks.CommandHandler{}
+	s := scheduler.NewScheduler(scheduler.NewMemoryStore(), inner)
+	s.SetPollInterval(10 * time.Millisecond)
+
+	fired := make(chan time.Time, 10)
+	if err := s.AddJob(ctx, scheduler.Job{
+		Name:     "every second",
+		Schedule: "* * * * * * *",
+		Commands: func(t time.Time) []eh.Command {
+			fired <- t
+			return nil
+		},
+	}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	s.Start(ctx)
+	defer s.Close()
+	var last time.Time
+	for i := 0; i < 2; i++ {
+		select {
+		case fire := <-fired:
+			if !fire.After(last) {
+				t.Error("the fires should be in order:", fire)
+			}
+			last = fire
+		case <-time.After(2 * time.Second):
+			t.Fatal("the job should fire")
+		}
+	}
+}
+
+func Test_Scheduler_MissedFires(t *testing.T) {
+	expr := cronexpr.MustParse("0 * * * *")
+	now := time.Now().UTC()
+	firstMissed := expr.Next(now.Add(-4 * time.Hour))
+	var missed []time.Time
+	for t := firstMissed; t.Before(now); t = expr.Next(t) {
+		missed = append(missed, t)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		policy   scheduler.MissedFirePolicy
+		expected []time.Time
+	}{
+		{"run once", scheduler.MissedFireRunOnce, missed[len(missed)-1:]},
+		{"run all", scheduler.MissedFireRunAll, missed},
+		{"skip", scheduler.MissedFireSkip, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := scheduler.NewMemoryStore()
+			s := scheduler.NewScheduler(store, &mocks.CommandHandler{})
+
+			// The state left by a previous process, that was down for hours.
+			if err := store.Save(ctx, scheduler.ScheduledCommand{
+				ID: "job_hourly",
+				Command: &scheduler.JobCommand{
+					Job:      "hourly",
+					Schedule: "0 * * * *",
+					Location: "UTC",
+				},
+				ExecuteAt: firstMissed,
+			}); err != nil {
+				t.Fatal("there should be no error:", err)
+			}
+
+			var fires []time.Time
+			if err := s.AddJob(ctx, scheduler.Job{
+				Name:        "hourly",
+				Schedule:    "0 * * * *",
+				MissedFires: tc.policy,
+				Commands: func(t time.Time) []eh.Command {
+					fires = append(fires, t)
+					return []eh.Command{mocks.Command{ID: "id"}}
+				},
+			}); err != nil {
+				t.Error("there should be no error:", err)
+			}
+			if err := s.HandleDue(ctx); err != nil {
+				t.Error("there should be no error:", err)
+			}
+
+			if len(fires) != len(tc.expected) {
+				t.Fatal("the fires should be correct:", fires)
+			}
+			for i, fire := range fires {
+				if !fire.Equal(tc.expected[i]) {
+					t.Error("the fire should be correct:", fire)
+				}
+			}
+			jobs, _ := s.Jobs(ctx)
+			if len(jobs) != 1 || !jobs[0].Next.Equal(expr.Next(now)) {
+				t.Error("the next fire should be after now:", jobs)
+			}
+		})
+	}
+}
+
+func Test_Scheduler_JobRetry(t *testing.T) {
+	expr := cronexpr.MustParse("0 * * * *")
+	now := time.Now().UTC()
+	fire := expr.Next(now.Add(-time.Hour))
+	handleErr := errors.New("command error")
+
+	for _, tc := range []struct {
+		name        string
+		maxAttempts int
+		failures    int
+		attempts    int
+	}{
+		{"retried", scheduler.DefaultMaxAttempts, 2, 3},
+		{"max attempts", 2, 2, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := scheduler.NewMemoryStore()
+			failures := tc.failures
+			inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+				if failures > 0 {
+					failures--
+					return handleErr
+				}
+				return nil
+			})
+			s := scheduler.NewScheduler(store, inner)
+			s.SetRetryBackoff(time.Millisecond, time.Millisecond)
+			s.SetMaxAttempts(tc.maxAttempts)
+
+			if err := store.Save(ctx, scheduler.ScheduledCommand{
+				ID: "job_hourly",
+				Command: &scheduler.JobCommand{
+					Job:      "hourly",
+					Schedule: "0 * * * *",
+					Location: "UTC",
+				},
+				ExecuteAt: fire,
+			}); err != nil {
+				t.Fatal("there should be no error:", err)
+			}
+
+			var fires []time.Time
+			if err := s.AddJob(ctx, scheduler.Job{
+				Name:     "hourly",
+				Schedule: "0 * * * *",
+				Commands: func(t time.Time) []eh.Command {
+					fires = append(fires, t)
+					return []eh.Command{mocks.Command{ID: "id"}}
+				},
+			}); err != nil {
+				t.Error("there should be no error:", err)
+			}
+
+			// The failed fire is retried after a backoff, and not every poll.
+			if err := s.HandleDue(ctx); err != nil {
+				t.Error("there should be no error:", err)
+			}
+			if err := s.HandleDue(ctx); err != nil {
+				t.Error("there should be no error:", err)
+			}
+			if len(fires) != 1 {
+				t.Error("the fire should not be retried before the backoff:", fires)
+			}
+			for i := 0; i < tc.attempts; i++ {
+				time.Sleep(10 * time.Millisecond)
+				if err := s.HandleDue(ctx); err != nil {
+					t.Error("there should be no error:", err)
+				}
+			}
+
+			if len(fires) != tc.attempts {
+				t.Fatal("the fire should be attempted:", fires)
+			}
+			for _, f := range fires {
+				if !f.Equal(fire) {
+					t.Error("the same fire should be retried:", f)
+				}
+			}
+			var errs []error
+			for len(s.Errors()) > 0 {
+				errs = append(errs, (<-s.Errors()).Err)
+			}
+			if tc.failures < tc.maxAttempts {
+				if len(errs) != tc.failures {
+					t.Error("the errors should be correct:", errs)
+				}
+			} else if len(errs) != tc.maxAttempts+1 || errs[len(errs)-1] != scheduler.ErrMaxAttempts {
+				t.Error("the fire should be given up:", errs)
+			}
+			c, err := s.Command(ctx, "job_hourly")
+			if err != nil {
+				t.Fatal("there should be no error:", err)
+			}
+			if jc := c.Command.(*scheduler.JobCommand); c.Attempts != 0 || !jc.Fire.IsZero() ||
+				!c.ExecuteAt.Equal(expr.Next(now)) {
+				t.Error("the next fire should be scheduled:", c)
+			}
+		})
+	}
+}
+
+func Test_Scheduler_JobNotAdded(t *testing.T) {
+	ctx := context.Background()
+	store := scheduler.NewMemoryStore()
+	s := scheduler.NewScheduler(store, &mocks.CommandHandler{})
+
+	// A job left by a process that is gone, which no process adds.
+	cmd := scheduler.ScheduledCommand{
+		ID: "job_hourly",
+		Command: &scheduler.JobCommand{
+			Job:      "hourly",
+			Schedule: "0 * * * *",
+			Location: "UTC",
+		},
+		ExecuteAt: time.Now(),
+	}
+	if err := store.Save(ctx, cmd); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+
+	// The job is left for an other process until the fire is missed.
+	if err := s.HandleDue(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	select {
+	case err := <-s.Errors():
+		t.Error("there should be no error:", err)
+	default:
+	}
+
+	// A missed fire is reported once.
+	cmd.ExecuteAt = time.Now().Add(-2 * scheduler.DefaultMissedFireThreshold)
+	if err := store.Save(ctx, cmd); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.HandleDue(ctx); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	select {
+	case err := <-s.Errors():
+		if err.Err != scheduler.ErrJobNotAdded || err.Command != cmd.Command {
+			t.Error("there should be a job not added error:", err)
+		}
+	default:
+		t.Error("there should be an error")
+	}
+	select {
+	case err := <-s.Errors():
+		t.Error("the error should only be reported once:", err)
+	default:
+	}
+	if cmds, _ := s.Commands(ctx); len(cmds) != 1 {
+		t.Error("the job should be kept for an other process:", cmds)
+	}
+}
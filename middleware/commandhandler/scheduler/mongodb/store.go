@@ -0,0 +1,313 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/commandhandler/scheduler"
+)
+
+// ErrCouldNotDialDB is when the database could not be dialed.
+var ErrCouldNotDialDB = errors.New("could not dial database")
+
+// ErrNoDBSession is when no database session is set.
+var ErrNoDBSession = errors.New("no database session")
+
+// ErrCouldNotClearDB is when the database could not be cleared.
+var ErrCouldNotClearDB = errors.New("could not clear database")
+
+// ErrCouldNotMarshalCommand is when a command could not be marshaled into BSON.
+var ErrCouldNotMarshalCommand = errors.New("could not marshal command")
+
+// ErrCouldNotUnmarshalCommand is when a command could not be unmarshaled into
+// a concrete type.
+var ErrCouldNotUnmarshalCommand = errors.New("could not unmarshal command")
+
+// ErrCouldNotSaveCommand is when a command could not be saved.
+var ErrCouldNotSaveCommand = errors.New("could not save command")
+
+// ErrCouldNotLoadCommands is when the commands could not be loaded.
+var ErrCouldNotLoadCommands = errors.New("could not load commands")
+
+// ErrCouldNotRemoveCommand is when a command could not be removed.
+var ErrCouldNotRemoveCommand = errors.New("could not remove command")
+
+// Store implements a scheduler.Store for MongoDB. The commands are kept in a
+// "scheduled_commands" collection per namespace, and must be registered with
+// eventhorizon.RegisterCommand. Commands that can not be unmarshaled, for
+// example when their type is not registered, are kept in the store but skipped
+// by FindAll and FindDue, and Find returns ErrCouldNotUnmarshalCommand.
+type Store struct {
+	session  *mgo.Session
+	dbPrefix string
+	// The names of the DBs where the index has been ensured.
+	indexed sync.Map
+}
+
+var _ = scheduler.Store(&Store{})
+
+// NewStore creates a new Store.
+func NewStore(url, dbPrefix string) (*Store, error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, ErrCouldNotDialDB
+	}
+
+	session.SetMode(mgo.Strong, true)
+	session.SetSafe(&mgo.Safe{W: 1})
+
+	return NewStoreWithSession(session, dbPrefix)
+}
+
+// NewStoreWithSession creates a new Store with a session.
+func NewStoreWithSession(session *mgo.Session, dbPrefix string) (*Store, error) {
+	if session == nil {
+		return nil, ErrNoDBSession
+	}
+
+	s := &Store{
+		session:  session,
+		dbPrefix: dbPrefix,
+	}
+
+	return s, nil
+}
+
+// Save implements the Save method of the scheduler.Store interface.
+func (s *Store) Save(ctx context.Context, cmd scheduler.ScheduledCommand) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	raw, err := bson.Marshal(cmd.Command)
+	if err != nil {
+		return scheduler.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotMarshalCommand,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if err := s.ensureIndex(ctx, sess); err != nil {
+		return scheduler.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveCommand,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if _, err := sess.DB(s.dbName(ctx)).C("scheduled_commands").UpsertId(cmd.ID, dbCommand{
+		ID:          cmd.ID,
+		CommandType: cmd.Command.CommandType(),
+		RawCommand:  bson.Raw{Kind: 3, Data: raw},
+		Context:     cmd.Context,
+		ExecuteAt:   cmd.ExecuteAt,
+		Created:     cmd.Created,
+		Attempts:    cmd.Attempts,
+	}); err != nil {
+		return scheduler.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveCommand,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Find implements the Find method of the scheduler.Store interface.
+func (s *Store) Find(ctx context.Context, id eh.ID) (scheduler.ScheduledCommand, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var c dbCommand
+	if err := sess.DB(s.dbName(ctx)).C("scheduled_commands").FindId(id).One(&c); err == mgo.ErrNotFound {
+		return scheduler.ScheduledCommand{}, scheduler.StoreError{
+			Err:       scheduler.ErrCommandNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if err != nil {
+		return scheduler.ScheduledCommand{}, scheduler.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotLoadCommands,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	cmd, err := c.scheduledCommand()
+	if err != nil {
+		return scheduler.ScheduledCommand{}, scheduler.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotUnmarshalCommand,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return cmd, nil
+}
+
+// FindAll implements the FindAll method of the scheduler.Store interface.
+func (s *Store) FindAll(ctx context.Context) ([]scheduler.ScheduledCommand, error) {
+	return s.find(ctx, bson.M{})
+}
+
+// FindDue implements the FindDue method of the scheduler.Store interface.
+func (s *Store) FindDue(ctx context.Context, t time.Time) ([]scheduler.ScheduledCommand, error) {
+	return s.find(ctx, bson.M{"execute_at": bson.M{"$lte": t}})
+}
+
+// Remove implements the Remove method of the scheduler.Store interface.
+func (s *Store) Remove(ctx context.Context, id eh.ID) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	if err := sess.DB(s.dbName(ctx)).C("scheduled_commands").RemoveId(id); err == mgo.ErrNotFound {
+		return scheduler.StoreError{
+			Err:       scheduler.ErrCommandNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if err != nil {
+		return scheduler.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotRemoveCommand,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Complete implements the Complete method of the scheduler.Store interface.
+func (s *Store) Complete(ctx context.Context, id eh.ID, executeAt time.Time) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	if err := sess.DB(s.dbName(ctx)).C("scheduled_commands").Remove(
+		bson.M{"_id": id, "execute_at": executeAt},
+	); err != nil && err != mgo.ErrNotFound {
+		return scheduler.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotRemoveCommand,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Clear clears the scheduled commands.
+func (s *Store) Clear(ctx context.Context) error {
+	s.indexed.Delete(s.dbName(ctx))
+	if err := s.session.DB(s.dbName(ctx)).C("scheduled_commands").DropCollection(); err != nil &&
+		err.Error() != "ns not found" {
+		return scheduler.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotClearDB,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Close closes the database session.
+func (s *Store) Close() {
+	s.session.Close()
+}
+
+// find finds the commands matching a query, ordered by execution time.
+func (s *Store) find(ctx context.Context, query bson.M) ([]scheduler.ScheduledCommand, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	// Skip the documents and commands that can not be unmarshaled, to not
+	// block the others.
+	cmds := []scheduler.ScheduledCommand{}
+	iter := sess.DB(s.dbName(ctx)).C("scheduled_commands").Find(query).
+		Sort("execute_at").Iter()
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		var c dbCommand
+		if err := raw.Unmarshal(&c); err != nil {
+			continue
+		}
+		cmd, err := c.scheduledCommand()
+		if err != nil {
+			continue
+		}
+		cmds = append(cmds, cmd)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, scheduler.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotLoadCommands,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return cmds, nil
+}
+
+// ensureIndex ensures the index of the execution time once per DB.
+func (s *Store) ensureIndex(ctx context.Context, sess *mgo.Session) error {
+	name := s.dbName(ctx)
+	if _, ok := s.indexed.Load(name); ok {
+		return nil
+	}
+	if err := sess.DB(name).C("scheduled_commands").EnsureIndexKey("execute_at"); err != nil {
+		return err
+	}
+	s.indexed.Store(name, struct{}{})
+	return nil
+}
+
+// dbName appends the namespace, if one is set, to the DB prefix to
+// get the name of the DB to use.
+func (s *Store) dbName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return s.dbPrefix + "_" + ns
+}
+
+// dbCommand is the DB representation of a scheduled command.
+type dbCommand struct {
+	ID          eh.ID                  `bson:"_id"`
+	CommandType eh.CommandType         `bson:"command_type"`
+	RawCommand  bson.Raw               `bson:"command"`
+	Context     map[string]interface{} `bson:"context"`
+	ExecuteAt   time.Time              `bson:"execute_at"`
+	Created     time.Time              `bson:"created"`
+	Attempts    int                    `bson:"attempts"`
+}
+
+// scheduledCommand unmarshals the command of a DB command.
+func (c dbCommand) scheduledCommand() (scheduler.ScheduledCommand, error) {
+	cmd, err := eh.CreateCommand(c.CommandType)
+	if err != nil {
+		return scheduler.ScheduledCommand{}, err
+	}
+	if err := c.RawCommand.Unmarshal(cmd); err != nil {
+		return scheduler.ScheduledCommand{}, err
+	}
+
+	return scheduler.ScheduledCommand{
+		ID:        c.ID,
+		Command:   cmd,
+		Context:   c.Context,
+		ExecuteAt: c.ExecuteAt,
+		Created:   c.Created,
+		Attempts:  c.Attempts,
+	}, nil
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jpillora/backoff"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// DefaultPollInterval is the default interval between polling the store for
+// due commands.
+const DefaultPollInterval = time.Second
+
+// DefaultRetryMin and DefaultRetryMax are the default min and max delay before
+// retrying a failed command.
+const (
+	DefaultRetryMin = time.Second
+	DefaultRetryMax = 5 * time.Minute
+)
+
+// DefaultMaxAttempts is the default max number of attempts to handle a command
+// before it is given up.
+const DefaultMaxAttempts = 10
+
+// ErrMaxAttempts is when a failed command is given up and removed after the
+// max number of attempts.
+var ErrMaxAttempts = errors.New("max attempts reached")
+
+// Scheduler is a durable scheduler of commands, which are saved in a Store and
+// handled when they are due by polling the store in the background. Unlike the
+// middleware returned by NewMiddleware pending commands are kept on restarts.
+//
+// Recurring jobs can be added with AddJob. Commands are handled at least once,
+// as a command can be handled before it is removed from the store. The ID of
+// the scheduled command is set as command ID in the context, to be used with
+// the dedup middleware.
+type Scheduler struct {
+	store        Store
+	handler      eh.CommandHandler
+	pollInterval time.Duration
+	retry        backoff.Backoff
+	maxAttempts  int
+	errCh        chan Error
+
+	// The recurring jobs, per namespace.
+	jobs   map[string]map[string]Job
+	jobsMu sync.RWMutex
+	// The missed fires of jobs not added in this process that have been
+	// reported, per namespace and job. Guarded by jobsMu.
+	orphans map[string]map[string]time.Time
+
+	// The running pollers, per namespace.
+	pollers   map[string]*poller
+	pollersMu sync.Mutex
+}
+
+type poller struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewScheduler creates a new Scheduler that handles due commands with a
+// command handler, typically the command bus.
+func NewScheduler(store Store, handler eh.CommandHandler) *Scheduler {
+	if store == nil || handler == nil {
+		return nil
+	}
+
+	return &Scheduler{
+		store:        store,
+		handler:      handler,
+		pollInterval: DefaultPollInterval,
+		retry:        backoff.Backoff{Min: DefaultRetryMin, Max: DefaultRetryMax},
+		maxAttempts:  DefaultMaxAttempts,
+		errCh:        make(chan Error, 100),
+		jobs:         map[string]map[string]Job{},
+		orphans:      map[string]map[string]time.Time{},
+		pollers:      map[string]*poller{},
+	}
+}
+
+// SetPollInterval sets the interval between polling the store for due commands.
+func (s *Scheduler) SetPollInterval(interval time.Duration) {
+	s.pollInterval = interval
+}
+
+// SetRetryBackoff sets the min and max delay before retrying a failed command.
+// The delay is doubled for each failed attempt.
+func (s *Scheduler) SetRetryBackoff(min, max time.Duration) {
+	s.retry.Min = min
+	s.retry.Max = max
+}
+
+// SetMaxAttempts sets the max number of attempts to handle a command, after
+// which it is removed and ErrMaxAttempts is sent on the error channel. A max of
+// 0 retries failed commands forever.
+func (s *Scheduler) SetMaxAttempts(max int) {
+	s.maxAttempts = max
+}
+
+// Errors returns an error channel where errors from handling commands are
+// sent. Errors are dropped if the channel is full.
+func (s *Scheduler) Errors() <-chan Error {
+	return s.errCh
+}
+
+// Middleware returns a middleware that schedules commands with an execution
+// time set by CommandWithExecuteTime, other commands are handled immediately.
+func (s *Scheduler) Middleware() eh.CommandHandlerMiddleware {
+	return eh.CommandHandlerMiddleware(func(h eh.CommandHandler) eh.CommandHandler {
+		return eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+			if c, ok := cmd.(Command); ok && !c.ExecuteAt().IsZero() {
+				if c, ok := cmd.(*command); ok {
+					cmd = c.Command
+				}
+				_, err := s.Schedule(ctx, cmd, c.ExecuteAt())
+				return err
+			}
+
+			return h.HandleCommand(ctx, cmd)
+		})
+	})
+}
+
+// Schedule schedules a command to be handled at a time, and returns the ID of
+// the scheduled command. The command ID is used as ID for IdentifiableCommands,
+// or else a new ID is created. The command ID from the context is not used, as
+// several commands can be scheduled with the same context.
+func (s *Scheduler) Schedule(ctx context.Context, cmd eh.Command, t time.Time) (eh.ID, error) {
+	id := eh.ID(uuid.New().String())
+	if c, ok := cmd.(eh.IdentifiableCommand); ok && !eh.IsNilID(c.CommandID()) {
+		id = c.CommandID()
+	}
+
+	if err := s.store.Save(ctx, ScheduledCommand{
+		ID:        id,
+		Command:   cmd,
+		Context:   eh.MarshalContext(ctx),
+		ExecuteAt: t,
+		Created:   time.Now(),
+	}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Commands returns all scheduled commands in the namespace of the context,
+// ordered by execution time.
+func (s *Scheduler) Commands(ctx context.Context) ([]ScheduledCommand, error) {
+	return s.store.FindAll(ctx)
+}
+
+// Command returns a scheduled command in the namespace of the context.
+func (s *Scheduler) Command(ctx context.Context, id eh.ID) (ScheduledCommand, error) {
+	return s.store.Find(ctx, id)
+}
+
+// Reschedule changes the execution time of a scheduled command.
+func (s *Scheduler) Reschedule(ctx context.Context, id eh.ID, t time.Time) error {
+	cmd, err := s.store.Find(ctx, id)
+	if err != nil {
+		return err
+	}
+	cmd.ExecuteAt = t
+	return s.store.Save(ctx, cmd)
+}
+
+// Cancel cancels a scheduled command.
+func (s *Scheduler) Cancel(ctx context.Context, id eh.ID) error {
+	return s.store.Remove(ctx, id)
+}
+
+// Start starts handling due commands in the background for the namespace of
+// the context, until Close is called. It can be called once for each namespace.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.pollersMu.Lock()
+	defer s.pollersMu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.pollers[ns]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(eh.NewContextWithNamespace(context.Background(), ns))
+	p := &poller{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	s.pollers[ns] = p
+
+	go func() {
+		defer close(p.done)
+		for {
+			if err := s.HandleDue(ctx); err != nil && ctx.Err() == nil {
+				s.report(err.(Error))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.pollInterval):
+			}
+		}
+	}()
+}
+
+// Close stops handling commands in all namespaces and waits for the background
+// handling to finish.
+func (s *Scheduler) Close() {
+	s.pollersMu.Lock()
+	pollers := s.pollers
+	s.pollers = map[string]*poller{}
+	s.pollersMu.Unlock()
+
+	for _, p := range pollers {
+		p.cancel()
+		<-p.done
+	}
+}
+
+// HandleDue handles all due commands in the namespace of the context, in order
+// of execution time. A failed command does not stop the others, it is kept and
+// retried after a backoff, and the error is sent on the error channel. After the
+// max number of attempts it is removed. An error is only returned if the due
+// commands could not be loaded.
+func (s *Scheduler) HandleDue(ctx context.Context) error {
+	cmds, err := s.store.FindDue(ctx, time.Now())
+	if err != nil {
+		return Error{Err: err, Ctx: ctx}
+	}
+
+	for _, cmd := range cmds {
+		if ctx.Err() != nil {
+			return Error{Err: ctx.Err(), Ctx: ctx}
+		}
+
+		if jc, ok := cmd.Command.(*JobCommand); ok {
+			if err := s.handleJob(ctx, cmd, jc); err != nil {
+				s.report(err.(Error))
+			}
+			continue
+		}
+
+		// Handle the command with its own context, in the same namespace.
+		cmdCtx := eh.NewContextWithNamespace(eh.UnmarshalContext(cmd.Context),
+			eh.NamespaceFromContext(ctx))
+		cmdCtx = eh.NewContextWithCommandID(cmdCtx, cmd.ID)
+		if err := s.handler.HandleCommand(cmdCtx, cmd.Command); err != nil {
+			s.report(Error{Err: err, Ctx: cmdCtx, Command: cmd.Command})
+			if err := s.retryLater(ctx, cmd); err != nil {
+				s.report(Error{Err: err, Ctx: cmdCtx, Command: cmd.Command})
+			}
+			continue
+		}
+		if err := s.store.Complete(ctx, cmd.ID, cmd.ExecuteAt); err != nil {
+			s.report(Error{Err: err, Ctx: cmdCtx, Command: cmd.Command})
+		}
+	}
+
+	return nil
+}
+
+// retryLater reschedules a failed command after a backoff, unless it has been
+// rescheduled or removed while it was handled. The command is removed and
+// ErrMaxAttempts is returned if it has reached the max number of attempts.
+func (s *Scheduler) retryLater(ctx context.Context, cmd ScheduledCommand) error {
+	current, err := s.store.Find(ctx, cmd.ID)
+	if sErr, ok := err.(StoreError); ok && sErr.Err == ErrCommandNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !current.ExecuteAt.Equal(cmd.ExecuteAt) {
+		return nil
+	}
+
+	if s.maxAttempts > 0 && cmd.Attempts+1 >= s.maxAttempts {
+		if err := s.store.Complete(ctx, cmd.ID, cmd.ExecuteAt); err != nil {
+			return err
+		}
+		return ErrMaxAttempts
+	}
+
+	cmd.ExecuteAt = time.Now().Add(s.retry.ForAttempt(float64(cmd.Attempts)))
+	cmd.Attempts++
+	return s.store.Save(ctx, cmd)
+}
+
+// report sends an error on the error channel, or drops it if the channel is full.
+func (s *Scheduler) report(err Error) {
+	select {
+	case s.errCh <- err:
+	default:
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/commandhandler/scheduler"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := scheduler.NewMemoryStore()
+	if store == nil {
+		t.Fatal("there should be a store")
+	}
+
+	t.Log("store with default namespace")
+	scheduler.AcceptanceTest(t, context.Background(), store)
+
+	t.Log("store with other namespace")
+	ctx := eh.NewContextWithNamespace(context.Background(), "ns")
+	scheduler.AcceptanceTest(t, ctx, store)
+}
+
+func Test_Scheduler(t *testing.T) {
+	ctx := eh.NewContextWithCorrelationID(context.Background(), "correlation")
+	inner := &mocks.CommandHandler{}
+	s := scheduler.NewScheduler(scheduler.NewMemoryStore(), inner)
+	h := eh.UseCommandHandlerMiddleware(inner, s.Middleware())
+
+	// Commands without an execution time are handled immediately.
+	cmd := mocks.Command{ID: uuid.New().String(), Content: "now"}
+	if err := h.HandleCommand(ctx, cmd); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(inner.Commands, []eh.Command{cmd}) {
+		t.Error("the command should have been handled:", inner.Commands)
+	}
+
+	// Scheduled commands are handled when due.
+	inner.Commands = nil
+	cmd1 := mocks.Command{ID: uuid.New().String(), Content: "cmd1"}
+	cmd2 := mocks.Command{ID: uuid.New().String(), Content: "cmd2"}
+	if err := h.HandleCommand(ctx, scheduler.CommandWithExecuteTime(cmd1, time.Now().Add(time.Hour))); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := h.HandleCommand(ctx, scheduler.CommandWithExecuteTime(cmd2, time.Now().Add(time.Hour))); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := s.HandleDue(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(inner.Commands) != 0 {
+		t.Error("the commands should not have been handled yet:", inner.Commands)
+	}
+
+	cmds, err := s.Commands(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(cmds) != 2 || cmds[0].Command != cmd1 || cmds[1].Command != cmd2 {
+		t.Fatal("the commands should be scheduled:", cmds)
+	}
+
+	// Reschedule and cancel commands.
+	if err := s.Reschedule(ctx, cmds[0].ID, time.Now()); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if err := s.Cancel(ctx, cmds[1].ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	err = s.Reschedule(ctx, cmds[1].ID, time.Now())
+	if sErr, ok := err.(scheduler.StoreError); !ok || sErr.Err != scheduler.ErrCommandNotFound {
+		t.Error("there should be a command not found error:", err)
+	}
+
+	if err := s.HandleDue(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(inner.Commands, []eh.Command{cmd1}) {
+		t.Error("the command should have been handled:", inner.Commands)
+	}
+	if id, _ := eh.CommandIDFromContext(inner.Context); id != cmds[0].ID {
+		t.Error("the command ID should be set:", id)
+	}
+	if id, _ := eh.CorrelationIDFromContext(inner.Context); id != "correlation" {
+		t.Error("the context should be kept:", id)
+	}
+	if cmds, _ := s.Commands(ctx); len(cmds) != 0 {
+		t.Error("there should be no scheduled commands:", cmds)
+	}
+}
+
+func Test_Scheduler_Errors(t *testing.T) {
+	ctx := context.Background()
+	handleErr := errors.New("command error")
+	var fail atomic.Bool
+	fail.Store(true)
+	handled := make(chan eh.Command, 10)
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		if fail.Load() {
+			return handleErr
+		}
+		handled <- cmd
+		return nil
+	})
+	s := scheduler.NewScheduler(scheduler.NewMemoryStore(), inner)
+	s.SetPollInterval(time.Millisecond)
+	s.SetRetryBackoff(time.Millisecond, time.Millisecond)
+
+	cmd := mocks.Command{ID: uuid.New().String(), Content: "cmd"}
+	if _, err := s.Schedule(ctx, cmd, time.Now()); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// Failed commands are kept and retried.
+	s.Start(ctx)
+	defer s.Close()
+	select {
+	case err := <-s.Errors():
+		if err.Err != handleErr || err.Command != cmd {
+			t.Error("the error should be correct:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("there should be an error")
+	}
+	if cmds, _ := s.Commands(ctx); len(cmds) != 1 || cmds[0].Attempts == 0 {
+		t.Error("the command should still be scheduled:", cmds)
+	}
+
+	fail.Store(false)
+	select {
+	case c := <-handled:
+		if c != cmd {
+			t.Error("the command should be correct:", c)
+		}
+	case <-time.After(time.Second):
+		t.Error("the command should have been handled")
+	}
+	s.Close()
+	if cmds, _ := s.Commands(ctx); len(cmds) != 0 {
+		t.Error("there should be no scheduled commands:", cmds)
+	}
+}
+
+func Test_Scheduler_FailedCommand(t *testing.T) {
+	ctx := context.Background()
+	handleErr := errors.New("command error")
+	var handled []eh.Command
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		if cmd.(mocks.Command).Content == "fail" {
+			return handleErr
+		}
+		handled = append(handled, cmd)
+		return nil
+	})
+	s := scheduler.NewScheduler(scheduler.NewMemoryStore(), inner)
+
+	failing := mocks.Command{ID: uuid.New().String(), Content: "fail"}
+	cmd := mocks.Command{ID: uuid.New().String(), Content: "cmd"}
+	now := time.Now()
+	failingID, err := s.Schedule(ctx, failing, now.Add(-time.Second))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := s.Schedule(ctx, cmd, now); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// A failed command does not stop the later ones, and is retried after
+	// a backoff.
+	if err := s.HandleDue(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(handled, []eh.Command{cmd}) {
+		t.Error("the later command should have been handled:", handled)
+	}
+	select {
+	case err := <-s.Errors():
+		if err.Err != handleErr || err.Command != failing {
+			t.Error("the error should be correct:", err)
+		}
+	default:
+		t.Error("there should be an error")
+	}
+	c, err := s.Command(ctx, failingID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if c.Attempts != 1 || c.ExecuteAt.Before(now.Add(scheduler.DefaultRetryMin)) {
+		t.Error("the command should be retried later:", c)
+	}
+}
+
+func Test_Scheduler_SameContextCommandID(t *testing.T) {
+	// Commands scheduled with the same context, for example from one request
+	// with an Idempotency-Key header, should not replace each other.
+	ctx := eh.NewContextWithCommandID(context.Background(), uuid.New().String())
+	s := scheduler.NewScheduler(scheduler.NewMemoryStore(), &mocks.CommandHandler{})
+
+	t1 := time.Now().Add(time.Hour)
+	cmd1 := mocks.Command{ID: uuid.New().String(), Content: "cmd1"}
+	cmd2 := mocks.Command{ID: uuid.New().String(), Content: "cmd2"}
+	id1, err := s.Schedule(ctx, cmd1, t1)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	id2, err := s.Schedule(ctx, cmd2, t1.Add(time.Second))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if id1 == id2 {
+		t.Error("the IDs should be different:", id1, id2)
+	}
+	cmds, err := s.Commands(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(cmds) != 2 || cmds[0].Command != cmd1 || cmds[1].Command != cmd2 {
+		t.Error("both commands should be scheduled:", cmds)
+	}
+}
+
+func Test_Scheduler_MaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	handleErr := errors.New("command error")
+	inner := eh.CommandHandlerFunc(func(ctx context.Context, cmd eh.Command) error {
+		return handleErr
+	})
+	s := scheduler.NewScheduler(scheduler.NewMemoryStore(), inner)
+	s.SetRetryBackoff(time.Millisecond, time.Millisecond)
+	s.SetMaxAttempts(2)
+
+	cmd := mocks.Command{ID: uuid.New().String(), Content: "fail"}
+	id, err := s.Schedule(ctx, cmd, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// The first attempt is retried.
+	if err := s.HandleDue(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	select {
+	case err := <-s.Errors():
+		if err.Err != handleErr {
+			t.Error("the error should be correct:", err)
+		}
+	default:
+		t.Error("there should be an error")
+	}
+	c, err := s.Command(ctx, id)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if c.Attempts != 1 {
+		t.Error("the command should be retried:", c)
+	}
+
+	// The last attempt gives up the command.
+	time.Sleep(10 * time.Millisecond)
+	if err := s.HandleDue(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	select {
+	case err := <-s.Errors():
+		if err.Err != handleErr {
+			t.Error("the error should be correct:", err)
+		}
+	default:
+		t.Error("there should be an error")
+	}
+	select {
+	case err := <-s.Errors():
+		if err.Err != scheduler.ErrMaxAttempts || err.Command != cmd {
+			t.Error("the error should be correct:", err)
+		}
+	default:
+		t.Error("there should be a max attempts error")
+	}
+	if _, err := s.Command(ctx, id); err == nil {
+		t.Error("the command should be removed")
+	}
+}
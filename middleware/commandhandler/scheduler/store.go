@@ -0,0 +1,189 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCommandNotFound is when a scheduled command could not be found.
+var ErrCommandNotFound = errors.New("scheduled command not found")
+
+// StoreError is an error in a Store.
+type StoreError struct {
+	// Err is the error.
+	Err error
+	// BaseErr is an optional underlying error, for example from the DB driver.
+	BaseErr error
+	// Namespace is the namespace for the error.
+	Namespace string
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e StoreError) Error() string {
+	errStr := e.Err.Error()
+	if e.BaseErr != nil {
+		errStr += ": " + e.BaseErr.Error()
+	}
+	return "scheduler: " + errStr + " (" + e.Namespace + ")"
+}
+
+// ScheduledCommand is a command scheduled to be handled at a later time.
+type ScheduledCommand struct {
+	// ID is the ID of the scheduled command.
+	ID eh.ID `json:"id"`
+	// Command is the command to handle, which must be registered with
+	// eventhorizon.RegisterCommand to be stored in a DB.
+	Command eh.Command `json:"command"`
+	// Context is the marshaled context to handle the command with.
+	Context map[string]interface{} `json:"context,omitempty"`
+	// ExecuteAt is when the command should be handled.
+	ExecuteAt time.Time `json:"execute_at"`
+	// Created is when the command was scheduled.
+	Created time.Time `json:"created"`
+	// Attempts is the number of failed attempts to handle the command.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// Store is a store of scheduled commands, with one set of commands per
+// namespace.
+type Store interface {
+	// Save saves a scheduled command, replacing any command with the same ID.
+	Save(context.Context, ScheduledCommand) error
+
+	// Find returns a scheduled command.
+	Find(context.Context, eh.ID) (ScheduledCommand, error)
+
+	// FindAll returns all scheduled commands, ordered by execution time.
+	FindAll(context.Context) ([]ScheduledCommand, error)
+
+	// FindDue returns the commands that should be handled at or before a
+	// time, ordered by execution time.
+	FindDue(context.Context, time.Time) ([]ScheduledCommand, error)
+
+	// Remove removes a scheduled command.
+	Remove(context.Context, eh.ID) error
+
+	// Complete removes a scheduled command after it has been handled, only if
+	// it has not been rescheduled to an other execution time.
+	Complete(ctx context.Context, id eh.ID, executeAt time.Time) error
+}
+
+// MemoryStore is a Store in memory, mainly useful for testing.
+type MemoryStore struct {
+	// The outer map is with namespace as key, the inner with command ID.
+	commands map[string]map[eh.ID]ScheduledCommand
+	mu       sync.RWMutex
+}
+
+var _ = Store(&MemoryStore{})
+
+// NewMemoryStore creates a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		commands: map[string]map[eh.ID]ScheduledCommand{},
+	}
+}
+
+// Save implements the Save method of the Store interface.
+func (s *MemoryStore) Save(ctx context.Context, cmd ScheduledCommand) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.commands[ns]; !ok {
+		s.commands[ns] = map[eh.ID]ScheduledCommand{}
+	}
+	s.commands[ns][cmd.ID] = cmd
+	return nil
+}
+
+// Find implements the Find method of the Store interface.
+func (s *MemoryStore) Find(ctx context.Context, id eh.ID) (ScheduledCommand, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cmd, ok := s.commands[eh.NamespaceFromContext(ctx)][id]
+	if !ok {
+		return ScheduledCommand{}, StoreError{
+			Err:       ErrCommandNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return cmd, nil
+}
+
+// FindAll implements the FindAll method of the Store interface.
+func (s *MemoryStore) FindAll(ctx context.Context) ([]ScheduledCommand, error) {
+	return s.find(ctx, func(ScheduledCommand) bool { return true }), nil
+}
+
+// FindDue implements the FindDue method of the Store interface.
+func (s *MemoryStore) FindDue(ctx context.Context, t time.Time) ([]ScheduledCommand, error) {
+	return s.find(ctx, func(cmd ScheduledCommand) bool {
+		return !cmd.ExecuteAt.After(t)
+	}), nil
+}
+
+// Remove implements the Remove method of the Store interface.
+func (s *MemoryStore) Remove(ctx context.Context, id eh.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.commands[ns][id]; !ok {
+		return StoreError{
+			Err:       ErrCommandNotFound,
+			Namespace: ns,
+		}
+	}
+	delete(s.commands[ns], id)
+	return nil
+}
+
+// Complete implements the Complete method of the Store interface.
+func (s *MemoryStore) Complete(ctx context.Context, id eh.ID, executeAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if cmd, ok := s.commands[ns][id]; ok && cmd.ExecuteAt.Equal(executeAt) {
+		delete(s.commands[ns], id)
+	}
+	return nil
+}
+
+// find returns the commands matching a filter, ordered by execution time.
+func (s *MemoryStore) find(ctx context.Context, filter func(ScheduledCommand) bool) []ScheduledCommand {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cmds := []ScheduledCommand{}
+	for _, cmd := range s.commands[eh.NamespaceFromContext(ctx)] {
+		if filter(cmd) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].ExecuteAt.Before(cmds[j].ExecuteAt)
+	})
+	return cmds
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+// AcceptanceTest is the acceptance test that all implementations of Store
+// should pass. It should manually be called from a test case in each
+// implementation:
+//
+//   func TestStore(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewStore()
+//       retry.AcceptanceTest(t, ctx, store)
+//   }
+//
+func AcceptanceTest(t *testing.T, ctx context.Context, store Store) {
+	// Times are rounded as DBs may not store them with full precision.
+	now := time.Now().Round(time.Millisecond)
+
+	t.Log("find all with no dead letters")
+	dls, err := store.FindAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(dls) != 0 {
+		t.Error("there should be no dead letters:", dls)
+	}
+
+	t.Log("save dead letters")
+	dl1 := DeadLetter{
+		ID:          uuid.New().String(),
+		HandlerType: "handler",
+		Event: eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			now, mocks.AggregateType, uuid.New().String(), 1,
+			eh.WithMetadata(map[string]interface{}{"num": "1"})),
+		Context:  map[string]interface{}{"key": "value"},
+		Err:      "handler failed",
+		Attempts: 3,
+		Created:  now.Add(time.Minute),
+		Updated:  now.Add(time.Minute),
+	}
+	dl2 := DeadLetter{
+		ID:          uuid.New().String(),
+		HandlerType: "handler",
+		Event: eh.NewEventForAggregate(mocks.EventOtherType, nil,
+			now, mocks.AggregateType, uuid.New().String(), 2),
+		Err:      "other handler failed",
+		Attempts: 1,
+		Created:  now,
+		Updated:  now,
+	}
+	for _, dl := range []DeadLetter{dl1, dl2} {
+		if err := store.Save(ctx, dl); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+
+	t.Log("find a dead letter")
+	dl, err := store.Find(ctx, dl1.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertDeadLetters(t, []DeadLetter{dl}, []DeadLetter{dl1})
+
+	t.Log("find an unknown dead letter")
+	_, err = store.Find(ctx, uuid.New().String())
+	if sErr, ok := err.(StoreError); !ok || sErr.Err != ErrDeadLetterNotFound {
+		t.Error("there should be a dead letter not found error:", err)
+	}
+
+	t.Log("find all dead letters")
+	dls, err = store.FindAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertDeadLetters(t, dls, []DeadLetter{dl2, dl1})
+
+	t.Log("find dead letters in an other namespace")
+	dls, err = store.FindAll(eh.NewContextWithNamespace(ctx, "other"))
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(dls) != 0 {
+		t.Error("there should be no dead letters:", dls)
+	}
+
+	t.Log("update a dead letter")
+	dl1.Attempts = 4
+	dl1.Err = "handler failed again"
+	dl1.Updated = now.Add(time.Hour)
+	if err := store.Save(ctx, dl1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	dl, err = store.Find(ctx, dl1.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertDeadLetters(t, []DeadLetter{dl}, []DeadLetter{dl1})
+
+	t.Log("remove a dead letter")
+	for _, id := range []eh.ID{dl1.ID, dl2.ID} {
+		if err := store.Remove(ctx, id); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	dls, err = store.FindAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(dls) != 0 {
+		t.Error("there should be no dead letters:", dls)
+	}
+
+	t.Log("remove an unknown dead letter")
+	err = store.Remove(ctx, dl1.ID)
+	if sErr, ok := err.(StoreError); !ok || sErr.Err != ErrDeadLetterNotFound {
+		t.Error("there should be a dead letter not found error:", err)
+	}
+}
+
+func assertDeadLetters(t *testing.T, dls, expected []DeadLetter) {
+	if len(dls) != len(expected) {
+		t.Error("the dead letters should be correct:", dls)
+		return
+	}
+	for i, dl := range dls {
+		e := expected[i]
+		if dl.ID != e.ID ||
+			dl.HandlerType != e.HandlerType ||
+			dl.Err != e.Err ||
+			dl.Attempts != e.Attempts ||
+			!dl.Created.Equal(e.Created) ||
+			!dl.Updated.Equal(e.Updated) ||
+			len(dl.Context) != len(e.Context) {
+			t.Error("the dead letter should be correct:", dl)
+		}
+		for k, v := range e.Context {
+			if dl.Context[k] != v {
+				t.Error("the context should be correct:", dl.Context)
+			}
+		}
+		if dl.Event == nil {
+			t.Error("the dead letter should have an event:", dl)
+			continue
+		}
+		if err := mocks.CompareEvents(dl.Event, e.Event); err != nil {
+			t.Error("the event should be correct:", err)
+		}
+		if dl.Event.Version() != e.Event.Version() ||
+			!dl.Event.Timestamp().Equal(e.Event.Timestamp()) {
+			t.Error("the event version and timestamp should be correct:", dl.Event)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jpillora/backoff"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrHandlerNotFound is when a dead letter is replayed for a handler that has
+// not been wrapped by the DeadLetterQueue.
+var ErrHandlerNotFound = errors.New("handler not found")
+
+// DefaultMaxAttempts is the default number of times to handle an event.
+const DefaultMaxAttempts = 5
+
+// Error is the error of the last attempt to handle an event.
+type Error struct {
+	// Err is the error.
+	Err error
+	// HandlerType is the type of the handler.
+	HandlerType eh.EventHandlerType
+	// Event is the event that could not be handled.
+	Event eh.Event
+	// Attempts is the number of times the event was handled.
+	Attempts int
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e Error) Error() string {
+	return fmt.Sprintf("%s: %s: %s (%d attempts)",
+		e.HandlerType, e.Event.String(), e.Err.Error(), e.Attempts)
+}
+
+// Option is an option for the retry middleware.
+type Option func(*options)
+
+type options struct {
+	maxAttempts int
+	backoff     backoff.Backoff
+	retryable   func(error) bool
+}
+
+// WithMaxAttempts sets the number of times to handle an event, including the
+// first attempt. The default is DefaultMaxAttempts.
+func WithMaxAttempts(attempts int) Option {
+	return func(o *options) {
+		o.maxAttempts = attempts
+	}
+}
+
+// WithBackoff sets the delays between the attempts, growing exponentially
+// from min to max with a random jitter. The default is 100ms to 10s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.backoff.Min = min
+		o.backoff.Max = max
+	}
+}
+
+// WithRetryable sets a func to decide which errors to retry. Other errors fail
+// at once. The default is to retry all errors.
+func WithRetryable(f func(error) bool) Option {
+	return func(o *options) {
+		o.retryable = f
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		maxAttempts: DefaultMaxAttempts,
+		backoff: backoff.Backoff{
+			Min:    100 * time.Millisecond,
+			Max:    10 * time.Second,
+			Jitter: true,
+		},
+		retryable: func(error) bool { return true },
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// NewMiddleware returns a new middleware that retries events failing in the
+// handler, waiting with an exponential backoff between the attempts. An Error
+// with the last error is returned if all attempts fail, or the context error
+// if it is done while waiting.
+func NewMiddleware(opts ...Option) eh.EventHandlerMiddleware {
+	o := newOptions(opts)
+	return eh.EventHandlerMiddleware(func(h eh.EventHandler) eh.EventHandler {
+		return &eventHandler{h, func(ctx context.Context, event eh.Event) error {
+			if attempts, err := o.handle(ctx, h, event); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return Error{
+					Err:         err,
+					HandlerType: h.HandlerType(),
+					Event:       event,
+					Attempts:    attempts,
+				}
+			}
+			return nil
+		}}
+	})
+}
+
+// DeadLetterQueue is a retry middleware that saves the events that still fail
+// after all attempts in a Store, instead of returning an error. The saved
+// dead letters can be inspected, replayed or discarded.
+type DeadLetterQueue struct {
+	store   Store
+	options options
+
+	// Handlers are kept by type to be able to replay events.
+	handlers   map[eh.EventHandlerType]eh.EventHandler
+	handlersMu sync.RWMutex
+}
+
+// NewDeadLetterQueue creates a new DeadLetterQueue.
+func NewDeadLetterQueue(store Store, opts ...Option) *DeadLetterQueue {
+	if store == nil {
+		return nil
+	}
+
+	return &DeadLetterQueue{
+		store:    store,
+		options:  newOptions(opts),
+		handlers: map[eh.EventHandlerType]eh.EventHandler{},
+	}
+}
+
+// Middleware returns an event handler middleware that retries failing events
+// and saves them as dead letters when all attempts have failed. Only an error
+// from saving the dead letter is returned, or the context error if it is done
+// while waiting, to let the event be handled again. Wrapping a handler with a
+// handler type that is already wrapped panics, as dead letters are replayed by
+// handler type.
+func (q *DeadLetterQueue) Middleware() eh.EventHandlerMiddleware {
+	return eh.EventHandlerMiddleware(func(h eh.EventHandler) eh.EventHandler {
+		q.handlersMu.Lock()
+		if _, ok := q.handlers[h.HandlerType()]; ok {
+			q.handlersMu.Unlock()
+			panic(fmt.Sprintf("eventhorizon: registering duplicate dead letter handlers for %q", h.HandlerType()))
+		}
+		q.handlers[h.HandlerType()] = h
+		q.handlersMu.Unlock()
+
+		return &eventHandler{h, func(ctx context.Context, event eh.Event) error {
+			attempts, err := q.options.handle(ctx, h, event)
+			if err == nil {
+				return nil
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			now := time.Now()
+			return q.store.Save(ctx, DeadLetter{
+				ID:          uuid.New().String(),
+				HandlerType: h.HandlerType(),
+				Event:       event,
+				Context:     eh.MarshalContext(ctx),
+				Err:         err.Error(),
+				Attempts:    attempts,
+				Created:     now,
+				Updated:     now,
+			})
+		}}
+	})
+}
+
+// DeadLetters returns all dead letters, ordered by creation time.
+func (q *DeadLetterQueue) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	return q.store.FindAll(ctx)
+}
+
+// DeadLetter returns a dead letter.
+func (q *DeadLetterQueue) DeadLetter(ctx context.Context, id eh.ID) (DeadLetter, error) {
+	return q.store.Find(ctx, id)
+}
+
+// Replay handles a dead-lettered event again, once, with the handler that
+// failed and the context that it was handled with. The dead letter is removed
+// if the event is handled, or else updated with the new error which is also
+// returned as an Error.
+func (q *DeadLetterQueue) Replay(ctx context.Context, id eh.ID) error {
+	dl, err := q.store.Find(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	q.handlersMu.RLock()
+	h, ok := q.handlers[dl.HandlerType]
+	q.handlersMu.RUnlock()
+	if !ok {
+		return Error{
+			Err:         ErrHandlerNotFound,
+			HandlerType: dl.HandlerType,
+			Event:       dl.Event,
+			Attempts:    dl.Attempts,
+		}
+	}
+
+	// Use the namespace of the store, which is not always in the context.
+	eventCtx := eh.NewContextWithNamespace(eh.UnmarshalContext(dl.Context),
+		eh.NamespaceFromContext(ctx))
+	if handlerErr := h.HandleEvent(eventCtx, dl.Event); handlerErr != nil {
+		dl.Err = handlerErr.Error()
+		dl.Attempts++
+		dl.Updated = time.Now()
+		if err := q.store.Save(ctx, dl); err != nil {
+			return err
+		}
+		return Error{
+			Err:         handlerErr,
+			HandlerType: dl.HandlerType,
+			Event:       dl.Event,
+			Attempts:    dl.Attempts,
+		}
+	}
+
+	return q.store.Remove(ctx, id)
+}
+
+// Discard removes a dead letter without handling the event.
+func (q *DeadLetterQueue) Discard(ctx context.Context, id eh.ID) error {
+	return q.store.Remove(ctx, id)
+}
+
+// handle handles an event until it succeeds, fails with an error that is not
+// retryable, all attempts have failed or the context is done. It returns the
+// number of attempts and the last error.
+func (o options) handle(ctx context.Context, h eh.EventHandler, event eh.Event) (int, error) {
+	// Use a backoff per event, as it is not safe for concurrent use.
+	delay := o.backoff
+	for attempt := 1; ; attempt++ {
+		err := h.HandleEvent(ctx, event)
+		if err == nil || !o.retryable(err) || attempt >= o.maxAttempts {
+			return attempt, err
+		}
+
+		select {
+		case <-time.After(delay.Duration()):
+		case <-ctx.Done():
+			return attempt, err
+		}
+	}
+}
+
+// eventHandler wraps an event handler, keeping its handler type.
+type eventHandler struct {
+	eh.EventHandler
+	handle eh.EventHandlerFunc
+}
+
+// HandleEvent implements the HandleEvent method of the eventhorizon.EventHandler interface.
+func (h *eventHandler) HandleEvent(ctx context.Context, event eh.Event) error {
+	return h.handle(ctx, event)
+}
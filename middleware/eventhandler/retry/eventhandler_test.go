@@ -0,0 +1,234 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/eventhandler/retry"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+var handlerErr = errors.New("handler error")
+
+func TestMemoryStore(t *testing.T) {
+	store := retry.NewMemoryStore()
+	if store == nil {
+		t.Fatal("there should be a store")
+	}
+
+	t.Log("store with default namespace")
+	retry.AcceptanceTest(t, context.Background(), store)
+
+	t.Log("store with other namespace")
+	ctx := eh.NewContextWithNamespace(context.Background(), "ns")
+	retry.AcceptanceTest(t, ctx, store)
+}
+
+func Test_EventHandler_Retry(t *testing.T) {
+	inner := &failingHandler{failures: 2}
+	m := retry.NewMiddleware(retry.WithBackoff(time.Millisecond, time.Millisecond))
+	h := eh.UseEventHandlerMiddleware(inner, m)
+	if h.HandlerType() != inner.HandlerType() {
+		t.Error("the handler type should be kept:", h.HandlerType())
+	}
+	if err := h.HandleEvent(context.Background(), newEvent()); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if inner.attempts != 3 {
+		t.Error("the event should have been retried:", inner.attempts)
+	}
+}
+
+func Test_EventHandler_MaxAttempts(t *testing.T) {
+	inner := &failingHandler{failures: 10}
+	m := retry.NewMiddleware(
+		retry.WithMaxAttempts(3),
+		retry.WithBackoff(time.Millisecond, time.Millisecond),
+	)
+	h := eh.UseEventHandlerMiddleware(inner, m)
+	event := newEvent()
+	err := h.HandleEvent(context.Background(), event)
+	rErr, ok := err.(retry.Error)
+	if !ok || rErr.Err != handlerErr || rErr.Attempts != 3 ||
+		rErr.HandlerType != inner.HandlerType() || rErr.Event != event {
+		t.Error("there should be a retry error:", err)
+	}
+	if inner.attempts != 3 {
+		t.Error("the event should have been handled 3 times:", inner.attempts)
+	}
+}
+
+func Test_EventHandler_NotRetryable(t *testing.T) {
+	inner := &failingHandler{failures: 10}
+	m := retry.NewMiddleware(
+		retry.WithBackoff(time.Millisecond, time.Millisecond),
+		retry.WithRetryable(func(err error) bool { return err != handlerErr }),
+	)
+	h := eh.UseEventHandlerMiddleware(inner, m)
+	err := h.HandleEvent(context.Background(), newEvent())
+	if rErr, ok := err.(retry.Error); !ok || rErr.Attempts != 1 {
+		t.Error("there should be a retry error:", err)
+	}
+	if inner.attempts != 1 {
+		t.Error("the event should not have been retried:", inner.attempts)
+	}
+}
+
+func Test_EventHandler_ContextDone(t *testing.T) {
+	inner := &failingHandler{failures: 10}
+	m := retry.NewMiddleware(retry.WithBackoff(time.Hour, time.Hour))
+	h := eh.UseEventHandlerMiddleware(inner, m)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := h.HandleEvent(ctx, newEvent()); err != context.DeadlineExceeded {
+		t.Error("there should be a context error:", err)
+	}
+}
+
+func Test_DeadLetterQueue(t *testing.T) {
+	ctx := mocks.WithContextOne(context.Background(), "one")
+	store := retry.NewMemoryStore()
+	q := retry.NewDeadLetterQueue(store,
+		retry.WithMaxAttempts(2),
+		retry.WithBackoff(time.Millisecond, time.Millisecond),
+	)
+	inner := &failingHandler{failures: 3}
+	h := eh.UseEventHandlerMiddleware(inner, q.Middleware())
+	event := newEvent()
+	if err := h.HandleEvent(ctx, event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	dls, err := q.DeadLetters(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(dls) != 1 {
+		t.Fatal("there should be a dead letter:", dls)
+	}
+	dl := dls[0]
+	if dl.HandlerType != inner.HandlerType() || dl.Event != event ||
+		dl.Err != handlerErr.Error() || dl.Attempts != 2 ||
+		dl.Context["context_one"] != "one" {
+		t.Error("the dead letter should be correct:", dl)
+	}
+
+	t.Log("replay an event that fails")
+	err = q.Replay(ctx, dl.ID)
+	if rErr, ok := err.(retry.Error); !ok || rErr.Err != handlerErr || rErr.Attempts != 3 {
+		t.Error("there should be a retry error:", err)
+	}
+	if dl, err = q.DeadLetter(ctx, dl.ID); err != nil || dl.Attempts != 3 {
+		t.Error("the dead letter should be updated:", dl, err)
+	}
+
+	t.Log("replay an event")
+	if err := q.Replay(ctx, dl.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if inner.attempts != 4 {
+		t.Error("the event should have been handled 4 times:", inner.attempts)
+	}
+	if v, ok := mocks.ContextOne(inner.ctx); !ok || v != "one" {
+		t.Error("the event should be replayed with the context:", v)
+	}
+	_, err = q.DeadLetter(ctx, dl.ID)
+	if sErr, ok := err.(retry.StoreError); !ok || sErr.Err != retry.ErrDeadLetterNotFound {
+		t.Error("there should be a dead letter not found error:", err)
+	}
+
+	t.Log("discard an event")
+	inner.failures = 10
+	if err := h.HandleEvent(ctx, event); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	dls, err = q.DeadLetters(ctx)
+	if err != nil || len(dls) != 1 {
+		t.Fatal("there should be a dead letter:", dls, err)
+	}
+	if err := q.Discard(ctx, dls[0].ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if dls, err = q.DeadLetters(ctx); err != nil || len(dls) != 0 {
+		t.Error("there should be no dead letters:", dls, err)
+	}
+
+	t.Log("replay for an unknown handler")
+	dl.ID = uuid.New().String()
+	dl.HandlerType = "unknown"
+	if err := store.Save(ctx, dl); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	err = q.Replay(ctx, dl.ID)
+	if rErr, ok := err.(retry.Error); !ok || rErr.Err != retry.ErrHandlerNotFound {
+		t.Error("there should be a handler not found error:", err)
+	}
+}
+
+func Test_DeadLetterQueue_ContextDone(t *testing.T) {
+	store := retry.NewMemoryStore()
+	q := retry.NewDeadLetterQueue(store, retry.WithBackoff(time.Hour, time.Hour))
+	h := eh.UseEventHandlerMiddleware(&failingHandler{failures: 10}, q.Middleware())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := h.HandleEvent(ctx, newEvent()); err != context.DeadlineExceeded {
+		t.Error("there should be a context error:", err)
+	}
+	if dls, err := q.DeadLetters(context.Background()); err != nil || len(dls) != 0 {
+		t.Error("there should be no dead letters:", dls, err)
+	}
+}
+
+func Test_DeadLetterQueue_DuplicateHandler(t *testing.T) {
+	q := retry.NewDeadLetterQueue(retry.NewMemoryStore())
+	eh.UseEventHandlerMiddleware(&failingHandler{}, q.Middleware())
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("there should be a panic")
+		}
+	}()
+	eh.UseEventHandlerMiddleware(&failingHandler{}, q.Middleware())
+}
+
+func newEvent() eh.Event {
+	return eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event"},
+		time.Now(), mocks.AggregateType, uuid.New().String(), 1)
+}
+
+// failingHandler fails a number of times before handling events.
+type failingHandler struct {
+	failures int
+	attempts int
+	ctx      context.Context
+}
+
+func (h *failingHandler) HandlerType() eh.EventHandlerType {
+	return "failingHandler"
+}
+
+func (h *failingHandler) HandleEvent(ctx context.Context, event eh.Event) error {
+	h.attempts++
+	h.ctx = ctx
+	if h.attempts <= h.failures {
+		return handlerErr
+	}
+	return nil
+}
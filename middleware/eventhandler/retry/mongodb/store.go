@@ -0,0 +1,275 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/middleware/eventhandler/retry"
+)
+
+// ErrCouldNotDialDB is when the database could not be dialed.
+var ErrCouldNotDialDB = errors.New("could not dial database")
+
+// ErrNoDBSession is when no database session is set.
+var ErrNoDBSession = errors.New("no database session")
+
+// ErrCouldNotClearDB is when the database could not be cleared.
+var ErrCouldNotClearDB = errors.New("could not clear database")
+
+// ErrCouldNotMarshalEvent is when an event could not be marshaled into BSON.
+var ErrCouldNotMarshalEvent = errors.New("could not marshal event")
+
+// ErrCouldNotUnmarshalEvent is when an event could not be unmarshaled into
+// a concrete type.
+var ErrCouldNotUnmarshalEvent = errors.New("could not unmarshal event")
+
+// ErrCouldNotSaveDeadLetter is when a dead letter could not be saved.
+var ErrCouldNotSaveDeadLetter = errors.New("could not save dead letter")
+
+// ErrCouldNotLoadDeadLetters is when the dead letters could not be loaded.
+var ErrCouldNotLoadDeadLetters = errors.New("could not load dead letters")
+
+// ErrCouldNotRemoveDeadLetter is when a dead letter could not be removed.
+var ErrCouldNotRemoveDeadLetter = errors.New("could not remove dead letter")
+
+// Store implements a retry.Store for MongoDB. The dead letters are kept in a
+// "dead_letters" collection per namespace, and the event data must be
+// registered with eventhorizon.RegisterEventData.
+type Store struct {
+	session  *mgo.Session
+	dbPrefix string
+}
+
+var _ = retry.Store(&Store{})
+
+// NewStore creates a new Store.
+func NewStore(url, dbPrefix string) (*Store, error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, ErrCouldNotDialDB
+	}
+
+	session.SetMode(mgo.Strong, true)
+	session.SetSafe(&mgo.Safe{W: 1})
+
+	return NewStoreWithSession(session, dbPrefix)
+}
+
+// NewStoreWithSession creates a new Store with a session.
+func NewStoreWithSession(session *mgo.Session, dbPrefix string) (*Store, error) {
+	if session == nil {
+		return nil, ErrNoDBSession
+	}
+
+	s := &Store{
+		session:  session,
+		dbPrefix: dbPrefix,
+	}
+
+	return s, nil
+}
+
+// Save implements the Save method of the retry.Store interface.
+func (s *Store) Save(ctx context.Context, dl retry.DeadLetter) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	// Marshal event data if there is any.
+	var rawData bson.Raw
+	if dl.Event.Data() != nil {
+		raw, err := bson.Marshal(dl.Event.Data())
+		if err != nil {
+			return retry.StoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotMarshalEvent,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		rawData = bson.Raw{Kind: 3, Data: raw}
+	}
+
+	c := sess.DB(s.dbName(ctx)).C("dead_letters")
+	if err := c.EnsureIndexKey("created"); err != nil {
+		return retry.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveDeadLetter,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if _, err := c.UpsertId(dl.ID, dbDeadLetter{
+		ID:            dl.ID,
+		HandlerType:   dl.HandlerType,
+		EventType:     dl.Event.EventType(),
+		RawData:       rawData,
+		Timestamp:     dl.Event.Timestamp(),
+		AggregateType: dl.Event.AggregateType(),
+		AggregateID:   dl.Event.AggregateID(),
+		Version:       dl.Event.Version(),
+		Metadata:      dl.Event.Metadata(),
+		Context:       dl.Context,
+		Err:           dl.Err,
+		Attempts:      dl.Attempts,
+		Created:       dl.Created,
+		Updated:       dl.Updated,
+	}); err != nil {
+		return retry.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotSaveDeadLetter,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Find implements the Find method of the retry.Store interface.
+func (s *Store) Find(ctx context.Context, id eh.ID) (retry.DeadLetter, error) {
+	dls, err := s.find(ctx, bson.M{"_id": id})
+	if err != nil {
+		return retry.DeadLetter{}, err
+	} else if len(dls) == 0 {
+		return retry.DeadLetter{}, retry.StoreError{
+			Err:       retry.ErrDeadLetterNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return dls[0], nil
+}
+
+// FindAll implements the FindAll method of the retry.Store interface.
+func (s *Store) FindAll(ctx context.Context) ([]retry.DeadLetter, error) {
+	return s.find(ctx, bson.M{})
+}
+
+// Remove implements the Remove method of the retry.Store interface.
+func (s *Store) Remove(ctx context.Context, id eh.ID) error {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	if err := sess.DB(s.dbName(ctx)).C("dead_letters").RemoveId(id); err == mgo.ErrNotFound {
+		return retry.StoreError{
+			Err:       retry.ErrDeadLetterNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if err != nil {
+		return retry.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotRemoveDeadLetter,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Clear clears the dead letters.
+func (s *Store) Clear(ctx context.Context) error {
+	if err := s.session.DB(s.dbName(ctx)).C("dead_letters").DropCollection(); err != nil &&
+		err.Error() != "ns not found" {
+		return retry.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotClearDB,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// Close closes the database session.
+func (s *Store) Close() {
+	s.session.Close()
+}
+
+// find finds the dead letters matching a query, ordered by creation time.
+func (s *Store) find(ctx context.Context, query bson.M) ([]retry.DeadLetter, error) {
+	sess := s.session.Copy()
+	defer sess.Close()
+
+	var dbDLs []dbDeadLetter
+	if err := sess.DB(s.dbName(ctx)).C("dead_letters").Find(query).
+		Sort("created").All(&dbDLs); err != nil {
+		return nil, retry.StoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotLoadDeadLetters,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	dls := make([]retry.DeadLetter, len(dbDLs))
+	for i, d := range dbDLs {
+		var data eh.EventData
+		if d.RawData.Kind != 0 {
+			var err error
+			if data, err = eh.CreateEventData(d.EventType); err != nil {
+				return nil, retry.StoreError{
+					BaseErr:   err,
+					Err:       ErrCouldNotUnmarshalEvent,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			if err := d.RawData.Unmarshal(data); err != nil {
+				return nil, retry.StoreError{
+					BaseErr:   err,
+					Err:       ErrCouldNotUnmarshalEvent,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+		}
+
+		dls[i] = retry.DeadLetter{
+			ID:          d.ID,
+			HandlerType: d.HandlerType,
+			Event: eh.NewEventForAggregate(d.EventType, data, d.Timestamp,
+				d.AggregateType, d.AggregateID, d.Version, eh.WithMetadata(d.Metadata)),
+			Context:  d.Context,
+			Err:      d.Err,
+			Attempts: d.Attempts,
+			Created:  d.Created,
+			Updated:  d.Updated,
+		}
+	}
+	return dls, nil
+}
+
+// dbName appends the namespace, if one is set, to the DB prefix to
+// get the name of the DB to use.
+func (s *Store) dbName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return s.dbPrefix + "_" + ns
+}
+
+// dbDeadLetter is the DB representation of a dead letter.
+type dbDeadLetter struct {
+	ID            eh.ID                  `bson:"_id"`
+	HandlerType   eh.EventHandlerType    `bson:"handler_type"`
+	EventType     eh.EventType           `bson:"event_type"`
+	RawData       bson.Raw               `bson:"data,omitempty"`
+	Timestamp     time.Time              `bson:"timestamp"`
+	AggregateType eh.AggregateType       `bson:"aggregate_type"`
+	AggregateID   eh.ID                  `bson:"aggregate_id"`
+	Version       int                    `bson:"version"`
+	Metadata      map[string]interface{} `bson:"metadata,omitempty"`
+	Context       map[string]interface{} `bson:"context"`
+	Err           string                 `bson:"error"`
+	Attempts      int                    `bson:"attempts"`
+	Created       time.Time              `bson:"created"`
+	Updated       time.Time              `bson:"updated"`
+}
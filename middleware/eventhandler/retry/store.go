@@ -0,0 +1,158 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrDeadLetterNotFound is when a dead letter could not be found.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// StoreError is an error in a Store.
+type StoreError struct {
+	// Err is the error.
+	Err error
+	// BaseErr is an optional underlying error, for example from the DB driver.
+	BaseErr error
+	// Namespace is the namespace for the error.
+	Namespace string
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e StoreError) Error() string {
+	errStr := e.Err.Error()
+	if e.BaseErr != nil {
+		errStr += ": " + e.BaseErr.Error()
+	}
+	return "retry: " + errStr + " (" + e.Namespace + ")"
+}
+
+// DeadLetter is an event that could not be handled by an event handler.
+type DeadLetter struct {
+	// ID is the ID of the dead letter.
+	ID eh.ID `json:"id"`
+	// HandlerType is the type of the handler that failed.
+	HandlerType eh.EventHandlerType `json:"handler_type"`
+	// Event is the event that failed, which must have its data registered with
+	// eventhorizon.RegisterEventData to be stored in a DB.
+	Event eh.Event `json:"event"`
+	// Context is the marshaled context the event was handled with.
+	Context map[string]interface{} `json:"context,omitempty"`
+	// Err is the error message of the last attempt.
+	Err string `json:"error"`
+	// Attempts is the number of times the event has been handled.
+	Attempts int `json:"attempts"`
+	// Created is when the event was dead-lettered.
+	Created time.Time `json:"created"`
+	// Updated is when the event was last handled.
+	Updated time.Time `json:"updated"`
+}
+
+// Store is a store of dead letters, with one set of dead letters per namespace.
+type Store interface {
+	// Save saves a dead letter, replacing any dead letter with the same ID.
+	Save(context.Context, DeadLetter) error
+
+	// Find returns a dead letter.
+	Find(context.Context, eh.ID) (DeadLetter, error)
+
+	// FindAll returns all dead letters, ordered by creation time.
+	FindAll(context.Context) ([]DeadLetter, error)
+
+	// Remove removes a dead letter.
+	Remove(context.Context, eh.ID) error
+}
+
+// MemoryStore is a Store in memory, mainly useful for testing.
+type MemoryStore struct {
+	// The outer map is with namespace as key, the inner with dead letter ID.
+	deadLetters map[string]map[eh.ID]DeadLetter
+	mu          sync.RWMutex
+}
+
+var _ = Store(&MemoryStore{})
+
+// NewMemoryStore creates a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		deadLetters: map[string]map[eh.ID]DeadLetter{},
+	}
+}
+
+// Save implements the Save method of the Store interface.
+func (s *MemoryStore) Save(ctx context.Context, dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.deadLetters[ns]; !ok {
+		s.deadLetters[ns] = map[eh.ID]DeadLetter{}
+	}
+	s.deadLetters[ns][dl.ID] = dl
+	return nil
+}
+
+// Find implements the Find method of the Store interface.
+func (s *MemoryStore) Find(ctx context.Context, id eh.ID) (DeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dl, ok := s.deadLetters[eh.NamespaceFromContext(ctx)][id]
+	if !ok {
+		return DeadLetter{}, StoreError{
+			Err:       ErrDeadLetterNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return dl, nil
+}
+
+// FindAll implements the FindAll method of the Store interface.
+func (s *MemoryStore) FindAll(ctx context.Context) ([]DeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dls := []DeadLetter{}
+	for _, dl := range s.deadLetters[eh.NamespaceFromContext(ctx)] {
+		dls = append(dls, dl)
+	}
+	sort.Slice(dls, func(i, j int) bool {
+		return dls[i].Created.Before(dls[j].Created)
+	})
+	return dls, nil
+}
+
+// Remove implements the Remove method of the Store interface.
+func (s *MemoryStore) Remove(ctx context.Context, id eh.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	if _, ok := s.deadLetters[ns][id]; !ok {
+		return StoreError{
+			Err:       ErrDeadLetterNotFound,
+			Namespace: ns,
+		}
+	}
+	delete(s.deadLetters[ns], id)
+	return nil
+}
@@ -341,6 +341,11 @@ func (b *EventBus) AddHandler(m eh.EventMatcher, h eh.EventHandler) {}
 // AddObserver implements the AddObserver method of the eventhorizon.EventBus interface.
 func (b *EventBus) AddObserver(m eh.EventMatcher, h eh.EventHandler) {}
 
+// RemoveHandler implements the RemoveHandler method of the eventhorizon.EventBus interface.
+func (b *EventBus) RemoveHandler(t eh.EventHandlerType) error {
+	return nil
+}
+
 // Errors implements the Error method of the eventhorizon.EventBus interface.
 func (b *EventBus) Errors() <-chan eh.EventBusError {
 	return make(chan eh.EventBusError)
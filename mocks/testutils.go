@@ -22,6 +22,7 @@ import (
 )
 
 // CompareEvents compares two events, ignoring their version and timestamp.
+// Metadata is compared if set on any of the events.
 func CompareEvents(e1, e2 eh.Event) error {
 	if e1.AggregateID() != e2.AggregateID() {
 		return fmt.Errorf("incorrect aggregate ID: %s (should be %s)", e1.AggregateID(), e2.AggregateID())
@@ -35,6 +36,9 @@ func CompareEvents(e1, e2 eh.Event) error {
 	if !reflect.DeepEqual(e1.Data(), e2.Data()) {
 		return fmt.Errorf("incorrect event data: %s (should be %s)", e1.Data(), e2.Data())
 	}
+	if !equalMetadata(e1.Metadata(), e2.Metadata()) {
+		return fmt.Errorf("incorrect event metadata: %v (should be %v)", e1.Metadata(), e2.Metadata())
+	}
 	return nil
 }
 
@@ -64,7 +68,18 @@ func EqualEvents(evts1, evts2 []eh.Event) bool {
 		if e1.Version() != e2.Version() {
 			return false
 		}
+		if !equalMetadata(e1.Metadata(), e2.Metadata()) {
+			return false
+		}
 	}
 
 	return true
 }
+
+// equalMetadata compares metadata, treating nil and empty metadata as equal.
+func equalMetadata(m1, m2 map[string]interface{}) bool {
+	if len(m1) == 0 && len(m2) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(m1, m2)
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventhorizon
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrOutboxNotSupported is when an outbox is used with a store that does not
+// have one.
+var ErrOutboxNotSupported = errors.New("outbox not supported")
+
+// OutboxEntry is an unpublished event in an Outbox.
+type OutboxEntry struct {
+	// ID is the ID of the entry, used to mark it as published.
+	ID string
+	// Event is the event to publish.
+	Event Event
+}
+
+// Outbox is a store of saved events that are not yet published. The events
+// are recorded atomically with saving them, and then published by a relay
+// that marks them as published. Events are published at least once.
+type Outbox interface {
+	// OutboxNamespaces returns the namespaces that may have unpublished events.
+	OutboxNamespaces(context.Context) ([]string, error)
+
+	// UnpublishedEvents returns up to limit unpublished events in the
+	// namespace, in the order they were saved.
+	UnpublishedEvents(ctx context.Context, limit int) ([]OutboxEntry, error)
+
+	// MarkPublished marks an entry as published, removing it from the outbox.
+	MarkPublished(ctx context.Context, id string) error
+}
+
+// OutboxEventStore is an EventStore with an Outbox.
+type OutboxEventStore interface {
+	EventStore
+	Outbox
+
+	// SaveWithOutbox saves the events like Save, and atomically records them as
+	// unpublished in the outbox.
+	SaveWithOutbox(ctx context.Context, events []Event, originalVersion int) error
+}
+
+// OutboxRepo is a ReadWriteRepo with an Outbox.
+type OutboxRepo interface {
+	ReadWriteRepo
+	Outbox
+
+	// SaveWithOutbox saves the entity like Save, and atomically records the
+	// events as unpublished in the outbox. Saving an entity with Save keeps
+	// its unpublished events.
+	SaveWithOutbox(ctx context.Context, entity Entity, events []Event) error
+}
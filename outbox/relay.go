@@ -0,0 +1,204 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// DefaultPollInterval is the default interval between checking the outbox for
+// unpublished events.
+const DefaultPollInterval = 100 * time.Millisecond
+
+// DefaultBatchSize is the default number of events to read from the outbox at
+// a time.
+const DefaultBatchSize = 100
+
+// Relay publishes the unpublished events of an outbox on an event bus, and
+// marks them as published. If publishing fails it is retried with an
+// exponential backoff, keeping the order of the events. As an event can be
+// published but not marked, events are published at least once.
+type Relay struct {
+	outbox       eh.Outbox
+	bus          eh.EventBus
+	pollInterval time.Duration
+	maxBackoff   time.Duration
+	batchSize    int
+	errCh        chan Error
+
+	// Serializes publishing from the background loop and Relay.
+	relayMu sync.Mutex
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewRelay creates a new Relay for an outbox and event bus.
+func NewRelay(outbox eh.Outbox, bus eh.EventBus) *Relay {
+	if outbox == nil || bus == nil {
+		return nil
+	}
+
+	return &Relay{
+		outbox:       outbox,
+		bus:          bus,
+		pollInterval: DefaultPollInterval,
+		maxBackoff:   time.Minute,
+		batchSize:    DefaultBatchSize,
+		errCh:        make(chan Error, 100),
+	}
+}
+
+// SetPollInterval sets the interval between checking the outbox, it is also
+// the first delay before retrying after an error.
+func (r *Relay) SetPollInterval(interval time.Duration) {
+	r.pollInterval = interval
+}
+
+// SetMaxBackoff sets the longest delay before retrying after repeated errors.
+func (r *Relay) SetMaxBackoff(max time.Duration) {
+	r.maxBackoff = max
+}
+
+// SetBatchSize sets the number of events to read from the outbox at a time.
+func (r *Relay) SetBatchSize(size int) {
+	r.batchSize = size
+}
+
+// Errors returns an error channel where async errors are sent. Errors are
+// dropped if the channel is full.
+func (r *Relay) Errors() <-chan Error {
+	return r.errCh
+}
+
+// Start starts relaying events in the background until Close is called.
+func (r *Relay) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+
+	go r.run(ctx)
+}
+
+// Close stops relaying events and waits for the background relaying to finish.
+func (r *Relay) Close() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+	r.cancel = nil
+}
+
+// Relay publishes all unpublished events in all namespaces of the outbox. It
+// stops at the first error, leaving the rest of the events unpublished.
+func (r *Relay) Relay(ctx context.Context) error {
+	r.relayMu.Lock()
+	defer r.relayMu.Unlock()
+
+	namespaces, err := r.outbox.OutboxNamespaces(ctx)
+	if err != nil {
+		return Error{Err: err, Ctx: ctx}
+	}
+
+	for _, ns := range namespaces {
+		if err := r.relayNamespace(eh.NewContextWithNamespace(ctx, ns)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Relay) relayNamespace(ctx context.Context) error {
+	for {
+		entries, err := r.outbox.UnpublishedEvents(ctx, r.batchSize)
+		if err != nil {
+			return Error{Err: err, Ctx: ctx}
+		}
+
+		for _, entry := range entries {
+			select {
+			case <-ctx.Done():
+				return Error{Err: ctx.Err(), Ctx: ctx}
+			default:
+			}
+
+			if err := r.bus.PublishEvent(ctx, entry.Event); err != nil {
+				return Error{Err: err, Ctx: ctx, Event: entry.Event}
+			}
+			if err := r.outbox.MarkPublished(ctx, entry.ID); err != nil {
+				return Error{Err: err, Ctx: ctx, Event: entry.Event}
+			}
+		}
+
+		if r.batchSize <= 0 || len(entries) < r.batchSize {
+			return nil
+		}
+	}
+}
+
+func (r *Relay) run(ctx context.Context) {
+	defer close(r.done)
+
+	delay := &backoff.Backoff{
+		Min: r.pollInterval,
+		Max: r.maxBackoff,
+	}
+	wait := r.pollInterval
+	for {
+		if err := r.Relay(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case r.errCh <- err.(Error):
+			default:
+			}
+			wait = delay.Duration()
+		} else {
+			delay.Reset()
+			wait = r.pollInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Error is an async error containing the error and the event, if any.
+type Error struct {
+	Err   error
+	Ctx   context.Context
+	Event eh.Event
+}
+
+// Error implements the Error method of the error interface.
+func (e Error) Error() string {
+	if e.Event == nil {
+		return fmt.Sprintf("could not relay events: %s", e.Err)
+	}
+	return fmt.Sprintf("could not relay event %s: %s", e.Event, e.Err)
+}
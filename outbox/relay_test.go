@@ -0,0 +1,142 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/eventstore/memory"
+	"github.com/looplab/eventhorizon/mocks"
+)
+
+func TestRelay(t *testing.T) {
+	if NewRelay(nil, &mocks.EventBus{}) != nil {
+		t.Error("there should be no relay without outbox")
+	}
+
+	store := memory.NewEventStore()
+	bus := &mocks.EventBus{}
+	relay := NewRelay(store, bus)
+	relay.SetBatchSize(2)
+
+	ctx := context.Background()
+	otherCtx := eh.NewContextWithNamespace(ctx, "other")
+	saved := saveEvents(t, ctx, store, 3)
+	saved = append(saved, saveEvents(t, otherCtx, store, 1)...)
+
+	if err := relay.Relay(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertPublished(t, bus, saved)
+	entries, err := store.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 0 {
+		t.Error("there should be no unpublished events:", entries)
+	}
+	if eh.NamespaceFromContext(bus.Context) != "other" {
+		t.Error("the event should be published in its namespace:", eh.NamespaceFromContext(bus.Context))
+	}
+}
+
+func TestRelayError(t *testing.T) {
+	store := memory.NewEventStore()
+	bus := &mocks.EventBus{}
+	relay := NewRelay(store, bus)
+
+	ctx := context.Background()
+	saved := saveEvents(t, ctx, store, 2)
+
+	// The events should be kept in the outbox on errors.
+	busErr := errors.New("bus error")
+	bus.Err = busErr
+	err := relay.Relay(ctx)
+	if rErr, ok := err.(Error); !ok || rErr.Err != busErr {
+		t.Error("there should be a bus error:", err)
+	}
+	entries, err := store.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 2 {
+		t.Error("there should be unpublished events:", entries)
+	}
+
+	bus.Err = nil
+	if err := relay.Relay(ctx); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	assertPublished(t, bus, saved)
+}
+
+func TestRelayStart(t *testing.T) {
+	store := memory.NewEventStore()
+	bus := &mocks.EventBus{Err: errors.New("bus error")}
+	relay := NewRelay(store, bus)
+	relay.SetPollInterval(time.Millisecond)
+	relay.SetMaxBackoff(5 * time.Millisecond)
+
+	ctx := context.Background()
+	saved := saveEvents(t, ctx, store, 2)
+
+	relay.Start()
+	select {
+	case err := <-relay.Errors():
+		if err.Err != bus.Err {
+			t.Error("there should be a bus error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("there should be an error")
+	}
+	relay.Close()
+
+	// Retry after the error.
+	bus.Err = nil
+	relay.Start()
+	time.Sleep(50 * time.Millisecond)
+	relay.Close()
+	assertPublished(t, bus, saved)
+}
+
+func saveEvents(t *testing.T, ctx context.Context, store eh.OutboxEventStore, n int) []eh.Event {
+	id := uuid.New().String()
+	events := make([]eh.Event, n)
+	for i := range events {
+		events[i] = eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event"},
+			time.Now().UTC(), mocks.AggregateType, id, i+1)
+	}
+	if err := store.SaveWithOutbox(ctx, events, 0); err != nil {
+		t.Fatal("there should be no error:", err)
+	}
+	return events
+}
+
+func assertPublished(t *testing.T, bus *mocks.EventBus, expected []eh.Event) {
+	if len(bus.Events) != len(expected) {
+		t.Fatal("there should be published events:", bus.Events)
+	}
+	for i, event := range bus.Events {
+		if err := mocks.CompareEvents(event, expected[i]); err != nil {
+			t.Error("the published event was incorrect:", err)
+		}
+	}
+}
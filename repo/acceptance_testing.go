@@ -157,3 +157,148 @@ func AcceptanceTest(t *testing.T, ctx context.Context, repo eh.ReadWriteRepo) {
 		t.Error("there should be a ErrEntityNotFound error:", err)
 	}
 }
+
+// OutboxAcceptanceTest is the acceptance test that all implementations of
+// OutboxRepo should pass. It should manually be called from a test case in
+// each implementation:
+//
+//   func Test_Repo(t *testing.T) {
+//       ctx := context.Background() // Or other when testing namespaces.
+//       store := NewRepo()
+//       repo.OutboxAcceptanceTest(t, ctx, store)
+//   }
+//
+func OutboxAcceptanceTest(t *testing.T, ctx context.Context, repo eh.OutboxRepo) {
+	// Save model with events.
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	entity1 := &mocks.Model{
+		ID:        uuid.New().String(),
+		Content:   "entity1",
+		CreatedAt: timestamp,
+	}
+	event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, entity1.ID, 1)
+	event2 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+		timestamp, mocks.AggregateType, entity1.ID, 2)
+	if err := repo.SaveWithOutbox(ctx, entity1, []eh.Event{event1, event2}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	entity, err := repo.Find(ctx, entity1.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(entity, entity1) {
+		t.Error("the item should be correct:", entity)
+	}
+
+	// Save the model again and another model, keeping the earlier events.
+	entity1.Content = "entity1_updated"
+	event3 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+		timestamp, mocks.AggregateType, entity1.ID, 3)
+	if err := repo.SaveWithOutbox(ctx, entity1, []eh.Event{event3}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	entity, err = repo.Find(ctx, entity1.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(entity, entity1) {
+		t.Error("the item should be correct:", entity)
+	}
+	entity2 := &mocks.Model{
+		ID:        uuid.New().String(),
+		Content:   "entity2",
+		CreatedAt: timestamp,
+	}
+	event4 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event4"},
+		timestamp, mocks.AggregateType, entity2.ID, 1)
+	if err := repo.SaveWithOutbox(ctx, entity2, []eh.Event{event4}); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	// Save the model without events, keeping the unpublished events.
+	entity1.Content = "entity1_saved"
+	if err := repo.Save(ctx, entity1); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	entity, err = repo.Find(ctx, entity1.ID)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if !reflect.DeepEqual(entity, entity1) {
+		t.Error("the item should be correct:", entity)
+	}
+
+	// Load unpublished events, in order.
+	expectedEvents := []eh.Event{event1, event2, event3, event4}
+	entries, err := repo.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != len(expectedEvents) {
+		t.Fatal("there should be unpublished events:", entries)
+	}
+	for i, entry := range entries {
+		if err := mocks.CompareEvents(entry.Event, expectedEvents[i]); err != nil {
+			t.Error("the unpublished event was incorrect:", err)
+		}
+	}
+	entries, err = repo.UnpublishedEvents(ctx, 2)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 2 {
+		t.Error("the unpublished events should be limited:", entries)
+	}
+
+	// The namespace should be in the outbox.
+	namespaces, err := repo.OutboxNamespaces(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	found := false
+	for _, ns := range namespaces {
+		if ns == eh.NamespaceFromContext(ctx) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("the namespace should be in the outbox namespaces:", namespaces)
+	}
+
+	// Mark events as published.
+	for _, entry := range entries {
+		if err := repo.MarkPublished(ctx, entry.ID); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	entries, err = repo.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 2 {
+		t.Fatal("there should be 2 unpublished events:", entries)
+	}
+	for i, entry := range entries {
+		if err := mocks.CompareEvents(entry.Event, expectedEvents[i+2]); err != nil {
+			t.Error("the unpublished event was incorrect:", err)
+		}
+		if err := repo.MarkPublished(ctx, entry.ID); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+	entries, err = repo.UnpublishedEvents(ctx, 0)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entries) != 0 {
+		t.Error("there should be no unpublished events:", entries)
+	}
+
+	// Clean up.
+	for _, id := range []eh.ID{entity1.ID, entity2.ID} {
+		if err := repo.Remove(ctx, id); err != nil {
+			t.Error("there should be no error:", err)
+		}
+	}
+}
@@ -16,8 +16,11 @@ package memory
 
 import (
 	"context"
+	"sort"
 	"sync"
 
+	"github.com/google/uuid"
+
 	eh "github.com/looplab/eventhorizon"
 )
 
@@ -32,13 +35,17 @@ type Repo struct {
 	// A list of all item ids, only the order is used.
 	// The outer map is for the namespace.
 	ids map[namespace][]eh.ID
+
+	// The unpublished events saved with the entities, per namespace.
+	outbox map[namespace][]eh.OutboxEntry
 }
 
 // NewRepo creates a new Repo.
 func NewRepo() *Repo {
 	r := &Repo{
-		ids: map[namespace][]eh.ID{},
-		db:  map[namespace]map[eh.ID]eh.Entity{},
+		ids:    map[namespace][]eh.ID{},
+		db:     map[namespace]map[eh.ID]eh.Entity{},
+		outbox: map[namespace][]eh.OutboxEntry{},
 	}
 	return r
 }
@@ -83,6 +90,11 @@ func (r *Repo) FindAll(ctx context.Context) ([]eh.Entity, error) {
 
 // Save implements the Save method of the eventhorizon.WriteRepo interface.
 func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
+	return r.SaveWithOutbox(ctx, entity, nil)
+}
+
+// SaveWithOutbox implements the SaveWithOutbox method of the eventhorizon.OutboxRepo interface.
+func (r *Repo) SaveWithOutbox(ctx context.Context, entity eh.Entity, events []eh.Event) error {
 	ns := r.namespace(ctx)
 
 	if eh.IsNilID(entity.EntityID()) {
@@ -101,6 +113,13 @@ func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
 	}
 	r.db[ns][id] = entity
 
+	for _, e := range events {
+		r.outbox[ns] = append(r.outbox[ns], eh.OutboxEntry{
+			ID:    uuid.New().String(),
+			Event: e,
+		})
+	}
+
 	return nil
 }
 
@@ -131,6 +150,50 @@ func (r *Repo) Remove(ctx context.Context, id eh.ID) error {
 	}
 }
 
+// OutboxNamespaces implements the OutboxNamespaces method of the eventhorizon.Outbox interface.
+func (r *Repo) OutboxNamespaces(ctx context.Context) ([]string, error) {
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+
+	namespaces := []string{}
+	for ns, entries := range r.outbox {
+		if len(entries) > 0 {
+			namespaces = append(namespaces, string(ns))
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// UnpublishedEvents implements the UnpublishedEvents method of the eventhorizon.Outbox interface.
+func (r *Repo) UnpublishedEvents(ctx context.Context, limit int) ([]eh.OutboxEntry, error) {
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+
+	entries := r.outbox[namespace(eh.NamespaceFromContext(ctx))]
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return append([]eh.OutboxEntry{}, entries...), nil
+}
+
+// MarkPublished implements the MarkPublished method of the eventhorizon.Outbox interface.
+func (r *Repo) MarkPublished(ctx context.Context, id string) error {
+	ns := namespace(eh.NamespaceFromContext(ctx))
+
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+
+	for i, e := range r.outbox[ns] {
+		if e.ID == id {
+			r.outbox[ns] = append(r.outbox[ns][:i:i], r.outbox[ns][i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
 // Helper to get the namespace and ensure that its data exists.
 func (r *Repo) namespace(ctx context.Context) namespace {
 	ns := namespace(eh.NamespaceFromContext(ctx))
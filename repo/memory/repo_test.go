@@ -40,6 +40,9 @@ func Test_ReadRepo(t *testing.T) {
 	ctx := eh.NewContextWithNamespace(context.Background(), "ns")
 	repo.AcceptanceTest(t, ctx, r)
 
+	// Repo with outbox.
+	repo.OutboxAcceptanceTest(t, context.Background(), r)
+	repo.OutboxAcceptanceTest(t, ctx, r)
 }
 
 func Test_Repository(t *testing.T) {
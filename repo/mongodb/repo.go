@@ -17,8 +17,11 @@ package mongodb
 import (
 	"context"
 	"errors"
+	"strings"
+	"time"
 
 	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 
 	eh "github.com/looplab/eventhorizon"
 )
@@ -38,6 +41,16 @@ var ErrModelNotSet = errors.New("model not set")
 // ErrInvalidQuery is when a query was not returned from the callback to FindCustom.
 var ErrInvalidQuery = errors.New("invalid query")
 
+// ErrCouldNotMarshalEvent is when an event could not be marshaled into BSON.
+var ErrCouldNotMarshalEvent = errors.New("could not marshal event")
+
+// ErrCouldNotUnmarshalEvent is when an event could not be unmarshaled into a concrete type.
+var ErrCouldNotUnmarshalEvent = errors.New("could not unmarshal event")
+
+// The number of times to try to save an entity with an outbox that is
+// concurrently modified.
+const outboxSaveAttempts = 10
+
 // Repo implements an MongoDB repository for entities.
 type Repo struct {
 	session    *mgo.Session
@@ -228,7 +241,15 @@ func (r *Repo) FindCustom(ctx context.Context, callback func(*mgo.Collection) *m
 }
 
 // Save implements the Save method of the eventhorizon.WriteRepo interface.
+// Unpublished events in the outbox of the entity are kept.
 func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
+	return r.SaveWithOutbox(ctx, entity, nil)
+}
+
+// SaveWithOutbox implements the SaveWithOutbox method of the eventhorizon.OutboxRepo interface.
+// The unpublished events are kept in the entity document, to be saved
+// atomically with the entity.
+func (r *Repo) SaveWithOutbox(ctx context.Context, entity eh.Entity, events []eh.Event) error {
 	sess := r.session.Copy()
 	defer sess.Close()
 
@@ -240,14 +261,175 @@ func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
 		}
 	}
 
-	if _, err := sess.DB(r.dbName(ctx)).C(r.collection).UpsertId(
-		entity.EntityID(), entity); err != nil {
+	// Marshal the entity to a document to be able to add the outbox.
+	doc := bson.M{}
+	raw, err := bson.Marshal(entity)
+	if err == nil {
+		err = bson.Unmarshal(raw, &doc)
+	}
+	if err != nil {
 		return eh.RepoError{
 			Err:       eh.ErrCouldNotSaveEntity,
 			BaseErr:   err,
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
+	doc["_id"] = entity.EntityID()
+
+	entries := make([]dbOutboxEntry, len(events))
+	for i, e := range events {
+		entry, err := newDBOutboxEntry(e)
+		if err != nil {
+			return eh.RepoError{
+				Err:       ErrCouldNotMarshalEvent,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		entries[i] = entry
+	}
+
+	// Replace the entity keeping the current outbox, only if the outbox has
+	// not been modified since it was read.
+	c := sess.DB(r.dbName(ctx)).C(r.collection)
+	for i := 0; i < outboxSaveAttempts; i++ {
+		var current struct {
+			Outbox   []dbOutboxEntry `bson:"_eh_outbox"`
+			Revision int             `bson:"_eh_outbox_rev"`
+		}
+		err := c.FindId(entity.EntityID()).
+			Select(bson.M{"_eh_outbox": 1, "_eh_outbox_rev": 1}).One(&current)
+		if err != nil && err != mgo.ErrNotFound {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotSaveEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		doc["_eh_outbox"] = append(current.Outbox, entries...)
+		doc["_eh_outbox_rev"] = current.Revision + 1
+
+		if err == mgo.ErrNotFound {
+			if err = c.Insert(doc); mgo.IsDup(err) {
+				continue
+			}
+		} else {
+			// Documents saved without an outbox have no revision.
+			revision := interface{}(current.Revision)
+			if current.Revision == 0 {
+				revision = bson.M{"$in": []interface{}{0, nil}}
+			}
+			if err = c.Update(bson.M{
+				"_id":            entity.EntityID(),
+				"_eh_outbox_rev": revision,
+			}, doc); err == mgo.ErrNotFound {
+				continue
+			}
+		}
+		if err != nil {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotSaveEntity,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return nil
+	}
+
+	return eh.RepoError{
+		Err:       eh.ErrCouldNotSaveEntity,
+		BaseErr:   errors.New("outbox concurrently modified"),
+		Namespace: eh.NamespaceFromContext(ctx),
+	}
+}
+
+// OutboxNamespaces implements the OutboxNamespaces method of the eventhorizon.Outbox interface.
+// It returns the namespaces of all databases of the repo.
+func (r *Repo) OutboxNamespaces(ctx context.Context) ([]string, error) {
+	sess := r.session.Copy()
+	defer sess.Close()
+
+	names, err := sess.DatabaseNames()
+	if err != nil {
+		return nil, eh.RepoError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	namespaces := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, r.dbPrefix+"_") {
+			namespaces = append(namespaces, strings.TrimPrefix(name, r.dbPrefix+"_"))
+		}
+	}
+	return namespaces, nil
+}
+
+// UnpublishedEvents implements the UnpublishedEvents method of the eventhorizon.Outbox interface.
+func (r *Repo) UnpublishedEvents(ctx context.Context, limit int) ([]eh.OutboxEntry, error) {
+	sess := r.session.Copy()
+	defer sess.Close()
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"_eh_outbox.0": bson.M{"$exists": true}}},
+		{"$project": bson.M{"_eh_outbox": 1}},
+		{"$unwind": "$_eh_outbox"},
+		{"$sort": bson.M{"_eh_outbox.id": 1}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+	pipeline = append(pipeline, bson.M{"$replaceRoot": bson.M{"newRoot": "$_eh_outbox"}})
+	iter := sess.DB(r.dbName(ctx)).C(r.collection).Pipe(pipeline).Iter()
+
+	entries := []eh.OutboxEntry{}
+	var e dbOutboxEntry
+	for iter.Next(&e) {
+		event, err := e.event()
+		if err != nil {
+			iter.Close()
+			return nil, eh.RepoError{
+				Err:       ErrCouldNotUnmarshalEvent,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		entries = append(entries, eh.OutboxEntry{
+			ID:    e.ID,
+			Event: event,
+		})
+		e = dbOutboxEntry{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, eh.RepoError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return entries, nil
+}
+
+// MarkPublished implements the MarkPublished method of the eventhorizon.Outbox interface.
+func (r *Repo) MarkPublished(ctx context.Context, id string) error {
+	sess := r.session.Copy()
+	defer sess.Close()
+
+	if err := sess.DB(r.dbName(ctx)).C(r.collection).Update(
+		bson.M{"_eh_outbox.id": id},
+		bson.M{
+			"$pull": bson.M{"_eh_outbox": bson.M{"id": id}},
+			"$inc":  bson.M{"_eh_outbox_rev": 1},
+		},
+	); err != nil && err != mgo.ErrNotFound {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
 	return nil
 }
 
@@ -313,6 +495,58 @@ func (r *Repo) dbName(ctx context.Context) string {
 	return r.dbPrefix + "_" + ns
 }
 
+// dbOutboxEntry is the DB representation of an unpublished event, kept in
+// the entity document.
+type dbOutboxEntry struct {
+	// ID is an object ID in hex, to keep the entries in order.
+	ID            string                 `bson:"id"`
+	EventType     eh.EventType           `bson:"event_type"`
+	RawData       bson.Raw               `bson:"data,omitempty"`
+	Timestamp     time.Time              `bson:"timestamp"`
+	AggregateType eh.AggregateType       `bson:"aggregate_type"`
+	AggregateID   string                 `bson:"aggregate_id"`
+	Version       int                    `bson:"version"`
+	Metadata      map[string]interface{} `bson:"metadata,omitempty"`
+}
+
+// newDBOutboxEntry returns a new dbOutboxEntry for an event.
+func newDBOutboxEntry(event eh.Event) (dbOutboxEntry, error) {
+	// Marshal event data if there is any.
+	var rawData bson.Raw
+	if event.Data() != nil {
+		raw, err := bson.Marshal(event.Data())
+		if err != nil {
+			return dbOutboxEntry{}, err
+		}
+		rawData = bson.Raw{Kind: 3, Data: raw}
+	}
+
+	return dbOutboxEntry{
+		ID:            bson.NewObjectId().Hex(),
+		EventType:     event.EventType(),
+		RawData:       rawData,
+		Timestamp:     event.Timestamp(),
+		AggregateType: event.AggregateType(),
+		AggregateID:   event.AggregateID(),
+		Version:       event.Version(),
+		Metadata:      event.Metadata(),
+	}, nil
+}
+
+// event returns the event of the entry, with concrete event data if the
+// event type is registered.
+func (e dbOutboxEntry) event() (eh.Event, error) {
+	var data eh.EventData
+	if d, err := eh.CreateEventData(e.EventType); err == nil && e.RawData.Kind != 0 {
+		if err := e.RawData.Unmarshal(d); err != nil {
+			return nil, err
+		}
+		data = d
+	}
+	return eh.NewEventForAggregate(e.EventType, data, e.Timestamp,
+		e.AggregateType, e.AggregateID, e.Version, eh.WithMetadata(e.Metadata)), nil
+}
+
 // Repository returns a parent ReadRepo if there is one.
 func Repository(repo eh.ReadRepo) *Repo {
 	if repo == nil {
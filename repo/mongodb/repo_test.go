@@ -76,6 +76,9 @@ func TestIntegration_ReadRepo(t *testing.T) {
 	repo.AcceptanceTest(t, ctx, r)
 	extraRepoTests(t, ctx, r)
 
+	// Repo with outbox.
+	repo.OutboxAcceptanceTest(t, context.Background(), r)
+	repo.OutboxAcceptanceTest(t, ctx, r)
 }
 
 func extraRepoTests(t *testing.T, ctx context.Context, r *mongodb.Repo) {
@@ -0,0 +1,109 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swap
+
+import (
+	"context"
+	"sync"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+// Repo is a middleware that delegates to a read repository which can be
+// swapped atomically per namespace, for example to replace a read model with
+// one that has been rebuilt in a new collection. Readers never see a partially
+// built repository, only the old one or the new one.
+type Repo struct {
+	repo eh.ReadWriteRepo
+
+	// The swapped repos, with namespace as key.
+	swapped   map[string]eh.ReadWriteRepo
+	swappedMu sync.RWMutex
+}
+
+// NewRepo creates a new Repo, using the repo for all namespaces until they
+// are swapped.
+func NewRepo(repo eh.ReadWriteRepo) *Repo {
+	return &Repo{
+		repo:    repo,
+		swapped: map[string]eh.ReadWriteRepo{},
+	}
+}
+
+// Swap replaces the repository for the namespace of the context with a new one
+// and returns the old one.
+func (r *Repo) Swap(ctx context.Context, repo eh.ReadWriteRepo) eh.ReadWriteRepo {
+	r.swappedMu.Lock()
+	defer r.swappedMu.Unlock()
+
+	ns := eh.NamespaceFromContext(ctx)
+	old, ok := r.swapped[ns]
+	if !ok {
+		old = r.repo
+	}
+	r.swapped[ns] = repo
+	return old
+}
+
+// Parent implements the Parent method of the eventhorizon.ReadRepo interface.
+// It returns the original repository, which is used for namespaces that have
+// not been swapped.
+func (r *Repo) Parent() eh.ReadRepo {
+	return r.repo
+}
+
+// Find implements the Find method of the eventhorizon.ReadRepo interface.
+func (r *Repo) Find(ctx context.Context, id eh.ID) (eh.Entity, error) {
+	return r.current(ctx).Find(ctx, id)
+}
+
+// FindAll implements the FindAll method of the eventhorizon.ReadRepo interface.
+func (r *Repo) FindAll(ctx context.Context) ([]eh.Entity, error) {
+	return r.current(ctx).FindAll(ctx)
+}
+
+// Save implements the Save method of the eventhorizon.WriteRepo interface.
+func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
+	return r.current(ctx).Save(ctx, entity)
+}
+
+// Remove implements the Remove method of the eventhorizon.WriteRepo interface.
+func (r *Repo) Remove(ctx context.Context, id eh.ID) error {
+	return r.current(ctx).Remove(ctx, id)
+}
+
+// current returns the repo for the namespace of the context.
+func (r *Repo) current(ctx context.Context) eh.ReadWriteRepo {
+	r.swappedMu.RLock()
+	defer r.swappedMu.RUnlock()
+
+	if repo, ok := r.swapped[eh.NamespaceFromContext(ctx)]; ok {
+		return repo
+	}
+	return r.repo
+}
+
+// Repository returns a parent ReadRepo if there is one.
+func Repository(repo eh.ReadRepo) *Repo {
+	if repo == nil {
+		return nil
+	}
+
+	if r, ok := repo.(*Repo); ok {
+		return r
+	}
+
+	return Repository(repo.Parent())
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swap_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/looplab/eventhorizon/repo"
+	"github.com/looplab/eventhorizon/repo/memory"
+	"github.com/looplab/eventhorizon/repo/swap"
+)
+
+func Test_ReadRepo(t *testing.T) {
+	baseRepo := memory.NewRepo()
+	r := swap.NewRepo(baseRepo)
+	if r == nil {
+		t.Error("there should be a repository")
+	}
+	if parent := r.Parent(); parent != baseRepo {
+		t.Error("the parent repo should be correct:", parent)
+	}
+
+	// Read repository with default namespace.
+	repo.AcceptanceTest(t, context.Background(), r)
+
+	// Read repository with other namespace.
+	ctx := eh.NewContextWithNamespace(context.Background(), "ns")
+	repo.AcceptanceTest(t, ctx, r)
+}
+
+func Test_Swap(t *testing.T) {
+	ctx := context.Background()
+	oldRepo := memory.NewRepo()
+	r := swap.NewRepo(oldRepo)
+	oldModel := &mocks.SimpleModel{ID: uuid.New().String(), Content: "old"}
+	if err := r.Save(ctx, oldModel); err != nil {
+		t.Error("there should be no error:", err)
+	}
+
+	newRepo := memory.NewRepo()
+	newModel := &mocks.SimpleModel{ID: uuid.New().String(), Content: "new"}
+	if err := newRepo.Save(ctx, newModel); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if old := r.Swap(ctx, newRepo); old != oldRepo {
+		t.Error("the old repo should be returned:", old)
+	}
+	if old := r.Swap(ctx, newRepo); old != newRepo {
+		t.Error("the swapped repo should be returned:", old)
+	}
+
+	entities, err := r.FindAll(ctx)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if len(entities) != 1 || entities[0] != newModel {
+		t.Error("only the new entities should be found:", entities)
+	}
+	if _, err := r.Find(ctx, oldModel.ID); err == nil {
+		t.Error("the old entity should not be found")
+	}
+
+	// Other namespaces should still use the old repo.
+	otherCtx := eh.NewContextWithNamespace(context.Background(), "other")
+	if err := r.Save(otherCtx, oldModel); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := oldRepo.Find(otherCtx, oldModel.ID); err != nil {
+		t.Error("the entity should be saved in the old repo:", err)
+	}
+
+	// Writes should go to the new repo.
+	if err := r.Remove(ctx, newModel.ID); err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if _, err := newRepo.Find(ctx, newModel.ID); err == nil {
+		t.Error("the entity should be removed from the new repo")
+	}
+}
+
+func Test_Repository(t *testing.T) {
+	if r := swap.Repository(nil); r != nil {
+		t.Error("the parent repository should be nil:", r)
+	}
+
+	inner := &mocks.Repo{}
+	if r := swap.Repository(inner); r != nil {
+		t.Error("the parent repository should be nil:", r)
+	}
+
+	r := swap.NewRepo(inner)
+	outer := &mocks.Repo{ParentRepo: r}
+	if p := swap.Repository(outer); p != r {
+		t.Error("the parent repository should be correct:", p)
+	}
+}
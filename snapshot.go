@@ -0,0 +1,45 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventhorizon
+
+import (
+	"context"
+	"time"
+)
+
+// Snapshot is the marshaled state of an aggregate at a specific version.
+type Snapshot struct {
+	// Version is the version of the aggregate when the snapshot was taken.
+	Version int
+	// AggregateType is the type of the aggregate.
+	AggregateType AggregateType
+	// Timestamp of when the snapshot was taken.
+	Timestamp time.Time
+	// State is the marshaled state of the aggregate.
+	State []byte
+}
+
+// SnapshotStore is an interface for a store of aggregate snapshots. It is
+// commonly implemented by an EventStore, keeping the snapshot together with
+// the events of the aggregate.
+type SnapshotStore interface {
+	// LoadSnapshot loads the latest snapshot of an aggregate, or nil if there
+	// is no snapshot.
+	LoadSnapshot(context.Context, ID) (*Snapshot, error)
+
+	// SaveSnapshot saves a snapshot of an aggregate, replacing any older one.
+	// Returns ErrAggregateNotFound if there is no aggregate.
+	SaveSnapshot(context.Context, ID, Snapshot) error
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventhorizon
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EventUpcaster upcasts the raw stored data of an event from one schema
+// version to the next. The raw data is the event data as a map, as decoded by
+// the store, which can be transformed freely. The event type can also be
+// changed, for example to merge two event types into one.
+//
+// An example, splitting a name into first and last name:
+//     func(t EventType, data map[string]interface{}) (EventType, map[string]interface{}, error) {
+//         parts := strings.SplitN(data["name"].(string), " ", 2)
+//         data["first_name"], data["last_name"] = parts[0], parts[1]
+//         delete(data, "name")
+//         return t, data, nil
+//     }
+type EventUpcaster func(EventType, map[string]interface{}) (EventType, map[string]interface{}, error)
+
+var eventUpcasters = make(map[EventType]map[int]EventUpcaster)
+var eventUpcastersMu sync.RWMutex
+
+// RegisterEventUpcaster registers an upcaster for an event type that upcasts
+// the raw data from schemaVersion to schemaVersion+1. Events stored before any
+// upcaster was registered have schema version 0. New events are always stored
+// with the current schema version of their type, see EventSchemaVersion.
+//
+// If an upcaster changes the event type the schema version is kept, and the
+// upcasters of the new type continue from the next schema version.
+func RegisterEventUpcaster(eventType EventType, schemaVersion int, upcaster EventUpcaster) {
+	if eventType == EventType("") {
+		panic("eventhorizon: attempt to register upcaster for empty event type")
+	}
+	if schemaVersion < 0 {
+		panic(fmt.Sprintf("eventhorizon: attempt to register upcaster for negative schema version of %q", eventType))
+	}
+	if upcaster == nil {
+		panic(fmt.Sprintf("eventhorizon: attempt to register nil upcaster for %q", eventType))
+	}
+
+	eventUpcastersMu.Lock()
+	defer eventUpcastersMu.Unlock()
+	if _, ok := eventUpcasters[eventType][schemaVersion]; ok {
+		panic(fmt.Sprintf("eventhorizon: registering duplicate upcasters for %q version %d", eventType, schemaVersion))
+	}
+	if _, ok := eventUpcasters[eventType]; !ok {
+		eventUpcasters[eventType] = map[int]EventUpcaster{}
+	}
+	eventUpcasters[eventType][schemaVersion] = upcaster
+}
+
+// UnregisterEventUpcaster removes the registration of an upcaster for an event
+// type and schema version.
+func UnregisterEventUpcaster(eventType EventType, schemaVersion int) {
+	eventUpcastersMu.Lock()
+	defer eventUpcastersMu.Unlock()
+	if _, ok := eventUpcasters[eventType][schemaVersion]; !ok {
+		panic(fmt.Sprintf("eventhorizon: unregister of non-registered upcaster for %q version %d", eventType, schemaVersion))
+	}
+	delete(eventUpcasters[eventType], schemaVersion)
+	if len(eventUpcasters[eventType]) == 0 {
+		delete(eventUpcasters, eventType)
+	}
+}
+
+// EventSchemaVersion returns the current schema version of an event type,
+// which is one more than the highest version with a registered upcaster.
+func EventSchemaVersion(eventType EventType) int {
+	eventUpcastersMu.RLock()
+	defer eventUpcastersMu.RUnlock()
+	version := 0
+	for v := range eventUpcasters[eventType] {
+		if v+1 > version {
+			version = v + 1
+		}
+	}
+	return version
+}
+
+// UpcastRawEventData upcasts encoded event data from its stored schema version,
+// if there is a newer one. The data is decoded into a map for the upcasters
+// with unmarshal, and encoded again with marshal, for example json.Unmarshal
+// and json.Marshal. It returns the resulting event type, its schema version and
+// the encoded data, which is nil if there is no data.
+func UpcastRawEventData(eventType EventType, schemaVersion int, data []byte,
+	unmarshal func([]byte, interface{}) error,
+	marshal func(interface{}) ([]byte, error)) (EventType, int, []byte, error) {
+	if EventSchemaVersion(eventType) <= schemaVersion {
+		return eventType, schemaVersion, data, nil
+	}
+
+	var rawData map[string]interface{}
+	if data != nil {
+		if err := unmarshal(data, &rawData); err != nil {
+			return eventType, schemaVersion, data, err
+		}
+	}
+
+	eventType, rawData, err := UpcastEventData(eventType, schemaVersion, rawData)
+	if err != nil {
+		return eventType, schemaVersion, data, err
+	}
+	schemaVersion = EventSchemaVersion(eventType)
+	if rawData == nil {
+		return eventType, schemaVersion, nil, nil
+	}
+	if data, err = marshal(rawData); err != nil {
+		return eventType, schemaVersion, nil, err
+	}
+	return eventType, schemaVersion, data, nil
+}
+
+// UpcastEventData runs all registered upcasters on raw event data, starting
+// at its stored schema version. It returns the resulting event type and data.
+// Stores should only call it when EventSchemaVersion for the stored event type
+// is higher than the stored schema version.
+func UpcastEventData(eventType EventType, schemaVersion int, data map[string]interface{}) (EventType, map[string]interface{}, error) {
+	for {
+		eventUpcastersMu.RLock()
+		upcaster, ok := eventUpcasters[eventType][schemaVersion]
+		eventUpcastersMu.RUnlock()
+		if !ok {
+			return eventType, data, nil
+		}
+
+		var err error
+		if eventType, data, err = upcaster(eventType, data); err != nil {
+			return eventType, data, err
+		}
+		schemaVersion++
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2018 - The Event Horizon authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventhorizon_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	eh "github.com/looplab/eventhorizon"
+)
+
+func Test_UpcastEventData(t *testing.T) {
+	if v := eh.EventSchemaVersion(TestEventUpcastType); v != 0 {
+		t.Error("the schema version should be 0:", v)
+	}
+	eventType, data, err := eh.UpcastEventData(TestEventUpcastType, 0,
+		map[string]interface{}{"name": "a"})
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if eventType != TestEventUpcastType {
+		t.Error("the event type should not change:", eventType)
+	}
+	if !reflect.DeepEqual(data, map[string]interface{}{"name": "a"}) {
+		t.Error("the data should not change:", data)
+	}
+
+	eh.RegisterEventUpcaster(TestEventUpcastType, 0,
+		func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+			data["title"] = data["name"]
+			delete(data, "name")
+			return t, data, nil
+		})
+	defer eh.UnregisterEventUpcaster(TestEventUpcastType, 0)
+	eh.RegisterEventUpcaster(TestEventUpcastType, 1,
+		func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+			return TestEventUpcastRenamedType, data, nil
+		})
+	defer eh.UnregisterEventUpcaster(TestEventUpcastType, 1)
+	eh.RegisterEventUpcaster(TestEventUpcastRenamedType, 2,
+		func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+			data["title"] = data["title"].(string) + "!"
+			return t, data, nil
+		})
+	defer eh.UnregisterEventUpcaster(TestEventUpcastRenamedType, 2)
+
+	if v := eh.EventSchemaVersion(TestEventUpcastType); v != 2 {
+		t.Error("the schema version should be 2:", v)
+	}
+	if v := eh.EventSchemaVersion(TestEventUpcastRenamedType); v != 3 {
+		t.Error("the schema version should be 3:", v)
+	}
+
+	// The full chain, continuing with the new type after a rename.
+	eventType, data, err = eh.UpcastEventData(TestEventUpcastType, 0,
+		map[string]interface{}{"name": "a"})
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if eventType != TestEventUpcastRenamedType {
+		t.Error("the event type should be renamed:", eventType)
+	}
+	if !reflect.DeepEqual(data, map[string]interface{}{"title": "a!"}) {
+		t.Error("the data should be upcasted:", data)
+	}
+
+	// Starting from a later version.
+	eventType, data, err = eh.UpcastEventData(TestEventUpcastType, 1,
+		map[string]interface{}{"title": "b"})
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if eventType != TestEventUpcastRenamedType {
+		t.Error("the event type should be renamed:", eventType)
+	}
+	if !reflect.DeepEqual(data, map[string]interface{}{"title": "b!"}) {
+		t.Error("the data should be upcasted:", data)
+	}
+}
+
+func Test_UpcastEventDataError(t *testing.T) {
+	upcastErr := errors.New("upcast error")
+	eh.RegisterEventUpcaster(TestEventUpcastErrorType, 0,
+		func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+			return t, data, upcastErr
+		})
+	defer eh.UnregisterEventUpcaster(TestEventUpcastErrorType, 0)
+
+	if _, _, err := eh.UpcastEventData(TestEventUpcastErrorType, 0, nil); err != upcastErr {
+		t.Error("there should be an upcast error:", err)
+	}
+}
+
+func Test_UpcastRawEventData(t *testing.T) {
+	// Data with the current schema version is not changed.
+	eventType, version, data, err := eh.UpcastRawEventData(TestEventUpcastRawType, 0,
+		[]byte(`{"name":"a"}`), json.Unmarshal, json.Marshal)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if eventType != TestEventUpcastRawType || version != 0 || string(data) != `{"name":"a"}` {
+		t.Error("the data should not change:", eventType, version, string(data))
+	}
+
+	eh.RegisterEventUpcaster(TestEventUpcastRawType, 0,
+		func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+			if data == nil {
+				return t, nil, nil
+			}
+			data["title"] = data["name"]
+			delete(data, "name")
+			return t, data, nil
+		})
+	defer eh.UnregisterEventUpcaster(TestEventUpcastRawType, 0)
+
+	eventType, version, data, err = eh.UpcastRawEventData(TestEventUpcastRawType, 0,
+		[]byte(`{"name":"a"}`), json.Unmarshal, json.Marshal)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if eventType != TestEventUpcastRawType || version != 1 || string(data) != `{"title":"a"}` {
+		t.Error("the data should be upcasted:", eventType, version, string(data))
+	}
+
+	// Events without data are kept without data.
+	_, version, data, err = eh.UpcastRawEventData(TestEventUpcastRawType, 0,
+		nil, json.Unmarshal, json.Marshal)
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if version != 1 || data != nil {
+		t.Error("there should be no data:", version, string(data))
+	}
+
+	// Invalid data.
+	if _, _, _, err := eh.UpcastRawEventData(TestEventUpcastRawType, 0,
+		[]byte(`{`), json.Unmarshal, json.Marshal); err == nil {
+		t.Error("there should be an error")
+	}
+}
+
+func Test_RegisterEventUpcasterTwice(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || r != "eventhorizon: registering duplicate upcasters for \"TestEventUpcastTwice\" version 0" {
+			t.Error("there should have been a panic:", r)
+		}
+	}()
+	upcaster := func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+		return t, data, nil
+	}
+	eh.RegisterEventUpcaster(TestEventUpcastTwiceType, 0, upcaster)
+	eh.RegisterEventUpcaster(TestEventUpcastTwiceType, 0, upcaster)
+}
+
+func Test_UnregisterEventUpcasterTwice(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || r != "eventhorizon: unregister of non-registered upcaster for \"TestEventUpcastUnregisterTwice\" version 0" {
+			t.Error("there should have been a panic:", r)
+		}
+	}()
+	eh.RegisterEventUpcaster(TestEventUpcastUnregisterTwiceType, 0,
+		func(t eh.EventType, data map[string]interface{}) (eh.EventType, map[string]interface{}, error) {
+			return t, data, nil
+		})
+	eh.UnregisterEventUpcaster(TestEventUpcastUnregisterTwiceType, 0)
+	eh.UnregisterEventUpcaster(TestEventUpcastUnregisterTwiceType, 0)
+}
+
+const (
+	TestEventUpcastType                eh.EventType = "TestEventUpcast"
+	TestEventUpcastRenamedType         eh.EventType = "TestEventUpcastRenamed"
+	TestEventUpcastErrorType           eh.EventType = "TestEventUpcastError"
+	TestEventUpcastRawType             eh.EventType = "TestEventUpcastRaw"
+	TestEventUpcastTwiceType           eh.EventType = "TestEventUpcastTwice"
+	TestEventUpcastUnregisterTwiceType eh.EventType = "TestEventUpcastUnregisterTwice"
+)